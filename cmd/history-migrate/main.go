@@ -0,0 +1,59 @@
+// Command history-migrate imports the JSON chat history files under
+// chat_history_dir (data/vtuber/chat/<conf_uid>/*.json) into the SQLite
+// history database. Histories already present in the database are skipped.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	appconfig "github.com/saker-ai/vtuber-server/internal/config"
+	"github.com/saker-ai/vtuber-server/internal/storage"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path to conf.yaml (defaults to the usual lookup)")
+	srcDir := flag.String("src", "", "chat history directory to import (defaults to chat_history_dir)")
+	dbPath := flag.String("db", "", "sqlite database path (defaults to history_db_path)")
+	flag.Parse()
+
+	if err := run(*configPath, *srcDir, *dbPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run migrates the histories under srcDir into the database at dbPath. Empty
+// paths fall back to the config.
+func run(configPath string, srcDir string, dbPath string) error {
+	cfg, err := appconfig.LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if srcDir == "" {
+		srcDir = cfg.ChatHistoryDir
+	}
+	if dbPath == "" {
+		dbPath = cfg.HistoryDBPath
+	}
+
+	dst, err := storage.OpenSQLiteStore(dbPath)
+	if err != nil {
+		return fmt.Errorf("open sqlite store: %w", err)
+	}
+	defer dst.Close()
+
+	report, err := storage.MigrateFileHistories(srcDir, dst)
+	if err != nil {
+		return fmt.Errorf("migrate histories: %w", err)
+	}
+	for _, migrateErr := range report.Errors {
+		fmt.Fprintln(os.Stderr, migrateErr)
+	}
+	fmt.Printf("imported=%d skipped=%d failed=%d src=%s db=%s\n", report.Imported, report.Skipped, report.Failed, srcDir, dbPath)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d histories failed to migrate", report.Failed)
+	}
+	return nil
+}
@@ -25,6 +25,7 @@ import (
 	appconfig "github.com/saker-ai/vtuber-server/internal/config"
 	apphttp "github.com/saker-ai/vtuber-server/internal/http"
 	applogger "github.com/saker-ai/vtuber-server/internal/logger"
+	"github.com/saker-ai/vtuber-server/internal/storage"
 	"github.com/saker-ai/vtuber-server/internal/ws"
 )
 
@@ -42,14 +43,25 @@ func main() {
 	}
 	defer logger.Sync()
 
-	wsHandler := ws.NewHandler(logger, cfg)
-	router := apphttp.NewRouter(cfg, wsHandler, logger)
+	history, err := storage.Open(cfg.HistoryBackend, cfg.ChatHistoryDir, cfg.HistoryDBPath)
+	if err != nil {
+		logger.Fatal("failed to open chat history store", zap.Error(err))
+	}
+	defer history.Close()
+
+	wsHandler := ws.NewHandler(logger, cfg, history)
+	defer wsHandler.Close()
+	router := apphttp.NewRouter(cfg, wsHandler, history, logger)
 
 	server := &http.Server{
 		Addr:    cfg.HTTPAddr,
 		Handler: router,
 	}
 
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	storage.StartRetention(janitorCtx, cfg.SystemConfig.HistoryRetention, history, cfg.RecordingsDir, logger)
+
 	go func() {
 		if err := listen(server, cfg, logger); err != nil && err != http.ErrServerClosed {
 			logger.Fatal("http server error", zap.Error(err))
@@ -18,21 +18,163 @@ import (
 
 // SystemConfig represents a systemConfig.
 type SystemConfig struct {
-	Host                   string `mapstructure:"host"`
-	Port                   int    `mapstructure:"port"`
-	ConfigAltsDir          string `mapstructure:"config_alts_dir"`
-	XiaoZhiBackendURL      string `mapstructure:"xiaozhi_backend_url"`
-	XiaoZhiProtocolVersion int    `mapstructure:"xiaozhi_protocol_version"`
-	XiaoZhiAudioFormat     string `mapstructure:"xiaozhi_audio_format"`
-	XiaoZhiOutputFormat    string `mapstructure:"xiaozhi_output_format"`
-	XiaoZhiSampleRate      int    `mapstructure:"xiaozhi_sample_rate"`
-	XiaoZhiChannels        int    `mapstructure:"xiaozhi_channels"`
-	XiaoZhiFrameDuration   int    `mapstructure:"xiaozhi_frame_duration"`
-	XiaoZhiListenMode      string `mapstructure:"xiaozhi_listen_mode"`
-	XiaoZhiDeviceID        string `mapstructure:"xiaozhi_device_id"`
-	XiaoZhiClientID        string `mapstructure:"xiaozhi_client_id"`
-	XiaoZhiAccessToken     string `mapstructure:"xiaozhi_access_token"`
-	XiaoZhiFeatureAEC      bool   `mapstructure:"xiaozhi_feature_aec"`
+	Host                   string                 `mapstructure:"host"`
+	Port                   int                    `mapstructure:"port"`
+	ConfigAltsDir          string                 `mapstructure:"config_alts_dir"`
+	XiaoZhiBackendURL      string                 `mapstructure:"xiaozhi_backend_url"`
+	XiaoZhiProtocolVersion int                    `mapstructure:"xiaozhi_protocol_version"`
+	XiaoZhiAudioFormat     string                 `mapstructure:"xiaozhi_audio_format"`
+	XiaoZhiOutputFormat    string                 `mapstructure:"xiaozhi_output_format"`
+	XiaoZhiSampleRate      int                    `mapstructure:"xiaozhi_sample_rate"`
+	XiaoZhiChannels        int                    `mapstructure:"xiaozhi_channels"`
+	XiaoZhiFrameDuration   int                    `mapstructure:"xiaozhi_frame_duration"`
+	XiaoZhiListenMode      string                 `mapstructure:"xiaozhi_listen_mode"`
+	XiaoZhiDeviceID        string                 `mapstructure:"xiaozhi_device_id"`
+	XiaoZhiClientID        string                 `mapstructure:"xiaozhi_client_id"`
+	XiaoZhiAccessToken     string                 `mapstructure:"xiaozhi_access_token"`
+	XiaoZhiFeatureAEC      bool                   `mapstructure:"xiaozhi_feature_aec"`
+	HistoryRetention       HistoryRetentionConfig `mapstructure:"history_retention"`
+	Recording              RecordingConfig        `mapstructure:"recording"`
+	VAD                    VADConfig              `mapstructure:"vad"`
+	BargeIn                BargeInConfig          `mapstructure:"barge_in"`
+	EchoCancellation       EchoCancellationConfig `mapstructure:"echo_cancellation"`
+	AudioProcessing        AudioProcessingConfig  `mapstructure:"audio_processing"`
+	JitterBuffer           JitterBufferConfig     `mapstructure:"jitter_buffer"`
+	Resampler              ResamplerConfig        `mapstructure:"resampler"`
+	SessionTimeouts        SessionTimeoutsConfig  `mapstructure:"session_timeouts"`
+	SessionResume          SessionResumeConfig    `mapstructure:"session_resume"`
+	Upstream               UpstreamConfig         `mapstructure:"upstream"`
+}
+
+// UpstreamConfig controls the XiaoZhi connections. With the default policy
+// "session" every session dials its own connection. With "share" sessions
+// for the same device ID share one connection and all see its events, so
+// they mirror one conversation; while a turn is under way only the session
+// that started it can abort it or steer listening. With "handoff" the
+// newest session takes it over and the older ones are closed. A shared
+// connection no session uses is closed after IdleSeconds, except those for
+// PrewarmDeviceIDs, which are opened at startup and kept. With
+// AllowClientDeviceID a client picks its device with the device_id query
+// parameter of /client-ws; such sessions share the device's connection
+// under every policy.
+type UpstreamConfig struct {
+	Policy              string   `mapstructure:"policy"`
+	IdleSeconds         int      `mapstructure:"idle_seconds"`
+	PrewarmDeviceIDs    []string `mapstructure:"prewarm_device_ids"`
+	AllowClientDeviceID bool     `mapstructure:"allow_client_device_id"`
+}
+
+// SessionResumeConfig keeps a session, and its XiaoZhi connection, alive
+// for GraceSeconds after the browser socket drops, so a client reconnecting
+// with the resume token from set-model-and-conf picks up where it left off.
+// Messages sent meanwhile are replayed on reattach; past ReplayMaxMessages
+// or ReplayMaxBytes the oldest are dropped.
+type SessionResumeConfig struct {
+	Enabled           bool `mapstructure:"enabled"`
+	GraceSeconds      int  `mapstructure:"grace_seconds"`
+	ReplayMaxMessages int  `mapstructure:"replay_max_messages"`
+	ReplayMaxBytes    int  `mapstructure:"replay_max_bytes"`
+}
+
+// SessionTimeoutsConfig bounds how long a session may stay in each state,
+// e.g. when the backend never sends tts stop. On expiry the reply is
+// aborted upstream, the conversation ended, listening re-armed outside
+// manual mode and the client shown an error. Zero disables a deadline.
+type SessionTimeoutsConfig struct {
+	Enabled              bool `mapstructure:"enabled"`
+	ProcessingASRSeconds int  `mapstructure:"processing_asr_seconds"`
+	ProcessingLLMSeconds int  `mapstructure:"processing_llm_seconds"`
+	SendingTTSSeconds    int  `mapstructure:"sending_tts_seconds"`
+	InterruptedSeconds   int  `mapstructure:"interrupted_seconds"`
+}
+
+// ResamplerConfig selects the resampler per direction: MicQuality for mic
+// audio going upstream, TTSQuality for TTS audio coming down. Algorithm is
+// "soxr" or "sinc", the pure-Go fallback; qualities are quick, low, medium,
+// high or very_high. Empty values use soxr at high quality.
+type ResamplerConfig struct {
+	Algorithm  string `mapstructure:"algorithm"`
+	MicQuality string `mapstructure:"mic_quality"`
+	TTSQuality string `mapstructure:"tts_quality"`
+}
+
+// JitterBufferConfig paces Opus TTS audio to the client instead of sending
+// fixed 300 ms chunks. FirstChunkMs goes out as soon as it arrives; after
+// that the client is kept between MinDelayMs and MaxDelayMs ahead depending
+// on the observed jitter, and up to MaxConcealMs of FEC or PLC covers a lost
+// packet. A pause in the stream is left silent.
+// Zero tuning values use the buffer defaults.
+type JitterBufferConfig struct {
+	Enabled      bool `mapstructure:"enabled"`
+	FirstChunkMs int  `mapstructure:"first_chunk_ms"`
+	MinDelayMs   int  `mapstructure:"min_delay_ms"`
+	MaxDelayMs   int  `mapstructure:"max_delay_ms"`
+	MaxConcealMs int  `mapstructure:"max_conceal_ms"`
+}
+
+// AudioProcessingConfig toggles the mic pre-processing stages applied to
+// each frame after echo cancellation. Zero tuning values use the stage
+// defaults.
+type AudioProcessingConfig struct {
+	HighPass         bool    `mapstructure:"high_pass"`
+	HighPassHz       float64 `mapstructure:"high_pass_hz"`
+	NoiseSuppression bool    `mapstructure:"noise_suppression"`
+	NoiseFloorDB     float64 `mapstructure:"noise_floor_db"`
+	AGC              bool    `mapstructure:"agc"`
+	AGCTargetDB      float64 `mapstructure:"agc_target_db"`
+	AGCMaxGainDB     float64 `mapstructure:"agc_max_gain_db"`
+	Limiter          bool    `mapstructure:"limiter"`
+}
+
+// EchoCancellationConfig controls removing the echo of TTS audio from mic
+// input in realtime listen mode. TTS audio becomes the echo reference when
+// the client reports that it started playing (audio-play-start); DelayMs is
+// the output latency of the client after that, before the filter window
+// starts. Clients that never report playback get no echo cancellation, and
+// a stall in playback puts the reference out of step until the client
+// reports that playback completed.
+type EchoCancellationConfig struct {
+	Enabled  bool `mapstructure:"enabled"`
+	FilterMs int  `mapstructure:"filter_ms"`
+	DelayMs  int  `mapstructure:"delay_ms"`
+}
+
+// BargeInConfig controls interrupting TTS when the user starts talking in
+// realtime listen mode. ThresholdDB sets the sensitivity: speech must be
+// louder than it for at least MinSpeechMs.
+type BargeInConfig struct {
+	Enabled     bool    `mapstructure:"enabled"`
+	ThresholdDB float64 `mapstructure:"threshold_db"`
+	MinSpeechMs int     `mapstructure:"min_speech_ms"`
+}
+
+// VADConfig controls server-side voice activity detection of mic input in
+// the auto and realtime listen modes. Zero values use the detector defaults.
+type VADConfig struct {
+	Enabled      bool    `mapstructure:"enabled"`
+	ThresholdDB  float64 `mapstructure:"threshold_db"`
+	MinSpeechMs  int     `mapstructure:"min_speech_ms"`
+	EndSilenceMs int     `mapstructure:"end_silence_ms"`
+	PreRollMs    int     `mapstructure:"pre_roll_ms"`
+}
+
+// RecordingConfig controls per-turn recording of mic and TTS audio.
+type RecordingConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Format is "wav" or "ogg" (Opus); ogg falls back to wav for rates Opus
+	// cannot encode.
+	Format string `mapstructure:"format"`
+}
+
+// HistoryRetentionConfig controls automatic pruning of chat histories.
+// Zero limits are disabled.
+type HistoryRetentionConfig struct {
+	Enabled         bool `mapstructure:"enabled"`
+	MaxAgeDays      int  `mapstructure:"max_age_days"`
+	MaxPerConf      int  `mapstructure:"max_per_conf"`
+	MaxTotalMB      int  `mapstructure:"max_total_mb"`
+	IntervalMinutes int  `mapstructure:"interval_minutes"`
+	DryRun          bool `mapstructure:"dry_run"`
 }
 
 // CharacterConfig represents a characterConfig.
@@ -63,6 +205,9 @@ type Config struct {
 	ConfigAltsDir          string          `mapstructure:"config_alts_dir"`
 	ModelDictPath          string          `mapstructure:"model_dict_path"`
 	ChatHistoryDir         string          `mapstructure:"chat_history_dir"`
+	HistoryBackend         string          `mapstructure:"history_backend"`
+	HistoryDBPath          string          `mapstructure:"history_db_path"`
+	RecordingsDir          string          `mapstructure:"recordings_dir"`
 	FrontendDir            string          `mapstructure:"frontend_dir"`
 	Live2DModelsDir        string          `mapstructure:"live2d_models_dir"`
 	BackgroundsDir         string          `mapstructure:"backgrounds_dir"`
@@ -107,6 +252,7 @@ func Load() (Config, error) {
 	v.SetDefault("tls_disable", false)
 	v.SetDefault("tls_cert_path", "")
 	v.SetDefault("tls_key_path", "")
+	v.SetDefault("history_backend", "file")
 	v.SetDefault("log.level", "info")
 	v.SetDefault("log.stdout", true)
 	v.SetDefault("log.file.enabled", true)
@@ -184,6 +330,7 @@ func LoadConfig(configPath string) (Config, error) {
 	v.SetDefault("tls_disable", false)
 	v.SetDefault("tls_cert_path", "")
 	v.SetDefault("tls_key_path", "")
+	v.SetDefault("history_backend", "file")
 
 	v.SetEnvPrefix("mio")
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
@@ -319,6 +466,8 @@ func derivePaths(cfg *Config) {
 	cfg.ConfigAltsDir = resolvePath(cfg.RootDir, configAlts, "config_templates")
 	cfg.ModelDictPath = resolvePath(cfg.RootDir, cfg.ModelDictPath, filepath.Join("webassets", "model_dict.json"))
 	cfg.ChatHistoryDir = resolvePath(cfg.RootDir, cfg.ChatHistoryDir, filepath.Join("data", "vtuber", "chat"))
+	cfg.HistoryDBPath = resolvePath(cfg.RootDir, cfg.HistoryDBPath, filepath.Join("data", "vtuber", "chat.db"))
+	cfg.RecordingsDir = resolvePath(cfg.RootDir, cfg.RecordingsDir, filepath.Join("data", "vtuber", "recordings"))
 	cfg.FrontendDir = resolvePath(cfg.RootDir, cfg.FrontendDir, filepath.Join("webassets", "vtuber"))
 	cfg.Live2DModelsDir = resolvePath(cfg.RootDir, cfg.Live2DModelsDir, filepath.Join("webassets", "live2d-models"))
 	cfg.BackgroundsDir = resolvePath(cfg.RootDir, cfg.BackgroundsDir, filepath.Join("webassets", "backgrounds"))
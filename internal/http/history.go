@@ -0,0 +1,90 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	appconfig "github.com/saker-ai/vtuber-server/internal/config"
+	"github.com/saker-ai/vtuber-server/internal/storage"
+)
+
+// maxImportBytes caps the size of an uploaded history export.
+const maxImportBytes = 32 << 20
+
+func mountHistoryAPI(router *gin.Engine, cfg appconfig.Config, history storage.HistoryStore) {
+	if history == nil {
+		return
+	}
+	api := router.Group("/api/history")
+	api.GET("/search", func(c *gin.Context) {
+		searcher, ok := history.(storage.HistorySearcher)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "history search is not supported by this store"})
+			return
+		}
+		limit, _ := strconv.Atoi(c.Query("limit"))
+		query := c.Query("q")
+		results, err := searcher.SearchHistories(confUIDParam(c, cfg), query, limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"query": query, "results": results})
+	})
+	api.GET("/recordings/*ref", func(c *gin.Context) {
+		path, err := storage.ResolveRecording(cfg.RecordingsDir, c.Param("ref"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.File(path)
+	})
+	api.GET("/export", func(c *gin.Context) {
+		format, err := storage.ParseFormat(c.Query("format"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		confUID := confUIDParam(c, cfg)
+		name := confUID
+		var data []byte
+		if historyUID := c.Query("history_uid"); historyUID != "" {
+			name = historyUID
+			data, err = storage.ExportHistory(history, confUID, historyUID, format)
+		} else {
+			data, err = storage.ExportConf(history, confUID, format)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s%s"`, name, storage.FormatExtension(format)))
+		c.Data(http.StatusOK, storage.FormatContentType(format), data)
+	})
+	api.POST("/import", func(c *gin.Context) {
+		data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes))
+		if err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		uids, err := storage.ImportHistories(history, confUIDParam(c, cfg), c.Query("format"), data)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "history_uids": uids})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"history_uids": uids})
+	})
+}
+
+// confUIDParam returns the conf_uid query parameter, defaulting to the
+// configured character.
+func confUIDParam(c *gin.Context, cfg appconfig.Config) string {
+	if confUID := c.Query("conf_uid"); confUID != "" {
+		return confUID
+	}
+	return cfg.CharacterConfig.ConfUID
+}
@@ -10,12 +10,13 @@ import (
 	"go.uber.org/zap"
 
 	appconfig "github.com/saker-ai/vtuber-server/internal/config"
+	"github.com/saker-ai/vtuber-server/internal/storage"
 	"github.com/saker-ai/vtuber-server/internal/ws"
 	"github.com/saker-ai/vtuber-server/webassets"
 )
 
 // NewRouter executes the newRouter function.
-func NewRouter(cfg appconfig.Config, wsHandler *ws.Handler, logger *zap.Logger) *gin.Engine {
+func NewRouter(cfg appconfig.Config, wsHandler *ws.Handler, history storage.HistoryStore, logger *zap.Logger) *gin.Engine {
 	router := gin.New()
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
@@ -30,6 +31,8 @@ func NewRouter(cfg appconfig.Config, wsHandler *ws.Handler, logger *zap.Logger)
 		wsHandler.Handle(c.Writer, c.Request)
 	})
 
+	mountHistoryAPI(router, cfg, history)
+
 	if !mountEmbeddedFrontend(router, logger) {
 		router.Static("/frontend", cfg.FrontendDir)
 		router.Static("/assets", filepath.Join(cfg.FrontendDir, "assets"))
@@ -1,9 +1,56 @@
 package media
 
-// AudioProcessor represents a audioProcessor.
-type AudioProcessor struct{}
+import (
+	"github.com/saker-ai/vtuber-server/internal/config"
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+)
+
+// AudioProcessor cleans up mic frames once echo is cancelled: high-pass
+// filter, noise suppression, AGC and limiter, each switched by config. The
+// pipeline is rebuilt when the frame format changes.
+type AudioProcessor struct {
+	cfg        config.AudioProcessingConfig
+	sampleRate int
+	channels   int
+	pipeline   *audio.Preprocessor
+}
 
 // NewAudioProcessor executes the newAudioProcessor function.
-func NewAudioProcessor() *AudioProcessor {
-	return &AudioProcessor{}
+func NewAudioProcessor(cfg config.AudioProcessingConfig) *AudioProcessor {
+	return &AudioProcessor{cfg: cfg}
+}
+
+// Enabled reports whether any stage is on.
+func (p *AudioProcessor) Enabled() bool {
+	return p != nil && p.preprocessorConfig(0, 0).Enabled()
+}
+
+// Process runs the pipeline over interleaved samples in place and returns
+// them.
+func (p *AudioProcessor) Process(samples []int16, sampleRate int, channels int) []int16 {
+	if !p.Enabled() || len(samples) == 0 || sampleRate <= 0 || channels <= 0 {
+		return samples
+	}
+	if p.pipeline == nil || p.sampleRate != sampleRate || p.channels != channels {
+		p.pipeline = audio.NewPreprocessor(p.preprocessorConfig(sampleRate, channels))
+		p.sampleRate = sampleRate
+		p.channels = channels
+	}
+	p.pipeline.Process(samples)
+	return samples
+}
+
+func (p *AudioProcessor) preprocessorConfig(sampleRate int, channels int) audio.PreprocessorConfig {
+	return audio.PreprocessorConfig{
+		SampleRate:       sampleRate,
+		Channels:         channels,
+		HighPass:         p.cfg.HighPass,
+		HighPassHz:       p.cfg.HighPassHz,
+		NoiseSuppression: p.cfg.NoiseSuppression,
+		NoiseFloorDB:     p.cfg.NoiseFloorDB,
+		AGC:              p.cfg.AGC,
+		AGCTargetDB:      p.cfg.AGCTargetDB,
+		AGCMaxGainDB:     p.cfg.AGCMaxGainDB,
+		Limiter:          p.cfg.Limiter,
+	}
 }
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// AudioFrameVersion is the binary audio frame layout understood by the server.
+const AudioFrameVersion = 1
+
+// AudioFrameHeaderSize is the fixed header length of a binary audio frame.
+//
+// Layout (big-endian):
+//
+//	0     version
+//	1     stream kind
+//	2     codec
+//	3     channels
+//	4-7   sample rate
+//	8-11  sequence number
+const AudioFrameHeaderSize = 12
+
+// AudioStream identifies what a binary audio frame carries.
+type AudioStream uint8
+
+const (
+	// AudioStreamMic carries microphone audio from the client.
+	AudioStreamMic AudioStream = 1
+	// AudioStreamTTS carries synthesized speech to the client.
+	AudioStreamTTS AudioStream = 2
+)
+
+// AudioCodec identifies the payload encoding of a binary audio frame.
+type AudioCodec uint8
+
+const (
+	// AudioCodecPCM16 is interleaved signed 16-bit little-endian PCM.
+	AudioCodecPCM16 AudioCodec = 0
+	// AudioCodecOggOpus is Ogg Opus: consecutive chunks of one stream per
+	// TTS reply, or per mic input.
+	AudioCodecOggOpus AudioCodec = 1
+	// AudioCodecWebMOpus is consecutive chunks of a WebM stream with an Opus
+	// track, as produced by MediaRecorder.
+	AudioCodecWebMOpus AudioCodec = 2
+	// AudioCodecOpus is a single raw Opus packet.
+	AudioCodecOpus AudioCodec = 3
+)
+
+// AudioFrameHeader describes a binary audio frame payload.
+type AudioFrameHeader struct {
+	Stream     AudioStream
+	Codec      AudioCodec
+	SampleRate int
+	Channels   int
+	Seq        uint32
+}
+
+// EncodeAudioFrame prepends the header to payload.
+func EncodeAudioFrame(h AudioFrameHeader, payload []byte) []byte {
+	frame := make([]byte, AudioFrameHeaderSize+len(payload))
+	frame[0] = AudioFrameVersion
+	frame[1] = byte(h.Stream)
+	frame[2] = byte(h.Codec)
+	frame[3] = byte(h.Channels)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(h.SampleRate))
+	binary.BigEndian.PutUint32(frame[8:12], h.Seq)
+	copy(frame[AudioFrameHeaderSize:], payload)
+	return frame
+}
+
+// DecodeAudioFrame splits a binary audio frame into header and payload. The
+// payload aliases frame.
+func DecodeAudioFrame(frame []byte) (AudioFrameHeader, []byte, error) {
+	if len(frame) < AudioFrameHeaderSize {
+		return AudioFrameHeader{}, nil, errors.New("audio frame too short")
+	}
+	if frame[0] != AudioFrameVersion {
+		return AudioFrameHeader{}, nil, errors.New("unsupported audio frame version")
+	}
+	h := AudioFrameHeader{
+		Stream:     AudioStream(frame[1]),
+		Codec:      AudioCodec(frame[2]),
+		Channels:   int(frame[3]),
+		SampleRate: int(binary.BigEndian.Uint32(frame[4:8])),
+		Seq:        binary.BigEndian.Uint32(frame[8:12]),
+	}
+	if h.Channels <= 0 || h.SampleRate <= 0 {
+		return AudioFrameHeader{}, nil, errors.New("invalid audio frame format")
+	}
+	return h, frame[AudioFrameHeaderSize:], nil
+}
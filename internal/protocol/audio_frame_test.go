@@ -0,0 +1,43 @@
+package protocol
+
+import "testing"
+
+func TestAudioFrameRoundTrip(t *testing.T) {
+	in := AudioFrameHeader{
+		Stream:     AudioStreamTTS,
+		Codec:      AudioCodecPCM16,
+		SampleRate: 24000,
+		Channels:   2,
+		Seq:        0x01020304,
+	}
+	payload := []byte{0x10, 0x20, 0x30, 0x40}
+	frame := EncodeAudioFrame(in, payload)
+	if len(frame) != AudioFrameHeaderSize+len(payload) {
+		t.Fatalf("frame len=%d, want %d", len(frame), AudioFrameHeaderSize+len(payload))
+	}
+
+	got, body, err := DecodeAudioFrame(frame)
+	if err != nil {
+		t.Fatalf("DecodeAudioFrame returned error: %v", err)
+	}
+	if got != in {
+		t.Fatalf("header=%+v, want %+v", got, in)
+	}
+	if string(body) != string(payload) {
+		t.Fatalf("payload=%v, want %v", body, payload)
+	}
+}
+
+func TestDecodeAudioFrameRejectsInvalid(t *testing.T) {
+	valid := EncodeAudioFrame(AudioFrameHeader{Stream: AudioStreamMic, SampleRate: 16000, Channels: 1}, nil)
+	cases := map[string][]byte{
+		"short":       valid[:AudioFrameHeaderSize-1],
+		"version":     append([]byte{9}, valid[1:]...),
+		"no channels": append(append([]byte(nil), valid[:3]...), append([]byte{0}, valid[4:]...)...),
+	}
+	for name, frame := range cases {
+		if _, _, err := DecodeAudioFrame(frame); err == nil {
+			t.Fatalf("%s: DecodeAudioFrame returned nil error", name)
+		}
+	}
+}
@@ -19,4 +19,29 @@ type ClientCommand struct {
 	InviteeUID string    `json:"invitee_uid,omitempty"`
 	TargetUID  string    `json:"target_uid,omitempty"`
 	HistoryUID string    `json:"history_uid,omitempty"`
+	Query      string    `json:"query,omitempty"`
+	Offset     int       `json:"offset,omitempty"`
+	Limit      int       `json:"limit,omitempty"`
+	Format     string    `json:"format,omitempty"`
+	Content    string    `json:"content,omitempty"`
+	Title      string    `json:"title,omitempty"`
+	Pinned     *bool     `json:"pinned,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	// BinaryAudio asks the server to exchange audio as binary frames; see
+	// AudioFrameHeader.
+	BinaryAudio *bool `json:"binary_audio,omitempty"`
+	// AudioOutputFormat selects the TTS encoding: "pcm16" (default) or
+	// "opus" for self-contained Ogg Opus chunks.
+	AudioOutputFormat string `json:"audio_output_format,omitempty"`
+	// AudioOutputRate and AudioOutputChannels set the client's preferred
+	// TTS playback format; the server converts to it. Zero keeps the
+	// upstream format.
+	AudioOutputRate     int `json:"audio_output_sample_rate,omitempty"`
+	AudioOutputChannels int `json:"audio_output_channels,omitempty"`
+	// AudioCodec marks mic-audio-data as encoded: "opus" carries raw packets
+	// in AudioPackets; "ogg" and "webm" carry container chunks, e.g. from
+	// MediaRecorder, in AudioData. Empty means PCM in AudioPCM or Audio.
+	AudioCodec   string   `json:"audio_codec,omitempty"`
+	AudioData    string   `json:"audio_data,omitempty"`
+	AudioPackets []string `json:"audio_packets,omitempty"`
 }
@@ -1,9 +1,11 @@
 package fsm
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 )
 
 // State describes the high-level conversation state for a client session.
@@ -27,18 +29,143 @@ const (
 	ModeRealtime Mode = "realtime"
 )
 
-// Machine is a lightweight deterministic session state machine.
+// Event triggers a transition.
+type Event string
+
+const (
+	EventListenStart       Event = "listen_start"
+	EventListenStop        Event = "listen_stop"
+	EventAudioCommit       Event = "audio_commit"
+	EventConversationStart Event = "conversation_start"
+	EventTTSStart          Event = "tts_start"
+	EventTTSStop           Event = "tts_stop"
+	EventInterrupt         Event = "interrupt"
+	EventForce             Event = "force"
+)
+
+// ErrTransitionRejected is wrapped by errors for events the current state
+// does not accept.
+var ErrTransitionRejected = errors.New("transition rejected")
+
+// historySize is how many transitions History keeps.
+const historySize = 32
+
+// rules maps an event and source state to the target state. Events missing
+// for a state are rejected.
+type rules map[Event]map[State]State
+
+// baseRules apply in every mode.
+var baseRules = rules{
+	EventListenStart: {
+		StateIdle:        StateListening,
+		StateListening:   StateListening,
+		StateInterrupted: StateListening,
+	},
+	EventListenStop: {
+		StateIdle:          StateIdle,
+		StateListening:     StateIdle,
+		StateProcessingASR: StateProcessingASR,
+		StateProcessingLLM: StateProcessingLLM,
+		StateSendingTTS:    StateSendingTTS,
+		StateInterrupted:   StateInterrupted,
+	},
+	EventAudioCommit: {
+		StateIdle:          StateProcessingASR,
+		StateListening:     StateProcessingASR,
+		StateProcessingASR: StateProcessingASR,
+		StateInterrupted:   StateProcessingASR,
+	},
+	EventConversationStart: {
+		StateIdle:          StateProcessingLLM,
+		StateListening:     StateProcessingLLM,
+		StateProcessingASR: StateProcessingLLM,
+		StateProcessingLLM: StateProcessingLLM,
+		StateInterrupted:   StateProcessingLLM,
+	},
+	EventTTSStart: {
+		StateIdle:          StateSendingTTS,
+		StateListening:     StateSendingTTS,
+		StateProcessingASR: StateSendingTTS,
+		StateProcessingLLM: StateSendingTTS,
+		StateSendingTTS:    StateSendingTTS,
+	},
+	EventTTSStop: {
+		StateProcessingLLM: StateListening,
+		StateSendingTTS:    StateListening,
+		StateInterrupted:   StateListening,
+	},
+	EventInterrupt: {
+		StateProcessingASR: StateInterrupted,
+		StateProcessingLLM: StateInterrupted,
+		StateSendingTTS:    StateInterrupted,
+	},
+}
+
+// modeRules override baseRules per mode. Manual mode goes idle after a
+// reply since the mic waits for the user; realtime mode keeps the mic open
+// while the reply is produced, so listening starts without leaving it.
+var modeRules = map[Mode]rules{
+	ModeManual: {
+		EventTTSStop: {
+			StateProcessingLLM: StateIdle,
+			StateSendingTTS:    StateIdle,
+			StateInterrupted:   StateIdle,
+		},
+	},
+	ModeRealtime: {
+		EventListenStart: {
+			StateProcessingASR: StateProcessingASR,
+			StateProcessingLLM: StateProcessingLLM,
+			StateSendingTTS:    StateSendingTTS,
+		},
+	},
+}
+
+// Transition records a state change.
+type Transition struct {
+	From   State
+	To     State
+	Event  Event
+	Mode   Mode
+	Reason string
+	At     time.Time
+}
+
+// Listener is called with a transition after it is applied.
+type Listener func(Transition)
+
+// Machine is a table-driven session state machine. Events move it between
+// states according to the rules of the current mode; events a state does not
+// accept are rejected with ErrTransitionRejected. Next to the state it tracks
+// whether the upstream is listening, which is independent of it in realtime
+// mode.
+//
+// Listeners run synchronously after each change, in order: exit hooks of the
+// old state, entry hooks of the new one, then subscribers. They must not fire
+// events on the same machine.
 type Machine struct {
-	mu    sync.RWMutex
-	state State
-	mode  Mode
+	mu            sync.RWMutex
+	state         State
+	mode          Mode
+	listening     bool
+	listenPending bool
+	history       []Transition
+
+	dispatchMu  sync.Mutex
+	entryHooks  map[State][]Listener
+	exitHooks   map[State][]Listener
+	subscribers map[int]Listener
+	nextSubID   int
 }
 
 // New creates a state machine with default idle/auto values.
 func New() *Machine {
 	return &Machine{
-		state: StateIdle,
-		mode:  ModeAuto,
+		state:       StateIdle,
+		mode:        ModeAuto,
+		entryHooks:  map[State][]Listener{},
+		exitHooks:   map[State][]Listener{},
+		subscribers: map[int]Listener{},
 	}
 }
 
@@ -70,56 +197,226 @@ func (m *Machine) SetMode(mode string) {
 	}
 }
 
+// InConversation reports whether a reply is being produced or torn down.
+func (m *Machine) InConversation() bool {
+	switch m.State() {
+	case StateProcessingLLM, StateSendingTTS, StateInterrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// Speaking reports whether TTS audio is being sent.
+func (m *Machine) Speaking() bool {
+	return m.State() == StateSendingTTS
+}
+
+// Listening reports whether the upstream is listening.
+func (m *Machine) Listening() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.listening
+}
+
+// ListenStatus reports whether the upstream is listening and whether a
+// listen start is in flight.
+func (m *Machine) ListenStatus() (listening bool, pending bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.listening, m.listenPending
+}
+
+// BeginListenStart claims the listen start unless the upstream is already
+// listening or another start is in flight, and reports which applied. The
+// caller that claims it must call EndListenStart.
+func (m *Machine) BeginListenStart() (listening bool, pending bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.listening || m.listenPending {
+		return m.listening, m.listenPending
+	}
+	m.listenPending = true
+	return false, false
+}
+
+// EndListenStart completes a claimed listen start and, when it succeeded,
+// fires EventListenStart.
+func (m *Machine) EndListenStart(ok bool) error {
+	m.mu.Lock()
+	m.listenPending = false
+	m.listening = ok
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return m.Fire(EventListenStart, "")
+}
+
 // OnListenStart moves session into listening.
-func (m *Machine) OnListenStart() {
-	m.transition(StateListening)
+func (m *Machine) OnListenStart() error {
+	m.mu.Lock()
+	m.listening = true
+	m.mu.Unlock()
+	return m.Fire(EventListenStart, "")
+}
+
+// OnListenStop records that the upstream stopped listening.
+func (m *Machine) OnListenStop() error {
+	m.mu.Lock()
+	m.listening = false
+	m.listenPending = false
+	m.mu.Unlock()
+	return m.Fire(EventListenStop, "")
 }
 
 // OnAudioCommit marks upstream audio collected and awaiting llm.
-func (m *Machine) OnAudioCommit() {
-	m.transition(StateProcessingASR)
+func (m *Machine) OnAudioCommit() error {
+	return m.Fire(EventAudioCommit, "")
 }
 
 // OnConversationStart marks llm/text response processing.
-func (m *Machine) OnConversationStart() {
-	m.transition(StateProcessingLLM)
+func (m *Machine) OnConversationStart() error {
+	return m.Fire(EventConversationStart, "")
 }
 
 // OnTTSStart enters speaking state.
-func (m *Machine) OnTTSStart() {
-	m.transition(StateSendingTTS)
+func (m *Machine) OnTTSStart() error {
+	return m.Fire(EventTTSStart, "")
 }
 
 // OnTTSStop exits speaking state according to mode policy.
-func (m *Machine) OnTTSStop() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	switch m.mode {
-	case ModeManual:
-		m.state = StateIdle
-	default:
-		m.state = StateListening
-	}
+func (m *Machine) OnTTSStop() error {
+	return m.Fire(EventTTSStop, "")
 }
 
 // OnInterrupt marks interruption.
-func (m *Machine) OnInterrupt() {
-	m.transition(StateInterrupted)
+func (m *Machine) OnInterrupt() error {
+	return m.Fire(EventInterrupt, "")
+}
+
+// Fire applies event if the current state accepts it in the current mode.
+// reason is kept in the transition for debugging.
+func (m *Machine) Fire(event Event, reason string) error {
+	m.dispatchMu.Lock()
+	defer m.dispatchMu.Unlock()
+	m.mu.Lock()
+	to, ok := m.target(event)
+	if !ok {
+		from, mode := m.state, m.mode
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s from %s in %s mode", ErrTransitionRejected, event, from, mode)
+	}
+	t, changed := m.apply(event, to, reason)
+	m.mu.Unlock()
+	if changed {
+		m.notify(t)
+	}
+	return nil
 }
 
 // Force sets state unconditionally.
 func (m *Machine) Force(state State) error {
+	return m.ForceWithReason(state, "")
+}
+
+// ForceWithReason sets state unconditionally and keeps reason in the
+// transition.
+func (m *Machine) ForceWithReason(state State, reason string) error {
 	switch state {
 	case StateIdle, StateListening, StateProcessingASR, StateProcessingLLM, StateSendingTTS, StateInterrupted:
-		m.transition(state)
-		return nil
 	default:
 		return fmt.Errorf("invalid state: %s", state)
 	}
+	m.dispatchMu.Lock()
+	defer m.dispatchMu.Unlock()
+	m.mu.Lock()
+	t, changed := m.apply(EventForce, state, reason)
+	m.mu.Unlock()
+	if changed {
+		m.notify(t)
+	}
+	return nil
 }
 
-func (m *Machine) transition(state State) {
-	m.mu.Lock()
+// History returns the most recent transitions, oldest first.
+func (m *Machine) History() []Transition {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Transition(nil), m.history...)
+}
+
+// AddEntryHook registers fn to run when the machine enters state.
+func (m *Machine) AddEntryHook(state State, fn Listener) {
+	m.dispatchMu.Lock()
+	defer m.dispatchMu.Unlock()
+	m.entryHooks[state] = append(m.entryHooks[state], fn)
+}
+
+// AddExitHook registers fn to run when the machine leaves state.
+func (m *Machine) AddExitHook(state State, fn Listener) {
+	m.dispatchMu.Lock()
+	defer m.dispatchMu.Unlock()
+	m.exitHooks[state] = append(m.exitHooks[state], fn)
+}
+
+// Subscribe registers fn for every transition and returns a function that
+// removes it.
+func (m *Machine) Subscribe(fn Listener) func() {
+	m.dispatchMu.Lock()
+	defer m.dispatchMu.Unlock()
+	id := m.nextSubID
+	m.nextSubID++
+	m.subscribers[id] = fn
+	return func() {
+		m.dispatchMu.Lock()
+		defer m.dispatchMu.Unlock()
+		delete(m.subscribers, id)
+	}
+}
+
+// target looks up the state event leads to. The caller holds mu.
+func (m *Machine) target(event Event) (State, bool) {
+	if to, ok := modeRules[m.mode][event][m.state]; ok {
+		return to, true
+	}
+	to, ok := baseRules[event][m.state]
+	return to, ok
+}
+
+// apply moves to state and records the transition. Staying in the same
+// state is not a transition. The caller holds mu.
+func (m *Machine) apply(event Event, state State, reason string) (Transition, bool) {
+	if state == m.state {
+		return Transition{}, false
+	}
+	t := Transition{
+		From:   m.state,
+		To:     state,
+		Event:  event,
+		Mode:   m.mode,
+		Reason: reason,
+		At:     time.Now(),
+	}
 	m.state = state
-	m.mu.Unlock()
+	if len(m.history) == historySize {
+		m.history = append(m.history[:0], m.history[1:]...)
+	}
+	m.history = append(m.history, t)
+	return t, true
+}
+
+// notify runs the listeners for t. The caller holds dispatchMu.
+func (m *Machine) notify(t Transition) {
+	for _, fn := range m.exitHooks[t.From] {
+		fn(t)
+	}
+	for _, fn := range m.entryHooks[t.To] {
+		fn(t)
+	}
+	for id := 0; id < m.nextSubID; id++ {
+		if fn, ok := m.subscribers[id]; ok {
+			fn(t)
+		}
+	}
 }
@@ -1,6 +1,10 @@
 package fsm
 
-import "testing"
+import (
+	"errors"
+	"strings"
+	"testing"
+)
 
 func TestMachineDefault(t *testing.T) {
 	m := New()
@@ -55,3 +59,115 @@ func TestMachineInvalidForce(t *testing.T) {
 		t.Fatal("Force(unknown) error=nil, want non-nil")
 	}
 }
+
+func TestMachineRejectsTransition(t *testing.T) {
+	m := New()
+	err := m.OnTTSStop()
+	if !errors.Is(err, ErrTransitionRejected) {
+		t.Fatalf("OnTTSStop from idle error=%v, want ErrTransitionRejected", err)
+	}
+	if got := m.State(); got != StateIdle {
+		t.Fatalf("state=%s, want %s", got, StateIdle)
+	}
+	if got := len(m.History()); got != 0 {
+		t.Fatalf("history=%d, want 0", got)
+	}
+}
+
+func TestMachineListenStartDuringReplyPerMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode    string
+		wantErr bool
+	}{
+		{"auto", true},
+		{"manual", true},
+		{"realtime", false},
+	} {
+		m := New()
+		m.SetMode(tc.mode)
+		_ = m.OnConversationStart()
+		_ = m.OnTTSStart()
+		err := m.OnListenStart()
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: OnListenStart error=%v, want error %v", tc.mode, err, tc.wantErr)
+		}
+		if got := m.State(); got != StateSendingTTS {
+			t.Fatalf("%s: state=%s, want %s", tc.mode, got, StateSendingTTS)
+		}
+		if !m.Listening() {
+			t.Fatalf("%s: Listening=false, want true", tc.mode)
+		}
+	}
+}
+
+func TestMachineListenersAndHistory(t *testing.T) {
+	m := New()
+	var calls []string
+	m.AddExitHook(StateIdle, func(tr Transition) { calls = append(calls, "exit:"+string(tr.From)) })
+	m.AddEntryHook(StateListening, func(tr Transition) { calls = append(calls, "enter:"+string(tr.To)) })
+	unsubscribe := m.Subscribe(func(tr Transition) { calls = append(calls, "sub:"+string(tr.Event)) })
+
+	_ = m.OnListenStart()
+	_ = m.OnListenStart()
+	unsubscribe()
+	_ = m.OnAudioCommit()
+
+	want := []string{"exit:idle", "enter:listening", "sub:listen_start"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Fatalf("calls=%v, want %v", calls, want)
+	}
+	history := m.History()
+	if len(history) != 2 {
+		t.Fatalf("history=%d, want 2", len(history))
+	}
+	if history[1].From != StateListening || history[1].To != StateProcessingASR || history[1].Event != EventAudioCommit {
+		t.Fatalf("history[1]=%+v, want listening->processing_asr on audio_commit", history[1])
+	}
+}
+
+func TestMachineHistoryIsBounded(t *testing.T) {
+	m := New()
+	for range historySize {
+		_ = m.OnListenStart()
+		_ = m.OnListenStop()
+	}
+	if got := len(m.History()); got != historySize {
+		t.Fatalf("history=%d, want %d", got, historySize)
+	}
+}
+
+func TestMachineListenStartClaim(t *testing.T) {
+	m := New()
+	if listening, pending := m.BeginListenStart(); listening || pending {
+		t.Fatalf("first BeginListenStart=(%v,%v), want (false,false)", listening, pending)
+	}
+	if listening, pending := m.BeginListenStart(); listening || !pending {
+		t.Fatalf("second BeginListenStart=(%v,%v), want (false,true)", listening, pending)
+	}
+	if err := m.EndListenStart(true); err != nil {
+		t.Fatalf("EndListenStart error: %v", err)
+	}
+	if listening, pending := m.ListenStatus(); !listening || pending {
+		t.Fatalf("ListenStatus=(%v,%v), want (true,false)", listening, pending)
+	}
+	if got := m.State(); got != StateListening {
+		t.Fatalf("state=%s, want %s", got, StateListening)
+	}
+	if err := m.OnListenStop(); err != nil {
+		t.Fatalf("OnListenStop error: %v", err)
+	}
+	if m.Listening() || m.State() != StateIdle {
+		t.Fatalf("after stop listening=%v state=%s, want false %s", m.Listening(), m.State(), StateIdle)
+	}
+}
+
+func TestMachineForceWithReasonRecordsReason(t *testing.T) {
+	m := New()
+	if err := m.ForceWithReason(StateListening, "barge_in"); err != nil {
+		t.Fatalf("ForceWithReason error: %v", err)
+	}
+	history := m.History()
+	if len(history) != 1 || history[0].Event != EventForce || history[0].Reason != "barge_in" {
+		t.Fatalf("history=%+v, want one forced transition with reason barge_in", history)
+	}
+}
@@ -0,0 +1,128 @@
+package fsm
+
+import (
+	"sync"
+	"time"
+)
+
+// Timeout describes a state that outlived its deadline.
+type Timeout struct {
+	State   State
+	Mode    Mode
+	Entered time.Time
+	After   time.Duration
+	// Count is how many times this state has timed out on the machine.
+	Count int
+}
+
+// Watchdog calls a recovery function when a Machine stays in a state longer
+// than the deadline configured for it. States without a deadline are never
+// timed. If the state is still unchanged after recovery, the deadline is
+// armed again.
+type Watchdog struct {
+	machine   *Machine
+	deadlines map[State]time.Duration
+	onTimeout func(Timeout)
+
+	mu          sync.Mutex
+	timer       *time.Timer
+	gen         uint64
+	counts      map[State]int
+	stopped     bool
+	unsubscribe func()
+}
+
+// NewWatchdog starts watching m. onTimeout runs on its own goroutine and
+// may fire events on m.
+func NewWatchdog(m *Machine, deadlines map[State]time.Duration, onTimeout func(Timeout)) *Watchdog {
+	w := &Watchdog{
+		machine:   m,
+		deadlines: deadlines,
+		onTimeout: onTimeout,
+		counts:    map[State]int{},
+	}
+	unsubscribe := m.Subscribe(func(t Transition) {
+		w.arm(t.To, t.At)
+	})
+	w.mu.Lock()
+	w.unsubscribe = unsubscribe
+	w.mu.Unlock()
+	w.arm(m.State(), time.Now())
+	return w
+}
+
+// Stop disarms the watchdog.
+func (w *Watchdog) Stop() {
+	w.mu.Lock()
+	w.stopped = true
+	w.gen++
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	unsubscribe := w.unsubscribe
+	w.unsubscribe = nil
+	w.mu.Unlock()
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+}
+
+// Counts returns how often each state has timed out.
+func (w *Watchdog) Counts() map[State]int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	counts := make(map[State]int, len(w.counts))
+	for state, n := range w.counts {
+		counts[state] = n
+	}
+	return counts
+}
+
+// arm restarts the deadline for state, entered at entered.
+func (w *Watchdog) arm(state State, entered time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	w.gen++
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	after := w.deadlines[state]
+	if after <= 0 {
+		return
+	}
+	gen := w.gen
+	w.timer = time.AfterFunc(after, func() {
+		w.fire(gen, state, entered, after)
+	})
+}
+
+func (w *Watchdog) fire(gen uint64, state State, entered time.Time, after time.Duration) {
+	w.mu.Lock()
+	if w.stopped || gen != w.gen || w.machine.State() != state {
+		w.mu.Unlock()
+		return
+	}
+	w.counts[state]++
+	timeout := Timeout{
+		State:   state,
+		Mode:    w.machine.Mode(),
+		Entered: entered,
+		After:   after,
+		Count:   w.counts[state],
+	}
+	w.mu.Unlock()
+
+	w.onTimeout(timeout)
+
+	w.mu.Lock()
+	stuck := !w.stopped && gen == w.gen
+	w.mu.Unlock()
+	if stuck {
+		w.arm(state, time.Now())
+	}
+}
@@ -0,0 +1,69 @@
+package fsm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdogFiresAfterDeadline(t *testing.T) {
+	m := New()
+	fired := make(chan Timeout, 4)
+	w := NewWatchdog(m, map[State]time.Duration{StateProcessingLLM: 20 * time.Millisecond}, func(to Timeout) {
+		fired <- to
+		_ = m.Force(StateIdle)
+	})
+	defer w.Stop()
+
+	_ = m.OnConversationStart()
+	select {
+	case to := <-fired:
+		if to.State != StateProcessingLLM || to.Count != 1 {
+			t.Fatalf("timeout=%+v, want processing_llm count 1", to)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not fire")
+	}
+	if got := w.Counts()[StateProcessingLLM]; got != 1 {
+		t.Fatalf("count=%d, want 1", got)
+	}
+	if got := m.State(); got != StateIdle {
+		t.Fatalf("state=%s, want %s", got, StateIdle)
+	}
+}
+
+func TestWatchdogDisarmsOnTransition(t *testing.T) {
+	m := New()
+	fired := make(chan Timeout, 1)
+	w := NewWatchdog(m, map[State]time.Duration{StateSendingTTS: 30 * time.Millisecond}, func(to Timeout) {
+		fired <- to
+	})
+	defer w.Stop()
+
+	_ = m.OnTTSStart()
+	_ = m.OnTTSStop()
+	select {
+	case to := <-fired:
+		t.Fatalf("unexpected timeout %+v", to)
+	case <-time.After(80 * time.Millisecond):
+	}
+}
+
+func TestWatchdogRearmsWhileStuck(t *testing.T) {
+	m := New()
+	fired := make(chan Timeout, 4)
+	w := NewWatchdog(m, map[State]time.Duration{StateProcessingASR: 10 * time.Millisecond}, func(to Timeout) {
+		fired <- to
+	})
+	_ = m.OnAudioCommit()
+	for want := 1; want <= 2; want++ {
+		select {
+		case to := <-fired:
+			if to.Count != want {
+				t.Fatalf("count=%d, want %d", to.Count, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout %d did not fire", want)
+		}
+	}
+	w.Stop()
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Export formats.
+const (
+	FormatMarkdown = "markdown"
+	FormatJSON     = "json"
+	FormatJSONL    = "jsonl"
+)
+
+// ExportedHistory is one history in a whole-conf JSON export.
+type ExportedHistory struct {
+	HistoryUID string           `json:"history_uid"`
+	Messages   []HistoryMessage `json:"messages"`
+	HistoryMeta
+}
+
+// exportRecord is one line of a whole-conf JSONL export.
+type exportRecord struct {
+	HistoryUID string `json:"history_uid,omitempty"`
+	HistoryMessage
+}
+
+// ParseFormat normalizes an export format name. An empty name means JSON.
+func ParseFormat(format string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", FormatJSON:
+		return FormatJSON, nil
+	case FormatJSONL, "ndjson":
+		return FormatJSONL, nil
+	case FormatMarkdown, "md":
+		return FormatMarkdown, nil
+	default:
+		return "", fmt.Errorf("unsupported history format: %q", format)
+	}
+}
+
+// FormatContentType returns the MIME type of an export format.
+func FormatContentType(format string) string {
+	switch format {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatJSONL:
+		return "application/x-ndjson"
+	default:
+		return "application/json"
+	}
+}
+
+// FormatExtension returns the file extension of an export format.
+func FormatExtension(format string) string {
+	if format == FormatMarkdown {
+		return ".md"
+	}
+	return "." + format
+}
+
+// ExportHistory renders a single history in format. JSON and JSONL exports
+// of a history with a title, pin or tags start with its metadata entry.
+func ExportHistory(store HistoryStore, confUID string, historyUID string, format string) ([]byte, error) {
+	format, err := ParseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := store.GetHistory(confUID, historyUID)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatMarkdown:
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "# %s\n", historyUID)
+		writeMarkdownMessages(&buf, messages)
+		return buf.Bytes(), nil
+	}
+	messages = append(exportedMetadata(historyMetaOf(store, confUID, historyUID)), messages...)
+	switch format {
+	case FormatJSONL:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		for _, msg := range messages {
+			if err := enc.Encode(msg); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	default:
+		return json.MarshalIndent(messages, "", "  ")
+	}
+}
+
+// ExportConf renders every history of confUID in format, newest first.
+func ExportConf(store HistoryStore, confUID string, format string) ([]byte, error) {
+	format, err := ParseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if !safeNamePattern.MatchString(confUID) {
+		return nil, errors.New("invalid conf_uid")
+	}
+	histories := []ExportedHistory{}
+	for _, info := range store.GetHistoryList(confUID) {
+		messages, err := store.GetHistory(confUID, info.UID)
+		if err != nil {
+			return nil, err
+		}
+		histories = append(histories, ExportedHistory{HistoryUID: info.UID, Messages: messages, HistoryMeta: info.HistoryMeta})
+	}
+	switch format {
+	case FormatMarkdown:
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "# %s\n", confUID)
+		for _, history := range histories {
+			fmt.Fprintf(&buf, "\n## %s\n", history.HistoryUID)
+			writeMarkdownMessages(&buf, history.Messages)
+		}
+		return buf.Bytes(), nil
+	case FormatJSONL:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		for _, history := range histories {
+			messages := append(exportedMetadata(history.HistoryMeta), history.Messages...)
+			for _, msg := range messages {
+				if err := enc.Encode(exportRecord{HistoryUID: history.HistoryUID, HistoryMessage: msg}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return buf.Bytes(), nil
+	default:
+		return json.MarshalIndent(histories, "", "  ")
+	}
+}
+
+// historyMetaOf looks up the metadata of historyUID, which GetHistory leaves
+// out.
+func historyMetaOf(store HistoryStore, confUID string, historyUID string) HistoryMeta {
+	for _, info := range store.GetHistoryList(confUID) {
+		if info.UID == historyUID {
+			return info.HistoryMeta
+		}
+	}
+	return HistoryMeta{}
+}
+
+// exportedMetadata returns the metadata entry that carries meta in a message
+// list, or none when meta is empty.
+func exportedMetadata(meta HistoryMeta) []HistoryMessage {
+	if meta.Title == "" && !meta.Pinned && len(meta.Tags) == 0 {
+		return nil
+	}
+	return []HistoryMessage{{Role: RoleMetadata, HistoryMeta: meta}}
+}
+
+func writeMarkdownMessages(buf *bytes.Buffer, messages []HistoryMessage) {
+	for _, msg := range messages {
+		name := msg.Name
+		if name == "" {
+			name = msg.Role
+		}
+		fmt.Fprintf(buf, "\n**%s** (%s, %s)\n\n%s\n", name, msg.Role, msg.Timestamp, msg.Content)
+	}
+}
+
+// ImportHistories validates a JSON or JSONL export and stores each history
+// it contains, with its title, pin and tags, under a fresh history UID.
+// Nothing is kept unless every history is stored. It returns the new
+// history UIDs in input order.
+func ImportHistories(store HistoryStore, confUID string, format string, data []byte) ([]string, error) {
+	format, err := ParseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if !safeNamePattern.MatchString(confUID) {
+		return nil, errors.New("invalid conf_uid")
+	}
+	var histories [][]HistoryMessage
+	switch format {
+	case FormatJSON:
+		histories, err = parseJSONExport(data)
+	case FormatJSONL:
+		histories, err = parseJSONLExport(data)
+	default:
+		return nil, errors.New("markdown exports cannot be imported")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(histories) == 0 {
+		return nil, errors.New("no histories to import")
+	}
+	for i, messages := range histories {
+		valid, err := validateImport(messages)
+		if err != nil {
+			return nil, fmt.Errorf("history %d: %w", i+1, err)
+		}
+		histories[i] = valid
+	}
+
+	uids := make([]string, 0, len(histories))
+	for _, messages := range histories {
+		uid := NewHistoryUID()
+		if err := store.ImportHistory(confUID, uid, messages); err != nil {
+			for _, stored := range uids {
+				store.DeleteHistory(confUID, stored)
+			}
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// parseJSONExport accepts either a single history (an array of messages) or
+// a whole-conf export (an array of ExportedHistory).
+func parseJSONExport(data []byte) ([][]HistoryMessage, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("invalid json export: %w", err)
+	}
+	var single []HistoryMessage
+	var histories [][]HistoryMessage
+	for i, item := range items {
+		var probe struct {
+			Messages *[]HistoryMessage `json:"messages"`
+			HistoryMessage
+		}
+		if err := json.Unmarshal(item, &probe); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		if probe.Messages != nil {
+			histories = append(histories, append(exportedMetadata(probe.HistoryMeta), *probe.Messages...))
+			continue
+		}
+		single = append(single, probe.HistoryMessage)
+	}
+	if len(single) > 0 && len(histories) > 0 {
+		return nil, errors.New("json export mixes messages and histories")
+	}
+	if len(single) > 0 {
+		return [][]HistoryMessage{single}, nil
+	}
+	return histories, nil
+}
+
+// parseJSONLExport groups lines by history_uid in order of first appearance.
+// Lines without a history_uid belong to a single unnamed history.
+func parseJSONLExport(data []byte) ([][]HistoryMessage, error) {
+	order := []string{}
+	groups := make(map[string][]HistoryMessage)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var record exportRecord
+		if err := json.Unmarshal(text, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if _, ok := groups[record.HistoryUID]; !ok {
+			order = append(order, record.HistoryUID)
+		}
+		groups[record.HistoryUID] = append(groups[record.HistoryUID], record.HistoryMessage)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	histories := make([][]HistoryMessage, 0, len(order))
+	for _, uid := range order {
+		histories = append(histories, groups[uid])
+	}
+	return histories, nil
+}
+
+// validateImport checks every message is a human or ai turn with an RFC3339
+// timestamp. Metadata entries are replaced by a fresh one leading the
+// history, which keeps the attributes of the first. Recording references
+// are dropped, as the recordings belong to the exported history.
+func validateImport(messages []HistoryMessage) ([]HistoryMessage, error) {
+	valid := make([]HistoryMessage, 1, len(messages)+1)
+	valid[0] = newMetadataMessage()
+	hasMeta := false
+	for i, msg := range messages {
+		if msg.Role == RoleMetadata {
+			if !hasMeta {
+				valid[0].HistoryMeta = normalizeMeta(msg.HistoryMeta)
+				hasMeta = true
+			}
+			continue
+		}
+		if msg.Role != RoleHuman && msg.Role != RoleAI {
+			return nil, fmt.Errorf("message %d: invalid role %q", i+1, msg.Role)
+		}
+		if _, err := time.Parse(time.RFC3339, msg.Timestamp); err != nil {
+			return nil, fmt.Errorf("message %d: invalid timestamp %q", i+1, msg.Timestamp)
+		}
+		msg.Audio = ""
+		valid = append(valid, msg)
+	}
+	if len(valid) == 1 {
+		return nil, errors.New("history has no messages")
+	}
+	return valid, nil
+}
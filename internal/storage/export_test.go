@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			uid, err := store.CreateHistory("conf")
+			if err != nil {
+				t.Fatalf("CreateHistory error: %v", err)
+			}
+			turns := []HistoryMessage{
+				{Role: RoleHuman, Timestamp: "2024-05-01T10:00:00Z", Content: "hello", Name: "Human"},
+				{Role: RoleAI, Timestamp: "2024-05-01T10:00:05Z", Content: "hi <there>", Name: "Mao"},
+			}
+			for _, msg := range turns {
+				if err := store.AppendHistoryMessage("conf", uid, msg); err != nil {
+					t.Fatalf("AppendHistoryMessage error: %v", err)
+				}
+			}
+
+			for _, format := range []string{FormatJSON, FormatJSONL} {
+				single, err := ExportHistory(store, "conf", uid, format)
+				if err != nil {
+					t.Fatalf("ExportHistory(%s) error: %v", format, err)
+				}
+				whole, err := ExportConf(store, "conf", format)
+				if err != nil {
+					t.Fatalf("ExportConf(%s) error: %v", format, err)
+				}
+				for _, data := range [][]byte{single, whole} {
+					uids, err := ImportHistories(store, "imported", format, data)
+					if err != nil {
+						t.Fatalf("ImportHistories(%s) error: %v", format, err)
+					}
+					if len(uids) != 1 || uids[0] == uid {
+						t.Fatalf("uids=%v, want one fresh uid", uids)
+					}
+					got, err := store.GetHistory("imported", uids[0])
+					if err != nil {
+						t.Fatalf("GetHistory error: %v", err)
+					}
+					if len(got) != len(turns) || !reflect.DeepEqual(got[1], turns[1]) {
+						t.Fatalf("imported=%+v, want %+v", got, turns)
+					}
+				}
+			}
+
+			md, err := ExportHistory(store, "conf", uid, "md")
+			if err != nil {
+				t.Fatalf("ExportHistory(markdown) error: %v", err)
+			}
+			if !strings.Contains(string(md), "**Mao** (ai, 2024-05-01T10:00:05Z)\n\nhi <there>") {
+				t.Fatalf("markdown=%q", md)
+			}
+		})
+	}
+}
+
+func TestImportHistoriesRejectsInvalidInput(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	cases := map[string]struct {
+		format string
+		data   string
+	}{
+		"bad role":      {FormatJSONL, `{"role":"system","timestamp":"2024-05-01T10:00:00Z","content":"x"}`},
+		"bad timestamp": {FormatJSON, `[{"role":"human","timestamp":"yesterday","content":"x"}]`},
+		"empty":         {FormatJSON, `[]`},
+		"markdown":      {FormatMarkdown, "# conf"},
+		"partly valid": {FormatJSONL, `{"history_uid":"a","role":"human","timestamp":"2024-05-01T10:00:00Z"}
+{"history_uid":"b","role":"bot","timestamp":"2024-05-01T10:00:00Z"}`},
+	}
+	for name, tc := range cases {
+		if _, err := ImportHistories(store, "conf", tc.format, []byte(tc.data)); err == nil {
+			t.Fatalf("%s: ImportHistories error=nil, want error", name)
+		}
+	}
+	if list := store.GetHistoryList("conf"); len(list) != 0 {
+		t.Fatalf("histories=%d after rejected imports, want 0", len(list))
+	}
+}
+
+func TestExportImportKeepsHistoryMeta(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			uid, _ := store.CreateHistory("conf")
+			store.AppendHistoryMessage("conf", uid, HistoryMessage{Role: RoleHuman, Timestamp: "2024-05-01T10:00:00Z", Content: "hello"})
+			want := HistoryMeta{Title: "Trip plans", Pinned: true, Tags: []string{"travel", "tokyo"}}
+			if _, err := store.UpdateHistoryMeta("conf", uid, func(meta *HistoryMeta) { *meta = want }); err != nil {
+				t.Fatalf("UpdateHistoryMeta error: %v", err)
+			}
+
+			for _, format := range []string{FormatJSON, FormatJSONL} {
+				single, err := ExportHistory(store, "conf", uid, format)
+				if err != nil {
+					t.Fatalf("ExportHistory(%s) error: %v", format, err)
+				}
+				whole, err := ExportConf(store, "conf", format)
+				if err != nil {
+					t.Fatalf("ExportConf(%s) error: %v", format, err)
+				}
+				for _, data := range [][]byte{single, whole} {
+					uids, err := ImportHistories(store, "imported", format, data)
+					if err != nil {
+						t.Fatalf("ImportHistories(%s) error: %v", format, err)
+					}
+					if got := historyMetaOf(store, "imported", uids[0]); !reflect.DeepEqual(got, want) {
+						t.Fatalf("%s imported meta=%+v, want %+v", format, got, want)
+					}
+					if got, _ := store.GetHistory("imported", uids[0]); len(got) != 1 {
+						t.Fatalf("%s imported messages=%+v, want one turn", format, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+// failingStore fails the import numbered failAt.
+type failingStore struct {
+	HistoryStore
+	imports int
+	failAt  int
+}
+
+func (s *failingStore) ImportHistory(confUID string, historyUID string, messages []HistoryMessage) error {
+	s.imports++
+	if s.imports == s.failAt {
+		return errors.New("disk full")
+	}
+	return s.HistoryStore.ImportHistory(confUID, historyUID, messages)
+}
+
+func TestImportHistoriesRollsBackOnStoreError(t *testing.T) {
+	store := &failingStore{HistoryStore: NewFileStore(t.TempDir()), failAt: 2}
+	data := `{"history_uid":"a","role":"human","timestamp":"2024-05-01T10:00:00Z","content":"one"}
+{"history_uid":"b","role":"human","timestamp":"2024-05-01T10:00:00Z","content":"two"}`
+	uids, err := ImportHistories(store, "conf", FormatJSONL, []byte(data))
+	if err == nil || uids != nil {
+		t.Fatalf("ImportHistories=%v, %v, want nil and an error", uids, err)
+	}
+	if list := store.GetHistoryList("conf"); len(list) != 0 {
+		t.Fatalf("histories=%d after a failed import, want 0", len(list))
+	}
+}
+
+func TestImportHistoriesDropsRecordingRefs(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	data := `[{"role":"human","timestamp":"2024-05-01T10:00:00Z","content":"hi","audio":"turn-1.ogg"}]`
+	uids, err := ImportHistories(store, "conf", FormatJSON, []byte(data))
+	if err != nil {
+		t.Fatalf("ImportHistories error: %v", err)
+	}
+	got, _ := store.GetHistory("conf", uids[0])
+	if len(got) != 1 || got[0].Audio != "" {
+		t.Fatalf("imported=%+v, want one turn without audio", got)
+	}
+}
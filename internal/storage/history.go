@@ -3,11 +3,13 @@ package storage
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,6 +22,18 @@ type HistoryMessage struct {
 	Content   string `json:"content,omitempty"`
 	Name      string `json:"name,omitempty"`
 	Avatar    string `json:"avatar,omitempty"`
+	// Audio references the turn's recording, see RecordingRef.
+	Audio string `json:"audio,omitempty"`
+	// HistoryMeta is only set on the metadata entry.
+	HistoryMeta
+}
+
+// HistoryMeta holds the user-editable attributes of a history. It is stored
+// on the history's metadata entry.
+type HistoryMeta struct {
+	Title  string   `json:"title,omitempty"`
+	Pinned bool     `json:"pinned,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
 }
 
 // HistoryInfo represents a historyInfo.
@@ -27,31 +41,59 @@ type HistoryInfo struct {
 	UID           string         `json:"uid"`
 	LatestMessage HistoryMessage `json:"latest_message"`
 	Timestamp     string         `json:"timestamp"`
+	HistoryMeta
 }
 
+// History message roles.
+const (
+	RoleHuman    = "human"
+	RoleAI       = "ai"
+	RoleMetadata = "metadata"
+	RoleSystem   = "system"
+)
+
 var safeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_\-\.]+$`)
 
-// CreateHistory executes the createHistory function.
-func CreateHistory(baseDir string, confUID string) (string, error) {
+// FileStore keeps each history as a JSON file under <baseDir>/<conf_uid>/.
+type FileStore struct {
+	baseDir string
+	// mu serializes read-modify-write cycles on history files.
+	mu sync.Mutex
+}
+
+// NewFileStore executes the newFileStore function.
+func NewFileStore(baseDir string) *FileStore {
+	return &FileStore{baseDir: baseDir}
+}
+
+// NewHistoryUID returns a new sortable history identifier.
+func NewHistoryUID() string {
+	return time.Now().Format("2006-01-02_15-04-05") + "_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+// CreateHistory executes the createHistory method.
+func (f *FileStore) CreateHistory(confUID string) (string, error) {
 	if confUID == "" {
 		return "", errors.New("conf_uid is empty")
 	}
-	dir, err := ensureConfDir(baseDir, confUID)
+	dir, err := ensureConfDir(f.baseDir, confUID)
 	if err != nil {
 		return "", err
 	}
-	uid := time.Now().Format("2006-01-02_15-04-05") + "_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	uid := NewHistoryUID()
 	path := filepath.Join(dir, uid+".json")
-	meta := []HistoryMessage{{Role: "metadata", Timestamp: time.Now().Format(time.RFC3339)}}
+	meta := []HistoryMessage{newMetadataMessage()}
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if err := writeHistory(path, meta); err != nil {
 		return "", err
 	}
 	return uid, nil
 }
 
-// GetHistory executes the getHistory function.
-func GetHistory(baseDir string, confUID string, historyUID string) ([]HistoryMessage, error) {
-	path, err := historyPath(baseDir, confUID, historyUID)
+// GetHistory executes the getHistory method.
+func (f *FileStore) GetHistory(confUID string, historyUID string) ([]HistoryMessage, error) {
+	path, err := historyPath(f.baseDir, confUID, historyUID)
 	if err != nil {
 		return nil, err
 	}
@@ -59,19 +101,51 @@ func GetHistory(baseDir string, confUID string, historyUID string) ([]HistoryMes
 	if err != nil {
 		return nil, err
 	}
-	filtered := []HistoryMessage{}
-	for _, msg := range messages {
-		if msg.Role == "metadata" || msg.Role == "system" {
-			continue
-		}
-		filtered = append(filtered, msg)
+	return filterConversation(messages), nil
+}
+
+// AppendHistoryMessage appends a human or ai turn to an existing history.
+// A missing timestamp is filled with the current time.
+func (f *FileStore) AppendHistoryMessage(confUID string, historyUID string, msg HistoryMessage) error {
+	msg, err := normalizeTurn(msg)
+	if err != nil {
+		return err
+	}
+	path, err := historyPath(f.baseDir, confUID, historyUID)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	messages, err := readHistory(path)
+	if err != nil {
+		return err
 	}
-	return filtered, nil
+	messages = append(messages, msg)
+	return writeHistory(path, messages)
 }
 
-// DeleteHistory executes the deleteHistory function.
-func DeleteHistory(baseDir string, confUID string, historyUID string) bool {
-	path, err := historyPath(baseDir, confUID, historyUID)
+// ImportHistory writes a complete history, including its metadata entry,
+// under historyUID. It fails if the history already exists.
+func (f *FileStore) ImportHistory(confUID string, historyUID string, messages []HistoryMessage) error {
+	if _, err := ensureConfDir(f.baseDir, confUID); err != nil {
+		return err
+	}
+	path, err := historyPath(f.baseDir, confUID, historyUID)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("history %s already exists", historyUID)
+	}
+	return writeHistory(path, withMetadata(messages))
+}
+
+// DeleteHistory executes the deleteHistory method.
+func (f *FileStore) DeleteHistory(confUID string, historyUID string) bool {
+	path, err := historyPath(f.baseDir, confUID, historyUID)
 	if err != nil {
 		return false
 	}
@@ -84,10 +158,10 @@ func DeleteHistory(baseDir string, confUID string, historyUID string) bool {
 	return true
 }
 
-// GetHistoryList executes the getHistoryList function.
-func GetHistoryList(baseDir string, confUID string) []HistoryInfo {
+// GetHistoryList executes the getHistoryList method.
+func (f *FileStore) GetHistoryList(confUID string) []HistoryInfo {
 	list := []HistoryInfo{}
-	dir, err := ensureConfDir(baseDir, confUID)
+	dir, err := ensureConfDir(f.baseDir, confUID)
 	if err != nil {
 		return list
 	}
@@ -107,15 +181,7 @@ func GetHistoryList(baseDir string, confUID string) []HistoryInfo {
 		if err != nil {
 			continue
 		}
-		var latest *HistoryMessage
-		for i := len(messages) - 1; i >= 0; i-- {
-			if messages[i].Role == "metadata" {
-				continue
-			}
-			msg := messages[i]
-			latest = &msg
-			break
-		}
+		latest := latestMessage(messages)
 		if latest == nil {
 			continue
 		}
@@ -123,14 +189,196 @@ func GetHistoryList(baseDir string, confUID string) []HistoryInfo {
 			UID:           historyUID,
 			LatestMessage: *latest,
 			Timestamp:     latest.Timestamp,
+			HistoryMeta:   metadataOf(messages),
 		})
 	}
 
-	sort.Slice(list, func(i, j int) bool {
+	sortHistoryList(list)
+
+	return list
+}
+
+// UpdateHistoryMeta applies update to the metadata of an existing history.
+func (f *FileStore) UpdateHistoryMeta(confUID string, historyUID string, update func(*HistoryMeta)) (HistoryMeta, error) {
+	path, err := historyPath(f.baseDir, confUID, historyUID)
+	if err != nil {
+		return HistoryMeta{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	messages, err := readHistory(path)
+	if err != nil {
+		return HistoryMeta{}, err
+	}
+	messages = withMetadata(messages)
+	update(&messages[0].HistoryMeta)
+	messages[0].HistoryMeta = normalizeMeta(messages[0].HistoryMeta)
+	if err := writeHistory(path, messages); err != nil {
+		return HistoryMeta{}, err
+	}
+	return messages[0].HistoryMeta, nil
+}
+
+// GetHistoryPage returns one page of the history list and the total count.
+func (f *FileStore) GetHistoryPage(confUID string, offset int, limit int) ([]HistoryInfo, int, error) {
+	list := f.GetHistoryList(confUID)
+	return pageHistoryList(list, offset, limit), len(list), nil
+}
+
+// ListConfUIDs returns every conf_uid that has a history directory.
+func (f *FileStore) ListConfUIDs() ([]string, error) {
+	if f.baseDir == "" {
+		return nil, errors.New("chat history base dir is empty")
+	}
+	entries, err := os.ReadDir(f.baseDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	confUIDs := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && safeNamePattern.MatchString(entry.Name()) {
+			confUIDs = append(confUIDs, entry.Name())
+		}
+	}
+	return confUIDs, nil
+}
+
+// ListHistoryUIDs returns every history UID stored for confUID.
+func (f *FileStore) ListHistoryUIDs(confUID string) ([]string, error) {
+	if !safeNamePattern.MatchString(confUID) {
+		return nil, errors.New("invalid conf_uid")
+	}
+	entries, err := os.ReadDir(filepath.Join(f.baseDir, confUID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	uids := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		uids = append(uids, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	return uids, nil
+}
+
+// ReadRawHistory returns every stored message of a history, including
+// its metadata entry.
+func (f *FileStore) ReadRawHistory(confUID string, historyUID string) ([]HistoryMessage, error) {
+	path, err := historyPath(f.baseDir, confUID, historyUID)
+	if err != nil {
+		return nil, err
+	}
+	return readHistory(path)
+}
+
+// Close executes the close method.
+func (f *FileStore) Close() error {
+	return nil
+}
+
+func newMetadataMessage() HistoryMessage {
+	return HistoryMessage{Role: RoleMetadata, Timestamp: time.Now().Format(time.RFC3339)}
+}
+
+// withMetadata makes sure messages start with a metadata entry.
+func withMetadata(messages []HistoryMessage) []HistoryMessage {
+	if len(messages) > 0 && messages[0].Role == RoleMetadata {
+		return messages
+	}
+	return append([]HistoryMessage{newMetadataMessage()}, messages...)
+}
+
+func normalizeTurn(msg HistoryMessage) (HistoryMessage, error) {
+	if msg.Role != RoleHuman && msg.Role != RoleAI {
+		return msg, fmt.Errorf("invalid history role: %q", msg.Role)
+	}
+	if msg.Timestamp == "" {
+		msg.Timestamp = time.Now().Format(time.RFC3339)
+	}
+	return msg, nil
+}
+
+func filterConversation(messages []HistoryMessage) []HistoryMessage {
+	filtered := []HistoryMessage{}
+	for _, msg := range messages {
+		if msg.Role == RoleMetadata || msg.Role == RoleSystem {
+			continue
+		}
+		filtered = append(filtered, msg)
+	}
+	return filtered
+}
+
+func latestMessage(messages []HistoryMessage) *HistoryMessage {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == RoleMetadata {
+			continue
+		}
+		msg := messages[i]
+		return &msg
+	}
+	return nil
+}
+
+func metadataOf(messages []HistoryMessage) HistoryMeta {
+	if len(messages) > 0 && messages[0].Role == RoleMetadata {
+		return messages[0].HistoryMeta
+	}
+	return HistoryMeta{}
+}
+
+// normalizeMeta trims the title and drops empty or duplicate tags.
+func normalizeMeta(meta HistoryMeta) HistoryMeta {
+	meta.Title = strings.TrimSpace(meta.Title)
+	tags := []string{}
+	seen := make(map[string]struct{}, len(meta.Tags))
+	for _, tag := range meta.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+	meta.Tags = tags
+	return meta
+}
+
+// sortHistoryList orders pinned histories first, then newest first.
+func sortHistoryList(list []HistoryInfo) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Pinned != list[j].Pinned {
+			return list[i].Pinned
+		}
 		return list[i].Timestamp > list[j].Timestamp
 	})
+}
 
-	return list
+func pageHistoryList(list []HistoryInfo, offset int, limit int) []HistoryInfo {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(list) {
+		return []HistoryInfo{}
+	}
+	end := len(list)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return list[offset:end]
 }
 
 func ensureConfDir(baseDir string, confUID string) (string, error) {
@@ -174,5 +422,34 @@ func writeHistory(path string, messages []HistoryMessage) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0o644)
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temp file in the same directory and
+// renames it over path so readers never observe a partially written history.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0o644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
 }
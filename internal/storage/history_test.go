@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStores(t *testing.T) map[string]HistoryStore {
+	t.Helper()
+	sqliteStore, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLiteStore error: %v", err)
+	}
+	t.Cleanup(func() { sqliteStore.Close() })
+	return map[string]HistoryStore{
+		BackendFile:   NewFileStore(t.TempDir()),
+		BackendSQLite: sqliteStore,
+	}
+}
+
+func TestAppendHistoryMessage(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			uid, err := store.CreateHistory("conf")
+			if err != nil {
+				t.Fatalf("CreateHistory error: %v", err)
+			}
+			if list := store.GetHistoryList("conf"); len(list) != 0 {
+				t.Fatalf("GetHistoryList before first turn=%+v, want empty", list)
+			}
+
+			if err := store.AppendHistoryMessage("conf", uid, HistoryMessage{Role: RoleHuman, Content: "hello"}); err != nil {
+				t.Fatalf("AppendHistoryMessage(human) error: %v", err)
+			}
+			if err := store.AppendHistoryMessage("conf", uid, HistoryMessage{Role: RoleAI, Content: "hi there", Name: "Mio"}); err != nil {
+				t.Fatalf("AppendHistoryMessage(ai) error: %v", err)
+			}
+
+			messages, err := store.GetHistory("conf", uid)
+			if err != nil {
+				t.Fatalf("GetHistory error: %v", err)
+			}
+			if len(messages) != 2 {
+				t.Fatalf("len(messages)=%d, want 2", len(messages))
+			}
+			if messages[0].Role != RoleHuman || messages[1].Role != RoleAI {
+				t.Fatalf("roles=%q,%q, want human,ai", messages[0].Role, messages[1].Role)
+			}
+			if messages[1].Timestamp == "" {
+				t.Fatal("timestamp is empty, want filled")
+			}
+
+			list := store.GetHistoryList("conf")
+			if len(list) != 1 || list[0].LatestMessage.Content != "hi there" {
+				t.Fatalf("GetHistoryList=%+v, want latest ai message", list)
+			}
+		})
+	}
+}
+
+func TestAppendHistoryMessageRejectsInvalidInput(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			uid, err := store.CreateHistory("conf")
+			if err != nil {
+				t.Fatalf("CreateHistory error: %v", err)
+			}
+			if err := store.AppendHistoryMessage("conf", uid, HistoryMessage{Role: RoleMetadata}); err == nil {
+				t.Fatal("AppendHistoryMessage(metadata) error=nil, want non-nil")
+			}
+			if err := store.AppendHistoryMessage("conf", "missing", HistoryMessage{Role: RoleHuman, Content: "x"}); err == nil {
+				t.Fatal("AppendHistoryMessage(missing history) error=nil, want non-nil")
+			}
+		})
+	}
+}
+
+func TestFileStoreAtomicWriteLeavesNoTempFiles(t *testing.T) {
+	baseDir := t.TempDir()
+	store := NewFileStore(baseDir)
+	uid, err := store.CreateHistory("conf")
+	if err != nil {
+		t.Fatalf("CreateHistory error: %v", err)
+	}
+	if err := store.AppendHistoryMessage("conf", uid, HistoryMessage{Role: RoleHuman, Content: "hello"}); err != nil {
+		t.Fatalf("AppendHistoryMessage error: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(baseDir, "conf"))
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("conf dir has %d entries, want 1", len(entries))
+	}
+}
+
+func TestHistoryPageAndDelete(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			timestamps := []string{"2026-01-01T00:00:00Z", "2026-01-03T00:00:00Z", "2026-01-02T00:00:00Z"}
+			uids := make([]string, len(timestamps))
+			for i, ts := range timestamps {
+				uids[i] = NewHistoryUID()
+				err := store.ImportHistory("conf", uids[i], []HistoryMessage{{Role: RoleHuman, Content: ts, Timestamp: ts}})
+				if err != nil {
+					t.Fatalf("ImportHistory error: %v", err)
+				}
+			}
+
+			page, total, err := store.GetHistoryPage("conf", 1, 1)
+			if err != nil {
+				t.Fatalf("GetHistoryPage error: %v", err)
+			}
+			if total != 3 || len(page) != 1 || page[0].UID != uids[2] {
+				t.Fatalf("GetHistoryPage=%+v total=%d, want middle history of 3", page, total)
+			}
+
+			if !store.DeleteHistory("conf", uids[1]) {
+				t.Fatal("DeleteHistory=false, want true")
+			}
+			if store.DeleteHistory("conf", uids[1]) {
+				t.Fatal("second DeleteHistory=true, want false")
+			}
+			if list := store.GetHistoryList("conf"); len(list) != 2 || list[0].UID != uids[2] {
+				t.Fatalf("GetHistoryList after delete=%+v, want 2 newest-first", list)
+			}
+		})
+	}
+}
+
+func TestMigrateFileHistories(t *testing.T) {
+	baseDir := t.TempDir()
+	src := NewFileStore(baseDir)
+	uid, err := src.CreateHistory("conf")
+	if err != nil {
+		t.Fatalf("CreateHistory error: %v", err)
+	}
+	if err := src.AppendHistoryMessage("conf", uid, HistoryMessage{Role: RoleHuman, Content: "hello"}); err != nil {
+		t.Fatalf("AppendHistoryMessage error: %v", err)
+	}
+
+	dst, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLiteStore error: %v", err)
+	}
+	defer dst.Close()
+
+	report, err := MigrateFileHistories(baseDir, dst)
+	if err != nil {
+		t.Fatalf("MigrateFileHistories error: %v", err)
+	}
+	if report.Imported != 1 || report.Failed != 0 {
+		t.Fatalf("report=%+v, want 1 imported", report)
+	}
+	messages, err := dst.GetHistory("conf", uid)
+	if err != nil || len(messages) != 1 || messages[0].Content != "hello" {
+		t.Fatalf("GetHistory=%+v err=%v, want migrated message", messages, err)
+	}
+
+	report, err = MigrateFileHistories(baseDir, dst)
+	if err != nil {
+		t.Fatalf("second MigrateFileHistories error: %v", err)
+	}
+	if report.Imported != 0 || report.Skipped != 1 {
+		t.Fatalf("second report=%+v, want 1 skipped", report)
+	}
+}
+
+func TestUpdateHistoryMetaSortsPinnedFirst(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			older, _ := store.CreateHistory("conf")
+			store.AppendHistoryMessage("conf", older, HistoryMessage{Role: RoleHuman, Timestamp: "2024-01-01T00:00:00Z", Content: "old"})
+			newer, _ := store.CreateHistory("conf")
+			store.AppendHistoryMessage("conf", newer, HistoryMessage{Role: RoleHuman, Timestamp: "2024-02-01T00:00:00Z", Content: "new"})
+
+			meta, err := store.UpdateHistoryMeta("conf", older, func(meta *HistoryMeta) {
+				meta.Title = "  Trip plans "
+				meta.Pinned = true
+				meta.Tags = []string{"travel", "", "travel", "japan"}
+			})
+			if err != nil {
+				t.Fatalf("UpdateHistoryMeta error: %v", err)
+			}
+			if meta.Title != "Trip plans" || !meta.Pinned || len(meta.Tags) != 2 {
+				t.Fatalf("meta=%+v, want normalized title and tags", meta)
+			}
+
+			list := store.GetHistoryList("conf")
+			if len(list) != 2 || list[0].UID != older || list[0].Title != "Trip plans" || !list[0].Pinned {
+				t.Fatalf("list=%+v, want pinned %s first", list, older)
+			}
+			if list[0].Tags[1] != "japan" {
+				t.Fatalf("tags=%v, want [travel japan]", list[0].Tags)
+			}
+			if _, err := store.UpdateHistoryMeta("conf", "missing", func(*HistoryMeta) {}); err == nil {
+				t.Fatal("UpdateHistoryMeta(missing) error=nil, want error")
+			}
+		})
+	}
+}
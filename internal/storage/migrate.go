@@ -0,0 +1,48 @@
+package storage
+
+import "fmt"
+
+// MigrationReport summarizes a file-to-store history migration.
+type MigrationReport struct {
+	Imported int
+	Skipped  int
+	Failed   int
+	Errors   []error
+}
+
+// MigrateFileHistories imports every <baseDir>/<conf_uid>/*.json history into
+// dst, keeping conf and history UIDs. Histories dst already holds are skipped,
+// so the migration can be re-run safely.
+func MigrateFileHistories(baseDir string, dst HistoryStore) (MigrationReport, error) {
+	report := MigrationReport{}
+	src := NewFileStore(baseDir)
+	confUIDs, err := src.ListConfUIDs()
+	if err != nil {
+		return report, err
+	}
+	for _, confUID := range confUIDs {
+		historyUIDs, err := src.ListHistoryUIDs(confUID)
+		if err != nil {
+			return report, err
+		}
+		for _, historyUID := range historyUIDs {
+			if _, err := dst.GetHistory(confUID, historyUID); err == nil {
+				report.Skipped++
+				continue
+			}
+			messages, err := src.ReadRawHistory(confUID, historyUID)
+			if err != nil {
+				report.Failed++
+				report.Errors = append(report.Errors, fmt.Errorf("read %s/%s: %w", confUID, historyUID, err))
+				continue
+			}
+			if err := dst.ImportHistory(confUID, historyUID, messages); err != nil {
+				report.Failed++
+				report.Errors = append(report.Errors, fmt.Errorf("import %s/%s: %w", confUID, historyUID, err))
+				continue
+			}
+			report.Imported++
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Turn recordings live next to, not inside, the history store, under
+// <baseDir>/<conf_uid>/<history_uid>/<name>. HistoryMessage.Audio holds the
+// "<conf_uid>/<history_uid>/<name>" reference.
+
+// RecordingRef returns the reference of a turn recording.
+func RecordingRef(confUID string, historyUID string, name string) string {
+	return confUID + "/" + historyUID + "/" + name
+}
+
+// RecordingPath returns the file path of a turn recording.
+func RecordingPath(baseDir string, confUID string, historyUID string, name string) (string, error) {
+	if baseDir == "" {
+		return "", errors.New("recordings dir is empty")
+	}
+	for _, part := range []string{confUID, historyUID, name} {
+		if !safeNamePattern.MatchString(part) || strings.HasPrefix(part, ".") {
+			return "", errors.New("invalid recording path")
+		}
+	}
+	return filepath.Join(baseDir, confUID, historyUID, name), nil
+}
+
+// ResolveRecording returns the file path of a recording reference.
+func ResolveRecording(baseDir string, ref string) (string, error) {
+	parts := strings.Split(strings.Trim(ref, "/"), "/")
+	if len(parts) != 3 {
+		return "", errors.New("invalid recording path")
+	}
+	return RecordingPath(baseDir, parts[0], parts[1], parts[2])
+}
+
+// RemoveRecordings deletes every recording of a history.
+func RemoveRecordings(baseDir string, confUID string, historyUID string) error {
+	if baseDir == "" || !safeNamePattern.MatchString(confUID) || !safeNamePattern.MatchString(historyUID) {
+		return errors.New("invalid recording path")
+	}
+	return os.RemoveAll(filepath.Join(baseDir, confUID, historyUID))
+}
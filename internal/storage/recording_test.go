@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveRecording(t *testing.T) {
+	base := t.TempDir()
+	ref := RecordingRef("conf", "history", "turn_human.wav")
+	path, err := ResolveRecording(base, ref)
+	if err != nil {
+		t.Fatalf("ResolveRecording error: %v", err)
+	}
+	if want := filepath.Join(base, "conf", "history", "turn_human.wav"); path != want {
+		t.Fatalf("path=%q, want %q", path, want)
+	}
+	for _, bad := range []string{"conf/history", "conf/../x.wav", "../conf/history/x.wav", "conf/history/.partial"} {
+		if _, err := ResolveRecording(base, bad); err == nil {
+			t.Fatalf("ResolveRecording(%q) error=nil, want error", bad)
+		}
+	}
+}
+
+func TestHistoryMessageAudioIsStored(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			uid, _ := store.CreateHistory("conf")
+			ref := RecordingRef("conf", uid, "turn_human.wav")
+			if err := store.AppendHistoryMessage("conf", uid, HistoryMessage{Role: RoleHuman, Content: "hi", Audio: ref}); err != nil {
+				t.Fatalf("AppendHistoryMessage error: %v", err)
+			}
+			messages, err := store.GetHistory("conf", uid)
+			if err != nil || len(messages) != 1 || messages[0].Audio != ref {
+				t.Fatalf("messages=%+v err=%v, want audio %q", messages, err, ref)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/internal/config"
+)
+
+// Retention prune reasons.
+const (
+	PruneReasonMaxAge     = "max_age"
+	PruneReasonMaxPerConf = "max_per_conf"
+	PruneReasonMaxTotal   = "max_total_size"
+)
+
+// HistoryUsage describes the age and storage footprint of one history.
+type HistoryUsage struct {
+	ConfUID string
+	UID     string
+	// Latest is the time of the newest message, or the creation time of a
+	// history without turns.
+	Latest time.Time
+	Bytes  int64
+}
+
+// UsageReporter is implemented by stores that can report per-history usage
+// for retention.
+type UsageReporter interface {
+	HistoryUsage() ([]HistoryUsage, error)
+}
+
+// RetentionPolicy bounds how much chat history is kept. Zero values disable
+// the corresponding limit.
+type RetentionPolicy struct {
+	MaxAge        time.Duration
+	MaxPerConf    int
+	MaxTotalBytes int64
+}
+
+// Enabled reports whether any limit is set.
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxPerConf > 0 || p.MaxTotalBytes > 0
+}
+
+// PrunedHistory is a history selected for deletion by a retention run.
+type PrunedHistory struct {
+	ConfUID string
+	UID     string
+	Reason  string
+	Latest  time.Time
+	Bytes   int64
+}
+
+// PlanRetention returns the histories policy prunes from usage at now. Age is
+// applied first, then the per-conf count, then the total size; the oldest
+// histories go first.
+func PlanRetention(usage []HistoryUsage, policy RetentionPolicy, now time.Time) []PrunedHistory {
+	kept := append([]HistoryUsage(nil), usage...)
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Latest.After(kept[j].Latest) })
+
+	pruned := []PrunedHistory{}
+	prune := func(u HistoryUsage, reason string) {
+		pruned = append(pruned, PrunedHistory{ConfUID: u.ConfUID, UID: u.UID, Reason: reason, Latest: u.Latest, Bytes: u.Bytes})
+	}
+
+	if policy.MaxAge > 0 {
+		cutoff := now.Add(-policy.MaxAge)
+		next := kept[:0]
+		for _, u := range kept {
+			if u.Latest.Before(cutoff) {
+				prune(u, PruneReasonMaxAge)
+				continue
+			}
+			next = append(next, u)
+		}
+		kept = next
+	}
+
+	if policy.MaxPerConf > 0 {
+		perConf := make(map[string]int)
+		next := kept[:0]
+		for _, u := range kept {
+			perConf[u.ConfUID]++
+			if perConf[u.ConfUID] > policy.MaxPerConf {
+				prune(u, PruneReasonMaxPerConf)
+				continue
+			}
+			next = append(next, u)
+		}
+		kept = next
+	}
+
+	if policy.MaxTotalBytes > 0 {
+		var total int64
+		for _, u := range kept {
+			total += u.Bytes
+		}
+		for i := len(kept) - 1; i >= 0 && total > policy.MaxTotalBytes; i-- {
+			prune(kept[i], PruneReasonMaxTotal)
+			total -= kept[i].Bytes
+		}
+	}
+	return pruned
+}
+
+// Janitor periodically enforces a RetentionPolicy on a history store.
+type Janitor struct {
+	store    HistoryStore
+	policy   RetentionPolicy
+	interval time.Duration
+	dryRun   bool
+	logger   *zap.Logger
+	now      func() time.Time
+	onPrune  func(PrunedHistory)
+}
+
+// NewJanitor executes the newJanitor function.
+func NewJanitor(store HistoryStore, policy RetentionPolicy, interval time.Duration, dryRun bool, logger *zap.Logger) *Janitor {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &Janitor{
+		store:    store,
+		policy:   policy,
+		interval: interval,
+		dryRun:   dryRun,
+		logger:   logger,
+		now:      time.Now,
+	}
+}
+
+// OnPrune registers fn to run after each history the janitor deletes, e.g.
+// to remove data kept outside the store.
+func (j *Janitor) OnPrune(fn func(PrunedHistory)) *Janitor {
+	j.onPrune = fn
+	return j
+}
+
+// Start runs the janitor immediately and then every interval until ctx is
+// done.
+func (j *Janitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			if _, err := j.RunOnce(); err != nil {
+				j.logger.Warn("history retention run failed", zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StartRetention starts a janitor enforcing cfg on store until ctx is done.
+// The recordings of each pruned history are removed from recordingsDir. It
+// reports false when retention is disabled or there is no store.
+func StartRetention(ctx context.Context, cfg config.HistoryRetentionConfig, store HistoryStore, recordingsDir string, logger *zap.Logger) bool {
+	if !cfg.Enabled || store == nil {
+		return false
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	policy := RetentionPolicy{
+		MaxAge:        time.Duration(cfg.MaxAgeDays) * 24 * time.Hour,
+		MaxPerConf:    cfg.MaxPerConf,
+		MaxTotalBytes: int64(cfg.MaxTotalMB) << 20,
+	}
+	janitor := NewJanitor(store, policy, time.Duration(cfg.IntervalMinutes)*time.Minute, cfg.DryRun, logger)
+	janitor.OnPrune(func(pruned PrunedHistory) {
+		if err := RemoveRecordings(recordingsDir, pruned.ConfUID, pruned.UID); err != nil {
+			logger.Warn("remove pruned history recordings failed", zap.String("history_uid", pruned.UID), zap.Error(err))
+		}
+	})
+	janitor.Start(ctx)
+	logger.Info("history retention janitor started",
+		zap.Int("max_age_days", cfg.MaxAgeDays),
+		zap.Int("max_per_conf", cfg.MaxPerConf),
+		zap.Int("max_total_mb", cfg.MaxTotalMB),
+		zap.Int("interval_minutes", cfg.IntervalMinutes),
+		zap.Bool("dry_run", cfg.DryRun),
+	)
+	return true
+}
+
+// RunOnce prunes every history the policy selects and returns them. In dry
+// run mode the histories are only logged.
+func (j *Janitor) RunOnce() ([]PrunedHistory, error) {
+	reporter, ok := j.store.(UsageReporter)
+	if !ok {
+		return nil, errors.New("history store does not report usage")
+	}
+	usage, err := reporter.HistoryUsage()
+	if err != nil {
+		return nil, err
+	}
+	planned := PlanRetention(usage, j.policy, j.now())
+	pruned := make([]PrunedHistory, 0, len(planned))
+	var freed int64
+	for _, p := range planned {
+		fields := []zap.Field{
+			zap.String("conf_uid", p.ConfUID),
+			zap.String("history_uid", p.UID),
+			zap.String("reason", p.Reason),
+			zap.Time("latest", p.Latest),
+			zap.Int64("bytes", p.Bytes),
+			zap.Bool("dry_run", j.dryRun),
+		}
+		if !j.dryRun && !j.store.DeleteHistory(p.ConfUID, p.UID) {
+			j.logger.Warn("history retention delete failed", fields...)
+			continue
+		}
+		if !j.dryRun && j.onPrune != nil {
+			j.onPrune(p)
+		}
+		j.logger.Info("history pruned", fields...)
+		pruned = append(pruned, p)
+		freed += p.Bytes
+	}
+	j.logger.Info("history retention run finished",
+		zap.Int("histories", len(usage)),
+		zap.Int("pruned", len(pruned)),
+		zap.Int64("freed_bytes", freed),
+		zap.Bool("dry_run", j.dryRun),
+	)
+	return pruned, nil
+}
+
+// HistoryUsage reports the usage of every history file.
+func (f *FileStore) HistoryUsage() ([]HistoryUsage, error) {
+	confUIDs, err := f.ListConfUIDs()
+	if err != nil {
+		return nil, err
+	}
+	usage := []HistoryUsage{}
+	for _, confUID := range confUIDs {
+		historyUIDs, err := f.ListHistoryUIDs(confUID)
+		if err != nil {
+			return nil, err
+		}
+		for _, historyUID := range historyUIDs {
+			path, err := historyPath(f.baseDir, confUID, historyUID)
+			if err != nil {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			latest := info.ModTime()
+			if messages, err := readHistory(path); err == nil {
+				if ts, ok := historyLatestTime(messages); ok {
+					latest = ts
+				}
+			}
+			usage = append(usage, HistoryUsage{ConfUID: confUID, UID: historyUID, Latest: latest, Bytes: info.Size()})
+		}
+	}
+	return usage, nil
+}
+
+// HistoryUsage reports the usage of every stored history. Sizes are the
+// byte length of the stored message fields.
+func (s *SQLiteStore) HistoryUsage() ([]HistoryUsage, error) {
+	rows, err := s.db.Query(
+		`SELECT h.conf_uid, h.uid, h.created_at, h.latest_timestamp,
+		        COALESCE(SUM(LENGTH(CAST(m.content AS BLOB)) + LENGTH(CAST(m.name AS BLOB)) +
+		                     LENGTH(CAST(m.avatar AS BLOB)) + LENGTH(m.role) + LENGTH(m.timestamp)), 0)
+		 FROM histories h
+		 LEFT JOIN messages m ON m.conf_uid = h.conf_uid AND m.history_uid = h.uid
+		 GROUP BY h.conf_uid, h.uid`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usage := []HistoryUsage{}
+	for rows.Next() {
+		var u HistoryUsage
+		var created, latest string
+		if err := rows.Scan(&u.ConfUID, &u.UID, &created, &latest, &u.Bytes); err != nil {
+			return nil, err
+		}
+		if latest == "" {
+			latest = created
+		}
+		u.Latest, _ = time.Parse(time.RFC3339, latest)
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// HistoryUsage forwards to the wrapped store.
+func (s *IndexedStore) HistoryUsage() ([]HistoryUsage, error) {
+	reporter, ok := s.HistoryStore.(UsageReporter)
+	if !ok {
+		return nil, errors.New("history store does not report usage")
+	}
+	return reporter.HistoryUsage()
+}
+
+// historyLatestTime returns the timestamp of the newest turn, falling back to
+// the metadata entry.
+func historyLatestTime(messages []HistoryMessage) (time.Time, bool) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if ts, err := time.Parse(time.RFC3339, messages[i].Timestamp); err == nil {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
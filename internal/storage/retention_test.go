@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/saker-ai/vtuber-server/internal/config"
+)
+
+func TestPlanRetention(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	usage := []HistoryUsage{
+		{ConfUID: "a", UID: "old", Latest: now.Add(-40 * day), Bytes: 10},
+		{ConfUID: "a", UID: "a1", Latest: now.Add(-1 * day), Bytes: 100},
+		{ConfUID: "a", UID: "a2", Latest: now.Add(-2 * day), Bytes: 100},
+		{ConfUID: "a", UID: "a3", Latest: now.Add(-3 * day), Bytes: 100},
+		{ConfUID: "b", UID: "b1", Latest: now.Add(-4 * day), Bytes: 100},
+		{ConfUID: "b", UID: "b2", Latest: now.Add(-5 * day), Bytes: 100},
+	}
+	pruned := PlanRetention(usage, RetentionPolicy{MaxAge: 30 * day, MaxPerConf: 2, MaxTotalBytes: 250}, now)
+	want := []struct{ uid, reason string }{
+		{"old", PruneReasonMaxAge},
+		{"a3", PruneReasonMaxPerConf},
+		{"b2", PruneReasonMaxTotal},
+		{"b1", PruneReasonMaxTotal},
+	}
+	if len(pruned) != len(want) {
+		t.Fatalf("pruned=%+v, want %d entries", pruned, len(want))
+	}
+	for i, w := range want {
+		if pruned[i].UID != w.uid || pruned[i].Reason != w.reason {
+			t.Fatalf("pruned[%d]=%s/%s, want %s/%s", i, pruned[i].UID, pruned[i].Reason, w.uid, w.reason)
+		}
+	}
+	if got := PlanRetention(usage, RetentionPolicy{}, now); len(got) != 0 {
+		t.Fatalf("empty policy pruned=%d, want 0", len(got))
+	}
+}
+
+func TestJanitorRunOnce(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			indexed := NewIndexedStore(store)
+			oldUID, _ := indexed.CreateHistory("conf")
+			indexed.AppendHistoryMessage("conf", oldUID, HistoryMessage{Role: RoleHuman, Timestamp: "2020-01-01T00:00:00Z", Content: "old"})
+			newUID, _ := indexed.CreateHistory("conf")
+			indexed.AppendHistoryMessage("conf", newUID, HistoryMessage{Role: RoleHuman, Content: "new"})
+
+			dry := NewJanitor(indexed, RetentionPolicy{MaxAge: 24 * time.Hour}, time.Hour, true, nil)
+			pruned, err := dry.RunOnce()
+			if err != nil {
+				t.Fatalf("RunOnce(dry) error: %v", err)
+			}
+			if len(pruned) != 1 || pruned[0].UID != oldUID {
+				t.Fatalf("dry pruned=%+v, want %s", pruned, oldUID)
+			}
+			if _, err := indexed.GetHistory("conf", oldUID); err != nil {
+				t.Fatalf("dry run deleted history: %v", err)
+			}
+
+			janitor := NewJanitor(indexed, RetentionPolicy{MaxAge: 24 * time.Hour}, time.Hour, false, nil)
+			if _, err := janitor.RunOnce(); err != nil {
+				t.Fatalf("RunOnce error: %v", err)
+			}
+			if _, err := indexed.GetHistory("conf", oldUID); err == nil {
+				t.Fatal("old history still present after pruning")
+			}
+			if _, err := indexed.GetHistory("conf", newUID); err != nil {
+				t.Fatalf("new history pruned: %v", err)
+			}
+		})
+	}
+}
+
+func TestStartRetention(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if StartRetention(ctx, config.HistoryRetentionConfig{MaxAgeDays: 1}, store, t.TempDir(), nil) {
+		t.Fatal("StartRetention(disabled)=true, want false")
+	}
+
+	oldUID, _ := store.CreateHistory("conf")
+	store.AppendHistoryMessage("conf", oldUID, HistoryMessage{Role: RoleHuman, Timestamp: "2020-01-01T00:00:00Z", Content: "old"})
+	if !StartRetention(ctx, config.HistoryRetentionConfig{Enabled: true, MaxAgeDays: 1}, store, t.TempDir(), nil) {
+		t.Fatal("StartRetention=false, want true")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := store.GetHistory("conf", oldUID); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("old history not pruned by the started janitor")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"errors"
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	defaultSearchLimit  = 50
+	snippetContextRunes = 40
+	highlightOpen       = "<mark>"
+	highlightClose      = "</mark>"
+)
+
+// SearchResult is one message matching a history search.
+type SearchResult struct {
+	HistoryUID string         `json:"history_uid"`
+	Message    HistoryMessage `json:"message"`
+	Timestamp  string         `json:"timestamp"`
+	Snippet    string         `json:"snippet"`
+}
+
+// HistorySearcher is implemented by stores that support full-text search.
+type HistorySearcher interface {
+	SearchHistories(confUID string, query string, limit int) ([]SearchResult, error)
+}
+
+// IndexedStore wraps a HistoryStore with an in-memory inverted index over
+// message content. The index for a conf_uid is built on its first search and
+// then kept up to date as messages are appended, imported or deleted.
+type IndexedStore struct {
+	HistoryStore
+
+	mu    sync.Mutex
+	confs map[string]*confIndex
+}
+
+type docKey struct {
+	historyUID string
+	seq        int
+}
+
+type confIndex struct {
+	docs     map[docKey]HistoryMessage
+	counts   map[string]int
+	postings map[string]map[docKey]struct{}
+}
+
+// NewIndexedStore executes the newIndexedStore function.
+func NewIndexedStore(store HistoryStore) *IndexedStore {
+	return &IndexedStore{
+		HistoryStore: store,
+		confs:        make(map[string]*confIndex),
+	}
+}
+
+// AppendHistoryMessage appends to the underlying store and indexes msg.
+func (s *IndexedStore) AppendHistoryMessage(confUID string, historyUID string, msg HistoryMessage) error {
+	msg, err := normalizeTurn(msg)
+	if err != nil {
+		return err
+	}
+	if err := s.HistoryStore.AppendHistoryMessage(confUID, historyUID, msg); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if idx := s.confs[confUID]; idx != nil {
+		idx.add(historyUID, msg)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// ImportHistory imports into the underlying store and indexes the messages.
+func (s *IndexedStore) ImportHistory(confUID string, historyUID string, messages []HistoryMessage) error {
+	if err := s.HistoryStore.ImportHistory(confUID, historyUID, messages); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if idx := s.confs[confUID]; idx != nil {
+		idx.removeHistory(historyUID)
+		for _, msg := range filterConversation(messages) {
+			idx.add(historyUID, msg)
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// DeleteHistory deletes from the underlying store and drops indexed messages.
+func (s *IndexedStore) DeleteHistory(confUID string, historyUID string) bool {
+	if !s.HistoryStore.DeleteHistory(confUID, historyUID) {
+		return false
+	}
+	s.mu.Lock()
+	if idx := s.confs[confUID]; idx != nil {
+		idx.removeHistory(historyUID)
+	}
+	s.mu.Unlock()
+	return true
+}
+
+// SearchHistories returns messages of confUID containing every term of query,
+// best matches first.
+func (s *IndexedStore) SearchHistories(confUID string, query string, limit int) ([]SearchResult, error) {
+	results := []SearchResult{}
+	if !safeNamePattern.MatchString(confUID) {
+		return results, errors.New("invalid conf_uid")
+	}
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return results, nil
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := s.confIndexLocked(confUID)
+	if err != nil {
+		return results, err
+	}
+
+	var candidates map[docKey]struct{}
+	for _, term := range uniqueTerms(terms) {
+		posting := idx.postings[term]
+		if len(posting) == 0 {
+			return results, nil
+		}
+		if candidates == nil || len(posting) < len(candidates) {
+			next := make(map[docKey]struct{}, len(posting))
+			for key := range posting {
+				if candidates == nil {
+					next[key] = struct{}{}
+					continue
+				}
+				if _, ok := candidates[key]; ok {
+					next[key] = struct{}{}
+				}
+			}
+			candidates = next
+			continue
+		}
+		for key := range candidates {
+			if _, ok := posting[key]; !ok {
+				delete(candidates, key)
+			}
+		}
+	}
+
+	type scored struct {
+		key   docKey
+		score int
+	}
+	matches := make([]scored, 0, len(candidates))
+	for key := range candidates {
+		matches = append(matches, scored{key: key, score: termFrequency(indexTokens(idx.docs[key].Content), terms)})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return idx.docs[matches[i].key].Timestamp > idx.docs[matches[j].key].Timestamp
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	highlights := highlightTerms(query)
+	for _, match := range matches {
+		msg := idx.docs[match.key]
+		results = append(results, SearchResult{
+			HistoryUID: match.key.historyUID,
+			Message:    msg,
+			Timestamp:  msg.Timestamp,
+			Snippet:    buildSnippet(msg.Content, highlights),
+		})
+	}
+	return results, nil
+}
+
+func (s *IndexedStore) confIndexLocked(confUID string) (*confIndex, error) {
+	if idx := s.confs[confUID]; idx != nil {
+		return idx, nil
+	}
+	idx := &confIndex{
+		docs:     make(map[docKey]HistoryMessage),
+		counts:   make(map[string]int),
+		postings: make(map[string]map[docKey]struct{}),
+	}
+	for _, info := range s.HistoryStore.GetHistoryList(confUID) {
+		messages, err := s.HistoryStore.GetHistory(confUID, info.UID)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range messages {
+			idx.add(info.UID, msg)
+		}
+	}
+	s.confs[confUID] = idx
+	return idx, nil
+}
+
+func (idx *confIndex) add(historyUID string, msg HistoryMessage) {
+	key := docKey{historyUID: historyUID, seq: idx.counts[historyUID]}
+	idx.counts[historyUID]++
+	idx.docs[key] = msg
+	for _, term := range uniqueTerms(indexTokens(msg.Content)) {
+		posting := idx.postings[term]
+		if posting == nil {
+			posting = make(map[docKey]struct{})
+			idx.postings[term] = posting
+		}
+		posting[key] = struct{}{}
+	}
+}
+
+func (idx *confIndex) removeHistory(historyUID string) {
+	count := idx.counts[historyUID]
+	for seq := 0; seq < count; seq++ {
+		key := docKey{historyUID: historyUID, seq: seq}
+		msg, ok := idx.docs[key]
+		if !ok {
+			continue
+		}
+		for _, term := range uniqueTerms(indexTokens(msg.Content)) {
+			if posting := idx.postings[term]; posting != nil {
+				delete(posting, key)
+				if len(posting) == 0 {
+					delete(idx.postings, term)
+				}
+			}
+		}
+		delete(idx.docs, key)
+	}
+	delete(idx.counts, historyUID)
+}
+
+// tokenize lowercases text and splits it into words. Runs of CJK characters,
+// which carry no word boundaries, become overlapping bigrams.
+func tokenize(text string) []string {
+	return tokenizeText(text, false)
+}
+
+// indexTokens tokenizes indexed content; CJK characters are additionally
+// emitted as unigrams so single-character queries match.
+func indexTokens(text string) []string {
+	return tokenizeText(text, true)
+}
+
+func tokenizeText(text string, cjkUnigrams bool) []string {
+	tokens := []string{}
+	var word []rune
+	var cjk []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		switch {
+		case len(cjk) == 1:
+			tokens = append(tokens, string(cjk))
+		case len(cjk) > 1:
+			for i := 0; i+1 < len(cjk); i++ {
+				tokens = append(tokens, string(cjk[i:i+2]))
+			}
+			if cjkUnigrams {
+				for _, r := range cjk {
+					tokens = append(tokens, string(r))
+				}
+			}
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, unicode.ToLower(r))
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return tokens
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+func uniqueTerms(terms []string) []string {
+	seen := make(map[string]struct{}, len(terms))
+	unique := make([]string, 0, len(terms))
+	for _, term := range terms {
+		if _, ok := seen[term]; ok {
+			continue
+		}
+		seen[term] = struct{}{}
+		unique = append(unique, term)
+	}
+	return unique
+}
+
+func termFrequency(tokens []string, terms []string) int {
+	wanted := make(map[string]struct{}, len(terms))
+	for _, term := range terms {
+		wanted[term] = struct{}{}
+	}
+	count := 0
+	for _, token := range tokens {
+		if _, ok := wanted[token]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+// highlightTerms returns the lowercased query fragments to mark in snippets:
+// whole words and whole CJK runs rather than index bigrams.
+func highlightTerms(query string) [][]rune {
+	fields := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+	terms := make([][]rune, 0, len(fields))
+	for _, field := range fields {
+		terms = append(terms, []rune(field))
+	}
+	sort.Slice(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+	return terms
+}
+
+// buildSnippet cuts a window of content around the first match and wraps
+// every match inside it in <mark> tags. The content itself is HTML-escaped,
+// so the tags are the only markup in the snippet.
+func buildSnippet(content string, terms [][]rune) string {
+	runes := []rune(content)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	first := -1
+	for _, term := range terms {
+		if pos := indexRunes(lower, term, 0); pos >= 0 && (first < 0 || pos < first) {
+			first = pos
+		}
+	}
+	if first < 0 {
+		first = 0
+	}
+	start := first - snippetContextRunes
+	if start < 0 {
+		start = 0
+	}
+	end := first + 2*snippetContextRunes
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	plain := start
+	for i := start; i < end; {
+		matched := 0
+		for _, term := range terms {
+			if len(term) > 0 && i+len(term) <= end && equalRunes(lower[i:i+len(term)], term) {
+				matched = len(term)
+				break
+			}
+		}
+		if matched == 0 {
+			i++
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[plain:i])))
+		b.WriteString(highlightOpen)
+		b.WriteString(html.EscapeString(string(runes[i : i+matched])))
+		b.WriteString(highlightClose)
+		i += matched
+		plain = i
+	}
+	b.WriteString(html.EscapeString(string(runes[plain:end])))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+func indexRunes(haystack []rune, needle []rune, from int) int {
+	if len(needle) == 0 {
+		return -1
+	}
+	for i := from; i+len(needle) <= len(haystack); i++ {
+		if equalRunes(haystack[i:i+len(needle)], needle) {
+			return i
+		}
+	}
+	return -1
+}
+
+func equalRunes(a []rune, b []rune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
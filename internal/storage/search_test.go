@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIndexedStoreSearch(t *testing.T) {
+	store := NewIndexedStore(NewFileStore(t.TempDir()))
+	first, err := store.CreateHistory("conf")
+	if err != nil {
+		t.Fatalf("CreateHistory error: %v", err)
+	}
+	if err := store.AppendHistoryMessage("conf", first, HistoryMessage{Role: RoleHuman, Content: "What is the weather in Tokyo?"}); err != nil {
+		t.Fatalf("AppendHistoryMessage error: %v", err)
+	}
+
+	results, err := store.SearchHistories("conf", "tokyo", 0)
+	if err != nil {
+		t.Fatalf("SearchHistories error: %v", err)
+	}
+	if len(results) != 1 || results[0].HistoryUID != first {
+		t.Fatalf("results=%+v, want one match in %s", results, first)
+	}
+	if !strings.Contains(results[0].Snippet, "<mark>Tokyo</mark>") {
+		t.Fatalf("snippet=%q, want highlighted Tokyo", results[0].Snippet)
+	}
+
+	// Messages written after the index was built are searchable.
+	second, err := store.CreateHistory("conf")
+	if err != nil {
+		t.Fatalf("CreateHistory error: %v", err)
+	}
+	if err := store.AppendHistoryMessage("conf", second, HistoryMessage{Role: RoleAI, Content: "今天东京天气很好"}); err != nil {
+		t.Fatalf("AppendHistoryMessage error: %v", err)
+	}
+	results, err = store.SearchHistories("conf", "东京天气", 0)
+	if err != nil {
+		t.Fatalf("SearchHistories(cjk) error: %v", err)
+	}
+	if len(results) != 1 || results[0].HistoryUID != second {
+		t.Fatalf("cjk results=%+v, want one match in %s", results, second)
+	}
+	if !strings.Contains(results[0].Snippet, "<mark>东京天气</mark>") {
+		t.Fatalf("cjk snippet=%q, want highlighted run", results[0].Snippet)
+	}
+	if results, _ := store.SearchHistories("conf", "京", 0); len(results) != 1 {
+		t.Fatalf("single cjk char results=%d, want 1", len(results))
+	}
+
+	if results, _ := store.SearchHistories("conf", "tokyo weather", 0); len(results) != 1 {
+		t.Fatalf("multi-term results=%d, want 1", len(results))
+	}
+	if results, _ := store.SearchHistories("conf", "tokyo paris", 0); len(results) != 0 {
+		t.Fatalf("non-matching term results=%d, want 0", len(results))
+	}
+
+	if !store.DeleteHistory("conf", first) {
+		t.Fatal("DeleteHistory=false, want true")
+	}
+	if results, _ := store.SearchHistories("conf", "tokyo", 0); len(results) != 0 {
+		t.Fatalf("results after delete=%d, want 0", len(results))
+	}
+}
+
+func TestBuildSnippetTrimsLongContent(t *testing.T) {
+	content := strings.Repeat("a ", 60) + "needle" + strings.Repeat(" b", 120)
+	snippet := buildSnippet(content, highlightTerms("needle"))
+	if !strings.HasPrefix(snippet, "…") || !strings.HasSuffix(snippet, "…") {
+		t.Fatalf("snippet=%q, want ellipsis on both ends", snippet)
+	}
+	if !strings.Contains(snippet, "<mark>needle</mark>") {
+		t.Fatalf("snippet=%q, want highlighted needle", snippet)
+	}
+}
+
+func TestBuildSnippetEscapesHTML(t *testing.T) {
+	content := `<img onerror="x"> the <b>needle</b> & more`
+	snippet := buildSnippet(content, highlightTerms("needle"))
+	want := `&lt;img onerror=&#34;x&#34;&gt; the &lt;b&gt;<mark>needle</mark>&lt;/b&gt; &amp; more`
+	if snippet != want {
+		t.Fatalf("snippet=%q, want %q", snippet, want)
+	}
+}
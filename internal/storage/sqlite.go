@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore keeps histories in an embedded SQLite database with an index
+// on the latest message timestamp, so listing does not read every history.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS histories (
+		conf_uid         TEXT NOT NULL,
+		uid              TEXT NOT NULL,
+		created_at       TEXT NOT NULL,
+		latest_seq       INTEGER NOT NULL DEFAULT 0,
+		latest_timestamp TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (conf_uid, uid)
+	);
+	CREATE INDEX IF NOT EXISTS idx_histories_latest
+		ON histories (conf_uid, latest_timestamp DESC);
+	CREATE TABLE IF NOT EXISTS messages (
+		conf_uid    TEXT NOT NULL,
+		history_uid TEXT NOT NULL,
+		seq         INTEGER NOT NULL,
+		role        TEXT NOT NULL,
+		timestamp   TEXT NOT NULL,
+		content     TEXT NOT NULL DEFAULT '',
+		name        TEXT NOT NULL DEFAULT '',
+		avatar      TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (conf_uid, history_uid, seq)
+	);`,
+	`ALTER TABLE histories ADD COLUMN title TEXT NOT NULL DEFAULT '';
+	ALTER TABLE histories ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE histories ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';
+	CREATE INDEX IF NOT EXISTS idx_histories_pinned_latest
+		ON histories (conf_uid, pinned DESC, latest_timestamp DESC);`,
+	`ALTER TABLE messages ADD COLUMN audio TEXT NOT NULL DEFAULT '';`,
+}
+
+// OpenSQLiteStore opens (and migrates) the database at path.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	if path == "" {
+		return nil, errors.New("chat history db path is empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	store := &SQLiteStore{db: db}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate history db: %w", err)
+	}
+	return store, nil
+}
+
+func (s *SQLiteStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateHistory executes the createHistory method.
+func (s *SQLiteStore) CreateHistory(confUID string) (string, error) {
+	if confUID == "" {
+		return "", errors.New("conf_uid is empty")
+	}
+	if !safeNamePattern.MatchString(confUID) {
+		return "", errors.New("invalid conf_uid")
+	}
+	uid := NewHistoryUID()
+	if err := s.ImportHistory(confUID, uid, nil); err != nil {
+		return "", err
+	}
+	return uid, nil
+}
+
+// GetHistory executes the getHistory method.
+func (s *SQLiteStore) GetHistory(confUID string, historyUID string) ([]HistoryMessage, error) {
+	messages, err := s.readMessages(confUID, historyUID)
+	if err != nil {
+		return nil, err
+	}
+	return filterConversation(messages), nil
+}
+
+// AppendHistoryMessage appends a human or ai turn to an existing history.
+func (s *SQLiteStore) AppendHistoryMessage(confUID string, historyUID string, msg HistoryMessage) error {
+	msg, err := normalizeTurn(msg)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var seq int
+	err = tx.QueryRow(
+		`SELECT COALESCE(MAX(m.seq), -1) + 1 FROM histories h
+		 LEFT JOIN messages m ON m.conf_uid = h.conf_uid AND m.history_uid = h.uid
+		 WHERE h.conf_uid = ? AND h.uid = ? GROUP BY h.uid`,
+		confUID, historyUID,
+	).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("history %s not found", historyUID)
+	}
+	if err != nil {
+		return err
+	}
+	if err := insertMessage(tx, confUID, historyUID, seq, msg); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`UPDATE histories SET latest_seq = ?, latest_timestamp = ? WHERE conf_uid = ? AND uid = ?`,
+		seq, msg.Timestamp, confUID, historyUID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ImportHistory writes a complete history under historyUID. It fails if the
+// history already exists.
+func (s *SQLiteStore) ImportHistory(confUID string, historyUID string, messages []HistoryMessage) error {
+	if !safeNamePattern.MatchString(confUID) || !safeNamePattern.MatchString(historyUID) {
+		return errors.New("invalid history path")
+	}
+	messages = withMetadata(messages)
+	meta := normalizeMeta(messages[0].HistoryMeta)
+	tags, err := encodeTags(meta.Tags)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(
+		`INSERT INTO histories (conf_uid, uid, created_at, title, pinned, tags) VALUES (?, ?, ?, ?, ?, ?)`,
+		confUID, historyUID, messages[0].Timestamp, meta.Title, meta.Pinned, tags,
+	); err != nil {
+		return fmt.Errorf("history %s already exists: %w", historyUID, err)
+	}
+	latestSeq := 0
+	latestTimestamp := ""
+	for seq, msg := range messages {
+		if err := insertMessage(tx, confUID, historyUID, seq, msg); err != nil {
+			return err
+		}
+		if msg.Role != RoleMetadata {
+			latestSeq = seq
+			latestTimestamp = msg.Timestamp
+		}
+	}
+	if _, err := tx.Exec(
+		`UPDATE histories SET latest_seq = ?, latest_timestamp = ? WHERE conf_uid = ? AND uid = ?`,
+		latestSeq, latestTimestamp, confUID, historyUID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteHistory executes the deleteHistory method.
+func (s *SQLiteStore) DeleteHistory(confUID string, historyUID string) bool {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM histories WHERE conf_uid = ? AND uid = ?`, confUID, historyUID)
+	if err != nil {
+		return false
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false
+	}
+	if _, err := tx.Exec(`DELETE FROM messages WHERE conf_uid = ? AND history_uid = ?`, confUID, historyUID); err != nil {
+		return false
+	}
+	return tx.Commit() == nil
+}
+
+// UpdateHistoryMeta applies update to the metadata of an existing history.
+func (s *SQLiteStore) UpdateHistoryMeta(confUID string, historyUID string, update func(*HistoryMeta)) (HistoryMeta, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return HistoryMeta{}, err
+	}
+	defer tx.Rollback()
+	var meta HistoryMeta
+	var tags string
+	err = tx.QueryRow(
+		`SELECT title, pinned, tags FROM histories WHERE conf_uid = ? AND uid = ?`,
+		confUID, historyUID,
+	).Scan(&meta.Title, &meta.Pinned, &tags)
+	if errors.Is(err, sql.ErrNoRows) {
+		return HistoryMeta{}, fmt.Errorf("history %s not found", historyUID)
+	}
+	if err != nil {
+		return HistoryMeta{}, err
+	}
+	if meta.Tags, err = decodeTags(tags); err != nil {
+		return HistoryMeta{}, err
+	}
+	update(&meta)
+	meta = normalizeMeta(meta)
+	if tags, err = encodeTags(meta.Tags); err != nil {
+		return HistoryMeta{}, err
+	}
+	if _, err := tx.Exec(
+		`UPDATE histories SET title = ?, pinned = ?, tags = ? WHERE conf_uid = ? AND uid = ?`,
+		meta.Title, meta.Pinned, tags, confUID, historyUID,
+	); err != nil {
+		return HistoryMeta{}, err
+	}
+	return meta, tx.Commit()
+}
+
+// GetHistoryList executes the getHistoryList method.
+func (s *SQLiteStore) GetHistoryList(confUID string) []HistoryInfo {
+	list, _, err := s.GetHistoryPage(confUID, 0, 0)
+	if err != nil {
+		return []HistoryInfo{}
+	}
+	return list
+}
+
+// GetHistoryPage returns one page of the history list and the total count.
+// A non-positive limit returns every history from offset on.
+func (s *SQLiteStore) GetHistoryPage(confUID string, offset int, limit int) ([]HistoryInfo, int, error) {
+	list := []HistoryInfo{}
+	var total int
+	if err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM histories WHERE conf_uid = ? AND latest_seq > 0`, confUID,
+	).Scan(&total); err != nil {
+		return list, 0, err
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(
+		`SELECT h.uid, h.title, h.pinned, h.tags, m.role, m.timestamp, m.content, m.name, m.avatar, m.audio
+		 FROM histories h
+		 JOIN messages m ON m.conf_uid = h.conf_uid AND m.history_uid = h.uid AND m.seq = h.latest_seq
+		 WHERE h.conf_uid = ? AND h.latest_seq > 0
+		 ORDER BY h.pinned DESC, h.latest_timestamp DESC
+		 LIMIT ? OFFSET ?`,
+		confUID, limit, offset,
+	)
+	if err != nil {
+		return list, total, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var info HistoryInfo
+		var tags string
+		latest := &info.LatestMessage
+		if err := rows.Scan(&info.UID, &info.Title, &info.Pinned, &tags, &latest.Role, &latest.Timestamp, &latest.Content, &latest.Name, &latest.Avatar, &latest.Audio); err != nil {
+			return list, total, err
+		}
+		if info.Tags, err = decodeTags(tags); err != nil {
+			return list, total, err
+		}
+		info.Timestamp = latest.Timestamp
+		list = append(list, info)
+	}
+	return list, total, rows.Err()
+}
+
+// Close executes the close method.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// readMessages returns every message of a history, with the history's
+// metadata on its metadata entry.
+func (s *SQLiteStore) readMessages(confUID string, historyUID string) ([]HistoryMessage, error) {
+	var meta HistoryMeta
+	var tags string
+	err := s.db.QueryRow(
+		`SELECT title, pinned, tags FROM histories WHERE conf_uid = ? AND uid = ?`, confUID, historyUID,
+	).Scan(&meta.Title, &meta.Pinned, &tags)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("history %s not found", historyUID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if meta.Tags, err = decodeTags(tags); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(
+		`SELECT role, timestamp, content, name, avatar, audio FROM messages
+		 WHERE conf_uid = ? AND history_uid = ? ORDER BY seq`,
+		confUID, historyUID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []HistoryMessage{}
+	for rows.Next() {
+		var msg HistoryMessage
+		if err := rows.Scan(&msg.Role, &msg.Timestamp, &msg.Content, &msg.Name, &msg.Avatar, &msg.Audio); err != nil {
+			return nil, err
+		}
+		if msg.Role == RoleMetadata {
+			msg.HistoryMeta = meta
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func insertMessage(tx *sql.Tx, confUID string, historyUID string, seq int, msg HistoryMessage) error {
+	_, err := tx.Exec(
+		`INSERT INTO messages (conf_uid, history_uid, seq, role, timestamp, content, name, avatar, audio)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		confUID, historyUID, seq, msg.Role, msg.Timestamp, msg.Content, msg.Name, msg.Avatar, msg.Audio,
+	)
+	return err
+}
+
+func encodeTags(tags []string) (string, error) {
+	if tags == nil {
+		tags = []string{}
+	}
+	data, err := json.Marshal(tags)
+	return string(data), err
+}
+
+func decodeTags(data string) ([]string, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var tags []string
+	if err := json.Unmarshal([]byte(data), &tags); err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, nil
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Supported history storage backends.
+const (
+	BackendFile   = "file"
+	BackendSQLite = "sqlite"
+)
+
+// HistoryStore persists chat histories grouped by conf_uid.
+type HistoryStore interface {
+	CreateHistory(confUID string) (string, error)
+	GetHistory(confUID string, historyUID string) ([]HistoryMessage, error)
+	AppendHistoryMessage(confUID string, historyUID string, msg HistoryMessage) error
+	ImportHistory(confUID string, historyUID string, messages []HistoryMessage) error
+	DeleteHistory(confUID string, historyUID string) bool
+	UpdateHistoryMeta(confUID string, historyUID string, update func(*HistoryMeta)) (HistoryMeta, error)
+	GetHistoryList(confUID string) []HistoryInfo
+	GetHistoryPage(confUID string, offset int, limit int) ([]HistoryInfo, int, error)
+	Close() error
+}
+
+// Open returns the history store selected by backend, wrapped with a
+// full-text search index. An empty backend selects the JSON file layout.
+func Open(backend string, baseDir string, dbPath string) (HistoryStore, error) {
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "", BackendFile:
+		return NewIndexedStore(NewFileStore(baseDir)), nil
+	case BackendSQLite:
+		store, err := OpenSQLiteStore(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		return NewIndexedStore(store), nil
+	default:
+		return nil, fmt.Errorf("unsupported history backend: %q", backend)
+	}
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxTitleWords = 4
+	maxTitleRunes = 20
+)
+
+var englishStopwords = map[string]struct{}{}
+
+func init() {
+	for _, word := range strings.Fields(`a about above after again all also am an and any are as at be because been
+		before being below between both but by can could did do does doing down during each few for from further
+		had has have having he her here hers herself him himself his how i if in into is it its itself just know
+		let like me more most my myself no nor not now of off on once only or other our ours ourselves out over
+		own please same she should so some such tell than thank thanks that the their theirs them themselves then
+		there these they this those through to too under until up very want was we were what when where which
+		while who whom why will with would you your yours yourself yourselves hi hello hey ok okay yes yeah sure
+		maybe really get got make need think going go one thing things something anything lot much many well
+		good great best nice better there's it's i'm you're don't can't what's how's`) {
+		englishStopwords[word] = struct{}{}
+	}
+}
+
+// chineseFillers are stripped from the start of a Chinese question, longest
+// first, before it becomes a title.
+var chineseFillers = []string{
+	"我想知道", "想问一下", "请问一下", "可不可以", "能不能", "我想问", "麻烦你", "帮我看看",
+	"请问", "你好", "您好", "我想", "想问", "可以", "帮我", "请你", "麻烦", "一下", "那个", "告诉我",
+	"请", "嗯", "呃", "啊",
+}
+
+// chineseTrailers are stripped from the end of a Chinese question.
+var chineseTrailers = []string{"可以吗", "好不好", "好吗", "行吗", "吗", "呢", "吧", "啊", "呀", "么", "嘛", "哦"}
+
+// GenerateTitle derives a short history title from the first human turn and
+// the AI reply. Chinese questions keep their leading clause; English text is
+// reduced to its most frequent keywords.
+func GenerateTitle(human string, ai string) string {
+	human = strings.TrimSpace(human)
+	ai = strings.TrimSpace(ai)
+	if human == "" {
+		human, ai = ai, ""
+	}
+	if human == "" {
+		return ""
+	}
+	if cjkRatio(human) >= 0.3 {
+		return chineseTitle(human, ai)
+	}
+	return englishTitle(human, ai)
+}
+
+func cjkRatio(text string) float64 {
+	letters, cjk := 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if isCJK(r) {
+			cjk++
+		}
+	}
+	if letters == 0 {
+		return 0
+	}
+	return float64(cjk) / float64(letters)
+}
+
+func englishTitle(human string, ai string) string {
+	type keyword struct {
+		word  string
+		score int
+		pos   int
+	}
+	keywords := map[string]*keyword{}
+	pos := 0
+	count := func(text string, weight int) {
+		for _, word := range titleWords(text) {
+			pos++
+			lower := strings.ToLower(word)
+			if _, stop := englishStopwords[lower]; stop || len([]rune(lower)) < 3 {
+				continue
+			}
+			kw := keywords[lower]
+			if kw == nil {
+				kw = &keyword{word: word, pos: pos}
+				keywords[lower] = kw
+			}
+			kw.score += weight
+		}
+	}
+	count(human, 3)
+	count(ai, 1)
+
+	ranked := make([]*keyword, 0, len(keywords))
+	for _, kw := range keywords {
+		// Words only the reply uses must recur to count as a topic.
+		if kw.score >= 2 {
+			ranked = append(ranked, kw)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].pos < ranked[j].pos
+	})
+	if len(ranked) > maxTitleWords {
+		ranked = ranked[:maxTitleWords]
+	}
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].pos < ranked[j].pos })
+
+	words := make([]string, 0, maxTitleWords)
+	for _, kw := range ranked {
+		words = append(words, kw.word)
+	}
+	if len(words) == 0 {
+		words = titleWords(human)
+		if len(words) > maxTitleWords+2 {
+			words = words[:maxTitleWords+2]
+		}
+	}
+	for i, word := range words {
+		runes := []rune(word)
+		if unicode.IsLower(runes[0]) {
+			runes[0] = unicode.ToUpper(runes[0])
+		}
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+// titleWords splits text into words, keeping inner apostrophes and hyphens.
+func titleWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' || r == '-')
+	})
+}
+
+func chineseTitle(human string, ai string) string {
+	clause := []rune{}
+	for _, part := range strings.FieldsFunc(human, isClauseBreak) {
+		part = trimChineseFillers(part)
+		if part != "" {
+			clause = []rune(part)
+			break
+		}
+	}
+	if len(clause) == 0 {
+		return ""
+	}
+	if len(clause) > maxTitleRunes && ai != "" {
+		// Start at the first bigram the reply also talks about.
+		for i := 0; i+1 < len(clause); i++ {
+			if isCJK(clause[i]) && isCJK(clause[i+1]) && strings.Contains(ai, string(clause[i:i+2])) {
+				clause = clause[i:]
+				break
+			}
+		}
+	}
+	if len(clause) > maxTitleRunes {
+		clause = clause[:maxTitleRunes]
+	}
+	return strings.TrimSpace(string(clause))
+}
+
+func isClauseBreak(r rune) bool {
+	return strings.ContainsRune("。！？，、；：,.!?;:\n\r\t ", r)
+}
+
+func trimChineseFillers(text string) string {
+	text = strings.TrimSpace(text)
+	for {
+		trimmed := false
+		for _, filler := range chineseFillers {
+			if strings.HasPrefix(text, filler) {
+				text = strings.TrimSpace(strings.TrimPrefix(text, filler))
+				trimmed = true
+				break
+			}
+		}
+		if !trimmed {
+			break
+		}
+	}
+	for _, trailer := range chineseTrailers {
+		if strings.HasSuffix(text, trailer) {
+			return strings.TrimSpace(strings.TrimSuffix(text, trailer))
+		}
+	}
+	return text
+}
+
+// AutoTitleHistory titles a history from its first human turn and AI reply
+// unless it already has a title. It reports the title and whether it was
+// set by this call.
+func AutoTitleHistory(store HistoryStore, confUID string, historyUID string) (string, bool, error) {
+	messages, err := store.GetHistory(confUID, historyUID)
+	if err != nil {
+		return "", false, err
+	}
+	var human, ai string
+	for _, msg := range messages {
+		if msg.Role == RoleHuman && human == "" {
+			human = msg.Content
+		}
+		if msg.Role == RoleAI && ai == "" && human != "" {
+			ai = msg.Content
+			break
+		}
+	}
+	if human == "" || ai == "" {
+		return "", false, nil
+	}
+	title := GenerateTitle(human, ai)
+	if title == "" {
+		return "", false, nil
+	}
+	set := false
+	meta, err := store.UpdateHistoryMeta(confUID, historyUID, func(meta *HistoryMeta) {
+		if meta.Title == "" {
+			meta.Title = title
+			set = true
+		}
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return meta.Title, set, nil
+}
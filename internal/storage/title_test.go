@@ -0,0 +1,53 @@
+package storage
+
+import "testing"
+
+func TestGenerateTitle(t *testing.T) {
+	cases := []struct {
+		human string
+		ai    string
+		want  string
+	}{
+		{
+			human: "Can you recommend a good ramen restaurant in Tokyo?",
+			ai:    "Sure! For ramen in Tokyo, try Ichiran in Shibuya.",
+			want:  "Recommend Ramen Restaurant Tokyo",
+		},
+		{
+			human: "你好，请问明天上海的天气怎么样？",
+			ai:    "明天上海多云，气温18到25度。",
+			want:  "明天上海的天气怎么样",
+		},
+		{
+			human: "请帮我写一首关于秋天落叶和远方故乡的现代诗好吗",
+			ai:    "好的，这是一首关于故乡的诗。",
+			want:  "写一首关于秋天落叶和远方故乡的现代诗",
+		},
+		{human: "hi", ai: "hello!", want: "Hi"},
+		{human: "", ai: "", want: ""},
+	}
+	for _, tc := range cases {
+		if got := GenerateTitle(tc.human, tc.ai); got != tc.want {
+			t.Fatalf("GenerateTitle(%q)=%q, want %q", tc.human, got, tc.want)
+		}
+	}
+}
+
+func TestAutoTitleHistoryKeepsExistingTitle(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	uid, _ := store.CreateHistory("conf")
+	store.AppendHistoryMessage("conf", uid, HistoryMessage{Role: RoleHuman, Content: "How do I bake sourdough bread?"})
+	if _, set, _ := AutoTitleHistory(store, "conf", uid); set {
+		t.Fatal("titled before the ai reply, want no title")
+	}
+	store.AppendHistoryMessage("conf", uid, HistoryMessage{Role: RoleAI, Content: "Start with an active sourdough starter."})
+	title, set, err := AutoTitleHistory(store, "conf", uid)
+	if err != nil || !set || title != "Bake Sourdough Bread" {
+		t.Fatalf("AutoTitleHistory=%q,%v,%v, want generated title", title, set, err)
+	}
+
+	store.UpdateHistoryMeta("conf", uid, func(meta *HistoryMeta) { meta.Title = "Baking" })
+	if title, set, _ := AutoTitleHistory(store, "conf", uid); set || title != "Baking" {
+		t.Fatalf("AutoTitleHistory=%q,%v, want existing title kept", title, set)
+	}
+}
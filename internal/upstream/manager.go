@@ -0,0 +1,435 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/pkg/xiaozhi"
+)
+
+// Policy decides what happens when a session asks for a device whose
+// connection is already in use.
+type Policy string
+
+const (
+	// PolicySession gives every session a connection of its own. Only
+	// sessions that ask for a device by ID share its connection.
+	PolicySession Policy = "session"
+	// PolicyShare lets every session use the connection; events from it go
+	// to all of them, so they mirror one conversation. Only the session that
+	// started the current turn controls it.
+	PolicyShare Policy = "share"
+	// PolicyHandoff gives the connection to the new session and revokes the
+	// leases of the others.
+	PolicyHandoff Policy = "handoff"
+)
+
+// ParsePolicy maps a config value to a Policy, defaulting to PolicySession.
+func ParsePolicy(value string) Policy {
+	switch Policy(strings.TrimSpace(strings.ToLower(value))) {
+	case PolicyShare:
+		return PolicyShare
+	case PolicyHandoff:
+		return PolicyHandoff
+	default:
+		return PolicySession
+	}
+}
+
+// Options configures a Manager.
+type Options struct {
+	Policy Policy
+	// IdleTimeout is how long a connection without leases stays open. Zero
+	// closes it as soon as the last lease is released.
+	IdleTimeout time.Duration
+}
+
+// Manager owns the XiaoZhi connections, one per device ID, and hands them
+// out as leases. Pre-warmed connections are never closed for being idle.
+type Manager struct {
+	opts   Options
+	logger *zap.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	conns  map[string]*conn
+	dialed map[*conn]struct{}
+	closed bool
+}
+
+type conn struct {
+	deviceID string
+	client   *xiaozhi.Client
+	leases   []*Lease
+	turn     *Lease
+	started  bool
+	pinned   bool
+	private  bool
+	idleSeq  uint64
+}
+
+// Lease is one session's use of a connection. Events reach it once started.
+type Lease struct {
+	manager   *Manager
+	conn      *conn
+	callbacks xiaozhi.Callbacks
+	onRevoke  func()
+	active    bool
+	released  bool
+}
+
+// NewManager executes the newManager function.
+func NewManager(opts Options, logger *zap.Logger) *Manager {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		opts:   opts,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[string]*conn),
+		dialed: make(map[*conn]struct{}),
+	}
+}
+
+// Policy returns the policy the manager was configured with.
+func (m *Manager) Policy() Policy {
+	return m.opts.Policy
+}
+
+// Prewarm connects cfg.DeviceID ahead of the first session and keeps the
+// connection open while idle.
+func (m *Manager) Prewarm(cfg xiaozhi.Config) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	c := m.connLocked(cfg)
+	c.pinned = true
+	connect := !c.started
+	c.started = true
+	m.mu.Unlock()
+	if connect {
+		m.logger.Info("xiaozhi connection pre-warmed", zap.String("device_id", cfg.DeviceID))
+		c.client.Connect(m.ctx)
+	}
+}
+
+// Acquire leases the connection for cfg.DeviceID, creating it from cfg if
+// there is none. Under PolicyHandoff the other leases on it are revoked and
+// their onRevoke called. The lease gets no events until Start.
+func (m *Manager) Acquire(cfg xiaozhi.Config, callbacks xiaozhi.Callbacks, onRevoke func()) *Lease {
+	m.mu.Lock()
+	c := m.connLocked(cfg)
+	// Disarm the idle timer.
+	c.idleSeq++
+	var revoked []*Lease
+	if m.opts.Policy == PolicyHandoff {
+		revoked = c.leases
+		for _, l := range revoked {
+			l.released = true
+		}
+		c.leases = nil
+		c.turn = nil
+	}
+	lease := &Lease{manager: m, conn: c, callbacks: callbacks, onRevoke: onRevoke}
+	c.leases = append(c.leases, lease)
+	leases := len(c.leases)
+	m.mu.Unlock()
+
+	if len(revoked) > 0 || leases > 1 {
+		m.logger.Info("xiaozhi connection reused",
+			zap.String("device_id", c.deviceID),
+			zap.Int("leases", leases),
+			zap.Int("revoked", len(revoked)),
+		)
+	}
+	for _, l := range revoked {
+		if l.onRevoke != nil {
+			l.onRevoke()
+		}
+	}
+	return lease
+}
+
+// Dial leases a connection of its own to one session. It is never shared
+// and is closed as soon as the lease is released.
+func (m *Manager) Dial(cfg xiaozhi.Config, callbacks xiaozhi.Callbacks) *Lease {
+	c := &conn{deviceID: cfg.DeviceID, private: true}
+	c.client = xiaozhi.NewClient(cfg, m.fanOut(c), m.logger)
+	lease := &Lease{manager: m, conn: c, callbacks: callbacks}
+	c.leases = []*Lease{lease}
+	m.mu.Lock()
+	if !m.closed {
+		m.dialed[c] = struct{}{}
+	}
+	m.mu.Unlock()
+	return lease
+}
+
+// Close closes every connection. Leases keep working as no-ops.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	conns := m.conns
+	dialed := m.dialed
+	m.conns = make(map[string]*conn)
+	m.dialed = make(map[*conn]struct{})
+	m.mu.Unlock()
+	m.cancel()
+	for _, c := range conns {
+		c.client.Close()
+	}
+	for c := range dialed {
+		c.client.Close()
+	}
+}
+
+// connLocked returns the connection for cfg.DeviceID, creating it if
+// needed. The caller holds mu.
+func (m *Manager) connLocked(cfg xiaozhi.Config) *conn {
+	if c, ok := m.conns[cfg.DeviceID]; ok {
+		return c
+	}
+	c := &conn{deviceID: cfg.DeviceID}
+	c.client = xiaozhi.NewClient(cfg, m.fanOut(c), m.logger)
+	if !m.closed {
+		m.conns[cfg.DeviceID] = c
+	}
+	return c
+}
+
+// fanOut builds callbacks that pass each event on to the started leases
+// of c.
+func (m *Manager) fanOut(c *conn) xiaozhi.Callbacks {
+	return xiaozhi.Callbacks{
+		OnSTT: func(text string) {
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnSTT != nil {
+					cb.OnSTT(text)
+				}
+			})
+		},
+		OnLLM: func(text string, state string) {
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnLLM != nil {
+					cb.OnLLM(text, state)
+				}
+			})
+		},
+		OnText: func(text string) {
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnText != nil {
+					cb.OnText(text)
+				}
+			})
+		},
+		OnTTS: func(state string, text string) {
+			if state == "stop" {
+				m.endTurn(c)
+			}
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnTTS != nil {
+					cb.OnTTS(state, text)
+				}
+			})
+		},
+		OnMCP: func(payload json.RawMessage) {
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnMCP != nil {
+					cb.OnMCP(payload)
+				}
+			})
+		},
+		OnGoodbye: func() {
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnGoodbye != nil {
+					cb.OnGoodbye()
+				}
+			})
+		},
+		OnAudio: func(frame xiaozhi.AudioFrame) {
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnAudio != nil {
+					cb.OnAudio(frame)
+				}
+			})
+		},
+		OnConnected: func() {
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnConnected != nil {
+					cb.OnConnected()
+				}
+			})
+		},
+		OnDisconnected: func(err error) {
+			m.endTurn(c)
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnDisconnected != nil {
+					cb.OnDisconnected(err)
+				}
+			})
+		},
+		OnError: func(err error) {
+			m.each(c, func(cb xiaozhi.Callbacks) {
+				if cb.OnError != nil {
+					cb.OnError(err)
+				}
+			})
+		},
+	}
+}
+
+// each calls fn with the callbacks of every started lease on c.
+func (m *Manager) each(c *conn, fn func(xiaozhi.Callbacks)) {
+	m.mu.Lock()
+	callbacks := make([]xiaozhi.Callbacks, 0, len(c.leases))
+	for _, l := range c.leases {
+		if l.active {
+			callbacks = append(callbacks, l.callbacks)
+		}
+	}
+	m.mu.Unlock()
+	for _, cb := range callbacks {
+		fn(cb)
+	}
+}
+
+// endTurn frees the turn on c.
+func (m *Manager) endTurn(c *conn) {
+	m.mu.Lock()
+	c.turn = nil
+	m.mu.Unlock()
+}
+
+// Client returns the leased connection. Sessions sharing it check Claim or
+// Controls before sending on it.
+func (l *Lease) Client() *xiaozhi.Client {
+	return l.conn.client
+}
+
+// Claim takes the turn on the connection unless another lease owns it, and
+// reports whether the lease owns it. The turn ends when the reply stops,
+// the connection drops, or the owner yields or is released.
+func (l *Lease) Claim() bool {
+	m := l.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l.released {
+		return false
+	}
+	if l.conn.turn == nil {
+		l.conn.turn = l
+	}
+	return l.conn.turn == l
+}
+
+// Controls reports whether the lease may steer the connection: listen
+// start and stop, listen mode and abort. That is when no turn is under way
+// or the lease owns it.
+func (l *Lease) Controls() bool {
+	m := l.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !l.released && (l.conn.turn == nil || l.conn.turn == l)
+}
+
+// Yield gives up the turn if the lease owns it.
+func (l *Lease) Yield() {
+	m := l.manager
+	m.mu.Lock()
+	if l.conn.turn == l {
+		l.conn.turn = nil
+	}
+	m.mu.Unlock()
+}
+
+// Start lets events through to the lease and connects a new connection. On
+// a connection that is already up, OnConnected is called right away so the
+// session sets up as if it had dialed itself.
+func (l *Lease) Start() {
+	m := l.manager
+	m.mu.Lock()
+	if l.released {
+		m.mu.Unlock()
+		return
+	}
+	l.active = true
+	connect := !l.conn.started
+	l.conn.started = true
+	m.mu.Unlock()
+	if connect {
+		l.conn.client.Connect(m.ctx)
+		return
+	}
+	if l.conn.client.Connected() && l.callbacks.OnConnected != nil {
+		go l.callbacks.OnConnected()
+	}
+}
+
+// Release gives the lease up. The connection is closed once it has had no
+// leases for the idle timeout, unless it was pre-warmed.
+func (l *Lease) Release() {
+	m := l.manager
+	m.mu.Lock()
+	if l.released {
+		m.mu.Unlock()
+		return
+	}
+	l.released = true
+	c := l.conn
+	if c.turn == l {
+		c.turn = nil
+	}
+	for i, other := range c.leases {
+		if other == l {
+			c.leases = append(c.leases[:i], c.leases[i+1:]...)
+			break
+		}
+	}
+	if c.private {
+		delete(m.dialed, c)
+		m.mu.Unlock()
+		c.client.Close()
+		return
+	}
+	if len(c.leases) > 0 || c.pinned {
+		m.mu.Unlock()
+		return
+	}
+	c.idleSeq++
+	seq := c.idleSeq
+	m.mu.Unlock()
+	if m.opts.IdleTimeout <= 0 {
+		m.closeIdle(c, seq)
+		return
+	}
+	time.AfterFunc(m.opts.IdleTimeout, func() {
+		m.closeIdle(c, seq)
+	})
+}
+
+// closeIdle closes c if it has stayed without leases since the release
+// numbered seq.
+func (m *Manager) closeIdle(c *conn, seq uint64) {
+	m.mu.Lock()
+	if c.idleSeq != seq || len(c.leases) > 0 {
+		m.mu.Unlock()
+		return
+	}
+	if m.conns[c.deviceID] == c {
+		delete(m.conns, c.deviceID)
+	}
+	m.mu.Unlock()
+	m.logger.Info("xiaozhi connection closed after idle", zap.String("device_id", c.deviceID))
+	c.client.Close()
+}
@@ -0,0 +1,179 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/saker-ai/vtuber-server/pkg/xiaozhi"
+)
+
+func testConfig(deviceID string) xiaozhi.Config {
+	return xiaozhi.Config{DeviceID: deviceID, ClientID: "test-client"}
+}
+
+func sttCounter(n *int) xiaozhi.Callbacks {
+	return xiaozhi.Callbacks{OnSTT: func(string) { *n++ }}
+}
+
+func TestAcquireSharesConnectionByDevice(t *testing.T) {
+	m := NewManager(Options{Policy: PolicyShare}, nil)
+	defer m.Close()
+
+	var first, second, other int
+	a := m.Acquire(testConfig("dev-a"), sttCounter(&first), nil)
+	b := m.Acquire(testConfig("dev-a"), sttCounter(&second), nil)
+	c := m.Acquire(testConfig("dev-b"), sttCounter(&other), nil)
+	if a.Client() != b.Client() {
+		t.Fatalf("same device got different clients")
+	}
+	if a.Client() == c.Client() {
+		t.Fatalf("different devices share a client")
+	}
+
+	a.Start()
+	m.fanOut(a.conn).OnSTT("hello")
+	if first != 1 || second != 0 {
+		t.Fatalf("before start: first=%d second=%d, want 1 0", first, second)
+	}
+	b.Start()
+	m.fanOut(a.conn).OnSTT("hello")
+	if first != 2 || second != 1 || other != 0 {
+		t.Fatalf("after start: first=%d second=%d other=%d, want 2 1 0", first, second, other)
+	}
+}
+
+func TestSharedTurnBelongsToClaimer(t *testing.T) {
+	m := NewManager(Options{Policy: PolicyShare}, nil)
+	defer m.Close()
+
+	a := m.Acquire(testConfig("dev"), xiaozhi.Callbacks{}, nil)
+	b := m.Acquire(testConfig("dev"), xiaozhi.Callbacks{}, nil)
+	if !a.Controls() || !b.Controls() {
+		t.Fatalf("leases cannot steer an idle connection")
+	}
+	if !a.Claim() {
+		t.Fatalf("a could not claim a free turn")
+	}
+	if b.Claim() || b.Controls() {
+		t.Fatalf("b steers the turn of a")
+	}
+	m.fanOut(a.conn).OnTTS("stop", "")
+	if !b.Claim() || a.Controls() {
+		t.Fatalf("turn not handed on after the reply stopped")
+	}
+	b.Yield()
+	if !a.Claim() {
+		t.Fatalf("a could not claim a yielded turn")
+	}
+	a.Release()
+	if !b.Claim() {
+		t.Fatalf("turn kept by a released lease")
+	}
+}
+
+func TestHandoffRevokesPreviousLease(t *testing.T) {
+	m := NewManager(Options{Policy: PolicyHandoff, IdleTimeout: time.Minute}, nil)
+	defer m.Close()
+
+	var first, second, revoked int
+	a := m.Acquire(testConfig("dev"), sttCounter(&first), func() { revoked++ })
+	a.Start()
+	b := m.Acquire(testConfig("dev"), sttCounter(&second), nil)
+	b.Start()
+	if revoked != 1 {
+		t.Fatalf("revoked=%d, want 1", revoked)
+	}
+	if a.Client() != b.Client() {
+		t.Fatalf("handoff dialed a new client")
+	}
+	m.fanOut(b.conn).OnSTT("hello")
+	if first != 0 || second != 1 {
+		t.Fatalf("first=%d second=%d, want 0 1", first, second)
+	}
+
+	// Releasing the revoked lease must not idle the connection.
+	a.Release()
+	if got := m.Acquire(testConfig("other"), xiaozhi.Callbacks{}, nil); got.Client() == b.Client() {
+		t.Fatalf("unrelated device got the handed off client")
+	}
+	m.mu.Lock()
+	leases := len(b.conn.leases)
+	m.mu.Unlock()
+	if leases != 1 {
+		t.Fatalf("leases=%d, want 1", leases)
+	}
+}
+
+func TestDialGivesPrivateConnection(t *testing.T) {
+	m := NewManager(Options{IdleTimeout: time.Minute}, nil)
+	defer m.Close()
+
+	var first, second int
+	a := m.Dial(testConfig("dev"), sttCounter(&first))
+	b := m.Dial(testConfig("dev"), sttCounter(&second))
+	shared := m.Acquire(testConfig("dev"), xiaozhi.Callbacks{}, nil)
+	if a.Client() == b.Client() || a.Client() == shared.Client() {
+		t.Fatalf("dialed connection is shared")
+	}
+
+	a.Start()
+	b.Start()
+	m.fanOut(a.conn).OnSTT("hello")
+	if first != 1 || second != 0 {
+		t.Fatalf("first=%d second=%d, want 1 0", first, second)
+	}
+
+	a.Release()
+	m.mu.Lock()
+	_, kept := m.dialed[a.conn]
+	m.mu.Unlock()
+	if kept {
+		t.Fatalf("released dialed connection was kept")
+	}
+}
+
+func TestIdleConnectionClosedAfterTimeout(t *testing.T) {
+	m := NewManager(Options{IdleTimeout: 30 * time.Millisecond}, nil)
+	defer m.Close()
+
+	a := m.Acquire(testConfig("dev"), xiaozhi.Callbacks{}, nil)
+	a.Release()
+	b := m.Acquire(testConfig("dev"), xiaozhi.Callbacks{}, nil)
+	if b.Client() != a.Client() {
+		t.Fatalf("connection closed before the idle timeout")
+	}
+	b.Release()
+	time.Sleep(100 * time.Millisecond)
+	c := m.Acquire(testConfig("dev"), xiaozhi.Callbacks{}, nil)
+	if c.Client() == a.Client() {
+		t.Fatalf("idle connection was kept")
+	}
+}
+
+func TestPrewarmedConnectionKeptWhileIdle(t *testing.T) {
+	m := NewManager(Options{}, nil)
+	defer m.Close()
+
+	m.Prewarm(testConfig("dev"))
+	a := m.Acquire(testConfig("dev"), xiaozhi.Callbacks{}, nil)
+	a.Release()
+	b := m.Acquire(testConfig("dev"), xiaozhi.Callbacks{}, nil)
+	if b.Client() != a.Client() {
+		t.Fatalf("pre-warmed connection was closed")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	cases := map[string]Policy{
+		"":          PolicySession,
+		"session":   PolicySession,
+		"share":     PolicyShare,
+		" Handoff ": PolicyHandoff,
+		"bogus":     PolicySession,
+	}
+	for value, want := range cases {
+		if got := ParsePolicy(value); got != want {
+			t.Fatalf("ParsePolicy(%q)=%q, want %q", value, got, want)
+		}
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -22,61 +23,103 @@ import (
 
 	appconfig "github.com/saker-ai/vtuber-server/internal/config"
 	"github.com/saker-ai/vtuber-server/internal/group"
+	"github.com/saker-ai/vtuber-server/internal/media"
 	"github.com/saker-ai/vtuber-server/internal/protocol"
 	"github.com/saker-ai/vtuber-server/internal/session/fsm"
 	"github.com/saker-ai/vtuber-server/internal/storage"
+	"github.com/saker-ai/vtuber-server/internal/upstream"
 	"github.com/saker-ai/vtuber-server/pkg/audio"
 	"github.com/saker-ai/vtuber-server/pkg/xiaozhi"
 )
 
 // Handler represents a handler.
 type Handler struct {
-	logger   *zap.Logger
-	upgrader websocket.Upgrader
-	config   appconfig.Config
-	group    *group.Manager
-	sessions map[string]*session
-	mu       sync.Mutex
+	logger    *zap.Logger
+	upgrader  websocket.Upgrader
+	config    appconfig.Config
+	group     *group.Manager
+	history   storage.HistoryStore
+	sessions  map[string]*session
+	resumable map[string]*session
+	upstream  *upstream.Manager
+	mu        sync.Mutex
 }
 
 type incomingMessage = protocol.ClientCommand
 
 type session struct {
-	conn             *websocket.Conn
-	sendMu           sync.Mutex
-	logger           *zap.Logger
-	xiaozhi          *xiaozhi.Client
-	handler          *Handler
-	clientUID        string
-	confName         string
-	confUID          string
-	live2dModelName  string
-	characterName    string
-	avatar           string
-	historyUID       string
-	llmText          string
-	inConversation   bool
-	ttsActive        bool
-	displaySent      bool
-	frameDuration    int
-	listening        bool
-	audioFormat      string
-	unsupportedAudio bool
-	sampleRate       int
-	channels         int
-	inputSampleRate  int
-	inputChannels    int
-	micPCMBuffer     []int16
-	frameSamples     int
-	ttsBuffer        []byte
-	ttsSampleRate    int
-	ttsChannels      int
-	resampler        *audio.StreamResampler
-	opusEncoder      *audio.OpusEncoder
-	opusScratch      []int16
-	pcmBytesScratch  []byte
-	listenMode       string
-	stateMachine     *fsm.Machine
+	conn              *websocket.Conn
+	sendMu            sync.Mutex
+	readMu            sync.Mutex
+	ctx               context.Context
+	cancel            context.CancelFunc
+	resumeToken       string
+	replay            *replayBuffer
+	detachSeq         uint64
+	closed            bool
+	revoked           bool
+	logger            *zap.Logger
+	xiaozhi           *xiaozhi.Client
+	upstream          *upstream.Lease
+	handler           *Handler
+	clientUID         string
+	confName          string
+	confUID           string
+	live2dModelName   string
+	characterName     string
+	avatar            string
+	historyUID        string
+	historyMu         sync.Mutex
+	titledHistoryUID  string
+	llmText           string
+	displaySent       bool
+	frameDuration     int
+	audioFormat       string
+	unsupportedAudio  bool
+	sampleRate        int
+	channels          int
+	inputSampleRate   int
+	inputChannels     int
+	micPCMBuffer      []int16
+	frameSamples      int
+	ttsBuffer         []byte
+	ttsSampleRate     int
+	ttsChannels       int
+	ttsMu             sync.Mutex
+	ttsJitter         *audio.JitterBuffer
+	ttsJitterRate     int
+	ttsJitterChannels int
+	ttsJitterStop     chan struct{}
+	ttsOutput         *audio.PCMConverter
+	ttsOutputIn       ttsOutputFormat
+	ttsOutputOut      ttsOutputFormat
+	clientOutput      ttsOutputFormat
+	resampler         *audio.StreamResampler
+	opusEncoder       *audio.OpusEncoder
+	opusScratch       []int16
+	pcmBytesScratch   []byte
+	stateMachine      *fsm.Machine
+	watchdog          *fsm.Watchdog
+	tasks             chan func(context.Context)
+	vad               *audio.VAD
+	vadEndPending     bool
+	vadTurnEnded      bool
+	bargeInVAD        *audio.VAD
+	echoCanceller     *audio.EchoCanceller
+	echoRefResampler  *audio.StreamResampler
+	echoRefRate       int
+	echoRefHeld       []int16
+	echoRefPlaying    bool
+	audioProcessor    *media.AudioProcessor
+	micOpus           *micOpusInput
+	binaryAudio       atomic.Bool
+	opusOutput        atomic.Bool
+	ttsOpusPackets    []ttsOpusPacket
+	ttsOpusAligned    bool
+	ttsOgg            *ttsOggStream
+	ttsFrameSeq       uint32
+	micFrameSeq       uint32
+	micFrameSeen      bool
 
 	mcpMu          sync.Mutex
 	mcpWaiters     map[string]chan captureResponse
@@ -95,13 +138,15 @@ type session struct {
 	ttsBytes      int
 	lastTTSLog    time.Time
 
-	listenMu            sync.Mutex
-	listenStartInFlight bool
+	recordMu     sync.Mutex
+	micRecording *pcmRecording
+	ttsRecording *pcmRecording
 }
 
 const (
 	ttsChunkDurationMs = 300
 	micTailSilenceMs   = 360
+	sessionTaskQueue   = 8
 )
 
 type captureResponse struct {
@@ -135,12 +180,14 @@ type mcpContent struct {
 }
 
 // NewHandler executes the newHandler function.
-func NewHandler(logger *zap.Logger, cfg appconfig.Config) *Handler {
-	return &Handler{
-		logger:   logger,
-		config:   cfg,
-		group:    group.NewManager(),
-		sessions: make(map[string]*session),
+func NewHandler(logger *zap.Logger, cfg appconfig.Config, history storage.HistoryStore) *Handler {
+	h := &Handler{
+		logger:    logger,
+		config:    cfg,
+		group:     group.NewManager(),
+		history:   history,
+		sessions:  make(map[string]*session),
+		resumable: make(map[string]*session),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -148,7 +195,22 @@ func NewHandler(logger *zap.Logger, cfg appconfig.Config) *Handler {
 				return true
 			},
 		},
+		upstream: upstream.NewManager(upstream.Options{
+			Policy:      upstream.ParsePolicy(cfg.SystemConfig.Upstream.Policy),
+			IdleTimeout: time.Duration(cfg.SystemConfig.Upstream.IdleSeconds) * time.Second,
+		}, logger),
+	}
+	for _, deviceID := range cfg.SystemConfig.Upstream.PrewarmDeviceIDs {
+		if deviceID != "" {
+			h.upstream.Prewarm(h.xiaozhiConfig(deviceID, deviceID))
+		}
 	}
+	return h
+}
+
+// Close closes the upstream connections.
+func (h *Handler) Close() {
+	h.upstream.Close()
 }
 
 // Handle executes the handle method.
@@ -160,26 +222,25 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	sess := h.resumeSession(r.URL.Query().Get("resume_token"), conn)
+	if sess == nil {
+		deviceID := ""
+		if h.config.SystemConfig.Upstream.AllowClientDeviceID {
+			deviceID = r.URL.Query().Get("device_id")
+		}
+		sess = h.newSession(conn, deviceID)
+	}
+	h.serve(sess, conn)
+}
 
+// newSession sets up a session for conn on the XiaoZhi connection of
+// deviceID, or of the configured device when empty. Unless the client asked
+// for a device or the upstream policy shares connections, the session dials
+// a connection of its own.
+func (h *Handler) newSession(conn *websocket.Conn, deviceID string) *session {
+	ctx, cancel := context.WithCancel(context.Background())
 	sessionID := fmt.Sprintf("%d", time.Now().UnixNano())
-	xzCfg := xiaozhi.Config{
-		BackendURL:      h.config.XiaoZhiBackendURL,
-		ProtocolVersion: h.config.XiaoZhiProtocolVersion,
-		AudioParams: xiaozhi.AudioParams{
-			Format:        h.config.XiaoZhiAudioFormat,
-			OutputFormat:  h.config.XiaoZhiOutputFormat,
-			SampleRate:    h.config.XiaoZhiSampleRate,
-			Channels:      h.config.XiaoZhiChannels,
-			FrameDuration: h.config.XiaoZhiFrameDuration,
-		},
-		ListenMode:  h.config.XiaoZhiListenMode,
-		DeviceID:    fallbackID(h.config.XiaoZhiDeviceID, "mio-device-"+sessionID),
-		ClientID:    fallbackID(h.config.XiaoZhiClientID, "mio-client-"+sessionID),
-		AccessToken: h.config.XiaoZhiAccessToken,
-		FeatureAEC:  h.config.XiaoZhiFeatureAEC,
-	}
+	xzCfg := h.xiaozhiConfig(deviceID, sessionID)
 
 	sess := &session{
 		conn:            conn,
@@ -198,13 +259,16 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 		inputSampleRate: h.config.XiaoZhiSampleRate,
 		inputChannels:   h.config.XiaoZhiChannels,
 		frameSamples:    h.config.XiaoZhiSampleRate * h.config.XiaoZhiFrameDuration / 1000,
-		listenMode:      h.config.XiaoZhiListenMode,
+		ctx:             ctx,
+		cancel:          cancel,
 		stateMachine:    fsm.New(),
+		tasks:           make(chan func(context.Context), sessionTaskQueue),
 		mcpWaiters:      make(map[string]chan captureResponse),
 		deviceID:        xzCfg.DeviceID,
 		clientID:        xzCfg.ClientID,
 	}
-	sess.stateMachine.SetMode(sess.listenMode)
+	sess.stateMachine.SetMode(h.config.XiaoZhiListenMode)
+	sess.stateMachine.Subscribe(sess.sendSessionState)
 	if sess.audioFormat == "opus" {
 		if enc, err := audio.AcquireOpusEncoder(sess.sampleRate, sess.channels, sess.frameDuration); err != nil {
 			sess.logger.Warn("opus encoder init failed", zap.Error(err))
@@ -212,6 +276,9 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 			sess.opusEncoder = enc
 		}
 	}
+	sess.initEchoCanceller()
+	sess.audioProcessor = media.NewAudioProcessor(h.config.SystemConfig.AudioProcessing)
+	h.makeResumable(sess)
 
 	sess.logger.Info("ws session opened",
 		zap.String("session_id", sess.clientUID),
@@ -221,10 +288,12 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 		zap.Int("sample_rate", sess.sampleRate),
 		zap.Int("channels", sess.channels),
 		zap.Int("frame_duration", sess.frameDuration),
+		zap.Bool("resumable", sess.resumeToken != ""),
 	)
 
 	h.registerSession(sess)
 	sess.sendModelAndConf()
+	sess.sendSessionState(sess.currentSessionState(""))
 
 	callbacks := xiaozhi.Callbacks{
 		OnSTT: func(text string) {
@@ -233,6 +302,7 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 				zap.Int("chars", len(text)),
 			)
 			sess.sendJSON(map[string]any{"type": "user-input-transcription", "text": text})
+			sess.recordHumanTurn(text)
 		},
 		OnLLM: func(text string, state string) {
 			sess.logger.Debug("xiaozhi llm",
@@ -249,8 +319,10 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 				zap.Int("chars", len(text)),
 			)
 			sess.ensureConversation()
+			sess.ttsMu.Lock()
 			sess.llmText = text
-			sess.sendJSON(map[string]any{"type": "full-text", "text": sess.llmText})
+			sess.ttsMu.Unlock()
+			sess.sendJSON(map[string]any{"type": "full-text", "text": text})
 		},
 		OnTTS: func(state string, text string) {
 			sess.logger.Debug("xiaozhi tts",
@@ -276,7 +348,7 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 		},
 		OnConnected: func() {
 			// Re-establish local state after reconnect.
-			sess.setListening(false)
+			sess.stopListening()
 			mode := sess.getListenMode()
 			if mode == "manual" {
 				sess.logger.Info("xiaozhi reconnected, manual mode waits for mic trigger",
@@ -287,7 +359,7 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 			sess.ensureListening(ctx, "reconnect")
 		},
 		OnDisconnected: func(err error) {
-			sess.setListening(false)
+			sess.stopListening()
 			sess.logger.Warn("xiaozhi disconnected, reset local listen state",
 				zap.String("session_id", sess.clientUID),
 				zap.Error(err),
@@ -298,40 +370,111 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	sess.xiaozhi = xiaozhi.NewClient(xzCfg, callbacks, h.logger)
-	sess.xiaozhi.Connect(ctx)
+	if deviceID != "" || h.upstream.Policy() != upstream.PolicySession {
+		sess.upstream = h.upstream.Acquire(xzCfg, callbacks, sess.revokeUpstream)
+	} else {
+		sess.upstream = h.upstream.Dial(xzCfg, callbacks)
+	}
+	sess.xiaozhi = sess.upstream.Client()
+	sess.upstream.Start()
+	sess.startWatchdog()
+	return sess
+}
+
+// serve reads client messages from conn until it closes, then detaches the
+// session from it. Tasks posted to the session run in between messages.
+func (h *Handler) serve(sess *session, conn *websocket.Conn) {
+	// A resumed session waits for the read loop of the socket it replaced.
+	sess.readMu.Lock()
+	defer sess.readMu.Unlock()
+	ctx := sess.ctx
+	messages := make(chan clientFrame)
+	go readClientFrames(sess, conn, messages)
+	for {
+		select {
+		case frame, ok := <-messages:
+			if !ok {
+				h.detachSession(sess, conn)
+				return
+			}
+			sess.handleClientFrame(ctx, frame)
+		case task := <-sess.tasks:
+			task(ctx)
+		}
+	}
+}
+
+// clientFrame is one websocket message read from the client.
+type clientFrame struct {
+	kind int
+	data []byte
+}
 
+// readClientFrames passes the messages read from conn on to messages and
+// closes it once the connection fails.
+func readClientFrames(sess *session, conn *websocket.Conn, messages chan<- clientFrame) {
+	defer close(messages)
 	for {
-		_, data, err := conn.ReadMessage()
+		kind, data, err := conn.ReadMessage()
 		if err != nil {
 			sess.logger.Debug("ws connection closed", zap.Error(err))
-			break
-		}
-		var msg incomingMessage
-		if err := json.Unmarshal(data, &msg); err != nil {
-			sess.sendJSON(map[string]any{"type": "error", "message": "invalid json"})
-			continue
-		}
-		if msg.Type != "heartbeat" {
-			sess.logger.Debug("ws incoming message",
-				zap.String("session_id", sess.clientUID),
-				zap.String("type", msg.Type),
-			)
+			return
 		}
-		sess.handleIncoming(ctx, msg)
+		messages <- clientFrame{kind: kind, data: data}
 	}
+}
 
-	sess.xiaozhi.Close()
-	if sess.resampler != nil {
-		sess.resampler.Close()
-		sess.resampler = nil
+func (s *session) handleClientFrame(ctx context.Context, frame clientFrame) {
+	if frame.kind == websocket.BinaryMessage {
+		s.handleBinaryMessage(ctx, frame.data)
+		return
+	}
+	var msg incomingMessage
+	if err := json.Unmarshal(frame.data, &msg); err != nil {
+		s.sendJSON(map[string]any{"type": "error", "message": "invalid json"})
+		return
 	}
-	if sess.opusEncoder != nil {
-		audio.ReleaseOpusEncoder(sess.opusEncoder)
-		sess.opusEncoder = nil
+	if msg.Type != "heartbeat" {
+		s.logger.Debug("ws incoming message",
+			zap.String("session_id", s.clientUID),
+			zap.String("type", msg.Type),
+		)
 	}
-	sess.logger.Info("ws session closed", zap.String("session_id", sess.clientUID))
-	h.unregisterSession(sess.clientUID)
+	s.handleIncoming(ctx, msg)
+}
+
+// post queues task to run on the goroutine serving the client, which owns
+// the mic and listen state. While the client is detached the task waits for
+// it to resume. It is dropped when the queue is full.
+func (s *session) post(task func(context.Context)) bool {
+	select {
+	case s.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// close tears the session down for good.
+func (s *session) close() {
+	s.stopWatchdog()
+	s.upstream.Release()
+	s.discardRecordings()
+	s.resetTTSJitter()
+	s.resetTTSOutput()
+	s.closeEchoCanceller()
+	if s.resampler != nil {
+		s.resampler.Close()
+		s.resampler = nil
+	}
+	if s.opusEncoder != nil {
+		audio.ReleaseOpusEncoder(s.opusEncoder)
+		s.opusEncoder = nil
+	}
+	s.cancel()
+	s.logger.Info("ws session closed", zap.String("session_id", s.clientUID))
+	s.handler.forgetResumeToken(s.resumeToken)
+	s.handler.unregisterSession(s.clientUID)
 }
 
 func (s *session) handleIncoming(ctx context.Context, msg incomingMessage) {
@@ -339,57 +482,51 @@ func (s *session) handleIncoming(ctx context.Context, msg incomingMessage) {
 }
 
 func (s *session) getListenMode() string {
-	s.listenMu.Lock()
-	mode := s.listenMode
-	s.listenMu.Unlock()
-	return mode
+	return string(s.stateMachine.Mode())
 }
 
-func (s *session) setListenMode(mode string) {
-	s.listenMu.Lock()
-	s.listenMode = mode
-	s.listenMu.Unlock()
+func (s *session) isListening() bool {
+	return s.stateMachine.Listening()
 }
 
-func (s *session) isListening() bool {
-	s.listenMu.Lock()
-	listening := s.listening
-	s.listenMu.Unlock()
-	return listening
+// stopListening records that the upstream is no longer listening.
+func (s *session) stopListening() {
+	s.logTransition(s.stateMachine.OnListenStop())
 }
 
-func (s *session) setListening(listening bool) {
-	s.listenMu.Lock()
-	s.listening = listening
-	if !listening {
-		s.listenStartInFlight = false
+// logTransition logs a transition the state machine rejected. Rejections
+// are expected when upstream events race each other, so they only show at
+// debug level.
+func (s *session) logTransition(err error) {
+	if err != nil {
+		s.logger.Debug("session state transition rejected",
+			zap.String("session_id", s.clientUID),
+			zap.String("state", string(s.stateMachine.State())),
+			zap.Error(err),
+		)
 	}
-	s.listenMu.Unlock()
 }
 
 func (s *session) ensureListening(ctx context.Context, reason string) bool {
-	s.listenMu.Lock()
-	mode := s.listenMode
-	if s.listening {
-		s.listenMu.Unlock()
+	listening, pending := s.stateMachine.BeginListenStart()
+	if listening {
 		return true
 	}
-	if s.listenStartInFlight {
-		s.listenMu.Unlock()
-		return s.waitListeningStartResult(ctx, mode, reason)
+	if pending {
+		return s.waitListeningStartResult(ctx, reason)
+	}
+	if !s.upstream.Controls() {
+		s.logTransition(s.stateMachine.EndListenStart(false))
+		s.logger.Debug("xiaozhi listen start skipped, turn owned by another session",
+			zap.String("session_id", s.clientUID),
+			zap.String("reason", reason),
+		)
+		return false
 	}
-	s.listenStartInFlight = true
-	s.listenMu.Unlock()
 
 	err := s.xiaozhi.SendListenState(ctx, "start")
-
-	s.listenMu.Lock()
-	s.listenStartInFlight = false
-	if err == nil {
-		s.listening = true
-	}
-	mode = s.listenMode
-	s.listenMu.Unlock()
+	s.logTransition(s.stateMachine.EndListenStart(err == nil))
+	mode := s.getListenMode()
 
 	if err != nil {
 		s.logger.Warn("xiaozhi listen start failed",
@@ -400,7 +537,6 @@ func (s *session) ensureListening(ctx context.Context, reason string) bool {
 		)
 		return false
 	}
-	s.stateMachine.OnListenStart()
 	s.logger.Info("xiaozhi listen start",
 		zap.String("session_id", s.clientUID),
 		zap.String("mode", mode),
@@ -409,18 +545,15 @@ func (s *session) ensureListening(ctx context.Context, reason string) bool {
 	return true
 }
 
-func (s *session) waitListeningStartResult(ctx context.Context, mode string, reason string) bool {
+func (s *session) waitListeningStartResult(ctx context.Context, reason string) bool {
 	timer := time.NewTimer(300 * time.Millisecond)
 	defer timer.Stop()
 	ticker := time.NewTicker(10 * time.Millisecond)
 	defer ticker.Stop()
 
 	for {
-		s.listenMu.Lock()
-		listening := s.listening
-		inFlight := s.listenStartInFlight
-		mode = s.listenMode
-		s.listenMu.Unlock()
+		listening, inFlight := s.stateMachine.ListenStatus()
+		mode := s.getListenMode()
 
 		if listening {
 			return true
@@ -482,16 +615,21 @@ func (s *session) handleMicAudioPCM(ctx context.Context, audioPCM string, sample
 
 func (s *session) handleMicEnd(ctx context.Context) {
 	s.flushMicBuffer(ctx, true)
+	s.resetVAD()
 	tailSilenceFrames := s.appendMicTailSilence(ctx)
 	mode := s.getListenMode()
 	shouldStop := mode == "manual"
 	if shouldStop && s.isListening() {
-		if err := s.xiaozhi.SendListenState(ctx, "stop"); err == nil {
+		if !s.upstream.Controls() {
+			s.logger.Debug("xiaozhi listen stop skipped, turn owned by another session",
+				zap.String("session_id", s.clientUID),
+			)
+		} else if err := s.xiaozhi.SendListenState(ctx, "stop"); err == nil {
 			s.logger.Info("xiaozhi listen stop", zap.String("session_id", s.clientUID))
 		} else {
 			s.logger.Warn("xiaozhi listen stop failed", zap.Error(err))
 		}
-		s.setListening(false)
+		s.stopListening()
 	}
 	s.logger.Debug("mic end state",
 		zap.String("session_id", s.clientUID),
@@ -499,7 +637,7 @@ func (s *session) handleMicEnd(ctx context.Context) {
 		zap.Bool("stopped", shouldStop),
 		zap.Bool("listening", s.isListening()),
 		zap.Int("tail_silence_frames", tailSilenceFrames),
-		zap.Int("llm_chars", len(s.llmText)),
+		zap.Int("llm_chars", len(s.replyText())),
 	)
 	s.logger.Info("mic audio end",
 		zap.String("session_id", s.clientUID),
@@ -512,9 +650,9 @@ func (s *session) handleMicEnd(ctx context.Context) {
 	)
 	s.micChunkCount = 0
 	s.micBytes = 0
-	s.stateMachine.OnAudioCommit()
+	s.logTransition(s.stateMachine.OnAudioCommit())
 	s.ensureConversation()
-	if s.llmText == "" {
+	if s.replyText() == "" {
 		s.sendJSON(map[string]any{"type": "full-text", "text": "Thinking..."})
 	}
 }
@@ -534,9 +672,14 @@ func (s *session) handleSetListenMode(mode string) {
 				zap.String("mode", mode),
 			)
 		}
-		s.setListenMode(mode)
 		s.stateMachine.SetMode(mode)
-		s.xiaozhi.SetListenMode(mode)
+		s.resetVAD()
+		if s.upstream.Controls() {
+			s.xiaozhi.SetListenMode(mode)
+		}
+		if prevMode != mode {
+			s.sendSessionState(s.currentSessionState("mode_change"))
+		}
 	default:
 		s.logger.Warn("invalid listen mode",
 			zap.String("session_id", s.clientUID),
@@ -549,6 +692,9 @@ func (s *session) handleMicPCMBytes(ctx context.Context, pcm []byte, sampleRate
 	if len(pcm) == 0 {
 		return
 	}
+	if !s.upstream.Claim() {
+		return
+	}
 	if !s.ensureListening(ctx, "mic-audio") {
 		return
 	}
@@ -611,7 +757,7 @@ func (s *session) handleMicPCMBytes(ctx context.Context, pcm []byte, sampleRate
 
 	if inputRate != s.sampleRate {
 		if s.resampler == nil {
-			res, err := audio.NewStreamResampler(inputRate, s.sampleRate)
+			res, err := audio.NewStreamResamplerWithOptions(inputRate, s.sampleRate, s.resamplerOptions(false))
 			if err != nil {
 				s.logger.Warn("resampler init failed", zap.Error(err))
 			} else {
@@ -628,11 +774,27 @@ func (s *session) handleMicPCMBytes(ctx context.Context, pcm []byte, sampleRate
 			return
 		}
 		s.processResampledFrames(ctx, false)
+		s.finishVADTurn(ctx)
 		return
 	}
 
 	s.appendPCMBuffer(pcm)
 	s.processPCMFrames(ctx, false)
+	s.finishVADTurn(ctx)
+}
+
+// resamplerOptions returns the configured resampler settings for mic audio,
+// or for TTS audio when tts is set.
+func (s *session) resamplerOptions(tts bool) audio.ResamplerOptions {
+	cfg := s.handler.config.SystemConfig.Resampler
+	quality := cfg.MicQuality
+	if tts {
+		quality = cfg.TTSQuality
+	}
+	return audio.ResamplerOptions{
+		Algorithm: audio.ResamplerAlgorithm(cfg.Algorithm),
+		Quality:   audio.ResamplerQuality(quality),
+	}
 }
 
 func (s *session) processResampledFrames(ctx context.Context, flush bool) {
@@ -651,13 +813,13 @@ func (s *session) processResampledFrames(ctx context.Context, flush bool) {
 		if !ok {
 			break
 		}
-		s.sendPCMFrame(ctx, frame)
+		s.forwardMicFrame(ctx, frame)
 		audio.ReleaseInt16(frame)
 		framesSent++
 	}
 	if flush {
 		if frame := s.resampler.PopRemainderPadded(frameSize); frame != nil {
-			s.sendPCMFrame(ctx, frame)
+			s.forwardMicFrame(ctx, frame)
 			audio.ReleaseInt16(frame)
 			framesSent++
 		}
@@ -685,13 +847,13 @@ func (s *session) processPCMFrames(ctx context.Context, flush bool) {
 	for len(s.micPCMBuffer) >= frameSize {
 		frame := s.micPCMBuffer[:frameSize]
 		s.micPCMBuffer = s.micPCMBuffer[frameSize:]
-		s.sendPCMFrame(ctx, frame)
+		s.forwardMicFrame(ctx, frame)
 		framesSent++
 	}
 	if flush && len(s.micPCMBuffer) > 0 {
 		frame := s.micPCMBuffer
 		s.micPCMBuffer = nil
-		s.sendPCMFrame(ctx, frame)
+		s.forwardMicFrame(ctx, frame)
 		framesSent++
 	}
 	if framesSent > 0 {
@@ -706,6 +868,7 @@ func (s *session) sendPCMFrame(ctx context.Context, frame []int16) {
 	if len(frame) == 0 {
 		return
 	}
+	s.recordMicFrame(frame, s.sampleRate, s.channels)
 	if s.audioFormat == "opus" {
 		if s.opusEncoder != nil {
 			frameBytes := audio.Int16SliceToBytesInto(s.pcmBytesScratch, frame)
@@ -827,12 +990,14 @@ func (s *session) handleConfigSwitch(ctx context.Context, filename string) {
 		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
 		return
 	}
+	s.historyMu.Lock()
 	s.confName = conf.ConfName
 	s.confUID = conf.ConfUID
 	s.live2dModelName = conf.Live2dModelName
 	s.characterName = conf.CharacterName
 	s.avatar = conf.Avatar
 	s.historyUID = ""
+	s.historyMu.Unlock()
 
 	s.sendModelAndConf()
 	s.sendJSON(map[string]any{"type": "config-switched"})
@@ -847,31 +1012,46 @@ func (s *session) handleInitConfig(ctx context.Context) {
 	s.sendModelAndConf()
 }
 
-func (s *session) handleHistoryList(ctx context.Context) {
-	histories := storage.GetHistoryList(s.handler.config.ChatHistoryDir, s.confUID)
-	s.sendJSON(map[string]any{"type": "history-list", "histories": histories})
+func (s *session) handleHistoryList(ctx context.Context, offset int, limit int) {
+	if limit <= 0 && offset <= 0 {
+		histories := s.handler.history.GetHistoryList(s.confUID)
+		s.sendJSON(map[string]any{"type": "history-list", "histories": histories})
+		return
+	}
+	histories, total, err := s.handler.history.GetHistoryPage(s.confUID, offset, limit)
+	if err != nil {
+		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
+		return
+	}
+	s.sendJSON(map[string]any{
+		"type":      "history-list",
+		"histories": histories,
+		"total":     total,
+		"offset":    offset,
+		"limit":     limit,
+	})
 }
 
 func (s *session) handleFetchHistory(ctx context.Context, historyUID string) {
 	if historyUID == "" {
 		return
 	}
-	messages, err := storage.GetHistory(s.handler.config.ChatHistoryDir, s.confUID, historyUID)
+	messages, err := s.handler.history.GetHistory(s.confUID, historyUID)
 	if err != nil {
 		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
 		return
 	}
-	s.historyUID = historyUID
+	s.setHistoryUID(historyUID)
 	s.sendJSON(map[string]any{"type": "history-data", "messages": messages})
 }
 
 func (s *session) handleCreateHistory(ctx context.Context) {
-	historyUID, err := storage.CreateHistory(s.handler.config.ChatHistoryDir, s.confUID)
+	historyUID, err := s.handler.history.CreateHistory(s.confUID)
 	if err != nil {
 		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
 		return
 	}
-	s.historyUID = historyUID
+	s.setHistoryUID(historyUID)
 	s.sendJSON(map[string]any{"type": "new-history-created", "history_uid": historyUID})
 }
 
@@ -879,13 +1059,113 @@ func (s *session) handleDeleteHistory(ctx context.Context, historyUID string) {
 	if historyUID == "" {
 		return
 	}
-	success := storage.DeleteHistory(s.handler.config.ChatHistoryDir, s.confUID, historyUID)
+	success := s.handler.history.DeleteHistory(s.confUID, historyUID)
 	s.sendJSON(map[string]any{"type": "history-deleted", "success": success, "history_uid": historyUID})
-	if success && s.historyUID == historyUID {
-		s.historyUID = ""
+	if success {
+		s.clearHistoryUID(historyUID)
+		if dir := s.handler.config.RecordingsDir; dir != "" {
+			if err := storage.RemoveRecordings(dir, s.confUID, historyUID); err != nil {
+				s.logger.Warn("remove history recordings failed",
+					zap.String("session_id", s.clientUID),
+					zap.String("history_uid", historyUID),
+					zap.Error(err),
+				)
+			}
+		}
 	}
 }
 
+func (s *session) handleSearchHistory(ctx context.Context, query string, limit int) {
+	searcher, ok := s.handler.history.(storage.HistorySearcher)
+	if !ok {
+		s.sendJSON(map[string]any{"type": "error", "message": "history search is not supported by this store"})
+		return
+	}
+	results, err := searcher.SearchHistories(s.confUID, query, limit)
+	if err != nil {
+		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
+		return
+	}
+	s.sendJSON(map[string]any{"type": "history-search-results", "query": query, "results": results})
+}
+
+func (s *session) handleRenameHistory(ctx context.Context, historyUID string, title string) {
+	s.handleUpdateHistoryMeta(ctx, historyUID, "history-renamed", func(meta *storage.HistoryMeta) {
+		meta.Title = title
+	})
+}
+
+func (s *session) handlePinHistory(ctx context.Context, historyUID string, pinned bool) {
+	s.handleUpdateHistoryMeta(ctx, historyUID, "history-pinned", func(meta *storage.HistoryMeta) {
+		meta.Pinned = pinned
+	})
+}
+
+func (s *session) handleTagHistory(ctx context.Context, historyUID string, tags []string) {
+	s.handleUpdateHistoryMeta(ctx, historyUID, "history-tagged", func(meta *storage.HistoryMeta) {
+		meta.Tags = tags
+	})
+}
+
+// handleUpdateHistoryMeta applies update to a history's metadata and replies
+// with respType and the resulting title, pinned flag and tags.
+func (s *session) handleUpdateHistoryMeta(ctx context.Context, historyUID string, respType string, update func(*storage.HistoryMeta)) {
+	if historyUID == "" {
+		return
+	}
+	meta, err := s.handler.history.UpdateHistoryMeta(s.confUID, historyUID, update)
+	if err != nil {
+		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
+		return
+	}
+	tags := meta.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	s.sendJSON(map[string]any{
+		"type":        respType,
+		"history_uid": historyUID,
+		"title":       meta.Title,
+		"pinned":      meta.Pinned,
+		"tags":        tags,
+	})
+}
+
+// handleExportHistory exports one history, or every history of the current
+// conf when historyUID is empty.
+func (s *session) handleExportHistory(ctx context.Context, historyUID string, format string) {
+	format, err := storage.ParseFormat(format)
+	if err != nil {
+		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
+		return
+	}
+	var data []byte
+	if historyUID != "" {
+		data, err = storage.ExportHistory(s.handler.history, s.confUID, historyUID, format)
+	} else {
+		data, err = storage.ExportConf(s.handler.history, s.confUID, format)
+	}
+	if err != nil {
+		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
+		return
+	}
+	s.sendJSON(map[string]any{
+		"type":        "history-exported",
+		"history_uid": historyUID,
+		"format":      format,
+		"content":     string(data),
+	})
+}
+
+func (s *session) handleImportHistory(ctx context.Context, format string, content string) {
+	uids, err := storage.ImportHistories(s.handler.history, s.confUID, format, []byte(content))
+	if err != nil {
+		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
+		return
+	}
+	s.sendJSON(map[string]any{"type": "history-imported", "history_uids": uids})
+}
+
 func (s *session) handleGroupInfo(ctx context.Context) {
 	s.handler.sendGroupUpdate(s.clientUID)
 }
@@ -913,30 +1193,56 @@ func (s *session) handleRemoveFromGroup(ctx context.Context, targetUID string) {
 }
 
 func (s *session) ensureConversation() {
-	if s.inConversation {
+	if s.stateMachine.InConversation() {
 		return
 	}
-	s.inConversation = true
+	s.ttsMu.Lock()
 	s.llmText = ""
 	s.ttsBuffer = nil
 	s.ttsSampleRate = 0
 	s.ttsChannels = 0
-	s.stateMachine.OnConversationStart()
+	s.ttsMu.Unlock()
+	s.logTransition(s.stateMachine.OnConversationStart())
 	s.sendJSON(map[string]any{"type": "control", "text": "conversation-chain-start"})
 }
 
 func (s *session) endConversation() {
-	if !s.inConversation {
+	s.endConversationTo(fsm.StateIdle, "conversation_end")
+}
+
+// endConversationTo ends the conversation and leaves the state machine in
+// state, recording reason.
+func (s *session) endConversationTo(state fsm.State, reason string) {
+	if !s.stateMachine.InConversation() {
 		return
 	}
-	s.inConversation = false
-	s.ttsActive = false
+	s.recordAITurn(s.replyText())
+	_ = s.stateMachine.ForceWithReason(state, reason)
+	s.resetEchoCanceller()
+	s.clearConversation()
+}
+
+// endConversationOnTTSStop ends the conversation once TTS is done, leaving
+// the state machine where the listen mode says a finished reply goes.
+func (s *session) endConversationOnTTSStop() {
+	if !s.stateMachine.InConversation() {
+		return
+	}
+	s.recordAITurn(s.replyText())
+	s.logTransition(s.stateMachine.OnTTSStop())
+	s.clearConversation()
+}
+
+func (s *session) clearConversation() {
+	s.resetTTSJitter()
+	s.resetTTSOutput()
+	s.ttsMu.Lock()
 	s.displaySent = false
 	s.llmText = ""
 	s.ttsBuffer = nil
 	s.ttsSampleRate = 0
 	s.ttsChannels = 0
-	_ = s.stateMachine.Force(fsm.StateIdle)
+	s.ttsMu.Unlock()
 	s.sendJSON(map[string]any{"type": "control", "text": "conversation-chain-end"})
 }
 
@@ -947,12 +1253,13 @@ func (s *session) handleTTS(ctx context.Context, state string, text string) {
 			return
 		}
 		s.ensureConversation()
-		s.llmText += text
-		s.sendJSON(map[string]any{"type": "full-text", "text": s.llmText})
+		s.appendReplyText(text)
 	case "start":
 		s.ensureConversation()
-		s.stateMachine.OnTTSStart()
-		s.ttsActive = true
+		s.logTransition(s.stateMachine.OnTTSStart())
+		s.resetTTSJitter()
+		s.resetTTSOutput()
+		s.ttsMu.Lock()
 		s.displaySent = false
 		s.ttsBuffer = nil
 		s.ttsSampleRate = 0
@@ -960,15 +1267,16 @@ func (s *session) handleTTS(ctx context.Context, state string, text string) {
 		s.ttsChunkCount = 0
 		s.ttsBytes = 0
 		s.lastTTSLog = time.Now()
+		s.ttsMu.Unlock()
 		s.logger.Info("tts start", zap.String("session_id", s.clientUID))
-		if s.llmText == "" {
+		if s.replyText() == "" {
 			s.sendJSON(map[string]any{"type": "full-text", "text": "Thinking..."})
 		}
 	case "stop":
-		s.ttsActive = false
-		s.stateMachine.OnTTSStop()
+		s.ttsMu.Lock()
 		s.flushTTSAudio(true)
-		s.sendJSON(map[string]any{"type": "backend-synth-complete"})
+		s.flushTTSJitter()
+		s.finishTTSOgg()
 		s.logger.Info("tts stop",
 			zap.String("session_id", s.clientUID),
 			zap.Int("chunks", s.ttsChunkCount),
@@ -976,29 +1284,56 @@ func (s *session) handleTTS(ctx context.Context, state string, text string) {
 			zap.Int("sample_rate", s.ttsSampleRate),
 			zap.Int("channels", s.ttsChannels),
 		)
+		s.ttsMu.Unlock()
+		s.sendJSON(map[string]any{"type": "backend-synth-complete"})
+		s.endConversationOnTTSStop()
 		if s.getListenMode() == "auto" && !s.isListening() {
 			s.ensureListening(ctx, "tts-stop-auto")
 		}
-		s.endConversation()
 	}
 }
 
 func (s *session) applyLLMText(text string, state string) {
 	if state == "stream" {
-		s.llmText += text
-	} else {
-		s.llmText = text
+		s.appendReplyText(text)
+		return
 	}
-	s.sendJSON(map[string]any{"type": "full-text", "text": s.llmText})
+	s.ttsMu.Lock()
+	s.llmText = text
+	s.ttsMu.Unlock()
+	s.sendJSON(map[string]any{"type": "full-text", "text": text})
+}
+
+// appendReplyText adds text to the reply and shows the client all of it.
+func (s *session) appendReplyText(text string) {
+	s.ttsMu.Lock()
+	s.llmText += text
+	full := s.llmText
+	s.ttsMu.Unlock()
+	s.sendJSON(map[string]any{"type": "full-text", "text": full})
+}
+
+// replyText returns the reply text so far. Like displaySent, llmText is
+// guarded by ttsMu because the jitter ticker reads it while sending audio.
+func (s *session) replyText() string {
+	s.ttsMu.Lock()
+	defer s.ttsMu.Unlock()
+	return s.llmText
 }
 
 func (s *session) handleAudio(frame xiaozhi.AudioFrame) {
-	if !s.ttsActive {
+	s.ttsMu.Lock()
+	defer s.ttsMu.Unlock()
+	if !s.stateMachine.Speaking() {
 		return
 	}
 	if len(frame.PCM) == 0 {
 		return
 	}
+	s.recordTTSAudio(frame.PCM, frame.SampleRate, frame.Channels)
+	if s.pushTTSJitter(frame) {
+		return
+	}
 	if s.ttsSampleRate == 0 {
 		s.ttsSampleRate = frame.SampleRate
 		s.ttsChannels = frame.Channels
@@ -1007,11 +1342,15 @@ func (s *session) handleAudio(frame xiaozhi.AudioFrame) {
 		s.ttsSampleRate = frame.SampleRate
 		s.ttsChannels = frame.Channels
 	}
+	s.queueTTSOpus(frame)
 	s.ttsBuffer = append(s.ttsBuffer, frame.PCM...)
 	s.flushTTSAudio(false)
 }
 
 func (s *session) flushTTSAudio(final bool) {
+	if final {
+		defer s.flushTTSOutput()
+	}
 	if len(s.ttsBuffer) == 0 {
 		return
 	}
@@ -1028,19 +1367,72 @@ func (s *session) flushTTSAudio(final bool) {
 	if chunkBytes <= 0 {
 		return
 	}
-	for len(s.ttsBuffer) >= chunkBytes {
-		chunk := s.ttsBuffer[:chunkBytes]
-		s.ttsBuffer = s.ttsBuffer[chunkBytes:]
-		s.sendAudioChunk(chunk, sampleRate, channels)
+	for {
+		n, packets := s.nextTTSChunk(chunkBytes, final)
+		if n <= 0 {
+			break
+		}
+		chunk := s.ttsBuffer[:n]
+		s.ttsBuffer = s.ttsBuffer[n:]
+		s.sendTTSChunk(chunk, packets, sampleRate, channels)
 	}
-	if final && len(s.ttsBuffer) > 0 {
-		chunk := s.ttsBuffer
+	if final {
 		s.ttsBuffer = nil
-		s.sendAudioChunk(chunk, sampleRate, channels)
 	}
 }
 
-func (s *session) sendAudioChunk(pcm []byte, sampleRate int, channels int) {
+// nextTTSChunk returns the byte length of the next chunk to send and, when
+// the buffer is backed by upstream Opus packets, the packets covering it.
+// Packet-backed chunks end on a packet boundary.
+func (s *session) nextTTSChunk(chunkBytes int, final bool) (int, [][]byte) {
+	if s.ttsOpusAligned && len(s.ttsOpusPackets) > 0 {
+		size, count := 0, 0
+		for count < len(s.ttsOpusPackets) && size < chunkBytes {
+			size += s.ttsOpusPackets[count].pcmBytes
+			count++
+		}
+		if size < chunkBytes && !final {
+			return 0, nil
+		}
+		if size <= len(s.ttsBuffer) {
+			packets := make([][]byte, count)
+			for i := range packets {
+				packets[i] = s.ttsOpusPackets[i].data
+			}
+			s.ttsOpusPackets = s.ttsOpusPackets[count:]
+			return size, packets
+		}
+		s.ttsOpusAligned = false
+		s.ttsOpusPackets = nil
+	}
+	if len(s.ttsBuffer) >= chunkBytes {
+		return chunkBytes, nil
+	}
+	if final {
+		return len(s.ttsBuffer), nil
+	}
+	return 0, nil
+}
+
+// sendAudioChunk sends a TTS chunk as PCM, or into the reply's Ogg Opus
+// stream when the client asked for Opus. The caller holds ttsMu.
+func (s *session) sendAudioChunk(pcm []byte, packets [][]byte, sampleRate int, channels int) {
+	if s.opusOutput.Load() {
+		err := s.sendOggChunk(pcm, packets, sampleRate, channels)
+		if err == nil {
+			return
+		}
+		s.logger.Debug("tts opus output failed, sending pcm",
+			zap.String("session_id", s.clientUID),
+			zap.Error(err),
+		)
+	}
+	s.sendAudioPayload(pcm, pcm, protocol.AudioCodecPCM16, sampleRate, channels)
+}
+
+// sendAudioPayload sends data, the encoding of pcm in codec, with the
+// lip-sync volumes of pcm.
+func (s *session) sendAudioPayload(pcm []byte, data []byte, codec protocol.AudioCodec, sampleRate int, channels int) {
 	sliceLength := s.frameDuration
 	if sampleRate > 0 && channels > 0 {
 		frames := (len(pcm) / 2) / channels
@@ -1051,10 +1443,10 @@ func (s *session) sendAudioChunk(pcm []byte, sampleRate int, channels int) {
 	if sliceLength <= 0 {
 		sliceLength = s.frameDuration
 	}
+	s.feedEchoReference(pcm, sampleRate, channels)
 	volumes := computeVolumes(pcm, sampleRate, channels, sliceLength)
 	payload := map[string]any{
 		"type":              "audio",
-		"audio_pcm":         base64.StdEncoding.EncodeToString(pcm),
 		"audio_format":      "pcm16",
 		"audio_sample_rate": sampleRate,
 		"audio_channels":    channels,
@@ -1067,7 +1459,23 @@ func (s *session) sendAudioChunk(pcm []byte, sampleRate int, channels int) {
 	if s.displaySent {
 		payload["display_text"] = nil
 	}
-	s.sendJSON(payload)
+	if codec == protocol.AudioCodecOggOpus {
+		payload["audio_format"] = "opus"
+		payload["audio_container"] = "ogg"
+	}
+	if s.binaryAudio.Load() {
+		s.ttsFrameSeq++
+		payload["audio_seq"] = s.ttsFrameSeq
+		s.sendJSON(payload)
+		s.sendAudioFrame(protocol.AudioStreamTTS, codec, s.ttsFrameSeq, data, sampleRate, channels)
+	} else {
+		if codec == protocol.AudioCodecOggOpus {
+			payload["audio_opus"] = base64.StdEncoding.EncodeToString(data)
+		} else {
+			payload["audio_pcm"] = base64.StdEncoding.EncodeToString(data)
+		}
+		s.sendJSON(payload)
+	}
 	s.displaySent = true
 	s.ttsChunkCount++
 	s.ttsBytes += len(pcm)
@@ -1098,10 +1506,15 @@ func (s *session) buildDisplayText() map[string]any {
 }
 
 func (s *session) sendModelAndConf() {
+	s.sendJSON(s.modelAndConf())
+}
+
+// modelAndConf builds the set-model-and-conf message, or an error message
+// when the model cannot be loaded.
+func (s *session) modelAndConf() map[string]any {
 	modelInfo, err := appconfig.LoadModelInfo(s.live2dModelName, s.handler.config.ModelDictPath)
 	if err != nil {
-		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
-		return
+		return map[string]any{"type": "error", "message": err.Error()}
 	}
 	payload := map[string]any{
 		"type":       "set-model-and-conf",
@@ -1110,7 +1523,10 @@ func (s *session) sendModelAndConf() {
 		"conf_uid":   s.confUID,
 		"client_uid": s.clientUID,
 	}
-	s.sendJSON(payload)
+	if s.resumeToken != "" {
+		payload["resume_token"] = s.resumeToken
+	}
+	return payload
 }
 
 func (s *session) handleMCP(ctx context.Context, payload json.RawMessage) {
@@ -1427,11 +1843,12 @@ func mcpErrorResult(message string) mcpResult {
 }
 
 func (s *session) sendJSON(payload any) {
-	s.sendMu.Lock()
-	defer s.sendMu.Unlock()
-	if err := s.conn.WriteJSON(payload); err != nil {
+	data, err := json.Marshal(payload)
+	if err != nil {
 		s.logger.Debug("ws send failed", zap.Error(err))
+		return
 	}
+	s.writeMessage(websocket.TextMessage, data)
 }
 
 func fallbackID(value string, fallback string) string {
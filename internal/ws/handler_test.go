@@ -0,0 +1,474 @@
+package ws
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	appconfig "github.com/saker-ai/vtuber-server/internal/config"
+	"github.com/saker-ai/vtuber-server/internal/storage"
+	xzcodec "github.com/saker-ai/vtuber-server/internal/transport/xiaozhi/codec"
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+)
+
+// testTimeout bounds every wait; the first Opus encoder can take seconds
+// to set up under the race detector.
+const testTimeout = 10 * time.Second
+
+// fakeBackend is a XiaoZhi server that acknowledges hello and answers a
+// text listen message with the stt event for its text, followed by a short
+// spoken reply when the text is "speak". Abort stops the reply and is
+// counted.
+type fakeBackend struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	conns   []*websocket.Conn
+	devices []string
+	aborts  int
+	writeMu sync.Mutex
+}
+
+func newFakeBackend(t *testing.T) *fakeBackend {
+	t.Helper()
+	b := &fakeBackend{}
+	upgrader := websocket.Upgrader{}
+	b.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b.mu.Lock()
+		b.conns = append(b.conns, conn)
+		b.devices = append(b.devices, r.Header.Get("Device-Id"))
+		id := len(b.conns)
+		b.mu.Unlock()
+		version := 1
+		var stop chan struct{}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg struct {
+				Type    string `json:"type"`
+				State   string `json:"state"`
+				Text    string `json:"text"`
+				Version int    `json:"version"`
+			}
+			if json.Unmarshal(data, &msg) != nil {
+				continue
+			}
+			switch {
+			case msg.Type == "hello":
+				version = msg.Version
+				b.write(conn, map[string]any{"type": "hello", "session_id": fmt.Sprintf("xz-%d", id)})
+			case msg.Type == "listen" && msg.State == "detect" && msg.Text != "":
+				b.write(conn, map[string]any{"type": "stt", "text": msg.Text})
+				if msg.Text == "speak" {
+					stop = make(chan struct{})
+					go b.speak(conn, version, stop)
+				}
+			case msg.Type == "abort":
+				b.mu.Lock()
+				b.aborts++
+				b.mu.Unlock()
+				if stop != nil {
+					close(stop)
+					stop = nil
+				}
+			}
+		}
+	}))
+	t.Cleanup(b.server.Close)
+	return b
+}
+
+func (b *fakeBackend) url() string {
+	return "ws" + strings.TrimPrefix(b.server.URL, "http")
+}
+
+func (b *fakeBackend) write(conn *websocket.Conn, payload any) {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	_ = conn.WriteJSON(payload)
+}
+
+// speak sends a reply of twenty 60 ms Opus packets in one burst, as a
+// backend synthesizing faster than real time does, and stops it a second
+// later or once stop is closed.
+func (b *fakeBackend) speak(conn *websocket.Conn, version int, stop chan struct{}) {
+	enc, err := audio.NewOpusEncoder(16000, 1, 60)
+	if err != nil {
+		return
+	}
+	defer enc.Close()
+	b.write(conn, map[string]any{"type": "tts", "state": "start"})
+	b.write(conn, map[string]any{"type": "tts", "state": "sentence_start", "text": "hello"})
+	pcm := make([]byte, 960*2)
+	for i := 0; i < 20; i++ {
+		for n := 0; n < 960; n++ {
+			sample := int16(8000 * math.Sin(2*math.Pi*440*float64(i*960+n)/16000))
+			binary.LittleEndian.PutUint16(pcm[n*2:], uint16(sample))
+		}
+		packet, err := enc.Encode(pcm)
+		if err != nil {
+			return
+		}
+		b.writeMu.Lock()
+		err = conn.WriteMessage(websocket.BinaryMessage, xzcodec.Pack(version, packet))
+		b.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	select {
+	case <-time.After(time.Second):
+	case <-stop:
+	}
+	b.write(conn, map[string]any{"type": "tts", "state": "stop"})
+}
+
+// broadcast sends payload on every connection.
+func (b *fakeBackend) broadcast(payload any) {
+	b.mu.Lock()
+	conns := append([]*websocket.Conn(nil), b.conns...)
+	b.mu.Unlock()
+	for _, conn := range conns {
+		b.write(conn, payload)
+	}
+}
+
+func (b *fakeBackend) abortCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.aborts
+}
+
+func (b *fakeBackend) connections() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.devices...)
+}
+
+// newTestHandler serves a handler talking to backend. configure adjusts the
+// config loaded from config/config.yaml.
+func newTestHandler(t *testing.T, backend *fakeBackend, configure func(*appconfig.Config)) (*Handler, string) {
+	t.Helper()
+	cfg, err := appconfig.LoadConfig("../../config/config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	cfg.XiaoZhiBackendURL = backend.url()
+	cfg.XiaoZhiDeviceID = "test-device"
+	cfg.SystemConfig.Recording.Enabled = false
+	cfg.SystemConfig.SessionResume.Enabled = false
+	if configure != nil {
+		configure(&cfg)
+	}
+	dir, err := os.MkdirTemp("", "ws-history-")
+	if err != nil {
+		t.Fatalf("MkdirTemp error: %v", err)
+	}
+	h := NewHandler(zap.NewNop(), cfg, storage.NewFileStore(dir))
+	server := httptest.NewServer(http.HandlerFunc(h.Handle))
+	t.Cleanup(func() {
+		server.Close()
+		// Clients are closed by now; let their sessions wind down.
+		deadline := time.Now().Add(testTimeout)
+		for time.Now().Before(deadline) {
+			h.mu.Lock()
+			open := len(h.sessions)
+			h.mu.Unlock()
+			if open == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		h.Close()
+		// An upstream callback may still be storing a turn, so removal is
+		// best effort.
+		_ = os.RemoveAll(dir)
+	})
+	return h, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// testClient is a browser connection collecting what the server sends.
+type testClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	messages chan map[string]any
+}
+
+func dialTestClient(t *testing.T, url string) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	c := &testClient{t: t, conn: conn, messages: make(chan map[string]any, 256)}
+	go func() {
+		defer close(c.messages)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg map[string]any
+			if json.Unmarshal(data, &msg) == nil {
+				c.messages <- msg
+			}
+		}
+	}()
+	t.Cleanup(func() { _ = conn.Close() })
+	return c
+}
+
+func (c *testClient) send(payload any) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(payload); err != nil {
+		c.t.Fatalf("send: %v", err)
+	}
+}
+
+// next returns the next message of type kind, or nil when none arrives
+// within timeout.
+func (c *testClient) next(kind string, timeout time.Duration) map[string]any {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				return nil
+			}
+			if msg["type"] == kind {
+				return msg
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+func (c *testClient) expect(kind string) map[string]any {
+	c.t.Helper()
+	msg := c.next(kind, testTimeout)
+	if msg == nil {
+		c.t.Fatalf("no %s message", kind)
+	}
+	return msg
+}
+
+// waitListening waits until the session of c is connected upstream and
+// listening, and returns its client UID.
+func waitListening(c *testClient) string {
+	c.t.Helper()
+	uid, _ := waitListeningConf(c)["client_uid"].(string)
+	return uid
+}
+
+// waitListeningConf is waitListening returning the set-model-and-conf
+// message.
+func waitListeningConf(c *testClient) map[string]any {
+	c.t.Helper()
+	conf := c.expect("set-model-and-conf")
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("session %v closed before listening", conf["client_uid"])
+			}
+			if msg["type"] == "session-state" && msg["listening"] == true {
+				return conf
+			}
+		case <-deadline:
+			c.t.Fatalf("session %v never started listening", conf["client_uid"])
+		}
+	}
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionsGetTheirOwnUpstream(t *testing.T) {
+	backend := newFakeBackend(t)
+	_, url := newTestHandler(t, backend, nil)
+
+	a := dialTestClient(t, url)
+	waitListening(a)
+	b := dialTestClient(t, url)
+	waitListening(b)
+
+	a.send(map[string]any{"type": "text-input", "text": "from a"})
+	if got := a.expect("user-input-transcription")["text"]; got != "from a" {
+		t.Fatalf("a transcription=%v, want from a", got)
+	}
+	b.send(map[string]any{"type": "text-input", "text": "from b"})
+	if got := b.expect("user-input-transcription")["text"]; got != "from b" {
+		t.Fatalf("b transcription=%v, want from b", got)
+	}
+	if msg := a.next("user-input-transcription", 300*time.Millisecond); msg != nil {
+		t.Fatalf("a got the event of b: %v", msg)
+	}
+
+	devices := backend.connections()
+	if len(devices) != 2 {
+		t.Fatalf("upstream connections=%d, want 2", len(devices))
+	}
+	for _, device := range devices {
+		if device != "test-device" {
+			t.Fatalf("device=%q, want test-device", device)
+		}
+	}
+}
+
+func TestSharePolicySharesUpstream(t *testing.T) {
+	backend := newFakeBackend(t)
+	_, url := newTestHandler(t, backend, func(cfg *appconfig.Config) {
+		cfg.SystemConfig.Upstream.Policy = "share"
+	})
+
+	a := dialTestClient(t, url)
+	waitListening(a)
+	b := dialTestClient(t, url)
+	waitListening(b)
+
+	a.send(map[string]any{"type": "text-input", "text": "from a"})
+	a.expect("user-input-transcription")
+	if got := b.expect("user-input-transcription")["text"]; got != "from a" {
+		t.Fatalf("b transcription=%v, want from a", got)
+	}
+	if n := len(backend.connections()); n != 1 {
+		t.Fatalf("upstream connections=%d, want 1", n)
+	}
+}
+
+func TestShareLetsOnlyTurnOwnerSteer(t *testing.T) {
+	backend := newFakeBackend(t)
+	_, url := newTestHandler(t, backend, func(cfg *appconfig.Config) {
+		cfg.SystemConfig.Upstream.Policy = "share"
+	})
+
+	a := dialTestClient(t, url)
+	waitListening(a)
+	b := dialTestClient(t, url)
+	waitListening(b)
+
+	a.send(map[string]any{"type": "text-input", "text": "speak"})
+	a.expect("user-input-transcription")
+	b.send(map[string]any{"type": "text-input", "text": "from b"})
+	b.expect("error")
+	b.send(map[string]any{"type": "interrupt-signal"})
+	// The reply of a plays out in both sessions.
+	a.expect("backend-synth-complete")
+	b.expect("backend-synth-complete")
+	if n := backend.abortCount(); n != 0 {
+		t.Fatalf("aborts=%d, want 0", n)
+	}
+
+	b.send(map[string]any{"type": "text-input", "text": "from b"})
+	if got := a.expect("user-input-transcription")["text"]; got != "from b" {
+		t.Fatalf("a transcription=%v, want from b", got)
+	}
+	b.send(map[string]any{"type": "interrupt-signal"})
+	waitFor(t, "the abort of b", func() bool { return backend.abortCount() == 1 })
+}
+
+func TestResumeReplaysMissedMessages(t *testing.T) {
+	backend := newFakeBackend(t)
+	h, url := newTestHandler(t, backend, func(cfg *appconfig.Config) {
+		cfg.SystemConfig.SessionResume.Enabled = true
+		cfg.SystemConfig.SessionResume.GraceSeconds = 1
+	})
+
+	a := dialTestClient(t, url)
+	conf := waitListeningConf(a)
+	token, _ := conf["resume_token"].(string)
+	if token == "" {
+		t.Fatalf("set-model-and-conf has no resume_token: %v", conf)
+	}
+	h.mu.Lock()
+	sess := h.resumable[token]
+	h.mu.Unlock()
+	if sess == nil {
+		t.Fatalf("token %q is not resumable", token)
+	}
+
+	_ = a.conn.Close()
+	waitFor(t, "detach", func() bool {
+		sess.sendMu.Lock()
+		defer sess.sendMu.Unlock()
+		return sess.conn == nil
+	})
+	backend.broadcast(map[string]any{"type": "stt", "text": "while away"})
+	waitFor(t, "the missed message to be buffered", func() bool {
+		sess.sendMu.Lock()
+		defer sess.sendMu.Unlock()
+		for _, msg := range sess.replay.messages {
+			if strings.Contains(string(msg.data), "while away") {
+				return true
+			}
+		}
+		return false
+	})
+
+	b := dialTestClient(t, url+"?resume_token="+token)
+	if uid := b.expect("set-model-and-conf")["client_uid"]; uid != conf["client_uid"] {
+		t.Fatalf("resumed client_uid=%v, want %v", uid, conf["client_uid"])
+	}
+	resumed := b.expect("session-resumed")
+	if n, _ := resumed["replayed"].(float64); n < 1 {
+		t.Fatalf("replayed=%v, want at least 1", resumed["replayed"])
+	}
+	if got := b.expect("user-input-transcription")["text"]; got != "while away" {
+		t.Fatalf("replayed transcription=%v, want while away", got)
+	}
+
+	b.send(map[string]any{"type": "text-input", "text": "back"})
+	if got := b.expect("user-input-transcription")["text"]; got != "back" {
+		t.Fatalf("transcription after resume=%v, want back", got)
+	}
+	if n := len(backend.connections()); n != 1 {
+		t.Fatalf("upstream connections=%d, want 1", n)
+	}
+}
+
+func TestFirstTurnAnnouncesAutoCreatedHistory(t *testing.T) {
+	backend := newFakeBackend(t)
+	_, url := newTestHandler(t, backend, nil)
+
+	c := dialTestClient(t, url)
+	waitListening(c)
+	c.send(map[string]any{"type": "text-input", "text": "first"})
+	created := c.expect("new-history-created")
+	if uid, _ := created["history_uid"].(string); uid == "" {
+		t.Fatalf("new-history-created=%v, want a history_uid", created)
+	}
+	c.send(map[string]any{"type": "text-input", "text": "second"})
+	c.expect("user-input-transcription")
+	if msg := c.next("new-history-created", 300*time.Millisecond); msg != nil {
+		t.Fatalf("second turn created another history: %v", msg)
+	}
+}
@@ -0,0 +1,134 @@
+package ws
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+)
+
+// echoRefMaxHeldSec bounds the reference held for a client that never
+// reports playback.
+const echoRefMaxHeldSec = 30
+
+func (s *session) initEchoCanceller() {
+	cfg := s.handler.config.SystemConfig.EchoCancellation
+	if !cfg.Enabled {
+		return
+	}
+	s.echoCanceller = audio.NewEchoCanceller(audio.EchoCancellerConfig{
+		SampleRate: s.sampleRate,
+		Channels:   s.channels,
+		FilterMs:   cfg.FilterMs,
+		DelayMs:    cfg.DelayMs,
+	})
+}
+
+func (s *session) closeEchoCanceller() {
+	s.ttsMu.Lock()
+	defer s.ttsMu.Unlock()
+	if s.echoRefResampler != nil {
+		s.echoRefResampler.Close()
+		s.echoRefResampler = nil
+	}
+	s.echoCanceller = nil
+}
+
+// resetEchoCanceller drops the reference of TTS audio that will no longer
+// play, along with the echo path learned from it.
+func (s *session) resetEchoCanceller() {
+	s.ttsMu.Lock()
+	defer s.ttsMu.Unlock()
+	s.echoRefHeld = nil
+	s.echoRefPlaying = false
+	if s.echoCanceller != nil {
+		s.echoCanceller.Reset()
+	}
+}
+
+// startEchoReference is called when the client reports that a reply started
+// playing. The reference held since the reply was sent is queued, and later
+// audio follows it as it is sent.
+func (s *session) startEchoReference() {
+	s.ttsMu.Lock()
+	defer s.ttsMu.Unlock()
+	if s.echoCanceller == nil || s.echoRefPlaying {
+		return
+	}
+	s.echoRefPlaying = true
+	s.echoCanceller.PushReference(s.echoRefHeld)
+	s.echoRefHeld = nil
+}
+
+// stopEchoReference is called when the client has played everything it
+// was sent. Reference left queued has no echo to cancel any more, and the
+// next reply is held until it starts playing.
+func (s *session) stopEchoReference() {
+	s.ttsMu.Lock()
+	defer s.ttsMu.Unlock()
+	s.echoRefPlaying = false
+	if s.echoCanceller != nil {
+		s.echoCanceller.DropReference()
+	}
+}
+
+// pushEchoReference queues mono reference samples once the client plays
+// the reply and holds them until then. The caller holds ttsMu.
+func (s *session) pushEchoReference(samples []int16) {
+	if s.echoRefPlaying {
+		s.echoCanceller.PushReference(samples)
+		return
+	}
+	s.echoRefHeld = append(s.echoRefHeld, samples...)
+	if over := len(s.echoRefHeld) - s.sampleRate*echoRefMaxHeldSec; over > 0 {
+		s.echoRefHeld = append(s.echoRefHeld[:0], s.echoRefHeld[over:]...)
+	}
+}
+
+// feedEchoReference converts TTS audio sent to the client into the
+// far-end reference, mono at the mic sample rate. The caller holds ttsMu.
+func (s *session) feedEchoReference(pcm []byte, sampleRate int, channels int) {
+	if s.echoCanceller == nil || len(pcm) == 0 || sampleRate <= 0 || channels <= 0 {
+		return
+	}
+	samples := audio.BytesToInt16Slice(pcm)
+	mono := samples[:len(samples)/channels]
+	for i := range mono {
+		sum := 0
+		for ch := 0; ch < channels; ch++ {
+			sum += int(samples[i*channels+ch])
+		}
+		mono[i] = int16(sum / channels)
+	}
+	if sampleRate == s.sampleRate {
+		s.pushEchoReference(mono)
+		return
+	}
+	if s.echoRefResampler == nil || s.echoRefRate != sampleRate {
+		s.echoRefResampler.Close()
+		res, err := audio.NewStreamResamplerWithOptions(sampleRate, s.sampleRate, s.resamplerOptions(true))
+		if err != nil {
+			s.logger.Warn("echo reference resampler init failed", zap.String("session_id", s.clientUID), zap.Error(err))
+			s.echoRefResampler = nil
+			return
+		}
+		s.echoRefResampler = res
+		s.echoRefRate = sampleRate
+	}
+	if err := s.echoRefResampler.AppendPCM(mono); err != nil {
+		s.logger.Warn("echo reference resample failed", zap.String("session_id", s.clientUID), zap.Error(err))
+		return
+	}
+	if frame, ok := s.echoRefResampler.PopFrame(s.echoRefResampler.Buffered()); ok {
+		s.pushEchoReference(frame)
+		audio.ReleaseInt16(frame)
+	}
+}
+
+// cancelEcho removes TTS echo from a mic frame in realtime mode, where the
+// mic stays open while the avatar speaks.
+func (s *session) cancelEcho(frame []int16) []int16 {
+	if s.echoCanceller == nil || s.getListenMode() != "realtime" {
+		return frame
+	}
+	return s.echoCanceller.Process(frame)
+}
@@ -0,0 +1,41 @@
+package ws
+
+import (
+	"testing"
+
+	appconfig "github.com/saker-ai/vtuber-server/internal/config"
+)
+
+func TestEchoReferenceWaitsForPlayback(t *testing.T) {
+	backend := newFakeBackend(t)
+	h, url := newTestHandler(t, backend, func(cfg *appconfig.Config) {
+		cfg.SystemConfig.EchoCancellation.Enabled = true
+	})
+
+	c := dialTestClient(t, url)
+	uid := waitListening(c)
+	h.mu.Lock()
+	sess := h.sessions[uid]
+	h.mu.Unlock()
+	echoRef := func() (int, bool) {
+		sess.ttsMu.Lock()
+		defer sess.ttsMu.Unlock()
+		return len(sess.echoRefHeld), sess.echoRefPlaying
+	}
+
+	c.send(map[string]any{"type": "text-input", "text": "speak"})
+	c.expect("backend-synth-complete")
+	if held, playing := echoRef(); held == 0 || playing {
+		t.Fatalf("before playback: held=%d playing=%v, want audio held", held, playing)
+	}
+	c.send(map[string]any{"type": "audio-play-start", "forwarded": true})
+	waitFor(t, "the reference to be queued", func() bool {
+		held, playing := echoRef()
+		return held == 0 && playing
+	})
+	c.send(map[string]any{"type": "frontend-playback-complete"})
+	c.expect("force-new-message")
+	if _, playing := echoRef(); playing {
+		t.Fatalf("reference still playing after playback completed")
+	}
+}
@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/internal/session/fsm"
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+)
+
+// detectBargeIn interrupts TTS playback once sustained speech is heard on
+// the mic in realtime mode.
+func (s *session) detectBargeIn(ctx context.Context, frame []int16) {
+	cfg := s.handler.config.SystemConfig.BargeIn
+	if !cfg.Enabled || !s.stateMachine.Speaking() || s.getListenMode() != "realtime" {
+		s.bargeInVAD = nil
+		return
+	}
+	if s.bargeInVAD == nil {
+		s.bargeInVAD = audio.NewVAD(audio.VADConfig{
+			SampleRate:  s.sampleRate,
+			Channels:    s.channels,
+			ThresholdDB: cfg.ThresholdDB,
+			MinSpeechMs: cfg.MinSpeechMs,
+		})
+	}
+	if s.bargeInVAD.Push(frame).Event != audio.VADSpeechStart {
+		return
+	}
+	s.bargeInVAD = nil
+	s.bargeIn(ctx)
+}
+
+// bargeIn aborts the current reply, drops buffered TTS audio and resumes
+// listening.
+func (s *session) bargeIn(ctx context.Context) {
+	s.ttsMu.Lock()
+	dropped := len(s.ttsBuffer)
+	s.ttsMu.Unlock()
+	s.logger.Info("barge-in detected",
+		zap.String("session_id", s.clientUID),
+		zap.Int("dropped_tts_bytes", dropped),
+	)
+	if err := s.abortUpstream(ctx); err != nil {
+		s.logger.Warn("xiaozhi abort failed", zap.String("session_id", s.clientUID), zap.Error(err))
+	}
+	s.logTransition(s.stateMachine.OnInterrupt())
+	s.ttsMu.Lock()
+	s.ttsBuffer = nil
+	s.ttsMu.Unlock()
+	s.resetTTSJitter()
+	s.resetTTSOutput()
+	s.resetEchoCanceller()
+	s.sendJSON(map[string]any{"type": "control", "text": "barge-in"})
+	if s.stateMachine.InConversation() {
+		s.endConversationTo(fsm.StateListening, "barge_in")
+		return
+	}
+	_ = s.stateMachine.ForceWithReason(fsm.StateListening, "barge_in")
+}
+
+// abortUpstream aborts the upstream reply and ends the turn. It leaves the
+// reply alone when another session sharing the connection owns the turn.
+func (s *session) abortUpstream(ctx context.Context) error {
+	if !s.upstream.Controls() {
+		return nil
+	}
+	err := s.xiaozhi.Abort(ctx)
+	s.upstream.Yield()
+	return err
+}
@@ -0,0 +1,107 @@
+package ws
+
+import (
+	"context"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/internal/protocol"
+)
+
+// onClientCapabilities negotiates optional wire features. Clients that never
+// send it keep receiving base64 audio inside JSON messages.
+func (s *session) onClientCapabilities(_ context.Context, msg incomingMessage) {
+	if msg.BinaryAudio != nil {
+		s.binaryAudio.Store(*msg.BinaryAudio)
+		s.logger.Info("client audio transport updated",
+			zap.String("session_id", s.clientUID),
+			zap.Bool("binary_audio", *msg.BinaryAudio),
+		)
+	}
+	switch msg.AudioOutputFormat {
+	case "":
+	case ttsOutputPCM16, ttsOutputOpus:
+		s.opusOutput.Store(msg.AudioOutputFormat == ttsOutputOpus)
+		s.logger.Info("client audio output format updated",
+			zap.String("session_id", s.clientUID),
+			zap.String("format", msg.AudioOutputFormat),
+		)
+	default:
+		s.logger.Warn("unsupported audio output format",
+			zap.String("session_id", s.clientUID),
+			zap.String("format", msg.AudioOutputFormat),
+		)
+	}
+	output := s.setClientOutputFormat(msg.AudioOutputRate, msg.AudioOutputChannels)
+	outputFormat := ttsOutputPCM16
+	if s.opusOutput.Load() {
+		outputFormat = ttsOutputOpus
+	}
+	s.sendJSON(map[string]any{
+		"type":                     "client-capabilities",
+		"binary_audio":             s.binaryAudio.Load(),
+		"audio_frame_version":      protocol.AudioFrameVersion,
+		"audio_output_format":      outputFormat,
+		"audio_output_sample_rate": output.rate,
+		"audio_output_channels":    output.channels,
+	})
+}
+
+// handleBinaryMessage accepts mic audio sent as a binary frame, as PCM or
+// Opus.
+func (s *session) handleBinaryMessage(ctx context.Context, data []byte) {
+	header, payload, err := protocol.DecodeAudioFrame(data)
+	if err != nil {
+		s.logger.Warn("invalid binary audio frame",
+			zap.String("session_id", s.clientUID),
+			zap.Error(err),
+		)
+		s.sendJSON(map[string]any{"type": "error", "message": "invalid audio frame"})
+		return
+	}
+	if header.Stream != protocol.AudioStreamMic {
+		s.logger.Debug("ignore binary audio frame",
+			zap.String("session_id", s.clientUID),
+			zap.Uint8("stream", uint8(header.Stream)),
+		)
+		return
+	}
+	if s.micFrameSeen && header.Seq != s.micFrameSeq+1 {
+		s.logger.Debug("mic audio frame gap",
+			zap.String("session_id", s.clientUID),
+			zap.Uint32("expected", s.micFrameSeq+1),
+			zap.Uint32("got", header.Seq),
+		)
+	}
+	s.micFrameSeq = header.Seq
+	s.micFrameSeen = true
+	if len(payload) == 0 {
+		return
+	}
+	switch header.Codec {
+	case protocol.AudioCodecPCM16:
+		s.lastMicRate = header.SampleRate
+		s.lastMicCh = header.Channels
+		s.handleMicPCMBytes(ctx, payload, header.SampleRate, header.Channels)
+	case protocol.AudioCodecOggOpus:
+		s.handleMicOpus(ctx, micCodecOgg, [][]byte{payload}, header.Channels)
+	case protocol.AudioCodecWebMOpus:
+		s.handleMicOpus(ctx, micCodecWebM, [][]byte{payload}, header.Channels)
+	case protocol.AudioCodecOpus:
+		s.handleMicOpus(ctx, micCodecOpus, [][]byte{payload}, header.Channels)
+	default:
+		s.sendJSON(map[string]any{"type": "error", "message": "unsupported audio codec"})
+	}
+}
+
+func (s *session) sendAudioFrame(stream protocol.AudioStream, codec protocol.AudioCodec, seq uint32, data []byte, sampleRate int, channels int) {
+	frame := protocol.EncodeAudioFrame(protocol.AudioFrameHeader{
+		Stream:     stream,
+		Codec:      codec,
+		SampleRate: sampleRate,
+		Channels:   channels,
+		Seq:        seq,
+	}, data)
+	s.writeMessage(websocket.BinaryMessage, frame)
+}
@@ -14,7 +14,7 @@ func (s *session) dispatchIncoming(ctx context.Context, msg incomingMessage) {
 		"set-listen-mode":            s.onSetListenMode,
 		"mcp-capture-response":       s.onMCPCaptureResponse,
 		"frontend-playback-complete": s.onFrontendPlaybackComplete,
-		"audio-play-start":           s.onNoop,
+		"audio-play-start":           s.onAudioPlayStart,
 		"fetch-configs":              s.onFetchConfigs,
 		"switch-config":              s.onSwitchConfig,
 		"fetch-backgrounds":          s.onFetchBackgrounds,
@@ -23,10 +23,18 @@ func (s *session) dispatchIncoming(ctx context.Context, msg incomingMessage) {
 		"fetch-and-set-history":      s.onFetchAndSetHistory,
 		"create-new-history":         s.onCreateNewHistory,
 		"delete-history":             s.onDeleteHistory,
+		"search-history":             s.onSearchHistory,
+		"export-history":             s.onExportHistory,
+		"import-history":             s.onImportHistory,
+		"rename-history":             s.onRenameHistory,
+		"pin-history":                s.onPinHistory,
+		"tag-history":                s.onTagHistory,
 		"request-group-info":         s.onRequestGroupInfo,
 		"add-client-to-group":        s.onAddClientToGroup,
 		"remove-client-from-group":   s.onRemoveClientFromGroup,
 		"ai-speak-signal":            s.onAISpeakSignal,
+		"client-capabilities":        s.onClientCapabilities,
+		"request-session-state":      s.onRequestSessionState,
 		"heartbeat":                  s.onNoop,
 	}
 
@@ -44,20 +52,29 @@ func (s *session) onTextInput(ctx context.Context, msg incomingMessage) {
 	if msg.Text == "" {
 		return
 	}
+	if !s.upstream.Claim() {
+		s.sendJSON(map[string]any{"type": "error", "message": "another session is talking to the device"})
+		return
+	}
 	if err := s.xiaozhi.SendTextInput(ctx, msg.Text); err != nil {
 		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
 	}
 }
 
 func (s *session) onInterruptSignal(ctx context.Context, _ incomingMessage) {
-	if err := s.xiaozhi.Abort(ctx); err != nil {
+	if err := s.abortUpstream(ctx); err != nil {
 		s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
 	}
-	s.stateMachine.OnInterrupt()
+	s.resetEchoCanceller()
+	s.logTransition(s.stateMachine.OnInterrupt())
 	s.endConversation()
 }
 
 func (s *session) onMicAudioData(ctx context.Context, msg incomingMessage) {
+	if msg.AudioCodec != "" && msg.AudioCodec != micCodecPCM16 {
+		s.handleMicAudioEncoded(ctx, msg)
+		return
+	}
 	if msg.AudioPCM != "" {
 		s.handleMicAudioPCM(ctx, msg.AudioPCM, msg.AudioRate, msg.AudioCh)
 		return
@@ -66,7 +83,7 @@ func (s *session) onMicAudioData(ctx context.Context, msg incomingMessage) {
 }
 
 func (s *session) onMicAudioEnd(ctx context.Context, _ incomingMessage) {
-	s.handleMicEnd(ctx)
+	s.handleClientMicEnd(ctx)
 }
 
 func (s *session) onSetListenMode(_ context.Context, msg incomingMessage) {
@@ -77,7 +94,12 @@ func (s *session) onMCPCaptureResponse(_ context.Context, msg incomingMessage) {
 	s.handleCaptureResponse(msg)
 }
 
+func (s *session) onAudioPlayStart(_ context.Context, _ incomingMessage) {
+	s.startEchoReference()
+}
+
 func (s *session) onFrontendPlaybackComplete(_ context.Context, _ incomingMessage) {
+	s.stopEchoReference()
 	s.sendJSON(map[string]any{"type": "force-new-message"})
 }
 
@@ -97,8 +119,8 @@ func (s *session) onRequestInitConfig(ctx context.Context, _ incomingMessage) {
 	s.handleInitConfig(ctx)
 }
 
-func (s *session) onFetchHistoryList(ctx context.Context, _ incomingMessage) {
-	s.handleHistoryList(ctx)
+func (s *session) onFetchHistoryList(ctx context.Context, msg incomingMessage) {
+	s.handleHistoryList(ctx, msg.Offset, msg.Limit)
 }
 
 func (s *session) onFetchAndSetHistory(ctx context.Context, msg incomingMessage) {
@@ -113,6 +135,30 @@ func (s *session) onDeleteHistory(ctx context.Context, msg incomingMessage) {
 	s.handleDeleteHistory(ctx, msg.HistoryUID)
 }
 
+func (s *session) onSearchHistory(ctx context.Context, msg incomingMessage) {
+	s.handleSearchHistory(ctx, msg.Query, msg.Limit)
+}
+
+func (s *session) onExportHistory(ctx context.Context, msg incomingMessage) {
+	s.handleExportHistory(ctx, msg.HistoryUID, msg.Format)
+}
+
+func (s *session) onImportHistory(ctx context.Context, msg incomingMessage) {
+	s.handleImportHistory(ctx, msg.Format, msg.Content)
+}
+
+func (s *session) onRenameHistory(ctx context.Context, msg incomingMessage) {
+	s.handleRenameHistory(ctx, msg.HistoryUID, msg.Title)
+}
+
+func (s *session) onPinHistory(ctx context.Context, msg incomingMessage) {
+	s.handlePinHistory(ctx, msg.HistoryUID, msg.Pinned == nil || *msg.Pinned)
+}
+
+func (s *session) onTagHistory(ctx context.Context, msg incomingMessage) {
+	s.handleTagHistory(ctx, msg.HistoryUID, msg.Tags)
+}
+
 func (s *session) onRequestGroupInfo(ctx context.Context, _ incomingMessage) {
 	s.handleGroupInfo(ctx)
 }
@@ -0,0 +1,137 @@
+package ws
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/internal/storage"
+)
+
+func (s *session) setHistoryUID(historyUID string) {
+	s.historyMu.Lock()
+	s.historyUID = historyUID
+	s.historyMu.Unlock()
+}
+
+// clearHistoryUID unselects historyUID if it is the active history.
+func (s *session) clearHistoryUID(historyUID string) {
+	s.historyMu.Lock()
+	if s.historyUID == historyUID {
+		s.historyUID = ""
+	}
+	s.historyMu.Unlock()
+}
+
+// ensureHistory returns the active history, creating one on the first turn
+// when the client has not selected or created a history yet. The client is
+// told about a created history as if it had asked for it.
+func (s *session) ensureHistory() (string, string, bool) {
+	s.historyMu.Lock()
+	if s.historyUID != "" {
+		defer s.historyMu.Unlock()
+		return s.confUID, s.historyUID, true
+	}
+	historyUID, err := s.handler.history.CreateHistory(s.confUID)
+	if err != nil {
+		s.historyMu.Unlock()
+		s.logger.Warn("auto create history failed",
+			zap.String("session_id", s.clientUID),
+			zap.String("conf_uid", s.confUID),
+			zap.Error(err),
+		)
+		return "", "", false
+	}
+	s.historyUID = historyUID
+	s.historyMu.Unlock()
+	s.logger.Info("history auto created",
+		zap.String("session_id", s.clientUID),
+		zap.String("conf_uid", s.confUID),
+		zap.String("history_uid", historyUID),
+	)
+	s.sendJSON(map[string]any{"type": "new-history-created", "history_uid": historyUID})
+	return s.confUID, historyUID, true
+}
+
+func (s *session) recordHumanTurn(text string) {
+	s.appendHistory(storage.HistoryMessage{
+		Role:    storage.RoleHuman,
+		Content: text,
+		Name:    "Human",
+	}, s.takeRecording(storage.RoleHuman))
+}
+
+func (s *session) recordAITurn(text string) {
+	confUID, historyUID, ok := s.appendHistory(storage.HistoryMessage{
+		Role:    storage.RoleAI,
+		Content: text,
+		Name:    s.characterName,
+		Avatar:  s.avatar,
+	}, s.takeRecording(storage.RoleAI))
+	if ok {
+		s.autoTitleHistory(confUID, historyUID)
+	}
+}
+
+// appendHistory stores msg in the active history together with the turn's
+// recording, if any.
+func (s *session) appendHistory(msg storage.HistoryMessage, rec *pcmRecording) (string, string, bool) {
+	if strings.TrimSpace(msg.Content) == "" {
+		if rec != nil {
+			rec.discard()
+		}
+		return "", "", false
+	}
+	confUID, historyUID, ok := s.ensureHistory()
+	if !ok {
+		if rec != nil {
+			rec.discard()
+		}
+		return "", "", false
+	}
+	msg.Audio = s.storeRecording(rec, confUID, historyUID, msg.Role)
+	if err := s.handler.history.AppendHistoryMessage(confUID, historyUID, msg); err != nil {
+		s.logger.Warn("append history failed",
+			zap.String("session_id", s.clientUID),
+			zap.String("history_uid", historyUID),
+			zap.String("role", msg.Role),
+			zap.Error(err),
+		)
+		return "", "", false
+	}
+	return confUID, historyUID, true
+}
+
+// autoTitleHistory titles the history after its first exchange. Histories
+// already checked by this session are skipped.
+func (s *session) autoTitleHistory(confUID string, historyUID string) {
+	s.historyMu.Lock()
+	if s.titledHistoryUID == historyUID {
+		s.historyMu.Unlock()
+		return
+	}
+	s.historyMu.Unlock()
+
+	title, set, err := storage.AutoTitleHistory(s.handler.history, confUID, historyUID)
+	if err != nil {
+		s.logger.Warn("auto title history failed",
+			zap.String("session_id", s.clientUID),
+			zap.String("history_uid", historyUID),
+			zap.Error(err),
+		)
+		return
+	}
+	if title == "" {
+		return
+	}
+	s.historyMu.Lock()
+	s.titledHistoryUID = historyUID
+	s.historyMu.Unlock()
+	if set {
+		s.logger.Info("history title generated",
+			zap.String("session_id", s.clientUID),
+			zap.String("history_uid", historyUID),
+			zap.String("title", title),
+		)
+	}
+}
@@ -0,0 +1,129 @@
+package ws
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+	"github.com/saker-ai/vtuber-server/pkg/xiaozhi"
+)
+
+const ttsJitterTick = 20 * time.Millisecond
+
+// pushTTSJitter hands an upstream Opus packet to the jitter buffer. It
+// reports false when the frame should take the fixed-chunk path instead.
+// The caller holds ttsMu.
+func (s *session) pushTTSJitter(frame xiaozhi.AudioFrame) bool {
+	cfg := s.handler.config.SystemConfig.JitterBuffer
+	if !cfg.Enabled || len(frame.Opus) == 0 {
+		return false
+	}
+	if s.ttsJitter == nil || s.ttsJitterRate != frame.SampleRate || s.ttsJitterChannels != frame.Channels {
+		s.flushTTSJitter()
+		jb, err := audio.NewJitterBuffer(audio.JitterBufferConfig{
+			SampleRate:   frame.SampleRate,
+			Channels:     frame.Channels,
+			FirstChunkMs: cfg.FirstChunkMs,
+			MinDelayMs:   cfg.MinDelayMs,
+			MaxDelayMs:   cfg.MaxDelayMs,
+			ChunkMs:      ttsChunkDurationMs,
+			MaxConcealMs: cfg.MaxConcealMs,
+		})
+		if err != nil {
+			s.logger.Warn("tts jitter buffer init failed",
+				zap.String("session_id", s.clientUID),
+				zap.Error(err),
+			)
+			return false
+		}
+		s.ttsJitter = jb
+		s.ttsJitterRate = frame.SampleRate
+		s.ttsJitterChannels = frame.Channels
+	}
+	s.ttsSampleRate = frame.SampleRate
+	s.ttsChannels = frame.Channels
+	now := time.Now()
+	s.ttsJitter.Push(frame.Seq, frame.Opus, now)
+	s.sendTTSJitterChunks(s.ttsJitter.Pop(now))
+	s.startTTSJitterTicker()
+	return true
+}
+
+// startTTSJitterTicker polls the jitter buffer so audio keeps flowing
+// between upstream packets.
+func (s *session) startTTSJitterTicker() {
+	if s.ttsJitterStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	s.ttsJitterStop = stop
+	go func() {
+		ticker := time.NewTicker(ttsJitterTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				s.ttsMu.Lock()
+				if s.ttsJitterStop == stop && s.ttsJitter != nil {
+					s.sendTTSJitterChunks(s.ttsJitter.Pop(now))
+				}
+				s.ttsMu.Unlock()
+			}
+		}
+	}()
+}
+
+func (s *session) stopTTSJitterTicker() {
+	if s.ttsJitterStop != nil {
+		close(s.ttsJitterStop)
+		s.ttsJitterStop = nil
+	}
+}
+
+// flushTTSJitter sends whatever the jitter buffer still holds at the end of
+// a TTS stream. The caller holds ttsMu.
+func (s *session) flushTTSJitter() {
+	s.stopTTSJitterTicker()
+	if s.ttsJitter == nil {
+		return
+	}
+	stats := s.ttsJitter.Stats()
+	if stats.Packets == 0 {
+		return
+	}
+	s.sendTTSJitterChunks(s.ttsJitter.Flush())
+	s.flushTTSOutput()
+	s.logger.Info("tts jitter stats",
+		zap.String("session_id", s.clientUID),
+		zap.Int("packets", stats.Packets),
+		zap.Int("late", stats.Late),
+		zap.Int("concealed", stats.Concealed),
+		zap.Int("recovered", stats.Recovered),
+		zap.Int("underruns", stats.Underruns),
+		zap.Float64("jitter_ms", stats.JitterMs),
+		zap.Float64("target_ms", stats.TargetMs),
+	)
+}
+
+// resetTTSJitter drops buffered TTS audio, e.g. after an interruption.
+func (s *session) resetTTSJitter() {
+	s.ttsMu.Lock()
+	defer s.ttsMu.Unlock()
+	s.stopTTSJitterTicker()
+	if s.ttsJitter != nil {
+		s.ttsJitter.Reset()
+	}
+}
+
+func (s *session) sendTTSJitterChunks(chunks [][]int16) {
+	for _, chunk := range chunks {
+		if len(chunk) == 0 {
+			continue
+		}
+		pcm := audio.Int16SliceToBytesInto(nil, chunk)
+		s.sendTTSChunk(pcm, nil, s.ttsJitterRate, s.ttsJitterChannels)
+	}
+}
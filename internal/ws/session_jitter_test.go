@@ -0,0 +1,35 @@
+package ws
+
+import (
+	"testing"
+
+	appconfig "github.com/saker-ai/vtuber-server/internal/config"
+)
+
+func TestTTSJitterTickerWithInterrupt(t *testing.T) {
+	backend := newFakeBackend(t)
+	_, url := newTestHandler(t, backend, func(cfg *appconfig.Config) {
+		cfg.SystemConfig.JitterBuffer.Enabled = true
+		cfg.SystemConfig.EchoCancellation.Enabled = true
+	})
+
+	c := dialTestClient(t, url)
+	waitListening(c)
+	for round := 0; round < 2; round++ {
+		c.send(map[string]any{"type": "text-input", "text": "speak"})
+		msg := c.expect("audio")
+		if msg["display_text"] == nil {
+			t.Fatalf("round %d: first audio has no display text: %v", round, msg)
+		}
+		// Chunks go out as the burst arrives until the client is far enough
+		// ahead; the ticker paces out the tail. Interrupt once it has, before
+		// the backend stops the reply.
+		played := msg["slice_length"].(float64)
+		for played < 1200 {
+			played += c.expect("audio")["slice_length"].(float64)
+		}
+		c.send(map[string]any{"type": "interrupt-signal"})
+		for c.expect("control")["text"] != "conversation-chain-end" {
+		}
+	}
+}
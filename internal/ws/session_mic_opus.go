@@ -0,0 +1,185 @@
+package ws
+
+import (
+	"context"
+	"encoding/base64"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+	"github.com/saker-ai/vtuber-server/pkg/audio/opusx"
+)
+
+const (
+	micCodecPCM16 = "pcm16"
+	micCodecOpus  = "opus"
+	micCodecOgg   = "ogg"
+	micCodecWebM  = "webm"
+
+	// micOpusDecodeRate is the rate encoded mic audio is decoded at before
+	// the usual resampling to the upstream rate.
+	micOpusDecodeRate = 48000
+)
+
+// micOpusInput holds the demuxers and decoder for encoded mic uploads. The
+// demuxers restart on a new stream header, so one MediaRecorder per turn and
+// one per session both work.
+type micOpusInput struct {
+	ogg      audio.OggOpusDemuxer
+	webm     audio.WebMOpusDemuxer
+	decoder  *opusx.Decoder
+	channels int
+	frame    []int16
+}
+
+// handleMicAudioEncoded decodes the base64 payload of an encoded
+// mic-audio-data message.
+func (s *session) handleMicAudioEncoded(ctx context.Context, msg incomingMessage) {
+	var chunks [][]byte
+	if msg.AudioCodec == micCodecOpus {
+		for _, packet := range msg.AudioPackets {
+			data, err := base64.StdEncoding.DecodeString(packet)
+			if err != nil {
+				s.logger.Warn("mic audio opus decode failed", zap.Error(err))
+				s.sendJSON(map[string]any{"type": "error", "message": "invalid mic audio packet"})
+				return
+			}
+			chunks = append(chunks, data)
+		}
+	} else if msg.AudioData != "" {
+		data, err := base64.StdEncoding.DecodeString(msg.AudioData)
+		if err != nil {
+			s.logger.Warn("mic audio data decode failed", zap.Error(err))
+			s.sendJSON(map[string]any{"type": "error", "message": "invalid mic audio data"})
+			return
+		}
+		chunks = append(chunks, data)
+	}
+	if len(chunks) == 0 {
+		return
+	}
+	s.handleMicOpus(ctx, msg.AudioCodec, chunks, msg.AudioCh)
+}
+
+// handleMicOpus demuxes encoded mic audio into Opus packets. Packets that
+// already match the upstream parameters are forwarded as-is; the rest are
+// decoded and go through the PCM path, which resamples and re-encodes them.
+func (s *session) handleMicOpus(ctx context.Context, codec string, chunks [][]byte, channels int) {
+	if s.micOpus == nil {
+		s.micOpus = &micOpusInput{}
+	}
+	in := s.micOpus
+	var packets [][]byte
+	switch codec {
+	case micCodecOpus:
+		packets = chunks
+	case micCodecOgg, micCodecWebM:
+		for _, chunk := range chunks {
+			var (
+				out [][]byte
+				err error
+			)
+			if codec == micCodecOgg {
+				out, err = in.ogg.Write(chunk)
+				channels = in.ogg.Head.Channels
+			} else {
+				out, err = in.webm.Write(chunk)
+				channels = in.webm.Channels
+			}
+			packets = append(packets, out...)
+			if err != nil {
+				s.logger.Warn("mic audio demux failed",
+					zap.String("session_id", s.clientUID),
+					zap.String("codec", codec),
+					zap.Error(err),
+				)
+				s.sendJSON(map[string]any{"type": "error", "message": "invalid mic audio stream"})
+			}
+		}
+	default:
+		s.sendJSON(map[string]any{"type": "error", "message": "unsupported mic audio codec"})
+		return
+	}
+	if len(packets) == 0 {
+		return
+	}
+	if channels <= 0 {
+		channels = 1
+	}
+	s.lastMicRate = micOpusDecodeRate
+	s.lastMicCh = channels
+
+	if s.micOpusPassthrough(packets, channels) {
+		if !s.upstream.Claim() || !s.ensureListening(ctx, "mic-audio") {
+			return
+		}
+		for _, packet := range packets {
+			s.micChunkCount++
+			s.micBytes += len(packet)
+			if err := s.xiaozhi.SendAudio(ctx, packet); err != nil {
+				s.logger.Warn("xiaozhi send opus audio failed", zap.Error(err))
+				s.sendJSON(map[string]any{"type": "error", "message": err.Error()})
+				return
+			}
+		}
+		return
+	}
+
+	pcm, err := in.decode(packets, channels)
+	if err != nil {
+		s.logger.Warn("mic audio opus decode failed",
+			zap.String("session_id", s.clientUID),
+			zap.Error(err),
+		)
+		s.sendJSON(map[string]any{"type": "error", "message": "invalid mic audio packet"})
+	}
+	if len(pcm) == 0 {
+		return
+	}
+	pcmBytes := audio.Int16SliceToBytesInto(audio.AcquireBytes(len(pcm)*2), pcm)
+	s.handleMicPCMBytes(ctx, pcmBytes, micOpusDecodeRate, channels)
+	audio.ReleaseBytes(pcmBytes)
+}
+
+// micOpusPassthrough reports whether packets can be sent upstream without
+// decoding: the upstream takes Opus with the same channels and frame
+// duration, and no mic stage needs the PCM.
+func (s *session) micOpusPassthrough(packets [][]byte, channels int) bool {
+	if s.audioFormat != "opus" || channels != s.channels {
+		return false
+	}
+	if s.audioProcessor.Enabled() || s.vadActive() || s.echoCanceller != nil || s.recordingEnabled() ||
+		s.handler.config.SystemConfig.BargeIn.Enabled {
+		return false
+	}
+	for _, packet := range packets {
+		samples, err := audio.OpusPacketSamples(packet)
+		if err != nil || samples*1000 != s.frameDuration*micOpusDecodeRate {
+			return false
+		}
+	}
+	return true
+}
+
+// decode decodes packets to interleaved PCM at micOpusDecodeRate. Packets
+// decoded before an error are still returned.
+func (in *micOpusInput) decode(packets [][]byte, channels int) ([]int16, error) {
+	if in.decoder == nil || in.channels != channels {
+		decoder, err := opusx.NewDecoder(micOpusDecodeRate, channels)
+		if err != nil {
+			return nil, err
+		}
+		in.decoder = decoder
+		in.channels = channels
+		in.frame = make([]int16, 5760*channels)
+	}
+	var pcm []int16
+	for _, packet := range packets {
+		n, err := in.decoder.Decode(packet, in.frame)
+		if err != nil {
+			return pcm, err
+		}
+		pcm = append(pcm, in.frame[:n*channels]...)
+	}
+	return pcm, nil
+}
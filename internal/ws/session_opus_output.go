@@ -0,0 +1,245 @@
+package ws
+
+import (
+	"bytes"
+	"errors"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/internal/protocol"
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+	"github.com/saker-ai/vtuber-server/pkg/xiaozhi"
+)
+
+const (
+	ttsOutputPCM16 = "pcm16"
+	ttsOutputOpus  = "opus"
+
+	ttsOpusFrameMs = 20
+)
+
+// ttsOpusPacket is an upstream Opus packet and the size of its decoded PCM
+// in ttsBuffer.
+type ttsOpusPacket struct {
+	data     []byte
+	pcmBytes int
+}
+
+// queueTTSOpus keeps upstream Opus packets alongside ttsBuffer so they can be
+// passed through instead of re-encoded. It must run before frame.PCM is
+// appended. Once a frame arrives without a packet the buffer is no longer
+// covered and chunks fall back to encoding until it drains.
+func (s *session) queueTTSOpus(frame xiaozhi.AudioFrame) {
+	if len(s.ttsBuffer) == 0 {
+		s.ttsOpusPackets = s.ttsOpusPackets[:0]
+		s.ttsOpusAligned = s.opusOutput.Load()
+	}
+	if !s.ttsOpusAligned {
+		return
+	}
+	if len(frame.Opus) == 0 {
+		s.ttsOpusAligned = false
+		s.ttsOpusPackets = nil
+		return
+	}
+	s.ttsOpusPackets = append(s.ttsOpusPackets, ttsOpusPacket{data: frame.Opus, pcmBytes: len(frame.PCM)})
+}
+
+// ttsOggStream muxes one TTS reply into a single Ogg Opus logical stream,
+// sent in pieces: the first piece carries the headers and the last one the
+// end-of-stream page. The writer holds its newest packet back, so a piece
+// covers the PCM of the packets it completes and the held one goes out with
+// the next piece.
+type ttsOggStream struct {
+	buf      bytes.Buffer
+	writer   *audio.OggOpusWriter
+	encoder  *audio.OpusEncoder
+	rate     int
+	channels int
+	// unencoded is PCM waiting for a full encoder frame. While it is not
+	// empty, upstream packets are not passed through.
+	unencoded []byte
+	// held is the PCM of the packet the writer holds back.
+	held []byte
+	// covered is the PCM of the packets completed since the last piece.
+	covered []byte
+	// samples counts the source audio in 48 kHz samples.
+	samples uint64
+}
+
+func newTTSOggStream(sampleRate int, channels int) (*ttsOggStream, error) {
+	if !opusRecordable(sampleRate, channels) {
+		return nil, errors.New("sample format not supported by opus")
+	}
+	st := &ttsOggStream{rate: sampleRate, channels: channels}
+	// The upstream encoder and ours both start with the reply, so the usual
+	// pre-skip applies.
+	writer, err := audio.NewOggOpusWriter(&st.buf, sampleRate, channels)
+	if err != nil {
+		return nil, err
+	}
+	st.writer = writer
+	return st, nil
+}
+
+// write adds a chunk to the stream. Upstream packets are used as-is when
+// they cover pcm exactly; otherwise pcm is encoded.
+func (st *ttsOggStream) write(pcm []byte, packets [][]byte) error {
+	st.samples += uint64(len(pcm) / (2 * st.channels) * 48000 / st.rate)
+	if len(st.unencoded) == 0 {
+		if sizes, ok := st.packetPCMSizes(packets, len(pcm)); ok {
+			for i, packet := range packets {
+				if err := st.writePacket(packet, pcm[:sizes[i]]); err != nil {
+					return err
+				}
+				pcm = pcm[sizes[i]:]
+			}
+			return nil
+		}
+	}
+	st.unencoded = append(st.unencoded, pcm...)
+	return st.encode(false)
+}
+
+// packetPCMSizes returns the PCM byte length of each packet, reporting false
+// unless they add up to total.
+func (st *ttsOggStream) packetPCMSizes(packets [][]byte, total int) ([]int, bool) {
+	if len(packets) == 0 {
+		return nil, false
+	}
+	sizes := make([]int, len(packets))
+	sum := 0
+	for i, packet := range packets {
+		samples, err := audio.OpusPacketSamples(packet)
+		if err != nil {
+			return nil, false
+		}
+		sizes[i] = samples * st.rate / 48000 * st.channels * 2
+		sum += sizes[i]
+	}
+	return sizes, sum == total
+}
+
+// encode encodes the full frames of unencoded PCM, and with final the short
+// remainder too, padded with silence.
+func (st *ttsOggStream) encode(final bool) error {
+	if st.encoder == nil {
+		enc, err := audio.NewOpusEncoder(st.rate, st.channels, ttsOpusFrameMs)
+		if err != nil {
+			return err
+		}
+		st.encoder = enc
+	}
+	frameBytes := st.encoder.GetFrameBytes()
+	for len(st.unencoded) >= frameBytes || (final && len(st.unencoded) > 0) {
+		n := min(frameBytes, len(st.unencoded))
+		frame := st.unencoded[:n]
+		packet, err := st.encoder.Encode(frame)
+		if err != nil {
+			return err
+		}
+		if err := st.writePacket(packet, frame); err != nil {
+			return err
+		}
+		st.unencoded = st.unencoded[n:]
+	}
+	if len(st.unencoded) == 0 {
+		st.unencoded = nil
+	}
+	return nil
+}
+
+func (st *ttsOggStream) writePacket(packet []byte, pcm []byte) error {
+	if len(packet) == 0 {
+		st.held = append(st.held, pcm...)
+		return nil
+	}
+	if err := st.writer.WritePacket(packet); err != nil {
+		return err
+	}
+	st.covered = append(st.covered, st.held...)
+	st.held = append(st.held[:0], pcm...)
+	return nil
+}
+
+// finish ends the stream, trimming the padding of its last packet.
+func (st *ttsOggStream) finish() error {
+	if err := st.encode(true); err != nil {
+		return err
+	}
+	if err := st.writer.CloseTrimmed(st.samples); err != nil {
+		return err
+	}
+	st.covered = append(st.covered, st.held...)
+	st.held = nil
+	return nil
+}
+
+// take returns the PCM completed since the last call and the Ogg pages
+// carrying it.
+func (st *ttsOggStream) take() ([]byte, []byte) {
+	if len(st.covered) == 0 {
+		return nil, nil
+	}
+	pcm := st.covered
+	ogg := append([]byte(nil), st.buf.Bytes()...)
+	st.covered = nil
+	st.buf.Reset()
+	return pcm, ogg
+}
+
+func (st *ttsOggStream) close() {
+	if st != nil && st.encoder != nil {
+		st.encoder.Close()
+		st.encoder = nil
+	}
+}
+
+// sendOggChunk adds a TTS chunk to the reply's Ogg stream and sends what it
+// completes. A change of format ends the stream and starts another. The
+// caller holds ttsMu.
+func (s *session) sendOggChunk(pcm []byte, packets [][]byte, sampleRate int, channels int) error {
+	if s.ttsOgg != nil && (s.ttsOgg.rate != sampleRate || s.ttsOgg.channels != channels) {
+		s.finishTTSOgg()
+	}
+	if s.ttsOgg == nil {
+		st, err := newTTSOggStream(sampleRate, channels)
+		if err != nil {
+			return err
+		}
+		s.ttsOgg = st
+	}
+	if err := s.ttsOgg.write(pcm, packets); err != nil {
+		s.dropTTSOgg()
+		return err
+	}
+	covered, ogg := s.ttsOgg.take()
+	if len(covered) > 0 {
+		s.sendAudioPayload(covered, ogg, protocol.AudioCodecOggOpus, sampleRate, channels)
+	}
+	return nil
+}
+
+// finishTTSOgg ends the reply's Ogg stream and sends its last piece. The
+// caller holds ttsMu.
+func (s *session) finishTTSOgg() {
+	st := s.ttsOgg
+	if st == nil {
+		return
+	}
+	s.ttsOgg = nil
+	defer st.close()
+	if err := st.finish(); err != nil {
+		s.logger.Debug("tts opus stream end failed", zap.String("session_id", s.clientUID), zap.Error(err))
+		return
+	}
+	if covered, ogg := st.take(); len(covered) > 0 {
+		s.sendAudioPayload(covered, ogg, protocol.AudioCodecOggOpus, st.rate, st.channels)
+	}
+}
+
+// dropTTSOgg discards the reply's Ogg stream unsent. The caller holds ttsMu.
+func (s *session) dropTTSOgg() {
+	s.ttsOgg.close()
+	s.ttsOgg = nil
+}
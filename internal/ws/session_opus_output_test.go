@@ -0,0 +1,71 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	appconfig "github.com/saker-ai/vtuber-server/internal/config"
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+)
+
+func TestOpusOutputIsOneStreamPerReply(t *testing.T) {
+	cases := map[string]func(*appconfig.Config){
+		"passthrough": nil,
+		// The jitter buffer hands out PCM, which is encoded.
+		"encoded": func(cfg *appconfig.Config) { cfg.SystemConfig.JitterBuffer.Enabled = true },
+	}
+	for name, configure := range cases {
+		t.Run(name, func(t *testing.T) {
+			backend := newFakeBackend(t)
+			_, url := newTestHandler(t, backend, configure)
+
+			c := dialTestClient(t, url)
+			waitListening(c)
+			c.send(map[string]any{"type": "client-capabilities", "audio_output_format": "opus"})
+			c.expect("client-capabilities")
+			c.send(map[string]any{"type": "text-input", "text": "speak"})
+
+			var stream []byte
+			played := 0.0
+			deadline := time.After(testTimeout)
+			for {
+				var msg map[string]any
+				select {
+				case msg = <-c.messages:
+				case <-deadline:
+					t.Fatal("reply never ended")
+				}
+				if msg == nil {
+					t.Fatal("connection closed during the reply")
+				}
+				if msg["type"] == "control" && msg["text"] == "conversation-chain-end" {
+					break
+				}
+				if msg["type"] != "audio" {
+					continue
+				}
+				data, err := base64.StdEncoding.DecodeString(msg["audio_opus"].(string))
+				if err != nil || msg["audio_container"] != "ogg" {
+					t.Fatalf("audio message is not ogg opus: %v", msg)
+				}
+				stream = append(stream, data...)
+				played += msg["slice_length"].(float64)
+			}
+			if n := bytes.Count(stream, []byte("OpusHead")); n != 1 {
+				t.Fatalf("reply has %d Ogg streams, want 1", n)
+			}
+			if played < 1190 || played > 1210 {
+				t.Fatalf("slice lengths add up to %v ms, want 1200", played)
+			}
+			pcm, _, err := audio.DecodeOggOpus(bytes.NewReader(stream))
+			if err != nil {
+				t.Fatalf("DecodeOggOpus error: %v", err)
+			}
+			if want := 1200*48 - 312; len(pcm) != want {
+				t.Fatalf("decoded %d samples, want %d", len(pcm), want)
+			}
+		})
+	}
+}
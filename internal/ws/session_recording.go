@@ -0,0 +1,292 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/internal/storage"
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+)
+
+const (
+	recordingFormatWAV     = "wav"
+	recordingFormatOgg     = "ogg"
+	recordingOpusFrameMs   = 20
+	recordingOggBufferSize = 32 * 1024
+)
+
+// pcmRecording streams 16-bit PCM into a WAV or Ogg/Opus file in a staging
+// directory until the turn it belongs to is stored.
+type pcmRecording struct {
+	file       *os.File
+	format     string
+	sampleRate int
+	channels   int
+	dataBytes  int64
+	started    time.Time
+
+	wav     *audio.WAVWriter
+	out     *bufio.Writer
+	ogg     *audio.OggOpusWriter
+	encoder *audio.OpusEncoder
+	pending []byte
+}
+
+// newPCMRecording starts a recording in format. Ogg/Opus falls back to WAV
+// for sample rates or channel counts Opus cannot encode.
+func newPCMRecording(dir string, format string, sampleRate int, channels int) (*pcmRecording, error) {
+	if format != recordingFormatOgg || !opusRecordable(sampleRate, channels) {
+		format = recordingFormatWAV
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "turn-*."+format+".partial")
+	if err != nil {
+		return nil, err
+	}
+	rec := &pcmRecording{file: file, format: format, sampleRate: sampleRate, channels: channels, started: time.Now()}
+	if format == recordingFormatOgg {
+		if rec.encoder, err = audio.AcquireOpusEncoder(sampleRate, channels, recordingOpusFrameMs); err != nil {
+			rec.discard()
+			return nil, err
+		}
+		rec.out = bufio.NewWriterSize(file, recordingOggBufferSize)
+		if rec.ogg, err = audio.NewOggOpusWriter(rec.out, sampleRate, channels); err != nil {
+			rec.discard()
+			return nil, err
+		}
+		return rec, nil
+	}
+	if rec.wav, err = audio.NewWAVWriter(file, audio.WAVFormat{SampleRate: sampleRate, Channels: channels, BitsPerSample: 16}); err != nil {
+		rec.discard()
+		return nil, err
+	}
+	return rec, nil
+}
+
+func opusRecordable(sampleRate int, channels int) bool {
+	switch sampleRate {
+	case 8000, 12000, 16000, 24000, 48000:
+		return channels == 1 || channels == 2
+	}
+	return false
+}
+
+func (r *pcmRecording) ext() string {
+	return "." + r.format
+}
+
+func (r *pcmRecording) write(pcm []byte) error {
+	if r.ogg == nil {
+		err := r.wav.WritePCM16(pcm)
+		r.dataBytes = r.wav.DataBytes()
+		return err
+	}
+	r.dataBytes += int64(len(pcm))
+	r.pending = append(r.pending, pcm...)
+	frameBytes := r.encoder.GetFrameBytes()
+	for len(r.pending) >= frameBytes {
+		if err := r.encodePending(frameBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodePending encodes up to n pending bytes as one Opus packet; a short
+// final frame is padded with silence by the encoder and trimmed again by
+// the granule finishOgg ends the stream on.
+func (r *pcmRecording) encodePending(n int) error {
+	if n > len(r.pending) {
+		n = len(r.pending)
+	}
+	packet, err := r.encoder.Encode(r.pending[:n])
+	r.pending = r.pending[n:]
+	if err != nil {
+		return err
+	}
+	if len(packet) == 0 {
+		return nil
+	}
+	return r.ogg.WritePacket(packet)
+}
+
+// finish completes the container and moves the file to path.
+func (r *pcmRecording) finish(path string) error {
+	if r.ogg != nil {
+		return r.finishOgg(path)
+	}
+	if err := r.wav.Close(); err != nil {
+		r.discard()
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		os.Remove(r.file.Name())
+		return err
+	}
+	return r.move(path)
+}
+
+func (r *pcmRecording) finishOgg(path string) error {
+	if len(r.pending) > 0 {
+		if err := r.encodePending(len(r.pending)); err != nil {
+			r.discard()
+			return err
+		}
+	}
+	samples := r.dataBytes / int64(2*r.channels) * 48000 / int64(r.sampleRate)
+	if err := r.ogg.CloseTrimmed(uint64(samples)); err != nil {
+		r.discard()
+		return err
+	}
+	if err := r.out.Flush(); err != nil {
+		r.discard()
+		return err
+	}
+	r.releaseEncoder()
+	if err := r.file.Close(); err != nil {
+		os.Remove(r.file.Name())
+		return err
+	}
+	return r.move(path)
+}
+
+func (r *pcmRecording) move(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		os.Remove(r.file.Name())
+		return err
+	}
+	return os.Rename(r.file.Name(), path)
+}
+
+func (r *pcmRecording) releaseEncoder() {
+	if r.encoder != nil {
+		audio.ReleaseOpusEncoder(r.encoder)
+		r.encoder = nil
+	}
+}
+
+func (r *pcmRecording) discard() {
+	r.releaseEncoder()
+	r.file.Close()
+	os.Remove(r.file.Name())
+}
+
+func (s *session) recordingEnabled() bool {
+	return s.handler.config.SystemConfig.Recording.Enabled && s.handler.config.RecordingsDir != ""
+}
+
+func (s *session) recordingStagingDir() string {
+	return filepath.Join(s.handler.config.RecordingsDir, ".partial")
+}
+
+// recordMicFrame tees a post-resample mic frame into the current human turn
+// recording.
+func (s *session) recordMicFrame(frame []int16, sampleRate int, channels int) {
+	if !s.recordingEnabled() || len(frame) == 0 {
+		return
+	}
+	pcm := make([]byte, len(frame)*2)
+	for i, sample := range frame {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(sample))
+	}
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+	s.micRecording = s.recordPCMLocked(s.micRecording, pcm, sampleRate, channels, "mic")
+}
+
+// recordTTSAudio tees decoded TTS PCM into the current ai turn recording.
+func (s *session) recordTTSAudio(pcm []byte, sampleRate int, channels int) {
+	if !s.recordingEnabled() || len(pcm) == 0 {
+		return
+	}
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+	s.ttsRecording = s.recordPCMLocked(s.ttsRecording, pcm, sampleRate, channels, "tts")
+}
+
+func (s *session) recordPCMLocked(rec *pcmRecording, pcm []byte, sampleRate int, channels int, source string) *pcmRecording {
+	if rec != nil && (rec.sampleRate != sampleRate || rec.channels != channels) {
+		// A turn has a single format; drop audio that does not match it.
+		return rec
+	}
+	if rec == nil {
+		var err error
+		rec, err = newPCMRecording(s.recordingStagingDir(), s.handler.config.SystemConfig.Recording.Format, sampleRate, channels)
+		if err != nil {
+			s.logger.Warn("recording start failed",
+				zap.String("session_id", s.clientUID),
+				zap.String("source", source),
+				zap.Error(err),
+			)
+			return nil
+		}
+	}
+	if err := rec.write(pcm); err != nil {
+		s.logger.Warn("recording write failed",
+			zap.String("session_id", s.clientUID),
+			zap.String("source", source),
+			zap.Error(err),
+		)
+		rec.discard()
+		return nil
+	}
+	return rec
+}
+
+// takeRecording detaches the pending recording of role.
+func (s *session) takeRecording(role string) *pcmRecording {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+	var rec *pcmRecording
+	if role == storage.RoleHuman {
+		rec, s.micRecording = s.micRecording, nil
+	} else {
+		rec, s.ttsRecording = s.ttsRecording, nil
+	}
+	return rec
+}
+
+// storeRecording moves rec next to the history and returns its reference.
+func (s *session) storeRecording(rec *pcmRecording, confUID string, historyUID string, role string) string {
+	if rec == nil {
+		return ""
+	}
+	if rec.dataBytes == 0 {
+		rec.discard()
+		return ""
+	}
+	name := fmt.Sprintf("%s_%s%s", rec.started.Format("20060102T150405.000"), role, rec.ext())
+	path, err := storage.RecordingPath(s.handler.config.RecordingsDir, confUID, historyUID, name)
+	if err == nil {
+		err = rec.finish(path)
+	} else {
+		rec.discard()
+	}
+	if err != nil {
+		s.logger.Warn("recording store failed",
+			zap.String("session_id", s.clientUID),
+			zap.String("history_uid", historyUID),
+			zap.String("role", role),
+			zap.Error(err),
+		)
+		return ""
+	}
+	return storage.RecordingRef(confUID, historyUID, name)
+}
+
+// discardRecordings drops recordings of turns that were never stored.
+func (s *session) discardRecordings() {
+	for _, role := range []string{storage.RoleHuman, storage.RoleAI} {
+		if rec := s.takeRecording(role); rec != nil {
+			rec.discard()
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// outboundMessage is a websocket message kept for replay.
+type outboundMessage struct {
+	kind int
+	data []byte
+}
+
+// replayBuffer holds the messages a detached client missed, dropping the
+// oldest past either limit. A zero limit is unbounded.
+type replayBuffer struct {
+	maxMessages int
+	maxBytes    int
+	messages    []outboundMessage
+	bytes       int
+	dropped     int
+}
+
+func (b *replayBuffer) push(kind int, data []byte) {
+	b.messages = append(b.messages, outboundMessage{kind: kind, data: data})
+	b.bytes += len(data)
+	for len(b.messages) > 0 &&
+		((b.maxMessages > 0 && len(b.messages) > b.maxMessages) || (b.maxBytes > 0 && b.bytes > b.maxBytes)) {
+		b.bytes -= len(b.messages[0].data)
+		b.messages[0] = outboundMessage{}
+		b.messages = b.messages[1:]
+		b.dropped++
+	}
+}
+
+// take empties the buffer and returns its messages and how many were
+// dropped.
+func (b *replayBuffer) take() ([]outboundMessage, int) {
+	messages, dropped := b.messages, b.dropped
+	b.messages, b.bytes, b.dropped = nil, 0, 0
+	return messages, dropped
+}
+
+// makeResumable issues sess a resume token when resumption is enabled.
+func (h *Handler) makeResumable(sess *session) {
+	cfg := h.config.SystemConfig.SessionResume
+	if !cfg.Enabled || cfg.GraceSeconds <= 0 {
+		return
+	}
+	sess.resumeToken = rand.Text()
+	sess.replay = &replayBuffer{maxMessages: cfg.ReplayMaxMessages, maxBytes: cfg.ReplayMaxBytes}
+	h.mu.Lock()
+	h.resumable[sess.resumeToken] = sess
+	h.mu.Unlock()
+}
+
+func (h *Handler) forgetResumeToken(token string) {
+	if token == "" {
+		return
+	}
+	h.mu.Lock()
+	delete(h.resumable, token)
+	h.mu.Unlock()
+}
+
+// resumeSession moves the session token belongs to onto conn and replays
+// what it missed. It returns nil when the token is unknown or expired.
+func (h *Handler) resumeSession(token string, conn *websocket.Conn) *session {
+	if token == "" {
+		return nil
+	}
+	h.mu.Lock()
+	sess := h.resumable[token]
+	h.mu.Unlock()
+	if sess == nil {
+		h.logger.Info("ws session resume rejected, starting a new session")
+		return nil
+	}
+	old, replayed, dropped, ok := sess.attach(conn)
+	if !ok {
+		h.logger.Info("ws session resume rejected, starting a new session")
+		return nil
+	}
+	if old != nil {
+		// The client came back before the old socket was noticed dead.
+		_ = old.Close()
+	}
+	sess.logger.Info("ws session resumed",
+		zap.String("session_id", sess.clientUID),
+		zap.Int("replayed", replayed),
+		zap.Int("dropped", dropped),
+	)
+	sess.sendSessionState(sess.currentSessionState("resume"))
+	return sess
+}
+
+// attach makes conn the session's socket and sends it the model and config,
+// a session-resumed notice and the buffered messages, in that order. It
+// returns the socket it replaced and reports false once the session has
+// closed.
+func (s *session) attach(conn *websocket.Conn) (*websocket.Conn, int, int, bool) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.closed || s.revoked {
+		return nil, 0, 0, false
+	}
+	old := s.conn
+	s.conn = conn
+	// Disarm the grace timer.
+	s.detachSeq++
+	messages, dropped := s.replay.take()
+	greeting := []map[string]any{
+		s.modelAndConf(),
+		{
+			"type":       "session-resumed",
+			"client_uid": s.clientUID,
+			"replayed":   len(messages),
+			"dropped":    dropped,
+		},
+	}
+	for _, payload := range greeting {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			continue
+		}
+		s.writeLocked(websocket.TextMessage, data)
+	}
+	for _, msg := range messages {
+		s.writeLocked(msg.kind, msg.data)
+	}
+	return old, len(messages), dropped, true
+}
+
+// detachSession runs when the read loop of conn ends. Unless a resumed
+// socket already took over, a resumable session waits out the grace period
+// for its client; any other session closes now.
+func (h *Handler) detachSession(sess *session, conn *websocket.Conn) {
+	sess.sendMu.Lock()
+	if sess.conn != conn {
+		sess.sendMu.Unlock()
+		return
+	}
+	sess.conn = nil
+	sess.detachSeq++
+	seq := sess.detachSeq
+	resumable := sess.resumeToken != "" && !sess.revoked
+	if !resumable {
+		sess.closed = true
+	}
+	sess.sendMu.Unlock()
+	if !resumable {
+		sess.close()
+		return
+	}
+	grace := time.Duration(h.config.SystemConfig.SessionResume.GraceSeconds) * time.Second
+	sess.logger.Info("ws session detached, waiting for resume",
+		zap.String("session_id", sess.clientUID),
+		zap.Duration("grace", grace),
+	)
+	time.AfterFunc(grace, func() {
+		sess.expire(seq)
+	})
+}
+
+// expire closes the session if it is still in the detach numbered seq.
+func (s *session) expire(seq uint64) {
+	s.sendMu.Lock()
+	if s.closed || s.detachSeq != seq {
+		s.sendMu.Unlock()
+		return
+	}
+	s.closed = true
+	s.sendMu.Unlock()
+	s.logger.Info("ws session resume grace expired", zap.String("session_id", s.clientUID))
+	// Wait for the read loop to finish detaching.
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	s.close()
+}
+
+// writeMessage sends a message to the client. While no socket is attached,
+// or when the write fails, a resumable session keeps it for replay.
+func (s *session) writeMessage(kind int, data []byte) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.writeLocked(kind, data) {
+		return
+	}
+	if s.replay != nil && !s.closed {
+		s.replay.push(kind, data)
+	}
+}
+
+// writeLocked writes to the attached socket. The caller holds sendMu.
+func (s *session) writeLocked(kind int, data []byte) bool {
+	if s.conn == nil {
+		return false
+	}
+	if err := s.conn.WriteMessage(kind, data); err != nil {
+		s.logger.Debug("ws send failed", zap.Error(err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package ws
+
+import (
+	"context"
+	"time"
+
+	"github.com/saker-ai/vtuber-server/internal/session/fsm"
+)
+
+// sendSessionState tells the client which state the session is in so it can
+// show a listening, thinking or speaking indicator. The reason is the cause
+// of the change, or its event when none was given.
+func (s *session) sendSessionState(t fsm.Transition) {
+	reason := t.Reason
+	if reason == "" {
+		reason = string(t.Event)
+	}
+	s.sendJSON(map[string]any{
+		"type":           "session-state",
+		"state":          string(t.To),
+		"previous_state": string(t.From),
+		"mode":           string(t.Mode),
+		"listening":      s.stateMachine.Listening(),
+		"reason":         reason,
+		"timestamp":      t.At.Format(time.RFC3339Nano),
+	})
+}
+
+// currentSessionState describes the current state by its last transition,
+// with the current mode. An empty reason keeps the transition's own.
+func (s *session) currentSessionState(reason string) fsm.Transition {
+	state := s.stateMachine.State()
+	t := fsm.Transition{From: state, To: state, Reason: "initial", At: time.Now()}
+	if history := s.stateMachine.History(); len(history) > 0 {
+		t = history[len(history)-1]
+	}
+	if reason != "" {
+		t.Reason = reason
+	}
+	t.Mode = s.stateMachine.Mode()
+	return t
+}
+
+// onRequestSessionState lets a reconnecting client render the right
+// indicator without waiting for the next transition.
+func (s *session) onRequestSessionState(_ context.Context, _ incomingMessage) {
+	s.sendSessionState(s.currentSessionState(""))
+}
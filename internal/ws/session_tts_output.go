@@ -0,0 +1,140 @@
+package ws
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+)
+
+// clientOutputMaxChannels bounds a client's preferred TTS channel count.
+const clientOutputMaxChannels = 2
+
+// clientOutputRates are the TTS playback rates a client may ask for. Odd
+// rates are refused: against the upstream rate they can need a polyphase
+// sinc filter with tens of thousands of phases.
+var clientOutputRates = map[int]bool{
+	8000: true, 11025: true, 12000: true, 16000: true, 22050: true, 24000: true,
+	32000: true, 44100: true, 48000: true, 88200: true, 96000: true, 176400: true, 192000: true,
+}
+
+// ttsOutputFormat is a PCM sample rate and channel count. Zero fields keep
+// the upstream value.
+type ttsOutputFormat struct {
+	rate     int
+	channels int
+}
+
+// setClientOutputFormat records the client's preferred TTS playback format.
+// Zero arguments leave the current preference unchanged; unsupported ones
+// are ignored. It returns the preference in effect.
+func (s *session) setClientOutputFormat(rate int, channels int) ttsOutputFormat {
+	s.ttsMu.Lock()
+	defer s.ttsMu.Unlock()
+	if rate == 0 && channels == 0 {
+		return s.clientOutput
+	}
+	if rate != 0 && !clientOutputRates[rate] {
+		s.logger.Warn("unsupported audio output sample rate",
+			zap.String("session_id", s.clientUID),
+			zap.Int("sample_rate", rate),
+		)
+		rate = s.clientOutput.rate
+	}
+	if channels < 0 || channels > clientOutputMaxChannels {
+		s.logger.Warn("unsupported audio output channels",
+			zap.String("session_id", s.clientUID),
+			zap.Int("channels", channels),
+		)
+		channels = s.clientOutput.channels
+	}
+	if rate != 0 {
+		s.clientOutput.rate = rate
+	}
+	if channels != 0 {
+		s.clientOutput.channels = channels
+	}
+	s.logger.Info("client audio output layout updated",
+		zap.String("session_id", s.clientUID),
+		zap.Int("sample_rate", s.clientOutput.rate),
+		zap.Int("channels", s.clientOutput.channels),
+	)
+	return s.clientOutput
+}
+
+// sendTTSChunk converts a TTS chunk to the client's preferred format, if it
+// set one, and sends it. Converted chunks drop the upstream Opus packets,
+// which no longer match. The caller holds ttsMu.
+func (s *session) sendTTSChunk(pcm []byte, packets [][]byte, sampleRate int, channels int) {
+	in := ttsOutputFormat{rate: sampleRate, channels: channels}
+	out := in
+	if s.clientOutput.rate > 0 {
+		out.rate = s.clientOutput.rate
+	}
+	if s.clientOutput.channels > 0 {
+		out.channels = s.clientOutput.channels
+	}
+	if out == in {
+		s.flushTTSOutput()
+		s.sendAudioChunk(pcm, packets, sampleRate, channels)
+		return
+	}
+	if s.ttsOutput == nil || s.ttsOutputIn != in || s.ttsOutputOut != out {
+		s.flushTTSOutput()
+		conv, err := audio.NewPCMConverter(in.rate, in.channels, out.rate, out.channels, s.resamplerOptions(true))
+		if err != nil {
+			s.logger.Warn("tts output converter init failed",
+				zap.String("session_id", s.clientUID),
+				zap.Error(err),
+			)
+			s.sendAudioChunk(pcm, packets, sampleRate, channels)
+			return
+		}
+		s.ttsOutput = conv
+		s.ttsOutputIn = in
+		s.ttsOutputOut = out
+	}
+	converted, err := s.ttsOutput.Convert(audio.BytesToInt16Slice(pcm))
+	if err != nil {
+		s.logger.Warn("tts output convert failed",
+			zap.String("session_id", s.clientUID),
+			zap.Error(err),
+		)
+		return
+	}
+	s.sendConvertedTTS(converted)
+}
+
+// flushTTSOutput sends what the output converter still holds and closes
+// it. The caller holds ttsMu.
+func (s *session) flushTTSOutput() {
+	if s.ttsOutput == nil {
+		return
+	}
+	tail, err := s.ttsOutput.Flush()
+	if err != nil {
+		s.logger.Warn("tts output flush failed",
+			zap.String("session_id", s.clientUID),
+			zap.Error(err),
+		)
+	}
+	s.sendConvertedTTS(tail)
+	s.ttsOutput.Close()
+	s.ttsOutput = nil
+}
+
+// resetTTSOutput drops audio held by the output converter and the Ogg
+// stream, e.g. after an interruption.
+func (s *session) resetTTSOutput() {
+	s.ttsMu.Lock()
+	defer s.ttsMu.Unlock()
+	s.ttsOutput.Close()
+	s.ttsOutput = nil
+	s.dropTTSOgg()
+}
+
+func (s *session) sendConvertedTTS(pcm []int16) {
+	if len(pcm) == 0 {
+		return
+	}
+	s.sendAudioChunk(audio.Int16SliceToBytesInto(nil, pcm), nil, s.ttsOutputOut.rate, s.ttsOutputOut.channels)
+}
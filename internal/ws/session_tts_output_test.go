@@ -0,0 +1,40 @@
+package ws
+
+import "testing"
+
+func TestChannelOnlyOutputPreference(t *testing.T) {
+	backend := newFakeBackend(t)
+	_, url := newTestHandler(t, backend, nil)
+
+	c := dialTestClient(t, url)
+	waitListening(c)
+	c.send(map[string]any{"type": "client-capabilities", "audio_output_channels": 2})
+	if got := c.expect("client-capabilities")["audio_output_channels"]; got != float64(2) {
+		t.Fatalf("audio_output_channels=%v, want 2", got)
+	}
+
+	c.send(map[string]any{"type": "text-input", "text": "speak"})
+	msg := c.expect("audio")
+	if msg["audio_channels"] != float64(2) || msg["audio_sample_rate"] != float64(16000) {
+		t.Fatalf("audio format=%v/%v, want 16000/2", msg["audio_sample_rate"], msg["audio_channels"])
+	}
+	// The reply ends with a flush of the output converter.
+	for c.expect("control")["text"] != "conversation-chain-end" {
+	}
+}
+
+func TestOutputRateMustBeStandard(t *testing.T) {
+	backend := newFakeBackend(t)
+	_, url := newTestHandler(t, backend, nil)
+
+	c := dialTestClient(t, url)
+	waitListening(c)
+	c.send(map[string]any{"type": "client-capabilities", "audio_output_sample_rate": 44101})
+	if got := c.expect("client-capabilities")["audio_output_sample_rate"]; got != float64(0) {
+		t.Fatalf("audio_output_sample_rate=%v, want 0 for 44101", got)
+	}
+	c.send(map[string]any{"type": "client-capabilities", "audio_output_sample_rate": 44100})
+	if got := c.expect("client-capabilities")["audio_output_sample_rate"]; got != float64(44100) {
+		t.Fatalf("audio_output_sample_rate=%v, want 44100", got)
+	}
+}
@@ -0,0 +1,60 @@
+package ws
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/pkg/xiaozhi"
+)
+
+// xiaozhiConfig describes the XiaoZhi connection for deviceID, falling back
+// to the configured device and then to one of the session's own.
+func (h *Handler) xiaozhiConfig(deviceID string, sessionID string) xiaozhi.Config {
+	return xiaozhi.Config{
+		BackendURL:      h.config.XiaoZhiBackendURL,
+		ProtocolVersion: h.config.XiaoZhiProtocolVersion,
+		AudioParams: xiaozhi.AudioParams{
+			Format:        h.config.XiaoZhiAudioFormat,
+			OutputFormat:  h.config.XiaoZhiOutputFormat,
+			SampleRate:    h.config.XiaoZhiSampleRate,
+			Channels:      h.config.XiaoZhiChannels,
+			FrameDuration: h.config.XiaoZhiFrameDuration,
+		},
+		ListenMode:  h.config.XiaoZhiListenMode,
+		DeviceID:    fallbackID(deviceID, fallbackID(h.config.XiaoZhiDeviceID, "mio-device-"+sessionID)),
+		ClientID:    fallbackID(h.config.XiaoZhiClientID, "mio-client-"+sessionID),
+		AccessToken: h.config.XiaoZhiAccessToken,
+		FeatureAEC:  h.config.XiaoZhiFeatureAEC,
+	}
+}
+
+// revokeUpstream closes the session after another one took its XiaoZhi
+// connection over. The session is not kept for resumption.
+func (s *session) revokeUpstream() {
+	s.logger.Info("xiaozhi connection handed off",
+		zap.String("session_id", s.clientUID),
+		zap.String("device_id", s.deviceID),
+	)
+	s.sendJSON(map[string]any{"type": "upstream-handoff", "message": "conversation moved to another client"})
+	s.handler.forgetResumeToken(s.resumeToken)
+
+	s.sendMu.Lock()
+	conn := s.conn
+	s.revoked = true
+	detached := conn == nil && !s.closed
+	if detached {
+		s.closed = true
+	}
+	s.sendMu.Unlock()
+	if conn != nil {
+		// The read loop ends and closes the revoked session.
+		_ = conn.Close()
+		return
+	}
+	if detached {
+		go func() {
+			s.readMu.Lock()
+			defer s.readMu.Unlock()
+			s.close()
+		}()
+	}
+}
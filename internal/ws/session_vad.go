@@ -0,0 +1,89 @@
+package ws
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/pkg/audio"
+)
+
+// vadActive reports whether server-side VAD gates mic input. Manual mode
+// leaves turn-taking to the client.
+func (s *session) vadActive() bool {
+	return s.handler.config.SystemConfig.VAD.Enabled && s.getListenMode() != "manual"
+}
+
+func (s *session) micVAD() *audio.VAD {
+	if s.vad == nil {
+		cfg := s.handler.config.SystemConfig.VAD
+		s.vad = audio.NewVAD(audio.VADConfig{
+			SampleRate:   s.sampleRate,
+			Channels:     s.channels,
+			ThresholdDB:  cfg.ThresholdDB,
+			MinSpeechMs:  cfg.MinSpeechMs,
+			EndSilenceMs: cfg.EndSilenceMs,
+			PreRollMs:    cfg.PreRollMs,
+		})
+	}
+	return s.vad
+}
+
+// forwardMicFrame cancels echo from a resampled mic frame, preprocesses it
+// and sends it upstream, dropping leading silence when VAD is active. The end of a turn is handled by
+// finishVADTurn once the current chunk is processed.
+func (s *session) forwardMicFrame(ctx context.Context, frame []int16) {
+	// As in WebRTC APM, the canceller sees the raw mic signal; noise
+	// suppression and AGC would distort the echo it has to match.
+	frame = s.cancelEcho(frame)
+	frame = s.audioProcessor.Process(frame, s.sampleRate, s.channels)
+	s.detectBargeIn(ctx, frame)
+	if !s.vadActive() {
+		s.sendPCMFrame(ctx, frame)
+		return
+	}
+	result := s.micVAD().Push(frame)
+	if result.Event == audio.VADSpeechStart {
+		s.vadTurnEnded = false
+		s.logger.Debug("vad speech start",
+			zap.String("session_id", s.clientUID),
+			zap.Int("pre_roll_frames", len(result.Frames)-1),
+		)
+	}
+	for _, f := range result.Frames {
+		s.sendPCMFrame(ctx, f)
+	}
+	if result.Event == audio.VADSpeechEnd {
+		s.vadEndPending = true
+	}
+}
+
+// finishVADTurn commits the mic turn after VAD detected trailing silence.
+func (s *session) finishVADTurn(ctx context.Context) {
+	if !s.vadEndPending {
+		return
+	}
+	s.vadEndPending = false
+	s.logger.Info("vad speech end", zap.String("session_id", s.clientUID))
+	s.handleMicEnd(ctx)
+	s.vadTurnEnded = true
+}
+
+// handleClientMicEnd handles mic-audio-end from the client, skipping it
+// when VAD already committed the turn.
+func (s *session) handleClientMicEnd(ctx context.Context) {
+	if s.vadActive() && s.vadTurnEnded {
+		s.vadTurnEnded = false
+		s.resetVAD()
+		s.logger.Debug("mic end already committed by vad", zap.String("session_id", s.clientUID))
+		return
+	}
+	s.handleMicEnd(ctx)
+}
+
+func (s *session) resetVAD() {
+	if s.vad != nil {
+		s.vad.Reset()
+	}
+	s.vadEndPending = false
+}
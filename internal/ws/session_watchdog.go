@@ -0,0 +1,90 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/saker-ai/vtuber-server/internal/session/fsm"
+)
+
+// startWatchdog arms the configured per-state deadlines.
+func (s *session) startWatchdog() {
+	cfg := s.handler.config.SystemConfig.SessionTimeouts
+	if !cfg.Enabled {
+		return
+	}
+	deadlines := map[fsm.State]time.Duration{
+		fsm.StateProcessingASR: time.Duration(cfg.ProcessingASRSeconds) * time.Second,
+		fsm.StateProcessingLLM: time.Duration(cfg.ProcessingLLMSeconds) * time.Second,
+		fsm.StateSendingTTS:    time.Duration(cfg.SendingTTSSeconds) * time.Second,
+		fsm.StateInterrupted:   time.Duration(cfg.InterruptedSeconds) * time.Second,
+	}
+	s.watchdog = fsm.NewWatchdog(s.stateMachine, deadlines, func(t fsm.Timeout) {
+		// The timer fires on its own goroutine; recover where client
+		// messages are handled.
+		queued := s.post(func(ctx context.Context) {
+			s.recoverStateTimeout(ctx, t)
+		})
+		if !queued {
+			s.logger.Warn("session state timeout dropped, task queue full",
+				zap.String("session_id", s.clientUID),
+				zap.String("state", string(t.State)),
+			)
+		}
+	})
+}
+
+func (s *session) stopWatchdog() {
+	if s.watchdog == nil {
+		return
+	}
+	s.watchdog.Stop()
+	counts := s.watchdog.Counts()
+	s.watchdog = nil
+	if len(counts) == 0 {
+		return
+	}
+	fields := []zap.Field{zap.String("session_id", s.clientUID)}
+	for state, n := range counts {
+		fields = append(fields, zap.Int(string(state), n))
+	}
+	s.logger.Info("session state timeouts", fields...)
+}
+
+// recoverStateTimeout gets a session stuck in t.State going again: it
+// aborts the upstream reply, ends the conversation, re-arms listening
+// unless the mic is manual, and tells the client. It does nothing if the
+// session has left t.State since the timeout fired.
+func (s *session) recoverStateTimeout(ctx context.Context, t fsm.Timeout) {
+	if s.stateMachine.State() != t.State {
+		return
+	}
+	s.logger.Warn("session state timeout",
+		zap.String("session_id", s.clientUID),
+		zap.String("state", string(t.State)),
+		zap.String("mode", string(t.Mode)),
+		zap.Duration("after", t.After),
+		zap.Int("count", t.Count),
+	)
+	if err := s.abortUpstream(ctx); err != nil {
+		s.logger.Warn("xiaozhi abort failed", zap.String("session_id", s.clientUID), zap.Error(err))
+	}
+	if s.stateMachine.InConversation() {
+		s.endConversationTo(fsm.StateIdle, "timeout")
+	} else {
+		_ = s.stateMachine.ForceWithReason(fsm.StateIdle, "timeout")
+	}
+	s.sendJSON(map[string]any{
+		"type":    "error",
+		"message": fmt.Sprintf("no response from backend after %s in %s", t.After, t.State),
+	})
+	if t.Mode != fsm.ModeManual {
+		// The upstream may have dropped out of listening without telling
+		// us; start it afresh.
+		s.stopListening()
+		s.ensureListening(ctx, "state-timeout")
+	}
+}
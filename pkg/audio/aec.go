@@ -0,0 +1,236 @@
+package audio
+
+import (
+	"math"
+	"sync"
+)
+
+// Echo canceller defaults.
+const (
+	DefaultAECFilterMs = 64
+	DefaultAECStepSize = 0.5
+
+	aecMaxReferenceSec = 30
+	aecRegularization  = 1e-6
+	aecMinFarPower     = 1e-7
+	aecGeigelRatio     = 0.6
+	aecDoubleTalkMs    = 30
+)
+
+// EchoCancellerConfig tunes an EchoCanceller. Zero values use the defaults.
+type EchoCancellerConfig struct {
+	SampleRate int
+	// Channels is the mic channel count. The echo is estimated on the first
+	// channel and removed from all of them.
+	Channels int
+	// FilterMs is the echo tail the adaptive filter can model.
+	FilterMs int
+	// DelayMs is the expected delay between sending reference audio and its
+	// echo reaching the mic, excluding what the filter covers.
+	DelayMs int
+	// StepSize is the NLMS step size in (0, 2).
+	StepSize float64
+}
+
+// EchoCanceller removes the echo of a far-end reference signal from mic
+// audio with a time-domain NLMS adaptive filter. Adaptation pauses during
+// double talk (Geigel detector) so near-end speech is not cancelled.
+// Reference audio is consumed one sample per mic sample, so both must be
+// at the configured sample rate. It is safe for concurrent use.
+type EchoCanceller struct {
+	mu sync.Mutex
+
+	channels  int
+	taps      int
+	delay     int
+	step      float64
+	maxQueued int
+
+	weights  []float64
+	history  []float64 // newest-first window, duplicated for contiguous reads
+	pos      int
+	power    float64
+	far      []float64
+	holdLeft int
+	holdLen  int
+}
+
+// NewEchoCanceller executes the newEchoCanceller function.
+func NewEchoCanceller(cfg EchoCancellerConfig) *EchoCanceller {
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = 16000
+	}
+	if cfg.Channels <= 0 {
+		cfg.Channels = 1
+	}
+	if cfg.FilterMs <= 0 {
+		cfg.FilterMs = DefaultAECFilterMs
+	}
+	if cfg.StepSize <= 0 || cfg.StepSize >= 2 {
+		cfg.StepSize = DefaultAECStepSize
+	}
+	if cfg.DelayMs < 0 {
+		cfg.DelayMs = 0
+	}
+	taps := maxInt(1, cfg.SampleRate*cfg.FilterMs/1000)
+	return &EchoCanceller{
+		channels:  cfg.Channels,
+		taps:      taps,
+		delay:     cfg.SampleRate * cfg.DelayMs / 1000,
+		step:      cfg.StepSize,
+		maxQueued: cfg.SampleRate * aecMaxReferenceSec,
+		weights:   make([]float64, taps),
+		history:   make([]float64, 2*taps),
+		pos:       taps,
+		holdLen:   cfg.SampleRate * aecDoubleTalkMs / 1000,
+	}
+}
+
+// PushReference queues mono far-end samples, e.g. TTS audio sent to the
+// client. When the queue was empty the configured delay is inserted first.
+func (e *EchoCanceller) PushReference(samples []int16) {
+	if len(samples) == 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.far) == 0 && e.delay > 0 {
+		e.far = append(e.far, make([]float64, e.delay)...)
+	}
+	for _, s := range samples {
+		e.far = append(e.far, float64(s)/32768)
+	}
+	if over := len(e.far) - e.maxQueued; over > 0 {
+		e.far = append(e.far[:0], e.far[over:]...)
+	}
+}
+
+// DropReference drops queued reference audio and keeps the learned echo
+// path.
+func (e *EchoCanceller) DropReference() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.far = nil
+}
+
+// Reset drops queued reference audio and the learned echo path.
+func (e *EchoCanceller) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.far = nil
+	for i := range e.weights {
+		e.weights[i] = 0
+	}
+	for i := range e.history {
+		e.history[i] = 0
+	}
+	e.power = 0
+	e.holdLeft = 0
+}
+
+// Process removes echo from an interleaved mic frame in place and returns
+// it.
+func (e *EchoCanceller) Process(frame []int16) []int16 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	samples := len(frame) / e.channels
+	if samples == 0 {
+		return frame
+	}
+	if len(e.far) == 0 && e.power == 0 {
+		// Nothing was played recently; leave the mic untouched.
+		return frame
+	}
+	farMax := e.windowMax()
+	for n := 0; n < samples; n++ {
+		x := 0.0
+		if len(e.far) > 0 {
+			x = e.far[0]
+			e.far = e.far[1:]
+		}
+		e.pushHistory(x)
+		if ax := math.Abs(x); ax > farMax {
+			farMax = ax
+		}
+		window := e.history[e.pos : e.pos+e.taps]
+
+		estimate := 0.0
+		for i, w := range e.weights {
+			estimate += w * window[i]
+		}
+		d := float64(frame[n*e.channels]) / 32768
+		residual := d - estimate
+
+		if math.Abs(d) > aecGeigelRatio*farMax && farMax > 0 {
+			e.holdLeft = e.holdLen
+		}
+		if e.holdLeft > 0 {
+			e.holdLeft--
+		} else if e.power > aecMinFarPower*float64(e.taps) {
+			g := e.step * residual / (e.power + aecRegularization)
+			for i := range e.weights {
+				e.weights[i] += g * window[i]
+			}
+		}
+
+		for ch := 0; ch < e.channels; ch++ {
+			idx := n*e.channels + ch
+			frame[idx] = clampInt16(float64(frame[idx]) - estimate*32768)
+		}
+	}
+	if len(e.far) == 0 {
+		e.far = nil
+	}
+	return frame
+}
+
+// pushHistory adds the newest reference sample and keeps the window power
+// current. The power is recomputed whenever the window wraps to stop
+// rounding drift.
+func (e *EchoCanceller) pushHistory(x float64) {
+	oldest := e.history[e.pos+e.taps-1]
+	e.pos--
+	if e.pos < 0 {
+		copy(e.history[e.taps+1:], e.history[:e.taps-1])
+		e.pos = e.taps
+		e.history[e.pos] = x
+		e.power = 0
+		for _, v := range e.history[e.pos : e.pos+e.taps] {
+			e.power += v * v
+		}
+		return
+	}
+	e.history[e.pos] = x
+	e.power += x*x - oldest*oldest
+	if e.power < 0 {
+		e.power = 0
+	}
+}
+
+func (e *EchoCanceller) windowMax() float64 {
+	max := 0.0
+	for _, v := range e.history[e.pos : e.pos+e.taps] {
+		if a := math.Abs(v); a > max {
+			max = a
+		}
+	}
+	return max
+}
+
+func clampInt16(v float64) int16 {
+	v = math.Round(v)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
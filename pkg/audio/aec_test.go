@@ -0,0 +1,143 @@
+package audio
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// echoPath convolves far with a short room response: a direct path after
+// 40 samples and two decaying reflections.
+func echoPath(far []float64) []float64 {
+	taps := map[int]float64{40: 0.5, 95: -0.2, 170: 0.08}
+	out := make([]float64, len(far))
+	for n := range out {
+		for delay, gain := range taps {
+			if n-delay >= 0 {
+				out[n] += gain * far[n-delay]
+			}
+		}
+	}
+	return out
+}
+
+func speechLikeNoise(rng *rand.Rand, samples int, amplitude float64) []float64 {
+	out := make([]float64, samples)
+	prev := 0.0
+	for i := range out {
+		// Low-passed noise with a slow envelope, loosely speech shaped.
+		prev = 0.7*prev + 0.3*(rng.Float64()*2-1)
+		env := 0.5 + 0.5*math.Sin(2*math.Pi*3*float64(i)/16000)
+		out[i] = amplitude * env * prev
+	}
+	return out
+}
+
+func toPCM(samples []float64) []int16 {
+	out := make([]int16, len(samples))
+	for i, v := range samples {
+		out[i] = clampInt16(v * 32768)
+	}
+	return out
+}
+
+func power(samples []int16) float64 {
+	sum := 0.0
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return sum / float64(maxInt(1, len(samples)))
+}
+
+func TestEchoCancellerConvergesOnSyntheticEcho(t *testing.T) {
+	const rate, seconds, frame = 16000, 4, 320
+	rng := rand.New(rand.NewSource(3))
+	far := speechLikeNoise(rng, rate*seconds, 0.6)
+	mic := toPCM(echoPath(far))
+
+	aec := NewEchoCanceller(EchoCancellerConfig{SampleRate: rate, Channels: 1, FilterMs: 16})
+	aec.PushReference(toPCM(far))
+	out := make([]int16, 0, len(mic))
+	for i := 0; i+frame <= len(mic); i += frame {
+		chunk := append([]int16(nil), mic[i:i+frame]...)
+		out = append(out, aec.Process(chunk)...)
+	}
+
+	tail := len(out) - rate
+	echo := power(mic[tail:len(out)])
+	residual := power(out[tail:])
+	erle := 10 * math.Log10(echo/math.Max(residual, 1e-9))
+	if erle < 20 {
+		t.Fatalf("ERLE=%.1f dB after convergence, want >= 20 dB", erle)
+	}
+}
+
+func TestEchoCancellerKeepsNearEndSpeech(t *testing.T) {
+	const rate, frame = 16000, 320
+	rng := rand.New(rand.NewSource(4))
+	far := speechLikeNoise(rng, rate*3, 0.3)
+	echo := echoPath(far)
+
+	aec := NewEchoCanceller(EchoCancellerConfig{SampleRate: rate, Channels: 1, FilterMs: 16})
+	aec.PushReference(toPCM(far))
+	near := make([]float64, len(far))
+	for i := 2 * rate; i < len(near); i++ {
+		near[i] = 0.5 * math.Sin(2*math.Pi*220*float64(i)/rate)
+	}
+	mixed := make([]float64, len(far))
+	for i := range mixed {
+		mixed[i] = echo[i] + near[i]
+	}
+	mic := toPCM(mixed)
+	out := make([]int16, 0, len(mic))
+	for i := 0; i+frame <= len(mic); i += frame {
+		chunk := append([]int16(nil), mic[i:i+frame]...)
+		out = append(out, aec.Process(chunk)...)
+	}
+
+	nearPCM := toPCM(near[2*rate : len(out)])
+	kept := power(nearPCM)
+	diff := make([]int16, len(nearPCM))
+	for i := range diff {
+		diff[i] = out[2*rate+i] - nearPCM[i]
+	}
+	// The near-end tone must come through largely intact during double talk.
+	if snr := 10 * math.Log10(kept/math.Max(power(diff), 1e-9)); snr < 10 {
+		t.Fatalf("near-end SNR=%.1f dB, want >= 10 dB", snr)
+	}
+}
+
+func TestEchoCancellerPassesThroughWithoutReference(t *testing.T) {
+	aec := NewEchoCanceller(EchoCancellerConfig{SampleRate: 16000, Channels: 1})
+	frame := []int16{100, -200, 300, -400}
+	got := aec.Process(append([]int16(nil), frame...))
+	for i := range frame {
+		if got[i] != frame[i] {
+			t.Fatalf("sample %d=%d, want %d", i, got[i], frame[i])
+		}
+	}
+}
+
+func TestEchoCancellerDelaysReference(t *testing.T) {
+	aec := NewEchoCanceller(EchoCancellerConfig{SampleRate: 16000, Channels: 1, DelayMs: 10})
+	aec.PushReference([]int16{1000})
+	aec.mu.Lock()
+	queued := len(aec.far)
+	aec.mu.Unlock()
+	if queued != 161 {
+		t.Fatalf("queued=%d, want 161", queued)
+	}
+}
+
+func TestEchoCancellerDropReferenceKeepsEchoPath(t *testing.T) {
+	aec := NewEchoCanceller(EchoCancellerConfig{SampleRate: 16000, Channels: 1})
+	aec.PushReference([]int16{1000, 2000})
+	aec.weights[0] = 0.5
+	aec.DropReference()
+	aec.mu.Lock()
+	queued, weight := len(aec.far), aec.weights[0]
+	aec.mu.Unlock()
+	if queued != 0 || weight != 0.5 {
+		t.Fatalf("queued=%d weight=%v, want 0 0.5", queued, weight)
+	}
+}
@@ -0,0 +1,365 @@
+package audio
+
+import (
+	"math"
+	"time"
+
+	"github.com/saker-ai/vtuber-server/pkg/audio/opusx"
+)
+
+// Jitter buffer defaults.
+const (
+	DefaultJitterFirstChunkMs = 60
+	DefaultJitterMinDelayMs   = 60
+	DefaultJitterMaxDelayMs   = 600
+	DefaultJitterChunkMs      = 300
+	DefaultJitterMaxConcealMs = 200
+
+	jitterFrameMs      = 20
+	jitterMaxPacketMs  = 120
+	jitterRiseGain     = 0.25
+	jitterFallGain     = 1.0 / 64
+	jitterTargetFactor = 2
+	jitterBoostDecay   = 0.995
+	jitterMaxGap       = 50
+)
+
+// JitterBufferConfig tunes a JitterBuffer. Zero values use the defaults.
+type JitterBufferConfig struct {
+	SampleRate int
+	Channels   int
+	// FirstChunkMs is sent as soon as it is decoded so playback starts early.
+	FirstChunkMs int
+	// MinDelayMs and MaxDelayMs bound the target depth of audio kept queued
+	// on the client.
+	MinDelayMs int
+	MaxDelayMs int
+	// ChunkMs is the largest chunk emitted at once.
+	ChunkMs int
+	// MaxConcealMs caps the concealment generated for one gap; after that
+	// playback skips to the next packet.
+	MaxConcealMs int
+}
+
+// JitterStats summarizes the current stream of a JitterBuffer.
+type JitterStats struct {
+	Packets   int
+	Late      int
+	Concealed int
+	Recovered int
+	Underruns int
+	JitterMs  float64
+	TargetMs  float64
+}
+
+// JitterBuffer paces decoded Opus audio to a client that plays it as it
+// arrives. It mirrors the client's playout clock to know how much audio is
+// still queued there, holds data back into larger chunks while that is above
+// the target depth, and sends what it has when it drops below. The target
+// follows the arrival jitter and grows after underruns. Packets are
+// numbered by the caller, one number per packet sent, so a gap in the
+// numbers is a lost packet. When the client is about to run dry and a later
+// packet shows such a gap, it is filled in with FEC from the packet after
+// it, or Opus PLC. Running out of packets is taken as a pause and left
+// silent. Time is passed in so it can be driven by a ticker. It is not safe
+// for concurrent use.
+type JitterBuffer struct {
+	cfg     JitterBufferConfig
+	decoder *opusx.Decoder
+	scratch []int16
+
+	packets map[uint32][]byte
+	nextSeq uint32
+	haveSeq bool
+
+	firstArrival time.Time
+	mediaMs      float64
+	minTransit   float64
+	jitterMs     float64
+	boostMs      float64
+	frameMs      float64
+
+	pcm         []int16
+	started     bool
+	playStart   time.Time
+	emittedMs   float64
+	concealedMs float64
+	dry         bool
+	stats       JitterStats
+}
+
+// NewJitterBuffer executes the newJitterBuffer function.
+func NewJitterBuffer(cfg JitterBufferConfig) (*JitterBuffer, error) {
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = 16000
+	}
+	if cfg.Channels <= 0 {
+		cfg.Channels = 1
+	}
+	if cfg.FirstChunkMs <= 0 {
+		cfg.FirstChunkMs = DefaultJitterFirstChunkMs
+	}
+	if cfg.MinDelayMs <= 0 {
+		cfg.MinDelayMs = DefaultJitterMinDelayMs
+	}
+	if cfg.MaxDelayMs < cfg.MinDelayMs {
+		cfg.MaxDelayMs = maxInt(DefaultJitterMaxDelayMs, cfg.MinDelayMs)
+	}
+	if cfg.ChunkMs <= 0 {
+		cfg.ChunkMs = DefaultJitterChunkMs
+	}
+	if cfg.MaxConcealMs <= 0 {
+		cfg.MaxConcealMs = DefaultJitterMaxConcealMs
+	}
+	decoder, err := opusx.NewDecoder(cfg.SampleRate, cfg.Channels)
+	if err != nil {
+		return nil, err
+	}
+	return &JitterBuffer{
+		cfg:     cfg,
+		decoder: decoder,
+		scratch: make([]int16, cfg.SampleRate*jitterMaxPacketMs/1000*cfg.Channels),
+		packets: map[uint32][]byte{},
+		frameMs: jitterFrameMs,
+	}, nil
+}
+
+// Push queues an Opus packet received at now. Packets older than the
+// playout position are dropped.
+func (j *JitterBuffer) Push(seq uint32, packet []byte, now time.Time) {
+	j.stats.Packets++
+	if !j.haveSeq {
+		j.nextSeq = seq
+		j.haveSeq = true
+	} else if int32(seq-j.nextSeq) < 0 {
+		j.stats.Late++
+		return
+	}
+	j.packets[seq] = packet
+
+	// Transit time relative to the fastest packet so far measures how late
+	// this one is; rises are tracked quickly, recovery slowly.
+	if j.firstArrival.IsZero() {
+		j.firstArrival = now
+	}
+	transit := float64(now.Sub(j.firstArrival).Milliseconds()) - j.mediaMs
+	if transit < j.minTransit {
+		j.minTransit = transit
+	}
+	if samples, err := OpusPacketSamples(packet); err == nil {
+		j.mediaMs += float64(samples) * 1000 / oggOpusGranuleRate
+	} else {
+		j.mediaMs += j.frameMs
+	}
+	spread := transit - j.minTransit
+	gain := jitterFallGain
+	if spread > j.jitterMs {
+		gain = jitterRiseGain
+	}
+	j.jitterMs += (spread - j.jitterMs) * gain
+}
+
+// Pop returns the chunks due at now, each at most ChunkMs long.
+func (j *JitterBuffer) Pop(now time.Time) [][]int16 {
+	j.decodeReady()
+	if !j.started {
+		if j.pcmMs() < float64(j.cfg.FirstChunkMs) {
+			return nil
+		}
+		j.started = true
+		j.playStart = now
+		first := j.take(float64(j.cfg.FirstChunkMs))
+		return append([][]int16{first}, j.Pop(now)...)
+	}
+
+	level := j.emittedMs - float64(now.Sub(j.playStart).Milliseconds())
+	if level < 0 {
+		// The client ran dry; move its clock to now.
+		if !j.dry {
+			j.dry = true
+			j.stats.Underruns++
+			j.boostMs = math.Min(j.boostMs+j.frameMs, float64(j.cfg.MaxDelayMs))
+		}
+		j.playStart = now.Add(-time.Duration(j.emittedMs) * time.Millisecond)
+		level = 0
+	}
+	if level < j.frameMs/2 && len(j.pcm) == 0 && len(j.packets) > 0 {
+		j.conceal()
+	}
+
+	target := j.targetMs()
+	var out [][]int16
+	for len(j.pcm) > 0 {
+		avail := j.pcmMs()
+		if level >= target && avail < float64(j.cfg.ChunkMs) {
+			break
+		}
+		chunk := j.take(math.Min(avail, float64(j.cfg.ChunkMs)))
+		level += j.samplesMs(len(chunk))
+		out = append(out, chunk)
+		j.dry = false
+	}
+	j.boostMs *= jitterBoostDecay
+	return out
+}
+
+// Flush decodes every queued packet, filling gaps, and returns the rest of
+// the stream. The buffer is then reset for the next stream.
+func (j *JitterBuffer) Flush() [][]int16 {
+	for len(j.packets) > 0 {
+		j.decodeReady()
+		if len(j.packets) > 0 {
+			j.recoverGap()
+		}
+	}
+	var out [][]int16
+	for len(j.pcm) > 0 {
+		out = append(out, j.take(math.Min(j.pcmMs(), float64(j.cfg.ChunkMs))))
+	}
+	j.Reset()
+	return out
+}
+
+// Reset drops queued audio and restarts the playout clock. Jitter history
+// is kept across streams.
+func (j *JitterBuffer) Reset() {
+	j.packets = map[uint32][]byte{}
+	j.haveSeq = false
+	j.firstArrival = time.Time{}
+	j.mediaMs = 0
+	j.minTransit = 0
+	j.pcm = nil
+	j.started = false
+	j.emittedMs = 0
+	j.concealedMs = 0
+	j.dry = false
+	j.stats = JitterStats{}
+}
+
+// Stats returns the counters and current estimates.
+func (j *JitterBuffer) Stats() JitterStats {
+	stats := j.stats
+	stats.JitterMs = j.jitterMs
+	stats.TargetMs = j.targetMs()
+	return stats
+}
+
+func (j *JitterBuffer) targetMs() float64 {
+	target := jitterTargetFactor*j.jitterMs + j.boostMs
+	return math.Max(float64(j.cfg.MinDelayMs), math.Min(target, float64(j.cfg.MaxDelayMs)))
+}
+
+// decodeReady decodes queued packets in order up to the first gap.
+func (j *JitterBuffer) decodeReady() {
+	for {
+		packet, ok := j.packets[j.nextSeq]
+		if !ok {
+			return
+		}
+		delete(j.packets, j.nextSeq)
+		j.nextSeq++
+		n, err := j.decoder.Decode(packet, j.scratch)
+		if err != nil {
+			// A corrupt packet counts as lost.
+			j.decodeLost(j.packets[j.nextSeq])
+			continue
+		}
+		j.frameMs = float64(n) * 1000 / float64(j.cfg.SampleRate)
+		j.pcm = append(j.pcm, j.scratch[:n*j.cfg.Channels]...)
+		j.concealedMs = 0
+	}
+}
+
+// conceal fills in for the missing packet at the playout position, which
+// a later packet shows is lost, within MaxConcealMs per gap. Past that it
+// skips to the later packet.
+func (j *JitterBuffer) conceal() {
+	if j.concealedMs >= float64(j.cfg.MaxConcealMs) {
+		if lowest, ok := j.lowestSeq(); ok {
+			j.nextSeq = lowest
+		}
+	} else {
+		j.recoverGap()
+	}
+	j.decodeReady()
+}
+
+// recoverGap gives up on the missing packet at the playout position and
+// conceals it, skipping ahead when the gap is implausibly large.
+func (j *JitterBuffer) recoverGap() {
+	lowest, found := j.lowestSeq()
+	if !found {
+		return
+	}
+	if lowest-j.nextSeq > jitterMaxGap {
+		j.nextSeq = lowest
+		return
+	}
+	j.nextSeq++
+	if j.nextSeq == lowest {
+		j.decodeLost(j.packets[lowest])
+		return
+	}
+	j.decodeLost(nil)
+}
+
+// lowestSeq returns the oldest queued packet number.
+func (j *JitterBuffer) lowestSeq() (uint32, bool) {
+	lowest, found := uint32(0), false
+	for seq := range j.packets {
+		if !found || int32(seq-lowest) < 0 {
+			lowest, found = seq, true
+		}
+	}
+	return lowest, found
+}
+
+// decodeLost produces one frame of concealment, from next's FEC data when
+// the following packet is available.
+func (j *JitterBuffer) decodeLost(next []byte) {
+	frame := int(j.frameMs*float64(j.cfg.SampleRate)/1000) * j.cfg.Channels
+	if frame <= 0 || frame > len(j.scratch) {
+		return
+	}
+	buf := j.scratch[:frame:frame]
+	var (
+		n   int
+		err error
+	)
+	if len(next) > 0 {
+		n, err = j.decoder.DecodeFEC(next, buf)
+		if err == nil {
+			j.stats.Recovered++
+		}
+	} else {
+		n, err = j.decoder.DecodePLC(buf)
+		if err == nil {
+			j.stats.Concealed++
+		}
+	}
+	if err != nil {
+		return
+	}
+	j.pcm = append(j.pcm, buf[:n*j.cfg.Channels]...)
+	j.concealedMs += j.samplesMs(n * j.cfg.Channels)
+}
+
+func (j *JitterBuffer) take(ms float64) []int16 {
+	n := int(ms*float64(j.cfg.SampleRate)/1000) * j.cfg.Channels
+	n = min(n, len(j.pcm))
+	chunk := append([]int16(nil), j.pcm[:n]...)
+	j.pcm = j.pcm[n:]
+	if len(j.pcm) == 0 {
+		j.pcm = nil
+	}
+	j.emittedMs += j.samplesMs(n)
+	return chunk
+}
+
+func (j *JitterBuffer) pcmMs() float64 {
+	return j.samplesMs(len(j.pcm))
+}
+
+func (j *JitterBuffer) samplesMs(samples int) float64 {
+	return float64(samples/j.cfg.Channels) * 1000 / float64(j.cfg.SampleRate)
+}
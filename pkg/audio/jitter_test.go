@@ -0,0 +1,163 @@
+package audio
+
+import (
+	"testing"
+	"time"
+)
+
+const ttsTestTick = 20 * time.Millisecond
+
+func jitterTotalMs(chunks [][]int16, sampleRate int) int {
+	samples := 0
+	for _, c := range chunks {
+		samples += len(c)
+	}
+	return samples * 1000 / sampleRate
+}
+
+func newTestJitterBuffer(t *testing.T) *JitterBuffer {
+	t.Helper()
+	j, err := NewJitterBuffer(JitterBufferConfig{SampleRate: 16000, Channels: 1})
+	if err != nil {
+		t.Fatalf("NewJitterBuffer error: %v", err)
+	}
+	return j
+}
+
+func TestJitterBufferSendsSmallFirstChunk(t *testing.T) {
+	packets := encodeSinePackets(t, 16000, 10)
+	j := newTestJitterBuffer(t)
+	start := time.Unix(0, 0)
+	var first [][]int16
+	for i := 0; i < 3; i++ {
+		now := start.Add(time.Duration(i*20) * time.Millisecond)
+		j.Push(uint32(i), packets[i], now)
+		if first = j.Pop(now); first != nil {
+			if i != 2 {
+				t.Fatalf("first chunk after %d packets, want 3", i+1)
+			}
+		}
+	}
+	if len(first) == 0 || len(first[0]) != 16000*DefaultJitterFirstChunkMs/1000 {
+		t.Fatalf("first chunk=%v, want %d samples", len(first), 16000*DefaultJitterFirstChunkMs/1000)
+	}
+}
+
+func TestJitterBufferSteadyStreamIsLossless(t *testing.T) {
+	packets := encodeSinePackets(t, 16000, 50)
+	j := newTestJitterBuffer(t)
+	start := time.Unix(0, 0)
+	var out [][]int16
+	for i, packet := range packets {
+		now := start.Add(time.Duration(i*20) * time.Millisecond)
+		j.Push(uint32(i), packet, now)
+		out = append(out, j.Pop(now)...)
+	}
+	stats := j.Stats()
+	out = append(out, j.Flush()...)
+	if got := jitterTotalMs(out, 16000); got != 50*20 {
+		t.Fatalf("output=%d ms, want %d ms", got, 50*20)
+	}
+	if stats.Concealed != 0 || stats.Underruns != 0 {
+		t.Fatalf("stats=%+v, want no concealment or underruns", stats)
+	}
+}
+
+func TestJitterBufferLeavesStallSilentAndAdapts(t *testing.T) {
+	packets := encodeSinePackets(t, 16000, 40)
+	j := newTestJitterBuffer(t)
+	start := time.Unix(0, 0)
+	now := start
+	var out [][]int16
+	for i, packet := range packets {
+		arrival := start.Add(time.Duration(i*20) * time.Millisecond)
+		if i >= 20 {
+			// The backend stalls for 300 ms halfway through.
+			arrival = arrival.Add(300 * time.Millisecond)
+		}
+		for ; now.Before(arrival); now = now.Add(10 * time.Millisecond) {
+			out = append(out, j.Pop(now)...)
+		}
+		j.Push(uint32(i), packet, arrival)
+		out = append(out, j.Pop(arrival)...)
+	}
+	stats := j.Stats()
+	if stats.Concealed != 0 || stats.Recovered != 0 {
+		t.Fatalf("stats=%+v, want no concealment without a lost packet", stats)
+	}
+	if stats.Underruns == 0 {
+		t.Fatalf("stats=%+v, want an underrun during the stall", stats)
+	}
+	if stats.TargetMs <= DefaultJitterMinDelayMs {
+		t.Fatalf("target=%.0f ms after a stall, want above %d ms", stats.TargetMs, DefaultJitterMinDelayMs)
+	}
+	out = append(out, j.Flush()...)
+	if got := jitterTotalMs(out, 16000); got != 40*20 {
+		t.Fatalf("output=%d ms, want %d ms", got, 40*20)
+	}
+}
+
+func TestJitterBufferPausesInsertNoPLC(t *testing.T) {
+	packets := encodeSinePackets(t, 16000, 30)
+	j := newTestJitterBuffer(t)
+	start := time.Unix(0, 0)
+	now := start
+	var out [][]int16
+	for i, packet := range packets {
+		// Three sentences of ten packets with 500 ms pauses between them.
+		arrival := start.Add(time.Duration(i*20+i/10*500) * time.Millisecond)
+		for ; now.Before(arrival); now = now.Add(ttsTestTick) {
+			out = append(out, j.Pop(now)...)
+		}
+		j.Push(uint32(i), packet, arrival)
+		out = append(out, j.Pop(arrival)...)
+	}
+	for end := now.Add(time.Second); now.Before(end); now = now.Add(ttsTestTick) {
+		out = append(out, j.Pop(now)...)
+	}
+	stats := j.Stats()
+	if stats.Concealed != 0 || stats.Recovered != 0 {
+		t.Fatalf("stats=%+v, want no concealment across pauses", stats)
+	}
+	out = append(out, j.Flush()...)
+	if got := jitterTotalMs(out, 16000); got != 30*20 {
+		t.Fatalf("output=%d ms, want %d ms", got, 30*20)
+	}
+}
+
+func TestJitterBufferRecoversLostPacket(t *testing.T) {
+	packets := encodeSinePackets(t, 16000, 10)
+	j := newTestJitterBuffer(t)
+	start := time.Unix(0, 0)
+	var out [][]int16
+	for i, packet := range packets {
+		if i == 5 {
+			continue
+		}
+		now := start.Add(time.Duration(i*20) * time.Millisecond)
+		j.Push(uint32(i), packet, now)
+		out = append(out, j.Pop(now)...)
+	}
+	stats := j.Stats()
+	out = append(out, j.Flush()...)
+	if stats.Recovered != 1 {
+		t.Fatalf("stats=%+v, want one recovered packet", stats)
+	}
+	if got := jitterTotalMs(out, 16000); got != 10*20 {
+		t.Fatalf("output=%d ms, want %d ms", got, 10*20)
+	}
+}
+
+func TestJitterBufferDropsLatePackets(t *testing.T) {
+	packets := encodeSinePackets(t, 16000, 4)
+	j := newTestJitterBuffer(t)
+	now := time.Unix(0, 0)
+	j.Push(1, packets[1], now)
+	j.Push(2, packets[2], now)
+	j.Push(3, packets[3], now)
+	j.Pop(now)
+	j.Push(0, packets[0], now)
+	if got := j.Stats().Late; got != 1 {
+		t.Fatalf("late=%d, want 1", got)
+	}
+}
@@ -0,0 +1,610 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+
+	"github.com/saker-ai/vtuber-server/pkg/audio/opusx"
+)
+
+// Ogg Opus (RFC 7845) constants.
+const (
+	oggOpusGranuleRate = 48000
+	oggOpusPreSkip     = 312
+	oggOpusVendor      = "vtuber-server"
+	oggPageHeaderSize  = 27
+	oggMaxSegments     = 255
+	oggMaxPagePayload  = oggMaxSegments * 255
+
+	oggFlagContinued = 0x01
+	oggFlagBOS       = 0x02
+	oggFlagEOS       = 0x04
+)
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// OpusHead is the identification header of an Ogg Opus stream.
+type OpusHead struct {
+	Version         uint8
+	Channels        int
+	PreSkip         int
+	InputSampleRate int
+	OutputGain      int16
+	MappingFamily   uint8
+}
+
+func (h OpusHead) marshal() []byte {
+	buf := make([]byte, 19)
+	copy(buf, "OpusHead")
+	buf[8] = 1
+	buf[9] = byte(h.Channels)
+	binary.LittleEndian.PutUint16(buf[10:], uint16(h.PreSkip))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(h.InputSampleRate))
+	binary.LittleEndian.PutUint16(buf[16:], uint16(h.OutputGain))
+	buf[18] = 0
+	return buf
+}
+
+func parseOpusHead(packet []byte) (OpusHead, error) {
+	if len(packet) < 19 || string(packet[:8]) != "OpusHead" {
+		return OpusHead{}, errors.New("ogg: missing OpusHead")
+	}
+	head := OpusHead{
+		Version:         packet[8],
+		Channels:        int(packet[9]),
+		PreSkip:         int(binary.LittleEndian.Uint16(packet[10:])),
+		InputSampleRate: int(binary.LittleEndian.Uint32(packet[12:])),
+		OutputGain:      int16(binary.LittleEndian.Uint16(packet[16:])),
+		MappingFamily:   packet[18],
+	}
+	if head.Version>>4 != 0 {
+		return OpusHead{}, fmt.Errorf("ogg: unsupported OpusHead version %d", head.Version)
+	}
+	if head.Channels == 0 {
+		return OpusHead{}, errors.New("ogg: OpusHead has no channels")
+	}
+	if head.MappingFamily == 0 && head.Channels > 2 {
+		return OpusHead{}, errors.New("ogg: mapping family 0 allows at most 2 channels")
+	}
+	return head, nil
+}
+
+func marshalOpusTags(vendor string, comments []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("OpusTags")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(vendor)))
+	buf.WriteString(vendor)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(comments)))
+	for _, comment := range comments {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(comment)))
+		buf.WriteString(comment)
+	}
+	return buf.Bytes()
+}
+
+func parseOpusTags(packet []byte) (string, []string, error) {
+	if len(packet) < 16 || string(packet[:8]) != "OpusTags" {
+		return "", nil, errors.New("ogg: missing OpusTags")
+	}
+	rest := packet[8:]
+	readString := func() (string, bool) {
+		if len(rest) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(rest)
+		rest = rest[4:]
+		if uint64(n) > uint64(len(rest)) {
+			return "", false
+		}
+		s := string(rest[:n])
+		rest = rest[n:]
+		return s, true
+	}
+	vendor, ok := readString()
+	if !ok || len(rest) < 4 {
+		return "", nil, errors.New("ogg: malformed OpusTags")
+	}
+	count := binary.LittleEndian.Uint32(rest)
+	rest = rest[4:]
+	comments := []string{}
+	for i := uint32(0); i < count; i++ {
+		comment, ok := readString()
+		if !ok {
+			return "", nil, errors.New("ogg: malformed OpusTags")
+		}
+		comments = append(comments, comment)
+	}
+	return vendor, comments, nil
+}
+
+// OpusPacketSamples returns the duration of an Opus packet in samples at
+// 48 kHz, derived from its TOC byte.
+func OpusPacketSamples(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, errors.New("opus: empty packet")
+	}
+	toc := packet[0]
+	config := int(toc >> 3)
+	var frameSamples int
+	switch {
+	case config < 12:
+		frameSamples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		frameSamples = []int{480, 960}[config%2]
+	default:
+		frameSamples = []int{120, 240, 480, 960}[config%4]
+	}
+	frames := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errors.New("opus: truncated packet")
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	samples := frames * frameSamples
+	if samples > 5760 {
+		return 0, errors.New("opus: packet longer than 120ms")
+	}
+	return samples, nil
+}
+
+// OggOpusWriter muxes Opus packets into an Ogg Opus stream. Each packet goes
+// on its own page so the stream can be cut at any packet boundary.
+type OggOpusWriter struct {
+	w       io.Writer
+	serial  uint32
+	pageSeq uint32
+	granule uint64
+	preSkip int
+	pending []byte
+	closed  bool
+}
+
+// NewOggOpusWriter writes the OpusHead and OpusTags headers for a stream of
+// channels whose source audio was sampled at sampleRate.
+func NewOggOpusWriter(w io.Writer, sampleRate int, channels int) (*OggOpusWriter, error) {
+	return NewOggOpusWriterWithPreSkip(w, sampleRate, channels, oggOpusPreSkip)
+}
+
+// NewOggOpusWriterWithPreSkip is NewOggOpusWriter with an explicit pre-skip
+// in 48 kHz samples. Streams cut from the middle of an encoder's output
+// should use 0 so no audio is dropped at the seams.
+func NewOggOpusWriterWithPreSkip(w io.Writer, sampleRate int, channels int, preSkip int) (*OggOpusWriter, error) {
+	if channels < 1 || channels > 2 {
+		return nil, fmt.Errorf("ogg: unsupported channel count %d", channels)
+	}
+	if preSkip < 0 || preSkip > 0xFFFF {
+		return nil, fmt.Errorf("ogg: invalid pre-skip %d", preSkip)
+	}
+	ow := &OggOpusWriter{w: w, serial: rand.Uint32(), preSkip: preSkip}
+	head := OpusHead{Version: 1, Channels: channels, PreSkip: preSkip, InputSampleRate: sampleRate}
+	if err := ow.writePacket(head.marshal(), 0, oggFlagBOS); err != nil {
+		return nil, err
+	}
+	if err := ow.writePacket(marshalOpusTags(oggOpusVendor, nil), 0, 0); err != nil {
+		return nil, err
+	}
+	return ow, nil
+}
+
+// WritePacket appends one Opus packet. Packets are held back by one so the
+// last one can carry the end-of-stream flag.
+func (w *OggOpusWriter) WritePacket(packet []byte) error {
+	if w.closed {
+		return errors.New("ogg: write after close")
+	}
+	samples, err := OpusPacketSamples(packet)
+	if err != nil {
+		return err
+	}
+	if w.pending != nil {
+		if err := w.flushPending(0); err != nil {
+			return err
+		}
+	}
+	w.pending = append([]byte(nil), packet...)
+	w.granule += uint64(samples)
+	return nil
+}
+
+// Granule returns the granule position after the packets written so far.
+func (w *OggOpusWriter) Granule() uint64 {
+	return w.granule
+}
+
+// Close writes the last page with the end-of-stream flag. It does not close
+// the underlying writer.
+func (w *OggOpusWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.pending == nil {
+		return w.writePage(nil, nil, w.granule, oggFlagEOS)
+	}
+	return w.flushPending(oggFlagEOS)
+}
+
+// CloseTrimmed is Close for a stream whose source audio is samples 48 kHz
+// samples long. The final granule position is cut back to end the stream
+// there, so decoders drop the silence a short last packet was padded with.
+func (w *OggOpusWriter) CloseTrimmed(samples uint64) error {
+	if end := uint64(w.preSkip) + samples; !w.closed && end < w.granule {
+		w.granule = end
+	}
+	return w.Close()
+}
+
+func (w *OggOpusWriter) flushPending(flags byte) error {
+	packet := w.pending
+	w.pending = nil
+	return w.writePacket(packet, w.granule, flags)
+}
+
+// writePacket lays packet out over as many pages as it needs. Only the page
+// that completes the packet carries granule; the others use -1.
+func (w *OggOpusWriter) writePacket(packet []byte, granule uint64, flags byte) error {
+	first := true
+	for {
+		chunk := packet
+		if len(chunk) > oggMaxPagePayload {
+			chunk = chunk[:oggMaxPagePayload]
+		}
+		packet = packet[len(chunk):]
+		complete := len(packet) == 0 && len(chunk) < oggMaxPagePayload
+		segments := make([]byte, 0, len(chunk)/255+1)
+		for n := len(chunk); n >= 255; n -= 255 {
+			segments = append(segments, 255)
+		}
+		if complete {
+			segments = append(segments, byte(len(chunk)%255))
+		}
+		pageFlags := flags &^ oggFlagEOS
+		if !first {
+			pageFlags = oggFlagContinued
+		}
+		pageGranule := ^uint64(0)
+		if complete {
+			pageGranule = granule
+			pageFlags |= flags & oggFlagEOS
+		}
+		if err := w.writePage(segments, chunk, pageGranule, pageFlags); err != nil {
+			return err
+		}
+		if complete {
+			return nil
+		}
+		first = false
+	}
+}
+
+func (w *OggOpusWriter) writePage(segments []byte, payload []byte, granule uint64, flags byte) error {
+	page := make([]byte, oggPageHeaderSize+len(segments)+len(payload))
+	copy(page, "OggS")
+	page[4] = 0
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.pageSeq)
+	page[26] = byte(len(segments))
+	copy(page[oggPageHeaderSize:], segments)
+	copy(page[oggPageHeaderSize+len(segments):], payload)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	w.pageSeq++
+	_, err := w.w.Write(page)
+	return err
+}
+
+// OggOpusReader demuxes the Opus packets of a single-stream Ogg Opus file,
+// verifying page checksums and sequence numbers.
+type OggOpusReader struct {
+	r        *bufio.Reader
+	Head     OpusHead
+	Vendor   string
+	Comments []string
+
+	oggStream
+}
+
+// oggStream reassembles packets from the pages of one logical stream.
+type oggStream struct {
+	serial  uint32
+	nextSeq uint32
+	started bool
+	lost    bool
+	eos     bool
+	granule uint64
+	packets [][]byte
+	partial []byte
+}
+
+// NewOggOpusReader reads and validates the OpusHead and OpusTags headers.
+func NewOggOpusReader(r io.Reader) (*OggOpusReader, error) {
+	or := &OggOpusReader{r: bufio.NewReader(r)}
+	headPacket, err := or.nextPacket()
+	if err != nil {
+		return nil, fmt.Errorf("ogg: read OpusHead: %w", err)
+	}
+	if or.Head, err = parseOpusHead(headPacket); err != nil {
+		return nil, err
+	}
+	tagsPacket, err := or.nextPacket()
+	if err != nil {
+		return nil, fmt.Errorf("ogg: read OpusTags: %w", err)
+	}
+	if or.Vendor, or.Comments, err = parseOpusTags(tagsPacket); err != nil {
+		return nil, err
+	}
+	return or, nil
+}
+
+// ReadPacket returns the next audio packet, or io.EOF after the last one.
+func (r *OggOpusReader) ReadPacket() ([]byte, error) {
+	return r.nextPacket()
+}
+
+// Granule returns the granule position of the last page read.
+func (r *OggOpusReader) Granule() uint64 {
+	return r.granule
+}
+
+func (r *OggOpusReader) nextPacket() ([]byte, error) {
+	for len(r.packets) == 0 {
+		if r.eos {
+			return nil, io.EOF
+		}
+		if err := r.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := r.packets[0]
+	r.packets = r.packets[1:]
+	return packet, nil
+}
+
+func (r *OggOpusReader) readPage() error {
+	header := make([]byte, oggPageHeaderSize)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if errors.Is(err, io.EOF) && r.started {
+			// Tolerate streams cut before their EOS page.
+			r.eos = true
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if string(header[:4]) != "OggS" || header[4] != 0 {
+		return errors.New("ogg: invalid page header")
+	}
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(r.r, segments); err != nil {
+		return err
+	}
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return err
+	}
+	return r.addPage(header, segments, payload)
+}
+
+// addPage verifies a page and queues the packets it completes. header is
+// modified.
+func (r *oggStream) addPage(header []byte, segments []byte, payload []byte) error {
+	wantCRC := binary.LittleEndian.Uint32(header[22:])
+	binary.LittleEndian.PutUint32(header[22:], 0)
+	crc := oggCRC(header)
+	for _, b := range segments {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	for _, b := range payload {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	if crc != wantCRC {
+		return errors.New("ogg: page checksum mismatch")
+	}
+
+	flags := header[5]
+	serial := binary.LittleEndian.Uint32(header[14:])
+	seq := binary.LittleEndian.Uint32(header[18:])
+	if !r.started {
+		if flags&oggFlagBOS == 0 {
+			return errors.New("ogg: first page is not a beginning of stream")
+		}
+		r.started = true
+		r.serial = serial
+	} else if serial != r.serial {
+		return errors.New("ogg: multiplexed streams are not supported")
+	} else if seq != r.nextSeq && !r.lost {
+		return fmt.Errorf("ogg: page %d missing", r.nextSeq)
+	}
+	r.nextSeq = seq + 1
+	// The head of a packet continued from a lost page is gone too.
+	skip := r.lost && flags&oggFlagContinued != 0
+	r.lost = false
+	if flags&oggFlagContinued == 0 {
+		r.partial = nil
+	}
+
+	offset := 0
+	for _, s := range segments {
+		if skip {
+			offset += int(s)
+			skip = s == 255
+			continue
+		}
+		r.partial = append(r.partial, payload[offset:offset+int(s)]...)
+		offset += int(s)
+		if s < 255 {
+			r.packets = append(r.packets, r.partial)
+			r.partial = nil
+		}
+	}
+	if granule := binary.LittleEndian.Uint64(header[6:]); granule != ^uint64(0) {
+		r.granule = granule
+	}
+	if flags&oggFlagEOS != 0 {
+		r.eos = true
+	}
+	return nil
+}
+
+// OggOpusDemuxer is a push-based Ogg Opus demuxer for streams that arrive in
+// arbitrary chunks, such as MediaRecorder output. A beginning-of-stream page
+// restarts it, so one demuxer can follow consecutive recordings.
+type OggOpusDemuxer struct {
+	Head OpusHead
+
+	buf     []byte
+	stream  oggStream
+	headers int
+	lost    bool
+}
+
+// Write consumes a chunk and returns the audio packets it completed. Bytes
+// that do not start a page are skipped up to the next capture pattern; the
+// error for them is returned once, along with the packets of the pages
+// after them.
+func (d *OggOpusDemuxer) Write(chunk []byte) ([][]byte, error) {
+	d.buf = append(d.buf, chunk...)
+	var out [][]byte
+	var invalid error
+	for len(d.buf) >= oggPageHeaderSize {
+		if string(d.buf[:4]) != "OggS" || d.buf[4] != 0 {
+			if !d.lost {
+				d.lost = true
+				d.stream.partial = nil
+				d.stream.lost = true
+				invalid = errors.New("ogg: invalid page header")
+			}
+			next := bytes.Index(d.buf[1:], []byte("OggS"))
+			if next < 0 {
+				// Keep what may be the start of a capture pattern.
+				d.buf = append(d.buf[:0], d.buf[len(d.buf)-3:]...)
+				break
+			}
+			d.buf = d.buf[next+1:]
+			continue
+		}
+		d.lost = false
+		segEnd := oggPageHeaderSize + int(d.buf[26])
+		if len(d.buf) < segEnd {
+			break
+		}
+		segments := d.buf[oggPageHeaderSize:segEnd]
+		size := 0
+		for _, s := range segments {
+			size += int(s)
+		}
+		if len(d.buf) < segEnd+size {
+			break
+		}
+		header, payload := d.buf[:oggPageHeaderSize], d.buf[segEnd:segEnd+size]
+		d.buf = d.buf[segEnd+size:]
+		if header[5]&oggFlagBOS != 0 {
+			d.stream = oggStream{}
+			d.headers = 0
+		}
+		if err := d.stream.addPage(header, segments, payload); err != nil {
+			return out, err
+		}
+		for _, packet := range d.stream.packets {
+			switch d.headers {
+			case 0:
+				head, err := parseOpusHead(packet)
+				if err != nil {
+					return out, err
+				}
+				d.Head = head
+				d.headers++
+			case 1:
+				// OpusTags carries nothing the demuxer needs.
+				d.headers++
+			default:
+				out = append(out, packet)
+			}
+		}
+		d.stream.packets = nil
+	}
+	if len(d.buf) == 0 {
+		d.buf = nil
+	}
+	return out, invalid
+}
+
+// DecodeOggOpus decodes a whole Ogg Opus stream to interleaved 48 kHz PCM,
+// dropping the pre-skip and trimming to the final granule position.
+func DecodeOggOpus(r io.Reader) ([]int16, int, error) {
+	or, err := NewOggOpusReader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	channels := or.Head.Channels
+	if or.Head.MappingFamily != 0 {
+		return nil, 0, fmt.Errorf("ogg: unsupported channel mapping family %d", or.Head.MappingFamily)
+	}
+	dec, err := opusx.NewDecoder(oggOpusGranuleRate, channels)
+	if err != nil {
+		return nil, 0, err
+	}
+	frame := make([]int16, 5760*channels)
+	pcm := []int16{}
+	for {
+		packet, err := or.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		n, err := dec.Decode(packet, frame)
+		if err != nil {
+			return nil, 0, err
+		}
+		pcm = append(pcm, frame[:n*channels]...)
+	}
+	total := len(pcm) / channels
+	if end := int(or.Granule()); or.Granule() > 0 && end < total {
+		total = end
+	}
+	skip := or.Head.PreSkip
+	if skip > total {
+		skip = total
+	}
+	return pcm[skip*channels : total*channels], channels, nil
+}
@@ -0,0 +1,280 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+func encodeSinePackets(t *testing.T, sampleRate int, frames int) [][]byte {
+	t.Helper()
+	enc, err := NewOpusEncoder(sampleRate, 1, 20)
+	if err != nil {
+		t.Fatalf("NewOpusEncoder error: %v", err)
+	}
+	defer enc.Close()
+	frameSize := enc.GetFrameSize()
+	packets := [][]byte{}
+	for f := 0; f < frames; f++ {
+		pcm := make([]int16, frameSize)
+		for i := range pcm {
+			n := f*frameSize + i
+			pcm[i] = int16(8000 * math.Sin(2*math.Pi*440*float64(n)/float64(sampleRate)))
+		}
+		packet, err := enc.Encode(Int16SliceToBytesInto(nil, pcm))
+		if err != nil {
+			t.Fatalf("Encode error: %v", err)
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+func TestOggOpusRoundTrip(t *testing.T) {
+	for _, sampleRate := range []int{16000, 48000} {
+		packets := encodeSinePackets(t, sampleRate, 25)
+		var buf bytes.Buffer
+		w, err := NewOggOpusWriter(&buf, sampleRate, 1)
+		if err != nil {
+			t.Fatalf("NewOggOpusWriter error: %v", err)
+		}
+		for _, packet := range packets {
+			if err := w.WritePacket(packet); err != nil {
+				t.Fatalf("WritePacket error: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close error: %v", err)
+		}
+		if w.Granule() != uint64(25*960) {
+			t.Fatalf("granule=%d, want %d", w.Granule(), 25*960)
+		}
+
+		r, err := NewOggOpusReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("NewOggOpusReader error: %v", err)
+		}
+		if r.Head.InputSampleRate != sampleRate || r.Head.Channels != 1 || r.Head.PreSkip != oggOpusPreSkip {
+			t.Fatalf("head=%+v", r.Head)
+		}
+		for i := 0; ; i++ {
+			packet, err := r.ReadPacket()
+			if errors.Is(err, io.EOF) {
+				if i != len(packets) {
+					t.Fatalf("read %d packets, want %d", i, len(packets))
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("ReadPacket error: %v", err)
+			}
+			if !bytes.Equal(packet, packets[i]) {
+				t.Fatalf("packet %d differs", i)
+			}
+		}
+
+		pcm, channels, err := DecodeOggOpus(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("DecodeOggOpus error: %v", err)
+		}
+		if channels != 1 || len(pcm) != 25*960-oggOpusPreSkip {
+			t.Fatalf("decoded %d samples on %d channels, want %d", len(pcm), channels, 25*960-oggOpusPreSkip)
+		}
+	}
+}
+
+func TestOggOpusWriterWithoutPreSkipKeepsAllSamples(t *testing.T) {
+	packets := encodeSinePackets(t, 24000, 10)
+	var buf bytes.Buffer
+	w, err := NewOggOpusWriterWithPreSkip(&buf, 24000, 1, 0)
+	if err != nil {
+		t.Fatalf("NewOggOpusWriterWithPreSkip error: %v", err)
+	}
+	for _, packet := range packets {
+		if err := w.WritePacket(packet); err != nil {
+			t.Fatalf("WritePacket error: %v", err)
+		}
+	}
+	w.Close()
+	pcm, _, err := DecodeOggOpus(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeOggOpus error: %v", err)
+	}
+	if len(pcm) != 10*960 {
+		t.Fatalf("decoded %d samples, want %d", len(pcm), 10*960)
+	}
+	if _, err := NewOggOpusWriterWithPreSkip(&buf, 24000, 1, -1); err == nil {
+		t.Fatalf("negative pre-skip returned nil error")
+	}
+}
+
+func TestOggOpusCloseTrimmedEndsOnSourceLength(t *testing.T) {
+	packets := encodeSinePackets(t, 16000, 3)
+	var buf bytes.Buffer
+	w, err := NewOggOpusWriter(&buf, 16000, 1)
+	if err != nil {
+		t.Fatalf("NewOggOpusWriter error: %v", err)
+	}
+	for _, packet := range packets {
+		if err := w.WritePacket(packet); err != nil {
+			t.Fatalf("WritePacket error: %v", err)
+		}
+	}
+	if err := w.CloseTrimmed(2000); err != nil {
+		t.Fatalf("CloseTrimmed error: %v", err)
+	}
+	if w.Granule() != oggOpusPreSkip+2000 {
+		t.Fatalf("granule=%d, want %d", w.Granule(), oggOpusPreSkip+2000)
+	}
+	pcm, _, err := DecodeOggOpus(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeOggOpus error: %v", err)
+	}
+	if len(pcm) != 2000 {
+		t.Fatalf("decoded %d samples, want 2000", len(pcm))
+	}
+}
+
+func TestOggOpusLargePacketSpansPages(t *testing.T) {
+	packet := make([]byte, 70000)
+	packet[0] = 0x08 // SILK 20ms, one frame
+	for i := 1; i < len(packet); i++ {
+		packet[i] = byte(i)
+	}
+	var buf bytes.Buffer
+	w, _ := NewOggOpusWriter(&buf, 48000, 2)
+	if err := w.WritePacket(packet); err != nil {
+		t.Fatalf("WritePacket error: %v", err)
+	}
+	w.Close()
+	r, err := NewOggOpusReader(&buf)
+	if err != nil {
+		t.Fatalf("NewOggOpusReader error: %v", err)
+	}
+	got, err := r.ReadPacket()
+	if err != nil || !bytes.Equal(got, packet) {
+		t.Fatalf("ReadPacket len=%d err=%v, want original packet", len(got), err)
+	}
+	if r.Granule() != 960 {
+		t.Fatalf("granule=%d, want 960", r.Granule())
+	}
+}
+
+func TestOggOpusReaderRejectsCorruptPage(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewOggOpusWriter(&buf, 48000, 1)
+	for _, packet := range encodeSinePackets(t, 48000, 3) {
+		w.WritePacket(packet)
+	}
+	w.Close()
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+	r, err := NewOggOpusReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewOggOpusReader error: %v", err)
+	}
+	for {
+		if _, err = r.ReadPacket(); err != nil {
+			break
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		t.Fatal("corrupt last page read to EOF, want checksum error")
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	cases := []struct {
+		packet []byte
+		want   int
+	}{
+		{[]byte{0x08}, 960},           // SILK NB 20ms
+		{[]byte{0x18}, 2880},          // SILK NB 60ms
+		{[]byte{0xf8}, 960},           // CELT FB 20ms
+		{[]byte{0xf9}, 1920},          // two 20ms frames
+		{[]byte{0xe3, 0x04}, 4 * 120}, // four 2.5ms frames
+	}
+	for _, tc := range cases {
+		got, err := OpusPacketSamples(tc.packet)
+		if err != nil || got != tc.want {
+			t.Fatalf("OpusPacketSamples(%x)=%d,%v, want %d", tc.packet, got, err, tc.want)
+		}
+	}
+}
+
+func TestOggOpusDemuxerChunkedStream(t *testing.T) {
+	packets := encodeSinePackets(t, 16000, 20)
+	var buf bytes.Buffer
+	w, _ := NewOggOpusWriter(&buf, 16000, 1)
+	for _, packet := range packets {
+		w.WritePacket(packet)
+	}
+	w.Close()
+	stream := append(buf.Bytes(), buf.Bytes()...)
+
+	d := &OggOpusDemuxer{}
+	got := feedInChunks(t, d.Write, stream, 13)
+	if len(got) != 2*len(packets) {
+		t.Fatalf("got %d packets, want %d", len(got), 2*len(packets))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], packets[i%len(packets)]) {
+			t.Fatalf("packet %d differs", i)
+		}
+	}
+	if d.Head.InputSampleRate != 16000 || d.Head.Channels != 1 {
+		t.Fatalf("head=%+v", d.Head)
+	}
+}
+
+func TestOggOpusDemuxerResyncsAfterCorruption(t *testing.T) {
+	packets := encodeSinePackets(t, 16000, 20)
+	var buf bytes.Buffer
+	w, _ := NewOggOpusWriter(&buf, 16000, 1)
+	for _, packet := range packets {
+		w.WritePacket(packet)
+	}
+	w.Close()
+	clean := buf.Bytes()
+
+	// Break the capture pattern of the page holding the fourth packet, then
+	// follow the stream with noise and a second, clean stream.
+	corrupted := append([]byte(nil), clean...)
+	page := 0
+	for i := 0; ; i++ {
+		if string(corrupted[i:i+4]) == "OggS" {
+			if page == 5 {
+				corrupted[i] = 'X'
+				break
+			}
+			page++
+		}
+	}
+	stream := append(corrupted, []byte("this chunk is not an ogg page at all")...)
+	stream = append(stream, clean...)
+
+	d := &OggOpusDemuxer{}
+	var got [][]byte
+	errs := 0
+	for off := 0; off < len(stream); off += 13 {
+		out, err := d.Write(stream[off:min(off+13, len(stream))])
+		if err != nil {
+			errs++
+		}
+		got = append(got, out...)
+	}
+	if errs != 2 {
+		t.Fatalf("errors=%d, want 2", errs)
+	}
+	want := append(append(append([][]byte(nil), packets[:3]...), packets[4:]...), packets...)
+	if len(got) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("packet %d differs", i)
+		}
+	}
+}
@@ -31,7 +31,8 @@ type Encoder struct {
 }
 
 type Decoder struct {
-	dec *opus.Decoder
+	dec      *opus.Decoder
+	channels int
 }
 
 func NewEncoder(sampleRate, channels int, app Application) (*Encoder, error) {
@@ -47,7 +48,7 @@ func NewDecoder(sampleRate, channels int) (*Decoder, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Decoder{dec: dec}, nil
+	return &Decoder{dec: dec, channels: channels}, nil
 }
 
 func (e *Encoder) Encode(pcm []int16, data []byte) (int, error) {
@@ -62,6 +63,23 @@ func (d *Decoder) DecodeFloat32(data []byte, pcm []float32) (int, error) {
 	return d.dec.DecodeFloat32(data, pcm)
 }
 
+// DecodeFEC recovers the packet lost before data from its in-band FEC,
+// falling back to PLC. cap(pcm) sets the lost duration.
+func (d *Decoder) DecodeFEC(data []byte, pcm []int16) (int, error) {
+	if err := d.dec.DecodeFEC(data, pcm); err != nil {
+		return 0, err
+	}
+	return cap(pcm) / d.channels, nil
+}
+
+// DecodePLC conceals a lost packet. cap(pcm) sets the lost duration.
+func (d *Decoder) DecodePLC(pcm []int16) (int, error) {
+	if err := d.dec.DecodePLC(pcm); err != nil {
+		return 0, err
+	}
+	return cap(pcm) / d.channels, nil
+}
+
 func (e *Encoder) Reset() error {
 	return e.enc.Reset()
 }
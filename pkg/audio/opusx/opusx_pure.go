@@ -62,6 +62,17 @@ func (d *Decoder) DecodeFloat32(data []byte, pcm []float32) (int, error) {
 	return d.dec.DecodeFloat32(data, pcm)
 }
 
+// DecodeFEC recovers the packet lost before data from its in-band FEC,
+// falling back to PLC. cap(pcm) sets the lost duration.
+func (d *Decoder) DecodeFEC(data []byte, pcm []int16) (int, error) {
+	return d.dec.DecodeFEC(data, pcm)
+}
+
+// DecodePLC conceals a lost packet. cap(pcm) sets the lost duration.
+func (d *Decoder) DecodePLC(pcm []int16) (int, error) {
+	return d.dec.DecodePLC(pcm)
+}
+
 func (e *Encoder) Reset() error {
 	return e.enc.Reset()
 }
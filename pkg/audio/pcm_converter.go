@@ -0,0 +1,135 @@
+package audio
+
+import "fmt"
+
+// PCMConverter converts an interleaved PCM16 stream to another sample rate
+// and channel layout. Input is mixed down to mono by averaging when either
+// side is mono, otherwise extra input channels are dropped; each remaining
+// channel is resampled on its own and then copied out to the extra output
+// channels, so mono becomes dual-mono stereo.
+type PCMConverter struct {
+	inChannels  int
+	outChannels int
+	channels    int
+	resamplers  []*StreamResampler
+	planar      []int16
+}
+
+// NewPCMConverter executes the newPCMConverter function.
+func NewPCMConverter(inRate, inChannels, outRate, outChannels int, opts ResamplerOptions) (*PCMConverter, error) {
+	if inRate <= 0 || outRate <= 0 || inChannels <= 0 || outChannels <= 0 {
+		return nil, fmt.Errorf("pcm convert: invalid format %d/%d -> %d/%d", inRate, inChannels, outRate, outChannels)
+	}
+	c := &PCMConverter{
+		inChannels:  inChannels,
+		outChannels: outChannels,
+		channels:    min(inChannels, outChannels),
+	}
+	if inRate != outRate {
+		for range c.channels {
+			r, err := NewStreamResamplerWithOptions(inRate, outRate, opts)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			c.resamplers = append(c.resamplers, r)
+		}
+	}
+	return c, nil
+}
+
+// Convert returns the converted samples that are ready. With resampling the
+// output lags the input; Flush returns the rest.
+func (c *PCMConverter) Convert(pcm []int16) ([]int16, error) {
+	frames := len(pcm) / c.inChannels
+	if c.resamplers == nil {
+		out := make([]int16, 0, frames*c.outChannels)
+		for i := range frames {
+			out = c.appendFrame(out, pcm[i*c.inChannels:(i+1)*c.inChannels])
+		}
+		return out, nil
+	}
+	for ch, r := range c.resamplers {
+		c.planar = c.planar[:0]
+		for i := range frames {
+			c.planar = append(c.planar, c.mix(pcm[i*c.inChannels:(i+1)*c.inChannels], ch))
+		}
+		if err := r.AppendPCM(c.planar); err != nil {
+			return nil, err
+		}
+	}
+	return c.drain(), nil
+}
+
+// Flush returns the samples still held by the resamplers. Without
+// resampling nothing is held back.
+func (c *PCMConverter) Flush() ([]int16, error) {
+	if c.resamplers == nil {
+		return nil, nil
+	}
+	for _, r := range c.resamplers {
+		if err := r.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	return c.drain(), nil
+}
+
+// Close releases the resamplers.
+func (c *PCMConverter) Close() {
+	if c == nil {
+		return
+	}
+	for _, r := range c.resamplers {
+		r.Close()
+	}
+	c.resamplers = nil
+}
+
+// drain interleaves the output every resampler has ready.
+func (c *PCMConverter) drain() []int16 {
+	if len(c.resamplers) == 0 {
+		return nil
+	}
+	n := c.resamplers[0].Buffered()
+	for _, r := range c.resamplers[1:] {
+		n = min(n, r.Buffered())
+	}
+	if n == 0 {
+		return nil
+	}
+	planes := make([][]int16, len(c.resamplers))
+	for ch, r := range c.resamplers {
+		planes[ch], _ = r.PopFrame(n)
+	}
+	out := make([]int16, n*c.outChannels)
+	for i := range n {
+		for ch := range c.outChannels {
+			out[i*c.outChannels+ch] = planes[min(ch, c.channels-1)][i]
+		}
+	}
+	for _, plane := range planes {
+		ReleaseInt16(plane)
+	}
+	return out
+}
+
+// appendFrame remixes one interleaved input frame onto out.
+func (c *PCMConverter) appendFrame(out []int16, frame []int16) []int16 {
+	for ch := range c.outChannels {
+		out = append(out, c.mix(frame, min(ch, c.channels-1)))
+	}
+	return out
+}
+
+// mix returns intermediate channel ch of an input frame.
+func (c *PCMConverter) mix(frame []int16, ch int) int16 {
+	if c.channels > 1 || len(frame) == 1 {
+		return frame[ch]
+	}
+	sum := 0
+	for _, v := range frame {
+		sum += int(v)
+	}
+	return int16(sum / len(frame))
+}
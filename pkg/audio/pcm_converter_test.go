@@ -0,0 +1,81 @@
+package audio
+
+import "testing"
+
+func TestPCMConverterRemixesChannels(t *testing.T) {
+	down, err := NewPCMConverter(16000, 2, 16000, 1, ResamplerOptions{})
+	if err != nil {
+		t.Fatalf("NewPCMConverter error: %v", err)
+	}
+	got, err := down.Convert([]int16{100, 300, -50, -150})
+	if err != nil {
+		t.Fatalf("Convert error: %v", err)
+	}
+	if len(got) != 2 || got[0] != 200 || got[1] != -100 {
+		t.Fatalf("downmix=%v, want [200 -100]", got)
+	}
+
+	up, err := NewPCMConverter(16000, 1, 16000, 2, ResamplerOptions{})
+	if err != nil {
+		t.Fatalf("NewPCMConverter error: %v", err)
+	}
+	got, err = up.Convert([]int16{7, -3})
+	if err != nil {
+		t.Fatalf("Convert error: %v", err)
+	}
+	if len(got) != 4 || got[0] != 7 || got[1] != 7 || got[2] != -3 || got[3] != -3 {
+		t.Fatalf("upmix=%v, want [7 7 -3 -3]", got)
+	}
+}
+
+func TestPCMConverterFlushAfterChannelOnlyConvert(t *testing.T) {
+	c, err := NewPCMConverter(24000, 1, 24000, 2, ResamplerOptions{})
+	if err != nil {
+		t.Fatalf("NewPCMConverter error: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Convert([]int16{1, 2, 3}); err != nil {
+		t.Fatalf("Convert error: %v", err)
+	}
+	tail, err := c.Flush()
+	if err != nil || len(tail) != 0 {
+		t.Fatalf("Flush=%v, %v, want nothing", tail, err)
+	}
+}
+
+func TestPCMConverterResamplesToStereo(t *testing.T) {
+	for _, alg := range []ResamplerAlgorithm{ResamplerSoxr, ResamplerSinc} {
+		c, err := NewPCMConverter(24000, 1, 48000, 2, ResamplerOptions{Algorithm: alg})
+		if err != nil {
+			t.Fatalf("NewPCMConverter error: %v", err)
+		}
+		in := make([]int16, 480)
+		for i := range in {
+			in[i] = int16(i * 10)
+		}
+		var out []int16
+		for range 50 {
+			got, err := c.Convert(in)
+			if err != nil {
+				t.Fatalf("Convert error: %v", err)
+			}
+			out = append(out, got...)
+		}
+		tail, err := c.Flush()
+		if err != nil {
+			t.Fatalf("Flush error: %v", err)
+		}
+		out = append(out, tail...)
+		c.Close()
+
+		want := 50 * len(in) * 2 * 2
+		if len(out) < want-200 || len(out) > want+200 {
+			t.Fatalf("%s: output=%d samples, want about %d", alg, len(out), want)
+		}
+		for i := 0; i < len(out); i += 2 {
+			if out[i] != out[i+1] {
+				t.Fatalf("%s: frame %d channels differ: %d vs %d", alg, i/2, out[i], out[i+1])
+			}
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package audio
+
+import "math"
+
+// Mic pre-processing defaults.
+const (
+	DefaultHighPassHz         = 80.0
+	DefaultNoiseFloorDB       = -18.0
+	DefaultAGCTargetDB        = -20.0
+	DefaultAGCMaxGainDB       = 24.0
+	DefaultLimiterCeilingDB   = -1.0
+	noiseSuppressorFrameMs    = 32
+	noiseOverSubtraction      = 2.0
+	noiseSmoothing            = 0.8
+	noiseRise                 = 0.005
+	noiseFall                 = 0.05
+	noiseInitFrames           = 6
+	noiseDecisionDirected     = 0.98
+	noiseBias                 = 1.5
+	agcBlockMs                = 10
+	agcGateDB                 = -55.0
+	agcAttack                 = 0.3
+	agcRelease                = 0.02
+	limiterReleaseMs          = 50
+	preprocessFullScale       = 32768.0
+	preprocessMinGain         = 1e-3
+	preprocessMinDenominator  = 1e-12
+	preprocessNoisePowerFloor = 1e-10
+)
+
+// PreprocessorConfig selects and tunes the mic pre-processing stages. Zero
+// tuning values use the defaults.
+type PreprocessorConfig struct {
+	SampleRate int
+	Channels   int
+
+	HighPass   bool
+	HighPassHz float64
+
+	NoiseSuppression bool
+	// NoiseFloorDB is the strongest attenuation applied to a noise-only bin.
+	NoiseFloorDB float64
+
+	AGC          bool
+	AGCTargetDB  float64
+	AGCMaxGainDB float64
+
+	Limiter          bool
+	LimiterCeilingDB float64
+}
+
+// Enabled reports whether any stage is on.
+func (c PreprocessorConfig) Enabled() bool {
+	return c.HighPass || c.NoiseSuppression || c.AGC || c.Limiter
+}
+
+// Preprocessor runs the high-pass filter, noise suppressor, AGC and limiter
+// over interleaved PCM, each channel independently. It is not safe for
+// concurrent use.
+type Preprocessor struct {
+	cfg      PreprocessorConfig
+	channels []*channelPreprocessor
+	scratch  []float64
+}
+
+type channelPreprocessor struct {
+	highPass *biquad
+	noise    *NoiseSuppressor
+	agc      *AGC
+	limiter  *Limiter
+}
+
+// NewPreprocessor executes the newPreprocessor function.
+func NewPreprocessor(cfg PreprocessorConfig) *Preprocessor {
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = 16000
+	}
+	if cfg.Channels <= 0 {
+		cfg.Channels = 1
+	}
+	p := &Preprocessor{cfg: cfg}
+	for ch := 0; ch < cfg.Channels; ch++ {
+		c := &channelPreprocessor{}
+		if cfg.HighPass {
+			c.highPass = newHighPass(cfg.SampleRate, cfg.HighPassHz)
+		}
+		if cfg.NoiseSuppression {
+			c.noise = NewNoiseSuppressor(cfg.SampleRate, cfg.NoiseFloorDB)
+		}
+		if cfg.AGC {
+			c.agc = NewAGC(cfg.SampleRate, cfg.AGCTargetDB, cfg.AGCMaxGainDB)
+		}
+		if cfg.Limiter {
+			c.limiter = NewLimiter(cfg.SampleRate, cfg.LimiterCeilingDB)
+		}
+		p.channels = append(p.channels, c)
+	}
+	return p
+}
+
+// Latency returns the delay in samples per channel the stages add.
+func (p *Preprocessor) Latency() int {
+	if len(p.channels) == 0 || p.channels[0].noise == nil {
+		return 0
+	}
+	return p.channels[0].noise.Latency()
+}
+
+// Process runs the enabled stages over pcm in place and returns it.
+func (p *Preprocessor) Process(pcm []int16) []int16 {
+	channels := len(p.channels)
+	frames := len(pcm) / channels
+	if frames == 0 {
+		return pcm
+	}
+	if cap(p.scratch) < frames {
+		p.scratch = make([]float64, frames)
+	}
+	buf := p.scratch[:frames]
+	for ch, stages := range p.channels {
+		for i := range buf {
+			buf[i] = float64(pcm[i*channels+ch]) / preprocessFullScale
+		}
+		if stages.highPass != nil {
+			stages.highPass.process(buf)
+		}
+		if stages.noise != nil {
+			stages.noise.Process(buf)
+		}
+		if stages.agc != nil {
+			stages.agc.Process(buf)
+		}
+		if stages.limiter != nil {
+			stages.limiter.Process(buf)
+		}
+		for i, v := range buf {
+			pcm[i*channels+ch] = clampInt16(v * preprocessFullScale)
+		}
+	}
+	return pcm
+}
+
+// biquad is a direct form I second-order IIR section.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+// newHighPass returns a Butterworth high-pass filter.
+func newHighPass(sampleRate int, cutoff float64) *biquad {
+	if cutoff <= 0 {
+		cutoff = DefaultHighPassHz
+	}
+	cutoff = math.Min(cutoff, float64(sampleRate)/2*0.9)
+	w := 2 * math.Pi * cutoff / float64(sampleRate)
+	// Q = 1/sqrt(2) gives the maximally flat Butterworth response.
+	alpha := math.Sin(w) / math.Sqrt2
+	cos := math.Cos(w)
+	a0 := 1 + alpha
+	return &biquad{
+		b0: (1 + cos) / 2 / a0,
+		b1: -(1 + cos) / a0,
+		b2: (1 + cos) / 2 / a0,
+		a1: -2 * cos / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+func (f *biquad) process(buf []float64) {
+	for i, x := range buf {
+		y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+		f.x2, f.x1 = f.x1, x
+		f.y2, f.y1 = f.y1, y
+		buf[i] = y
+	}
+}
+
+// NoiseSuppressor is a spectral-subtraction noise suppressor working on
+// 50% overlapped sqrt-Hann frames. The noise spectrum is tracked with a
+// fast-falling, slow-rising estimate, so it follows stationary noise while
+// speech passes through. Output lags input by Latency samples.
+type NoiseSuppressor struct {
+	size      int
+	hop       int
+	floor     float64
+	window    []float64
+	frame     []float64
+	pending   []float64
+	overlap   []float64
+	out       []float64
+	spectrum  []complex128
+	smoothed  []float64
+	noise     []float64
+	gains     []float64
+	clean     []float64
+	initCount int
+}
+
+// NewNoiseSuppressor executes the newNoiseSuppressor function.
+func NewNoiseSuppressor(sampleRate int, floorDB float64) *NoiseSuppressor {
+	if floorDB >= 0 {
+		floorDB = DefaultNoiseFloorDB
+	}
+	size := nextPowerOfTwo(maxInt(64, sampleRate*noiseSuppressorFrameMs/1000))
+	hop := size / 2
+	window := make([]float64, size)
+	for i := range window {
+		window[i] = math.Sqrt(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size)))
+	}
+	bins := size/2 + 1
+	return &NoiseSuppressor{
+		size:     size,
+		hop:      hop,
+		floor:    math.Pow(10, floorDB/20),
+		window:   window,
+		frame:    make([]float64, size),
+		overlap:  make([]float64, size),
+		out:      make([]float64, hop),
+		spectrum: make([]complex128, size),
+		smoothed: make([]float64, bins),
+		noise:    make([]float64, bins),
+		gains:    make([]float64, bins),
+		clean:    make([]float64, bins),
+	}
+}
+
+// Latency returns the delay in samples between input and output.
+func (n *NoiseSuppressor) Latency() int {
+	return n.hop
+}
+
+// Process denoises buf in place. The output is delayed by Latency samples.
+func (n *NoiseSuppressor) Process(buf []float64) {
+	n.pending = append(n.pending, buf...)
+	consumed := 0
+	for len(n.pending)-consumed >= n.hop {
+		n.processHop(n.pending[consumed : consumed+n.hop])
+		consumed += n.hop
+	}
+	n.pending = append(n.pending[:0], n.pending[consumed:]...)
+	copy(buf, n.out[:len(buf)])
+	n.out = append(n.out[:0], n.out[len(buf):]...)
+}
+
+func (n *NoiseSuppressor) processHop(hop []float64) {
+	copy(n.frame, n.frame[n.hop:])
+	copy(n.frame[n.size-n.hop:], hop)
+	for i, v := range n.frame {
+		n.spectrum[i] = complex(v*n.window[i], 0)
+	}
+	fft(n.spectrum, false)
+
+	bins := len(n.noise)
+	for k := 0; k < bins; k++ {
+		re, im := real(n.spectrum[k]), imag(n.spectrum[k])
+		p := re*re + im*im
+		if n.initCount == 0 {
+			n.smoothed[k] = p
+		}
+		n.smoothed[k] = noiseSmoothing*n.smoothed[k] + (1-noiseSmoothing)*p
+		switch {
+		case n.initCount < noiseInitFrames:
+			// Assume the first frames are background noise.
+			n.noise[k] += p / noiseInitFrames
+		case n.smoothed[k] < n.noise[k]:
+			n.noise[k] += noiseFall * (n.smoothed[k] - n.noise[k])
+		default:
+			n.noise[k] += noiseRise * (n.smoothed[k] - n.noise[k])
+		}
+		noise := math.Max(n.noise[k]*noiseBias, preprocessNoisePowerFloor)
+		// Power subtraction gain driven by a decision-directed a priori SNR,
+		// which keeps isolated noise peaks from turning into musical noise.
+		post := math.Max(p/noise-1, 0)
+		prior := noiseDecisionDirected*n.clean[k]/noise + (1-noiseDecisionDirected)*post
+		n.gains[k] = math.Max(math.Sqrt(prior/(1+prior)), n.floor)
+		n.clean[k] = n.gains[k] * n.gains[k] * p
+		n.spectrum[k] *= complex(n.gains[k], 0)
+		if k > 0 && k < n.size-k {
+			n.spectrum[n.size-k] = cmplxConj(n.spectrum[k])
+		}
+	}
+	if n.initCount < noiseInitFrames {
+		n.initCount++
+	}
+	fft(n.spectrum, true)
+
+	for i := range n.overlap {
+		n.overlap[i] += real(n.spectrum[i]) * n.window[i]
+	}
+	n.out = append(n.out, n.overlap[:n.hop]...)
+	copy(n.overlap, n.overlap[n.hop:])
+	for i := n.size - n.hop; i < n.size; i++ {
+		n.overlap[i] = 0
+	}
+}
+
+func cmplxConj(c complex128) complex128 {
+	return complex(real(c), -imag(c))
+}
+
+// AGC is an automatic gain control that moves the block RMS level toward a
+// target. Blocks below the gate keep the current gain so silence is not
+// boosted.
+type AGC struct {
+	block   int
+	target  float64
+	maxGain float64
+	gain    float64
+	pending int
+	sum     float64
+}
+
+// NewAGC executes the newAGC function.
+func NewAGC(sampleRate int, targetDB float64, maxGainDB float64) *AGC {
+	if targetDB >= 0 {
+		targetDB = DefaultAGCTargetDB
+	}
+	if maxGainDB <= 0 {
+		maxGainDB = DefaultAGCMaxGainDB
+	}
+	return &AGC{
+		block:   maxInt(1, sampleRate*agcBlockMs/1000),
+		target:  math.Pow(10, targetDB/20),
+		maxGain: math.Pow(10, maxGainDB/20),
+		gain:    1,
+	}
+}
+
+// Gain returns the current linear gain.
+func (a *AGC) Gain() float64 {
+	return a.gain
+}
+
+// Process applies the gain to buf in place, updating it once per block.
+func (a *AGC) Process(buf []float64) {
+	gate := math.Pow(10, agcGateDB/20)
+	for i, x := range buf {
+		a.sum += x * x
+		a.pending++
+		if a.pending == a.block {
+			rms := math.Sqrt(a.sum / float64(a.block))
+			if rms > gate {
+				desired := math.Max(math.Min(a.target/rms, a.maxGain), preprocessMinGain)
+				rate := agcRelease
+				if desired < a.gain {
+					rate = agcAttack
+				}
+				a.gain += (desired - a.gain) * rate
+			}
+			a.pending = 0
+			a.sum = 0
+		}
+		buf[i] = x * a.gain
+	}
+}
+
+// Limiter is a peak limiter with instant attack that keeps samples under a
+// ceiling.
+type Limiter struct {
+	ceiling  float64
+	release  float64
+	envelope float64
+}
+
+// NewLimiter executes the newLimiter function.
+func NewLimiter(sampleRate int, ceilingDB float64) *Limiter {
+	if ceilingDB >= 0 {
+		ceilingDB = DefaultLimiterCeilingDB
+	}
+	return &Limiter{
+		ceiling: math.Pow(10, ceilingDB/20),
+		release: math.Exp(-1 / (float64(sampleRate) * limiterReleaseMs / 1000)),
+	}
+}
+
+// Process limits buf in place.
+func (l *Limiter) Process(buf []float64) {
+	for i, x := range buf {
+		peak := math.Abs(x)
+		if peak > l.envelope {
+			l.envelope = peak
+		} else {
+			l.envelope = peak + (l.envelope-peak)*l.release
+		}
+		if l.envelope > l.ceiling {
+			buf[i] = x * l.ceiling / l.envelope
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package audio
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+func rmsDB(buf []float64) float64 {
+	sum := 0.0
+	for _, v := range buf {
+		sum += v * v
+	}
+	return 10 * math.Log10(sum/float64(len(buf))+1e-20)
+}
+
+func sine(freq float64, amplitude float64, sampleRate int, samples int) []float64 {
+	out := make([]float64, samples)
+	for i := range out {
+		out[i] = amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate))
+	}
+	return out
+}
+
+func TestFFTRoundTrip(t *testing.T) {
+	x := make([]complex128, 64)
+	for i := range x {
+		x[i] = complex(math.Sin(float64(i)), math.Cos(3*float64(i)))
+	}
+	orig := append([]complex128(nil), x...)
+	fft(x, false)
+	// Bin 0 is the plain sum.
+	var sum complex128
+	for _, v := range orig {
+		sum += v
+	}
+	if cmplx.Abs(x[0]-sum) > 1e-9 {
+		t.Fatalf("bin0=%v, want %v", x[0], sum)
+	}
+	fft(x, true)
+	for i := range x {
+		if cmplx.Abs(x[i]-orig[i]) > 1e-9 {
+			t.Fatalf("sample %d=%v, want %v", i, x[i], orig[i])
+		}
+	}
+}
+
+func TestHighPassRemovesLowFrequencies(t *testing.T) {
+	hp := newHighPass(16000, 100)
+	hum := sine(30, 0.5, 16000, 16000)
+	hp.process(hum)
+	voice := sine(1000, 0.5, 16000, 16000)
+	hp2 := newHighPass(16000, 100)
+	hp2.process(voice)
+	// A second-order filter rolls off 12 dB/octave below the cutoff.
+	if got := rmsDB(hum[8000:]); got > -27 {
+		t.Fatalf("30Hz hum level=%.1f dB, want <= -27 dB", got)
+	}
+	if got, want := rmsDB(voice[8000:]), rmsDB(sine(1000, 0.5, 16000, 8000)); math.Abs(got-want) > 0.5 {
+		t.Fatalf("1kHz level=%.1f dB, want %.1f dB", got, want)
+	}
+}
+
+func TestNoiseSuppressorReducesStationaryNoise(t *testing.T) {
+	const rate = 16000
+	rng := rand.New(rand.NewSource(5))
+	ns := NewNoiseSuppressor(rate, -20)
+	noise := make([]float64, rate*3)
+	for i := range noise {
+		noise[i] = 0.02 * (rng.Float64()*2 - 1)
+	}
+	tone := sine(500, 0.3, rate, len(noise))
+	in := make([]float64, len(noise))
+	for i := range in {
+		in[i] = noise[i]
+		if i >= 2*rate {
+			in[i] += tone[i]
+		}
+	}
+	out := append([]float64(nil), in...)
+	for i := 0; i < len(out); i += 160 {
+		ns.Process(out[i : i+160])
+	}
+
+	lat := ns.Latency()
+	noiseIn := rmsDB(in[rate : 2*rate])
+	noiseOut := rmsDB(out[rate+lat : 2*rate])
+	if noiseIn-noiseOut < 10 {
+		t.Fatalf("noise reduced by %.1f dB, want >= 10 dB", noiseIn-noiseOut)
+	}
+	toneOut := rmsDB(out[2*rate+rate/2+lat:])
+	toneIn := rmsDB(tone[2*rate+rate/2:])
+	if math.Abs(toneOut-toneIn) > 1.5 {
+		t.Fatalf("tone level=%.1f dB, want about %.1f dB", toneOut, toneIn)
+	}
+}
+
+func TestNoiseSuppressorPreservesLengthAndDelay(t *testing.T) {
+	ns := NewNoiseSuppressor(16000, -1)
+	total := 0
+	for _, n := range []int{1, 7, 300, 512, 33} {
+		buf := make([]float64, n)
+		ns.Process(buf)
+		total += len(buf)
+	}
+	if total != 853 {
+		t.Fatalf("processed=%d, want 853", total)
+	}
+	if ns.Latency() != 256 {
+		t.Fatalf("latency=%d, want 256", ns.Latency())
+	}
+}
+
+func TestAGCBoostsQuietSpeechAndIgnoresSilence(t *testing.T) {
+	const rate = 16000
+	agc := NewAGC(rate, -20, 24)
+	silence := make([]float64, rate)
+	agc.Process(silence)
+	if agc.Gain() != 1 {
+		t.Fatalf("gain after silence=%v, want 1", agc.Gain())
+	}
+	quiet := sine(300, 0.02, rate, rate*5)
+	agc.Process(quiet)
+	got := rmsDB(quiet[rate*4:])
+	if math.Abs(got+20) > 1.5 {
+		t.Fatalf("output level=%.1f dB, want about -20 dB", got)
+	}
+}
+
+func TestLimiterKeepsPeaksUnderCeiling(t *testing.T) {
+	l := NewLimiter(16000, -6)
+	buf := sine(200, 1.5, 16000, 16000)
+	l.Process(buf)
+	ceiling := math.Pow(10, -6.0/20)
+	for i, v := range buf {
+		if math.Abs(v) > ceiling+1e-9 {
+			t.Fatalf("sample %d=%v exceeds ceiling %v", i, v, ceiling)
+		}
+	}
+}
+
+func TestPreprocessorStereoChannelsIndependent(t *testing.T) {
+	p := NewPreprocessor(PreprocessorConfig{SampleRate: 16000, Channels: 2, AGC: true, AGCTargetDB: -20})
+	pcm := make([]int16, 2*16000*3)
+	for i := 0; i < len(pcm)/2; i++ {
+		pcm[2*i] = int16(600 * math.Sin(2*math.Pi*300*float64(i)/16000))
+	}
+	p.Process(pcm)
+	for i := len(pcm) / 2; i < len(pcm); i += 2 {
+		if pcm[i+1] != 0 {
+			t.Fatalf("right channel sample %d=%d, want 0", i+1, pcm[i+1])
+		}
+	}
+	left := make([]float64, 0, 16000)
+	for i := len(pcm) - 2*16000; i < len(pcm); i += 2 {
+		left = append(left, float64(pcm[i])/32768)
+	}
+	if got := rmsDB(left); math.Abs(got+20) > 1.5 {
+		t.Fatalf("left level=%.1f dB, want about -20 dB", got)
+	}
+}
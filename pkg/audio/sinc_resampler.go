@@ -0,0 +1,173 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+// sincParams is the filter design used for a ResamplerQuality.
+type sincParams struct {
+	taps    int     // filter length in samples at the lower of the two rates
+	rolloff float64 // cutoff as a fraction of the lower Nyquist frequency
+	beta    float64 // Kaiser window shape
+}
+
+var sincQuality = map[ResamplerQuality]sincParams{
+	ResamplerQualityQuick:    {taps: 8, rolloff: 0.80, beta: 4},
+	ResamplerQualityLow:      {taps: 16, rolloff: 0.85, beta: 6},
+	ResamplerQualityMedium:   {taps: 32, rolloff: 0.90, beta: 7.5},
+	ResamplerQualityHigh:     {taps: 64, rolloff: 0.94, beta: 9},
+	ResamplerQualityVeryHigh: {taps: 128, rolloff: 0.96, beta: 11},
+}
+
+// sincStreamResampler is a pure-Go polyphase windowed-sinc resampler for
+// mono float32 streams. The rate ratio is reduced to up/down; each of the up
+// phases has its own Kaiser-windowed sinc kernel, so output samples cost one
+// dot product each. Output is aligned with the input: output sample k is the
+// input interpolated at time k*down/up.
+type sincStreamResampler struct {
+	up, down int
+	taps     int
+	phases   [][]float32
+
+	hist []float32 // input from sample base onwards
+	base int64
+	next int64 // index of the next output sample
+}
+
+func newSincStreamResampler(inRate, outRate int, quality ResamplerQuality) (*sincStreamResampler, error) {
+	if inRate <= 0 || outRate <= 0 {
+		return nil, fmt.Errorf("resample: invalid rates %d -> %d", inRate, outRate)
+	}
+	params, ok := sincQuality[quality]
+	if !ok {
+		return nil, fmt.Errorf("resample: unknown quality %q", quality)
+	}
+	g := gcd(inRate, outRate)
+	up, down := outRate/g, inRate/g
+
+	// The cutoff sits below the lower Nyquist; when downsampling the kernel
+	// is stretched so it spans the same number of output periods.
+	ratio := math.Min(1, float64(up)/float64(down))
+	cutoff := ratio * params.rolloff
+	taps := int(math.Ceil(float64(params.taps) / ratio))
+	taps += taps & 1
+	half := taps / 2
+
+	i0Beta := besselI0(params.beta)
+	phases := make([][]float32, up)
+	for p := range phases {
+		frac := float64(p) / float64(up)
+		coeffs := make([]float64, taps)
+		var sum float64
+		for j := range coeffs {
+			t := frac + float64(half-1-j)
+			x := t / float64(half)
+			if x <= -1 || x >= 1 {
+				continue
+			}
+			c := cutoff * sinc(cutoff*t) * besselI0(params.beta*math.Sqrt(1-x*x)) / i0Beta
+			coeffs[j] = c
+			sum += c
+		}
+		// Normalize every phase to unity DC gain so no phase adds ripple.
+		kernel := make([]float32, taps)
+		for j, c := range coeffs {
+			kernel[j] = float32(c / sum)
+		}
+		phases[p] = kernel
+	}
+	r := &sincStreamResampler{up: up, down: down, taps: taps, phases: phases}
+	r.reset()
+	return r, nil
+}
+
+// Process resamples input and returns the output samples that no longer
+// depend on future input.
+func (r *sincStreamResampler) Process(input []float32) ([]float32, error) {
+	r.hist = append(r.hist, input...)
+	return r.drain(nil), nil
+}
+
+// Flush returns the tail of the stream, treating the input as followed by
+// silence, and resets the resampler for a new stream.
+func (r *sincStreamResampler) Flush() ([]float32, error) {
+	r.hist = append(r.hist, make([]float32, r.taps/2)...)
+	out := r.drain(nil)
+	r.reset()
+	return out, nil
+}
+
+// Close is a no-op; the resampler holds no pooled resources.
+func (r *sincStreamResampler) Close() {}
+
+func (r *sincStreamResampler) reset() {
+	// The first output needs taps/2-1 samples before time 0; start the
+	// history with that much silence.
+	lead := r.taps/2 - 1
+	r.hist = make([]float32, lead, lead+r.taps*4)
+	r.base = -int64(lead)
+	r.next = 0
+}
+
+func (r *sincStreamResampler) drain(out []float32) []float32 {
+	half := int64(r.taps / 2)
+	up, down := int64(r.up), int64(r.down)
+	limit := r.base + int64(len(r.hist))
+	for {
+		pos := r.next * down
+		n := pos / up
+		if n+half >= limit {
+			break
+		}
+		kernel := r.phases[pos%up]
+		start := n - half + 1 - r.base
+		window := r.hist[start : start+int64(r.taps)]
+		var acc float32
+		for j, c := range kernel {
+			acc += window[j] * c
+		}
+		out = append(out, acc)
+		r.next++
+	}
+	// Drop input no later output can reach.
+	first := (r.next*down)/up - half + 1
+	if drop := first - r.base; drop > 0 {
+		drop = min(drop, int64(len(r.hist)))
+		kept := copy(r.hist, r.hist[drop:])
+		r.hist = r.hist[:kept]
+		r.base += drop
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// besselI0 is the zeroth-order modified Bessel function of the first kind,
+// by its power series.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	half := x / 2
+	for k := 1; k < 64; k++ {
+		term *= half / float64(k)
+		t := term * term
+		sum += t
+		if t < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,50 @@
+package audio
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSincResamplerSweepSNR(t *testing.T) {
+	for _, tc := range []struct {
+		quality ResamplerQuality
+		minDB   float64
+	}{
+		{ResamplerQualityMedium, 70},
+		{ResamplerQualityHigh, 90},
+		{ResamplerQualityVeryHigh, 110},
+	} {
+		for _, rates := range resamplerRates {
+			opts := ResamplerOptions{Algorithm: ResamplerSinc, Quality: tc.quality}
+			if snr := sweepSNR(t, opts, rates[0], rates[1]); snr < tc.minDB {
+				t.Fatalf("%s %d->%d: snr=%.1f dB, want >= %.0f", tc.quality, rates[0], rates[1], snr, tc.minDB)
+			}
+		}
+	}
+}
+
+func TestSincResamplerChunking(t *testing.T) {
+	in := make([]float32, 4410)
+	for i := range in {
+		in[i] = float32(i%97) / 97
+	}
+	opts := ResamplerOptions{Algorithm: ResamplerSinc, Quality: ResamplerQualityHigh}
+	want := resampleAll(t, opts, 44100, 16000, in, len(in))
+	if len(want) != 1600 {
+		t.Fatalf("output=%d samples, want 1600", len(want))
+	}
+	for _, chunk := range []int{1, 37, 441} {
+		if got := resampleAll(t, opts, 44100, 16000, in, chunk); !slices.Equal(got, want) {
+			t.Fatalf("chunk %d: output differs from one-shot", chunk)
+		}
+	}
+}
+
+func TestStreamResamplerRejectsUnknownOptions(t *testing.T) {
+	if _, err := NewStreamResamplerWithOptions(48000, 16000, ResamplerOptions{Quality: "ultra"}); err == nil {
+		t.Fatalf("unknown quality returned nil error")
+	}
+	if _, err := NewStreamResamplerWithOptions(48000, 16000, ResamplerOptions{Algorithm: "linear"}); err == nil {
+		t.Fatalf("unknown algorithm returned nil error")
+	}
+}
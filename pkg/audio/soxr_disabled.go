@@ -0,0 +1,12 @@
+//go:build nosoxr
+
+package audio
+
+// newSoxrEngine falls back to the sinc resampler in builds without soxr.
+func newSoxrEngine(inRate, outRate int, quality ResamplerQuality) (resamplerEngine, error) {
+	r, err := newSincStreamResampler(inRate, outRate, quality)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -1,7 +1,10 @@
+//go:build !nosoxr
+
 package audio
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 
 	resampler "github.com/godeps/go-audio-soxr"
@@ -51,15 +54,35 @@ func releaseSoxrResampler(inRate, outRate int, quality resampler.QualityPreset,
 	getSoxrPool(key).Put(r)
 }
 
-func newSoxrStreamResampler(inRate, outRate int) (*soxrStreamResampler, error) {
-	r, err := acquireSoxrResampler(inRate, outRate, resampler.QualityHigh)
+var soxrQuality = map[ResamplerQuality]resampler.QualityPreset{
+	ResamplerQualityQuick:    resampler.QualityQuick,
+	ResamplerQualityLow:      resampler.QualityLow,
+	ResamplerQualityMedium:   resampler.QualityMedium,
+	ResamplerQualityHigh:     resampler.QualityHigh,
+	ResamplerQualityVeryHigh: resampler.QualityVeryHigh,
+}
+
+func newSoxrEngine(inRate, outRate int, quality ResamplerQuality) (resamplerEngine, error) {
+	r, err := newSoxrStreamResampler(inRate, outRate, quality)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func newSoxrStreamResampler(inRate, outRate int, quality ResamplerQuality) (*soxrStreamResampler, error) {
+	preset, ok := soxrQuality[quality]
+	if !ok {
+		return nil, fmt.Errorf("resample: unknown quality %q", quality)
+	}
+	r, err := acquireSoxrResampler(inRate, outRate, preset)
 	if err != nil {
 		return nil, err
 	}
 	return &soxrStreamResampler{
 		inRate:  inRate,
 		outRate: outRate,
-		quality: resampler.QualityHigh,
+		quality: preset,
 		r:       r,
 	}, nil
 }
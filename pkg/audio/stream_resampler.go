@@ -1,14 +1,73 @@
 package audio
 
+import "fmt"
+
+// ResamplerAlgorithm selects the resampler implementation.
+type ResamplerAlgorithm string
+
+// Resampler algorithms. Builds with the nosoxr tag leave soxr out and use
+// sinc for both.
+const (
+	ResamplerSoxr ResamplerAlgorithm = "soxr"
+	ResamplerSinc ResamplerAlgorithm = "sinc"
+)
+
+// ResamplerQuality trades CPU for passband width and stopband attenuation.
+type ResamplerQuality string
+
+// Resampler quality presets, mapped to the soxr presets of the same name and
+// to sinc filters of increasing length.
+const (
+	ResamplerQualityQuick    ResamplerQuality = "quick"
+	ResamplerQualityLow      ResamplerQuality = "low"
+	ResamplerQualityMedium   ResamplerQuality = "medium"
+	ResamplerQualityHigh     ResamplerQuality = "high"
+	ResamplerQualityVeryHigh ResamplerQuality = "very_high"
+)
+
+// ResamplerOptions selects the algorithm and quality of a StreamResampler.
+// Empty fields use soxr at high quality.
+type ResamplerOptions struct {
+	Algorithm ResamplerAlgorithm
+	Quality   ResamplerQuality
+}
+
+// resamplerEngine is the streaming core behind StreamResampler.
+type resamplerEngine interface {
+	Process(input []float32) ([]float32, error)
+	Flush() ([]float32, error)
+	Close()
+}
+
 // StreamResampler keeps resampling state across frames.
 type StreamResampler struct {
-	resampler *soxrStreamResampler
+	resampler resamplerEngine
 	outBuf    []float32
 }
 
 // NewStreamResampler creates a streaming resampler for continuous audio.
 func NewStreamResampler(inRate, outRate int) (*StreamResampler, error) {
-	r, err := newSoxrStreamResampler(inRate, outRate)
+	return NewStreamResamplerWithOptions(inRate, outRate, ResamplerOptions{})
+}
+
+// NewStreamResamplerWithOptions creates a streaming resampler with the given
+// algorithm and quality.
+func NewStreamResamplerWithOptions(inRate, outRate int, opts ResamplerOptions) (*StreamResampler, error) {
+	if opts.Quality == "" {
+		opts.Quality = ResamplerQualityHigh
+	}
+	var (
+		r   resamplerEngine
+		err error
+	)
+	switch opts.Algorithm {
+	case "", ResamplerSoxr:
+		r, err = newSoxrEngine(inRate, outRate, opts.Quality)
+	case ResamplerSinc:
+		r, err = newSincStreamResampler(inRate, outRate, opts.Quality)
+	default:
+		return nil, fmt.Errorf("resample: unknown algorithm %q", opts.Algorithm)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +119,14 @@ func (s *StreamResampler) Flush() error {
 	return nil
 }
 
+// Buffered returns the number of resampled samples ready to pop.
+func (s *StreamResampler) Buffered() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.outBuf)
+}
+
 // PopFrame returns a fixed-size PCM16 frame if available.
 func (s *StreamResampler) PopFrame(frameSize int) ([]int16, bool) {
 	if s == nil || frameSize <= 0 || len(s.outBuf) < frameSize {
@@ -0,0 +1,122 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// sweepSNR resamples a stepped sine sweep from 100 Hz to 0.9 of the lower
+// Nyquist and returns the worst SNR in dB. Each tone is fitted by least
+// squares at its own frequency, so the resampler's delay and passband gain
+// do not count; aliasing, imaging and other distortion do.
+func sweepSNR(t testing.TB, opts ResamplerOptions, inRate, outRate int) float64 {
+	t.Helper()
+	const steps = 8
+	top := 0.9 * float64(min(inRate, outRate)) / 2
+	worst := math.Inf(1)
+	for step := range steps {
+		freq := 100 + (top-100)*float64(step)/(steps-1)
+		in := make([]float32, inRate/4)
+		for i := range in {
+			in[i] = float32(0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(inRate)))
+		}
+		got := resampleAll(t, opts, inRate, outRate, in, inRate/50)
+		edge := outRate / 20
+		if len(got) < 3*edge {
+			t.Fatalf("output=%d samples, want at least %d", len(got), 3*edge)
+		}
+		worst = math.Min(worst, toneSNR(got[edge:len(got)-edge], 2*math.Pi*freq/float64(outRate)))
+	}
+	return worst
+}
+
+// toneSNR fits a sinusoid of angular frequency w to y and returns the ratio
+// of its energy to the residual in dB.
+func toneSNR(y []float32, w float64) float64 {
+	var cc, cs, ss, yc, ys float64
+	for i, v := range y {
+		c, s := math.Cos(w*float64(i)), math.Sin(w*float64(i))
+		cc += c * c
+		cs += c * s
+		ss += s * s
+		yc += float64(v) * c
+		ys += float64(v) * s
+	}
+	det := cc*ss - cs*cs
+	a := (yc*ss - ys*cs) / det
+	b := (ys*cc - yc*cs) / det
+	var signal, noise float64
+	for i, v := range y {
+		fit := a*math.Cos(w*float64(i)) + b*math.Sin(w*float64(i))
+		d := float64(v) - fit
+		signal += fit * fit
+		noise += d * d
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+func resampleAll(t testing.TB, opts ResamplerOptions, inRate, outRate int, in []float32, chunk int) []float32 {
+	t.Helper()
+	r, err := NewStreamResamplerWithOptions(inRate, outRate, opts)
+	if err != nil {
+		t.Fatalf("NewStreamResamplerWithOptions error: %v", err)
+	}
+	defer r.Close()
+	var out []float32
+	for off := 0; off < len(in); off += chunk {
+		part, err := r.resampler.Process(in[off:min(off+chunk, len(in))])
+		if err != nil {
+			t.Fatalf("Process error: %v", err)
+		}
+		out = append(out, part...)
+	}
+	tail, err := r.resampler.Flush()
+	if err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	return append(out, tail...)
+}
+
+var resamplerQualities = []ResamplerQuality{
+	ResamplerQualityQuick,
+	ResamplerQualityLow,
+	ResamplerQualityMedium,
+	ResamplerQualityHigh,
+	ResamplerQualityVeryHigh,
+}
+
+var resamplerRates = [][2]int{{48000, 16000}, {16000, 24000}, {44100, 16000}}
+
+// BenchmarkStreamResampler compares CPU cost per 20 ms frame across
+// algorithms and presets, reporting the sweep SNR alongside.
+func BenchmarkStreamResampler(b *testing.B) {
+	for _, alg := range []ResamplerAlgorithm{ResamplerSoxr, ResamplerSinc} {
+		for _, q := range resamplerQualities {
+			for _, rates := range resamplerRates {
+				opts := ResamplerOptions{Algorithm: alg, Quality: q}
+				name := fmt.Sprintf("%s/%s/%d-%d", alg, q, rates[0], rates[1])
+				b.Run(name, func(b *testing.B) {
+					snr := sweepSNR(b, opts, rates[0], rates[1])
+					r, err := NewStreamResamplerWithOptions(rates[0], rates[1], opts)
+					if err != nil {
+						b.Fatalf("NewStreamResamplerWithOptions error: %v", err)
+					}
+					defer r.Close()
+					frame := make([]int16, rates[0]/50)
+					for i := range frame {
+						frame[i] = int16(8000 * math.Sin(2*math.Pi*440*float64(i)/float64(rates[0])))
+					}
+					b.ResetTimer()
+					for range b.N {
+						if err := r.AppendPCM(frame); err != nil {
+							b.Fatalf("AppendPCM error: %v", err)
+						}
+						r.outBuf = r.outBuf[:0]
+					}
+					b.ReportMetric(snr, "snr_dB")
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package audio
+
+import "math"
+
+// VAD defaults.
+const (
+	DefaultVADThresholdDB  = -45.0
+	DefaultVADMinSpeechMs  = 90
+	DefaultVADEndSilenceMs = 700
+	DefaultVADPreRollMs    = 300
+
+	vadNoiseMarginDB = 9.0
+	vadLoudMarginDB  = 12.0
+	vadMaxZCR        = 0.35
+	vadFloorAttack   = 0.05
+	vadFloorRelease  = 0.002
+	vadMinDB         = -96.0
+)
+
+// VADEvent is a speech boundary reported by VAD.Push.
+type VADEvent int
+
+// VAD events.
+const (
+	VADNone VADEvent = iota
+	VADSpeechStart
+	VADSpeechEnd
+)
+
+// VADConfig tunes the voice activity detector. Zero values use the defaults.
+type VADConfig struct {
+	SampleRate int
+	Channels   int
+	// ThresholdDB is the minimum frame level in dBFS counted as speech; the
+	// effective threshold also tracks the background noise floor.
+	ThresholdDB float64
+	// MinSpeechMs is how long speech must last before a turn starts.
+	MinSpeechMs int
+	// EndSilenceMs is the trailing silence that ends a turn.
+	EndSilenceMs int
+	// PreRollMs is how much audio before the detected start is kept so the
+	// first syllable is not clipped.
+	PreRollMs int
+}
+
+// VADResult is the outcome of pushing one frame.
+type VADResult struct {
+	Event VADEvent
+	// Frames holds the audio to forward, oldest first: nothing during
+	// silence, the pre-roll plus the frame when speech starts, and every
+	// frame while in speech including the trailing silence. The pushed
+	// frame itself is not copied.
+	Frames [][]int16
+}
+
+// VAD is an energy and zero-crossing voice activity detector with an
+// adaptive noise floor. It gates leading silence and reports the end of a
+// turn after trailing silence. It is not safe for concurrent use.
+type VAD struct {
+	cfg        VADConfig
+	noiseDB    float64
+	speaking   bool
+	speechMs   float64
+	silenceMs  float64
+	preRoll    [][]int16
+	preRollLen float64
+}
+
+// NewVAD executes the newVAD function.
+func NewVAD(cfg VADConfig) *VAD {
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = 16000
+	}
+	if cfg.Channels <= 0 {
+		cfg.Channels = 1
+	}
+	if cfg.ThresholdDB == 0 {
+		cfg.ThresholdDB = DefaultVADThresholdDB
+	}
+	if cfg.MinSpeechMs <= 0 {
+		cfg.MinSpeechMs = DefaultVADMinSpeechMs
+	}
+	if cfg.EndSilenceMs <= 0 {
+		cfg.EndSilenceMs = DefaultVADEndSilenceMs
+	}
+	if cfg.PreRollMs < 0 {
+		cfg.PreRollMs = 0
+	}
+	return &VAD{cfg: cfg, noiseDB: cfg.ThresholdDB - vadNoiseMarginDB}
+}
+
+// Speaking reports whether the detector is inside a speech turn.
+func (v *VAD) Speaking() bool {
+	return v.speaking
+}
+
+// Reset ends any turn in progress and drops the pre-roll. The noise floor
+// estimate is kept.
+func (v *VAD) Reset() {
+	v.speaking = false
+	v.speechMs = 0
+	v.silenceMs = 0
+	v.preRoll = nil
+	v.preRollLen = 0
+}
+
+// Push classifies an interleaved frame. The frame is copied when it has to
+// be held back, so callers may reuse it.
+func (v *VAD) Push(frame []int16) VADResult {
+	if len(frame) == 0 {
+		return VADResult{}
+	}
+	durationMs := v.frameMs(frame)
+	voiced := v.classify(frame)
+
+	if v.speaking {
+		result := VADResult{Frames: [][]int16{frame}}
+		if voiced {
+			v.silenceMs = 0
+			return result
+		}
+		v.silenceMs += durationMs
+		if v.silenceMs >= float64(v.cfg.EndSilenceMs) {
+			v.Reset()
+			result.Event = VADSpeechEnd
+		}
+		return result
+	}
+
+	if voiced {
+		v.speechMs += durationMs
+	} else {
+		v.speechMs = 0
+	}
+	if v.speechMs < float64(v.cfg.MinSpeechMs) {
+		v.holdPreRoll(frame, durationMs)
+		return VADResult{}
+	}
+	frames := append(v.preRoll, frame)
+	v.preRoll = nil
+	v.preRollLen = 0
+	v.speaking = true
+	v.silenceMs = 0
+	return VADResult{Event: VADSpeechStart, Frames: frames}
+}
+
+// holdPreRoll keeps the pre-roll before the current speech onset plus the
+// speech seen so far, so a confirmed start can replay both.
+func (v *VAD) holdPreRoll(frame []int16, durationMs float64) {
+	limit := float64(v.cfg.PreRollMs) + v.speechMs
+	v.preRoll = append(v.preRoll, append([]int16(nil), frame...))
+	v.preRollLen += durationMs
+	for len(v.preRoll) > 1 {
+		oldestMs := v.frameMs(v.preRoll[0])
+		if v.preRollLen-oldestMs < limit {
+			break
+		}
+		v.preRoll = v.preRoll[1:]
+		v.preRollLen -= oldestMs
+	}
+}
+
+func (v *VAD) frameMs(frame []int16) float64 {
+	return float64(len(frame)/v.cfg.Channels) * 1000 / float64(v.cfg.SampleRate)
+}
+
+// classify reports whether the frame looks like speech and updates the
+// noise floor, which falls quickly and rises slowly so steady background
+// noise stops counting as speech after a few seconds.
+func (v *VAD) classify(frame []int16) bool {
+	levelDB, zcr := FrameLevel(frame, v.cfg.Channels)
+	threshold := math.Max(v.cfg.ThresholdDB, v.noiseDB+vadNoiseMarginDB)
+	voiced := levelDB >= threshold && (zcr <= vadMaxZCR || levelDB >= threshold+vadLoudMarginDB)
+	rate := vadFloorRelease
+	if levelDB < v.noiseDB {
+		rate = vadFloorAttack
+	}
+	v.noiseDB += (levelDB - v.noiseDB) * rate
+	return voiced
+}
+
+// FrameLevel returns the RMS level in dBFS and the zero-crossing rate of the
+// first channel of an interleaved frame.
+func FrameLevel(frame []int16, channels int) (float64, float64) {
+	if channels <= 0 {
+		channels = 1
+	}
+	var sum float64
+	crossings := 0
+	samples := 0
+	prev := int16(0)
+	for i := 0; i < len(frame); i += channels {
+		s := frame[i]
+		sum += float64(s) * float64(s)
+		if samples > 0 && (s >= 0) != (prev >= 0) {
+			crossings++
+		}
+		prev = s
+		samples++
+	}
+	if samples == 0 {
+		return vadMinDB, 0
+	}
+	rms := math.Sqrt(sum/float64(samples)) / 32768
+	levelDB := vadMinDB
+	if rms > 0 {
+		levelDB = math.Max(20*math.Log10(rms), vadMinDB)
+	}
+	zcr := 0.0
+	if samples > 1 {
+		zcr = float64(crossings) / float64(samples-1)
+	}
+	return levelDB, zcr
+}
@@ -0,0 +1,122 @@
+package audio
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+const vadTestFrame = 320 // 20ms at 16kHz
+
+func toneFrame(offset int, amplitude float64) []int16 {
+	frame := make([]int16, vadTestFrame)
+	for i := range frame {
+		frame[i] = int16(amplitude * math.Sin(2*math.Pi*300*float64(offset+i)/16000))
+	}
+	return frame
+}
+
+func noiseFrame(rng *rand.Rand, amplitude float64) []int16 {
+	frame := make([]int16, vadTestFrame)
+	for i := range frame {
+		frame[i] = int16(amplitude * (rng.Float64()*2 - 1))
+	}
+	return frame
+}
+
+func TestVADGatesLeadingSilenceAndEndsTurn(t *testing.T) {
+	vad := NewVAD(VADConfig{SampleRate: 16000, Channels: 1, MinSpeechMs: 60, EndSilenceMs: 400, PreRollMs: 100})
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 25; i++ {
+		if r := vad.Push(noiseFrame(rng, 20)); r.Event != VADNone || len(r.Frames) != 0 {
+			t.Fatalf("silence frame %d: event=%v frames=%d, want none", i, r.Event, len(r.Frames))
+		}
+	}
+
+	start := -1
+	forwarded := 0
+	for i := 0; i < 50; i++ {
+		r := vad.Push(toneFrame(i*vadTestFrame, 8000))
+		forwarded += len(r.Frames)
+		if r.Event == VADSpeechStart {
+			if start >= 0 {
+				t.Fatalf("second speech start at frame %d", i)
+			}
+			start = i
+			// 100ms pre-roll plus the 60ms needed to confirm speech.
+			if len(r.Frames) != 8 {
+				t.Fatalf("start frames=%d, want 8", len(r.Frames))
+			}
+		}
+	}
+	if start != 2 {
+		t.Fatalf("speech start at frame %d, want 2", start)
+	}
+	if !vad.Speaking() {
+		t.Fatalf("expected speaking during tone")
+	}
+
+	end := -1
+	for i := 0; i < 40; i++ {
+		r := vad.Push(noiseFrame(rng, 20))
+		if end >= 0 {
+			if len(r.Frames) != 0 {
+				t.Fatalf("frame %d forwarded after speech end", i)
+			}
+			continue
+		}
+		if len(r.Frames) != 1 {
+			t.Fatalf("trailing frame %d: frames=%d, want 1", i, len(r.Frames))
+		}
+		if r.Event == VADSpeechEnd {
+			end = i
+		}
+	}
+	if end != 19 {
+		t.Fatalf("speech end after %d trailing frames, want 20", end+1)
+	}
+	if vad.Speaking() {
+		t.Fatalf("expected silence after speech end")
+	}
+}
+
+func TestVADIgnoresNoiseLikeFrames(t *testing.T) {
+	vad := NewVAD(VADConfig{SampleRate: 16000, Channels: 1})
+	rng := rand.New(rand.NewSource(2))
+	// White noise around -40 dBFS crosses zero far more often than voiced
+	// speech and stays below the loud margin.
+	for i := 0; i < 100; i++ {
+		if r := vad.Push(noiseFrame(rng, 570)); r.Event != VADNone {
+			t.Fatalf("noise frame %d: event=%v, want none", i, r.Event)
+		}
+	}
+}
+
+func TestVADShortBurstDoesNotStartTurn(t *testing.T) {
+	vad := NewVAD(VADConfig{SampleRate: 16000, Channels: 1, MinSpeechMs: 100})
+	for i := 0; i < 3; i++ {
+		if r := vad.Push(toneFrame(i*vadTestFrame, 8000)); r.Event != VADNone {
+			t.Fatalf("burst frame %d: event=%v, want none", i, r.Event)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if r := vad.Push(make([]int16, vadTestFrame)); r.Event != VADNone {
+			t.Fatalf("silence frame %d: event=%v, want none", i, r.Event)
+		}
+	}
+}
+
+func TestFrameLevel(t *testing.T) {
+	level, zcr := FrameLevel(toneFrame(0, 16384), 1)
+	// A half-scale sine is about -9 dBFS RMS.
+	if math.Abs(level+9.03) > 0.2 {
+		t.Fatalf("level=%.2f, want about -9.03", level)
+	}
+	if math.Abs(zcr-0.0376) > 0.01 {
+		t.Fatalf("zcr=%.4f, want about 0.0376", zcr)
+	}
+	if level, _ := FrameLevel(make([]int16, 10), 1); level != vadMinDB {
+		t.Fatalf("silence level=%v, want %v", level, vadMinDB)
+	}
+}
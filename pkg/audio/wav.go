@@ -0,0 +1,479 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// WAV format tags.
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatIEEEFloat  = 0x0003
+	wavFormatExtensible = 0xFFFE
+
+	// wavUnknownSize marks a RIFF or data size that is not known up front,
+	// e.g. a stream written to a non-seekable writer.
+	wavUnknownSize = 0xFFFFFFFF
+)
+
+// wavSubFormatSuffix is the KSDATAFORMAT_SUBTYPE GUID tail shared by the PCM
+// and IEEE float sub formats of WAVE_FORMAT_EXTENSIBLE.
+var wavSubFormatSuffix = []byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71}
+
+// WAVFormat describes the sample layout of a WAV stream.
+type WAVFormat struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	// Float marks 32-bit IEEE float samples.
+	Float bool
+}
+
+// BlockAlign returns the size in bytes of one frame of samples.
+func (f WAVFormat) BlockAlign() int {
+	return f.Channels * f.BitsPerSample / 8
+}
+
+func (f WAVFormat) validate() error {
+	if f.SampleRate <= 0 {
+		return fmt.Errorf("wav: invalid sample rate %d", f.SampleRate)
+	}
+	if f.Channels <= 0 || f.Channels > math.MaxUint16 {
+		return fmt.Errorf("wav: invalid channel count %d", f.Channels)
+	}
+	if f.Float {
+		if f.BitsPerSample != 32 {
+			return fmt.Errorf("wav: unsupported float bits per sample %d", f.BitsPerSample)
+		}
+		return nil
+	}
+	switch f.BitsPerSample {
+	case 8, 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("wav: unsupported bits per sample %d", f.BitsPerSample)
+}
+
+// extensible reports whether the format needs WAVE_FORMAT_EXTENSIBLE, which
+// is required for more than two channels or more than 16 bits per sample.
+func (f WAVFormat) extensible() bool {
+	return f.Channels > 2 || f.BitsPerSample > 16
+}
+
+func (f WAVFormat) tag() uint16 {
+	if f.Float {
+		return wavFormatIEEEFloat
+	}
+	return wavFormatPCM
+}
+
+// WAVWriter writes samples to a WAV stream. Sizes are patched on Close when
+// the underlying writer is an io.WriteSeeker; otherwise they are left as
+// unknown, which streaming readers accept.
+type WAVWriter struct {
+	w              io.Writer
+	format         WAVFormat
+	dataSizeOffset int64
+	dataBytes      int64
+	scratch        []byte
+	closed         bool
+}
+
+// NewWAVWriter writes the WAV header for format to w.
+func NewWAVWriter(w io.Writer, format WAVFormat) (*WAVWriter, error) {
+	if err := format.validate(); err != nil {
+		return nil, err
+	}
+	header := wavHeader(format, wavUnknownSize)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &WAVWriter{w: w, format: format, dataSizeOffset: int64(len(header) - 4)}, nil
+}
+
+func wavHeader(format WAVFormat, dataSize uint32) []byte {
+	fmtSize := 16
+	if format.extensible() {
+		fmtSize = 40
+	}
+	buf := make([]byte, 12+8+fmtSize+8)
+	copy(buf[0:4], "RIFF")
+	riffSize := uint32(wavUnknownSize)
+	if dataSize != wavUnknownSize {
+		riffSize = uint32(len(buf)-8) + dataSize + dataSize%2
+	}
+	binary.LittleEndian.PutUint32(buf[4:8], riffSize)
+	copy(buf[8:12], "WAVE")
+	copy(buf[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(fmtSize))
+	fmtChunk := buf[20 : 20+fmtSize]
+	tag := format.tag()
+	if format.extensible() {
+		tag = wavFormatExtensible
+	}
+	binary.LittleEndian.PutUint16(fmtChunk[0:2], tag)
+	binary.LittleEndian.PutUint16(fmtChunk[2:4], uint16(format.Channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:8], uint32(format.SampleRate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:12], uint32(format.SampleRate*format.BlockAlign()))
+	binary.LittleEndian.PutUint16(fmtChunk[12:14], uint16(format.BlockAlign()))
+	binary.LittleEndian.PutUint16(fmtChunk[14:16], uint16(format.BitsPerSample))
+	if format.extensible() {
+		binary.LittleEndian.PutUint16(fmtChunk[16:18], 22)
+		binary.LittleEndian.PutUint16(fmtChunk[18:20], uint16(format.BitsPerSample))
+		binary.LittleEndian.PutUint32(fmtChunk[20:24], wavChannelMask(format.Channels))
+		binary.LittleEndian.PutUint16(fmtChunk[24:26], format.tag())
+		copy(fmtChunk[26:40], wavSubFormatSuffix)
+	}
+	data := buf[20+fmtSize:]
+	copy(data[0:4], "data")
+	binary.LittleEndian.PutUint32(data[4:8], dataSize)
+	return buf
+}
+
+// wavChannelMask returns the default speaker mask for mono, stereo and the
+// common surround layouts, or 0 (unassigned) for anything else.
+func wavChannelMask(channels int) uint32 {
+	switch channels {
+	case 1:
+		return 0x4
+	case 2:
+		return 0x3
+	case 4:
+		return 0x33
+	case 6:
+		return 0x3F
+	case 8:
+		return 0x63F
+	}
+	return 0
+}
+
+// Format returns the format being written.
+func (w *WAVWriter) Format() WAVFormat {
+	return w.format
+}
+
+// WritePCM16 writes little-endian 16-bit PCM bytes.
+func (w *WAVWriter) WritePCM16(pcm []byte) error {
+	if w.format.BitsPerSample == 16 && !w.format.Float {
+		return w.writeData(pcm)
+	}
+	samples := BytesToInt16Slice(pcm)
+	return w.WriteInt16(samples)
+}
+
+// WriteInt16 writes interleaved 16-bit samples, converting them to the
+// stream format.
+func (w *WAVWriter) WriteInt16(samples []int16) error {
+	size := w.format.BitsPerSample / 8
+	buf := w.buffer(len(samples) * size)
+	for i, sample := range samples {
+		out := buf[i*size:]
+		switch {
+		case w.format.Float:
+			binary.LittleEndian.PutUint32(out, math.Float32bits(float32(sample)/32768))
+		case size == 1:
+			out[0] = byte(int(sample)>>8 + 128)
+		case size == 2:
+			binary.LittleEndian.PutUint16(out, uint16(sample))
+		case size == 3:
+			v := int32(sample) << 8
+			out[0], out[1], out[2] = byte(v), byte(v>>8), byte(v>>16)
+		default:
+			binary.LittleEndian.PutUint32(out, uint32(int32(sample)<<16))
+		}
+	}
+	return w.writeData(buf)
+}
+
+// WriteFloat32 writes interleaved samples in [-1, 1], converting them to
+// the stream format. Out of range samples are clipped for integer formats.
+func (w *WAVWriter) WriteFloat32(samples []float32) error {
+	size := w.format.BitsPerSample / 8
+	buf := w.buffer(len(samples) * size)
+	for i, sample := range samples {
+		out := buf[i*size:]
+		if w.format.Float {
+			binary.LittleEndian.PutUint32(out, math.Float32bits(sample))
+			continue
+		}
+		v := float64(sample)
+		if v > 1 {
+			v = 1
+		} else if v < -1 {
+			v = -1
+		}
+		switch size {
+		case 1:
+			out[0] = byte(int(math.Round(v*127)) + 128)
+		case 2:
+			binary.LittleEndian.PutUint16(out, uint16(int16(math.Round(v*math.MaxInt16))))
+		case 3:
+			s := int32(math.Round(v * (1<<23 - 1)))
+			out[0], out[1], out[2] = byte(s), byte(s>>8), byte(s>>16)
+		default:
+			binary.LittleEndian.PutUint32(out, uint32(int32(math.Round(v*math.MaxInt32))))
+		}
+	}
+	return w.writeData(buf)
+}
+
+func (w *WAVWriter) buffer(size int) []byte {
+	if cap(w.scratch) < size {
+		w.scratch = make([]byte, size)
+	}
+	return w.scratch[:size]
+}
+
+func (w *WAVWriter) writeData(data []byte) error {
+	if w.closed {
+		return errors.New("wav: write after close")
+	}
+	n, err := w.w.Write(data)
+	w.dataBytes += int64(n)
+	return err
+}
+
+// DataBytes returns the number of sample bytes written so far.
+func (w *WAVWriter) DataBytes() int64 {
+	return w.dataBytes
+}
+
+// Close pads the data chunk to an even size and patches the RIFF and data
+// sizes when the writer can seek. It does not close the underlying writer.
+func (w *WAVWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	seeker, ok := w.w.(io.WriteSeeker)
+	if !ok || w.dataBytes > math.MaxUint32-int64(w.dataSizeOffset)-8 {
+		// Without a known data size a pad byte would read back as a sample.
+		return nil
+	}
+	if w.dataBytes%2 == 1 {
+		if _, err := w.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	end, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(w.dataSizeOffset+4+w.dataBytes+w.dataBytes%2-8))
+	if err := writeAt(seeker, 4, size[:]); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(size[:], uint32(w.dataBytes))
+	if err := writeAt(seeker, w.dataSizeOffset, size[:]); err != nil {
+		return err
+	}
+	_, err = seeker.Seek(end, io.SeekStart)
+	return err
+}
+
+func writeAt(w io.WriteSeeker, offset int64, data []byte) error {
+	if _, err := w.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// WAVReader reads samples from a WAV stream. Chunks before the data chunk
+// are parsed up front; samples are then read incrementally.
+type WAVReader struct {
+	r         io.Reader
+	format    WAVFormat
+	remaining int64
+	unbounded bool
+	scratch   []byte
+}
+
+// NewWAVReader parses the header of a WAV stream up to its data chunk.
+func NewWAVReader(r io.Reader) (*WAVReader, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, errors.New("wav: invalid header")
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errors.New("wav: invalid header")
+	}
+	var (
+		format    WAVFormat
+		hasFormat bool
+	)
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return nil, errors.New("wav: data chunk not found")
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		switch id {
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return nil, errors.New("wav: invalid fmt chunk")
+			}
+			body := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return nil, errors.New("wav: invalid fmt chunk")
+			}
+			parsed, err := parseWAVFormat(body[:size])
+			if err != nil {
+				return nil, err
+			}
+			format, hasFormat = parsed, true
+		case "data":
+			if !hasFormat {
+				return nil, errors.New("wav: data chunk before fmt chunk")
+			}
+			reader := &WAVReader{r: r, format: format, remaining: size}
+			// Streamed WAVs leave the size unset; read those until EOF.
+			reader.unbounded = size == wavUnknownSize || size == 0
+			return reader, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return nil, errors.New("wav: data chunk not found")
+			}
+		}
+	}
+}
+
+func parseWAVFormat(body []byte) (WAVFormat, error) {
+	tag := binary.LittleEndian.Uint16(body[0:2])
+	format := WAVFormat{
+		Channels:      int(binary.LittleEndian.Uint16(body[2:4])),
+		SampleRate:    int(binary.LittleEndian.Uint32(body[4:8])),
+		BitsPerSample: int(binary.LittleEndian.Uint16(body[14:16])),
+	}
+	if tag == wavFormatExtensible {
+		if len(body) < 40 || !bytes.Equal(body[26:40], wavSubFormatSuffix) {
+			return WAVFormat{}, errors.New("wav: unsupported extensible sub format")
+		}
+		tag = binary.LittleEndian.Uint16(body[24:26])
+	}
+	switch tag {
+	case wavFormatPCM:
+	case wavFormatIEEEFloat:
+		format.Float = true
+	default:
+		return WAVFormat{}, fmt.Errorf("wav: unsupported format tag 0x%04x", tag)
+	}
+	if err := format.validate(); err != nil {
+		return WAVFormat{}, err
+	}
+	if blockAlign := int(binary.LittleEndian.Uint16(body[12:14])); blockAlign != format.BlockAlign() {
+		return WAVFormat{}, fmt.Errorf("wav: invalid block align %d", blockAlign)
+	}
+	return format, nil
+}
+
+// Format returns the format of the stream.
+func (r *WAVReader) Format() WAVFormat {
+	return r.format
+}
+
+// ReadInt16 reads up to len(dst) interleaved samples converted to 16-bit and
+// returns how many were read. It returns io.EOF once the data is exhausted;
+// a truncated trailing sample is dropped.
+func (r *WAVReader) ReadInt16(dst []int16) (int, error) {
+	raw, err := r.readRaw(len(dst))
+	size := r.format.BitsPerSample / 8
+	n := len(raw) / size
+	for i := 0; i < n; i++ {
+		in := raw[i*size:]
+		switch {
+		case r.format.Float:
+			dst[i] = float32ToInt16(math.Float32frombits(binary.LittleEndian.Uint32(in)))
+		case size == 1:
+			dst[i] = int16(int(in[0])-128) << 8
+		case size == 2:
+			dst[i] = int16(binary.LittleEndian.Uint16(in))
+		case size == 3:
+			dst[i] = int16(in[1]) | int16(int8(in[2]))<<8
+		default:
+			dst[i] = int16(binary.LittleEndian.Uint32(in) >> 16)
+		}
+	}
+	return n, err
+}
+
+// ReadFloat32 reads up to len(dst) interleaved samples converted to floats
+// in [-1, 1] and returns how many were read. It returns io.EOF once the data
+// is exhausted.
+func (r *WAVReader) ReadFloat32(dst []float32) (int, error) {
+	raw, err := r.readRaw(len(dst))
+	size := r.format.BitsPerSample / 8
+	n := len(raw) / size
+	for i := 0; i < n; i++ {
+		in := raw[i*size:]
+		switch {
+		case r.format.Float:
+			dst[i] = math.Float32frombits(binary.LittleEndian.Uint32(in))
+		case size == 1:
+			dst[i] = float32(int(in[0])-128) / 128
+		case size == 2:
+			dst[i] = float32(int16(binary.LittleEndian.Uint16(in))) / 32768
+		case size == 3:
+			v := int32(in[0]) | int32(in[1])<<8 | int32(int8(in[2]))<<16
+			dst[i] = float32(v) / (1 << 23)
+		default:
+			dst[i] = float32(float64(int32(binary.LittleEndian.Uint32(in))) / (1 << 31))
+		}
+	}
+	return n, err
+}
+
+// readRaw reads the bytes of up to samples whole samples.
+func (r *WAVReader) readRaw(samples int) ([]byte, error) {
+	size := r.format.BitsPerSample / 8
+	want := int64(samples * size)
+	if !r.unbounded && want > r.remaining {
+		want = r.remaining - r.remaining%int64(size)
+	}
+	if want <= 0 {
+		return nil, io.EOF
+	}
+	if int64(cap(r.scratch)) < want {
+		r.scratch = make([]byte, want)
+	}
+	buf := r.scratch[:want]
+	n, err := io.ReadFull(r.r, buf)
+	r.remaining -= int64(n)
+	n -= n % size
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && n > 0) {
+		// The stream ended early; keep what was read and stop afterwards.
+		r.remaining, r.unbounded = 0, false
+		err = nil
+	}
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	return buf[:n], err
+}
+
+// DecodeWAV reads a whole WAV stream as interleaved 16-bit samples.
+func DecodeWAV(r io.Reader) ([]int16, WAVFormat, error) {
+	reader, err := NewWAVReader(r)
+	if err != nil {
+		return nil, WAVFormat{}, err
+	}
+	var samples []int16
+	buf := make([]int16, 4096)
+	for {
+		n, err := reader.ReadInt16(buf)
+		samples = append(samples, buf[:n]...)
+		if err == io.EOF {
+			return samples, reader.Format(), nil
+		}
+		if err != nil {
+			return nil, WAVFormat{}, err
+		}
+	}
+}
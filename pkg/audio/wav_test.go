@@ -0,0 +1,208 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func sineInt16(samples int, channels int) []int16 {
+	out := make([]int16, samples*channels)
+	for i := 0; i < samples; i++ {
+		for ch := 0; ch < channels; ch++ {
+			out[i*channels+ch] = int16(12000 * math.Sin(2*math.Pi*float64(i*(ch+1))/64))
+		}
+	}
+	return out
+}
+
+func TestWAVRoundTripFormats(t *testing.T) {
+	cases := []struct {
+		format    WAVFormat
+		tolerance int
+	}{
+		{WAVFormat{SampleRate: 8000, Channels: 1, BitsPerSample: 8}, 256},
+		{WAVFormat{SampleRate: 16000, Channels: 1, BitsPerSample: 16}, 0},
+		{WAVFormat{SampleRate: 24000, Channels: 2, BitsPerSample: 24}, 0},
+		{WAVFormat{SampleRate: 44100, Channels: 2, BitsPerSample: 32}, 0},
+		{WAVFormat{SampleRate: 48000, Channels: 2, BitsPerSample: 32, Float: true}, 1},
+		{WAVFormat{SampleRate: 48000, Channels: 6, BitsPerSample: 16}, 0},
+	}
+	for _, tc := range cases {
+		samples := sineInt16(321, tc.format.Channels)
+		var buf bytes.Buffer
+		w, err := NewWAVWriter(&buf, tc.format)
+		if err != nil {
+			t.Fatalf("NewWAVWriter(%+v) error: %v", tc.format, err)
+		}
+		if err := w.WriteInt16(samples); err != nil {
+			t.Fatalf("WriteInt16 error: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close error: %v", err)
+		}
+
+		got, format, err := DecodeWAV(&buf)
+		if err != nil {
+			t.Fatalf("DecodeWAV(%+v) error: %v", tc.format, err)
+		}
+		if format != tc.format {
+			t.Fatalf("format=%+v, want %+v", format, tc.format)
+		}
+		if len(got) != len(samples) {
+			t.Fatalf("%+v: samples=%d, want %d", tc.format, len(got), len(samples))
+		}
+		for i := range samples {
+			diff := int(got[i]) - int(samples[i])
+			if diff < -tc.tolerance || diff > tc.tolerance {
+				t.Fatalf("%+v: sample %d=%d, want %d", tc.format, i, got[i], samples[i])
+			}
+		}
+	}
+}
+
+func TestWAVWriterPatchesSizesWhenSeekable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.wav")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	w, err := NewWAVWriter(file, WAVFormat{SampleRate: 16000, Channels: 1, BitsPerSample: 24})
+	if err != nil {
+		t.Fatalf("NewWAVWriter error: %v", err)
+	}
+	if err := w.WriteInt16(sineInt16(101, 1)); err != nil {
+		t.Fatalf("WriteInt16 error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	file.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile error: %v", err)
+	}
+	// 24-bit uses WAVE_FORMAT_EXTENSIBLE: 12 + 8+40 + 8 header bytes, then
+	// 303 data bytes and a pad byte.
+	if len(data) != 68+303+1 {
+		t.Fatalf("file size=%d, want %d", len(data), 68+303+1)
+	}
+	if got := binary.LittleEndian.Uint32(data[4:8]); got != uint32(len(data)-8) {
+		t.Fatalf("riff size=%d, want %d", got, len(data)-8)
+	}
+	if got := binary.LittleEndian.Uint16(data[20:22]); got != wavFormatExtensible {
+		t.Fatalf("format tag=0x%04x, want extensible", got)
+	}
+	if got := binary.LittleEndian.Uint32(data[64:68]); got != 303 {
+		t.Fatalf("data size=%d, want 303", got)
+	}
+}
+
+func TestWAVReaderStreamsUnknownSize(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWAVWriter(&buf, WAVFormat{SampleRate: 16000, Channels: 1, BitsPerSample: 16})
+	if err != nil {
+		t.Fatalf("NewWAVWriter error: %v", err)
+	}
+	samples := sineInt16(1000, 1)
+	if err := w.WriteInt16(samples); err != nil {
+		t.Fatalf("WriteInt16 error: %v", err)
+	}
+	w.Close()
+	if got := binary.LittleEndian.Uint32(buf.Bytes()[40:44]); got != wavUnknownSize {
+		t.Fatalf("data size=%#x, want unknown", got)
+	}
+
+	r, err := NewWAVReader(&buf)
+	if err != nil {
+		t.Fatalf("NewWAVReader error: %v", err)
+	}
+	total := 0
+	chunk := make([]int16, 160)
+	for {
+		n, err := r.ReadInt16(chunk)
+		for i := 0; i < n; i++ {
+			if chunk[i] != samples[total+i] {
+				t.Fatalf("sample %d=%d, want %d", total+i, chunk[i], samples[total+i])
+			}
+		}
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadInt16 error: %v", err)
+		}
+	}
+	if total != len(samples) {
+		t.Fatalf("samples=%d, want %d", total, len(samples))
+	}
+}
+
+func TestWAVReaderFloat32(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWAVWriter(&buf, WAVFormat{SampleRate: 48000, Channels: 1, BitsPerSample: 32, Float: true})
+	if err != nil {
+		t.Fatalf("NewWAVWriter error: %v", err)
+	}
+	in := []float32{0, 0.5, -0.25, 1, -1, 1.5}
+	if err := w.WriteFloat32(in); err != nil {
+		t.Fatalf("WriteFloat32 error: %v", err)
+	}
+	w.Close()
+	data := buf.Bytes()
+	r, err := NewWAVReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewWAVReader error: %v", err)
+	}
+	out := make([]float32, 10)
+	n, err := r.ReadFloat32(out)
+	if err != nil || n != len(in) {
+		t.Fatalf("ReadFloat32 n=%d err=%v, want %d", n, err, len(in))
+	}
+	for i := range in {
+		if out[i] != in[i] {
+			t.Fatalf("sample %d=%v, want %v", i, out[i], in[i])
+		}
+	}
+	ints := make([]int16, 1)
+	r, _ = NewWAVReader(bytes.NewReader(data))
+	r.ReadFloat32(make([]float32, 5))
+	if _, err := r.ReadInt16(ints); err != nil || ints[0] != math.MaxInt16 {
+		t.Fatalf("clipped sample=%d err=%v, want %d", ints[0], err, math.MaxInt16)
+	}
+}
+
+func TestWAVReaderSkipsChunksAndRejectsBadInput(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWAVWriter(&buf, WAVFormat{SampleRate: 16000, Channels: 1, BitsPerSample: 16})
+	w.WriteInt16([]int16{1, 2, 3})
+	w.Close()
+	header := buf.Bytes()[:36]
+	data := buf.Bytes()[36:]
+
+	withList := append([]byte{}, header...)
+	withList = append(withList, 'L', 'I', 'S', 'T', 3, 0, 0, 0, 'a', 'b', 'c', 0)
+	withList = append(withList, data...)
+	got, _, err := DecodeWAV(bytes.NewReader(withList))
+	if err != nil || len(got) != 3 || got[2] != 3 {
+		t.Fatalf("DecodeWAV with LIST=%v err=%v", got, err)
+	}
+
+	if _, err := NewWAVReader(bytes.NewReader([]byte("RIFF\x00\x00\x00\x00WAVX"))); err == nil {
+		t.Fatalf("expected error for non-WAVE header")
+	}
+	if _, err := NewWAVReader(bytes.NewReader(append([]byte("RIFF\x00\x00\x00\x00WAVE"), data...))); err == nil {
+		t.Fatalf("expected error for data before fmt")
+	}
+	bad := append([]byte{}, buf.Bytes()...)
+	binary.LittleEndian.PutUint16(bad[34:36], 12)
+	if _, err := NewWAVReader(bytes.NewReader(bad)); err == nil {
+		t.Fatalf("expected error for 12-bit samples")
+	}
+}
@@ -0,0 +1,216 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Matroska element IDs read by WebMOpusDemuxer.
+const (
+	webmIDEBML        = 0x1A45DFA3
+	webmIDSegment     = 0x18538067
+	webmIDTracks      = 0x1654AE6B
+	webmIDTrackEntry  = 0xAE
+	webmIDTrackNumber = 0xD7
+	webmIDCodecID     = 0x86
+	webmIDAudio       = 0xE1
+	webmIDSampling    = 0xB5
+	webmIDChannels    = 0x9F
+	webmIDCluster     = 0x1F43B675
+	webmIDBlockGroup  = 0xA0
+	webmIDBlock       = 0xA1
+	webmIDSimpleBlock = 0xA3
+
+	webmCodecOpus      = "A_OPUS"
+	webmMaxElementSize = 1 << 20
+)
+
+// WebMOpusDemuxer is a push-based demuxer for the Opus track of a WebM
+// stream, such as MediaRecorder output delivered in timeslices. Master
+// elements are entered without tracking their size, so the unknown-size
+// Segment and Cluster elements live encoders produce are supported. An EBML
+// header restarts it. Laced blocks are not supported.
+type WebMOpusDemuxer struct {
+	SampleRate int
+	Channels   int
+
+	buf  []byte
+	skip int
+
+	opusTrack     uint64
+	entryNumber   uint64
+	entryCodec    string
+	entryRate     int
+	entryChannels int
+}
+
+// Write consumes a chunk and returns the Opus packets it completed.
+func (d *WebMOpusDemuxer) Write(chunk []byte) ([][]byte, error) {
+	if d.skip > 0 {
+		n := min(d.skip, len(chunk))
+		d.skip -= n
+		chunk = chunk[n:]
+	}
+	d.buf = append(d.buf, chunk...)
+	var out [][]byte
+	for len(d.buf) > 0 {
+		id, idLen, err := readVint(d.buf, true)
+		if err != nil {
+			d.buf = nil
+			return out, err
+		}
+		if idLen == 0 {
+			break
+		}
+		size, sizeLen, err := readVint(d.buf[idLen:], false)
+		if err != nil {
+			d.buf = nil
+			return out, err
+		}
+		if sizeLen == 0 {
+			break
+		}
+		headerLen := idLen + sizeLen
+		unknownSize := size == 1<<(7*uint(sizeLen))-1
+
+		switch id {
+		case webmIDSegment, webmIDTracks, webmIDAudio, webmIDCluster, webmIDBlockGroup:
+			d.buf = d.buf[headerLen:]
+			continue
+		case webmIDTrackEntry:
+			d.entryNumber, d.entryCodec, d.entryRate, d.entryChannels = 0, "", 0, 0
+			d.buf = d.buf[headerLen:]
+			continue
+		case webmIDEBML:
+			d.reset()
+		}
+		if unknownSize {
+			d.buf = nil
+			return out, fmt.Errorf("webm: unknown size for element %#x", id)
+		}
+
+		switch id {
+		case webmIDTrackNumber, webmIDCodecID, webmIDSampling, webmIDChannels, webmIDSimpleBlock, webmIDBlock:
+			if size > webmMaxElementSize {
+				d.buf = nil
+				return out, fmt.Errorf("webm: element %#x too large", id)
+			}
+			end := headerLen + int(size)
+			if len(d.buf) < end {
+				return out, nil
+			}
+			packet, err := d.readElement(id, d.buf[headerLen:end])
+			d.buf = d.buf[end:]
+			if err != nil {
+				return out, err
+			}
+			if packet != nil {
+				out = append(out, packet)
+			}
+		default:
+			end := uint64(headerLen) + size
+			if uint64(len(d.buf)) >= end {
+				d.buf = d.buf[end:]
+				continue
+			}
+			d.skip = int(end - uint64(len(d.buf)))
+			d.buf = nil
+		}
+	}
+	if len(d.buf) == 0 {
+		d.buf = nil
+	}
+	return out, nil
+}
+
+func (d *WebMOpusDemuxer) reset() {
+	*d = WebMOpusDemuxer{buf: d.buf}
+}
+
+// readElement handles a fully buffered element and returns an Opus packet
+// when it is a block of the Opus track.
+func (d *WebMOpusDemuxer) readElement(id uint64, data []byte) ([]byte, error) {
+	switch id {
+	case webmIDTrackNumber:
+		d.entryNumber = readUint(data)
+	case webmIDCodecID:
+		d.entryCodec = string(data)
+	case webmIDChannels:
+		d.entryChannels = int(readUint(data))
+	case webmIDSampling:
+		switch len(data) {
+		case 4:
+			d.entryRate = int(math.Float32frombits(binary.BigEndian.Uint32(data)))
+		case 8:
+			d.entryRate = int(math.Float64frombits(binary.BigEndian.Uint64(data)))
+		}
+	case webmIDSimpleBlock, webmIDBlock:
+		return d.readBlock(data)
+	}
+	if d.entryCodec == webmCodecOpus && d.entryNumber != 0 {
+		d.opusTrack = d.entryNumber
+		d.SampleRate = d.entryRate
+		if d.SampleRate <= 0 {
+			d.SampleRate = 48000
+		}
+		d.Channels = d.entryChannels
+		if d.Channels <= 0 {
+			d.Channels = 1
+		}
+	}
+	return nil, nil
+}
+
+func (d *WebMOpusDemuxer) readBlock(data []byte) ([]byte, error) {
+	track, n, err := readVint(data, false)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || len(data) < n+3 {
+		return nil, errors.New("webm: block too short")
+	}
+	if d.opusTrack == 0 || track != d.opusTrack {
+		return nil, nil
+	}
+	if lacing := data[n+2] >> 1 & 0x03; lacing != 0 {
+		return nil, errors.New("webm: laced blocks are not supported")
+	}
+	return append([]byte(nil), data[n+3:]...), nil
+}
+
+// readVint decodes an EBML variable-length integer. Element IDs keep their
+// length marker bit; sizes and track numbers drop it. n is 0 when b does not
+// hold the whole integer yet.
+func readVint(b []byte, keepMarker bool) (value uint64, n int, err error) {
+	if len(b) == 0 {
+		return 0, 0, nil
+	}
+	if b[0] == 0 {
+		return 0, 0, errors.New("webm: invalid variable-length integer")
+	}
+	n = 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if len(b) < n {
+		return 0, 0, nil
+	}
+	value = uint64(b[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> n)
+	}
+	for _, c := range b[1:n] {
+		value = value<<8 | uint64(c)
+	}
+	return value, n, nil
+}
+
+func readUint(data []byte) uint64 {
+	var v uint64
+	for _, c := range data {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
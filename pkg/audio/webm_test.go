@@ -0,0 +1,115 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func ebmlElement(id uint32, data []byte) []byte {
+	out := []byte{}
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(out) > 0 {
+			out = append(out, b)
+		}
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(data))|1<<56)
+	out = append(out, size...)
+	return append(out, data...)
+}
+
+func ebmlUnknown(id uint32) []byte {
+	out := []byte{}
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(out) > 0 {
+			out = append(out, b)
+		}
+	}
+	return append(out, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// mediaRecorderWebM lays packets out the way browsers do: an unknown-size
+// Segment and Cluster, one SimpleBlock per packet.
+func mediaRecorderWebM(packets [][]byte, flags byte) []byte {
+	rate := make([]byte, 8)
+	binary.BigEndian.PutUint64(rate, math.Float64bits(48000))
+	out := concat(
+		ebmlElement(webmIDEBML, ebmlElement(0x4282, []byte("webm"))),
+		ebmlUnknown(webmIDSegment),
+		ebmlElement(0x1549A966, ebmlElement(0x2AD7B1, []byte{0x0F, 0x42, 0x40})),
+		ebmlElement(webmIDTracks, ebmlElement(webmIDTrackEntry, concat(
+			ebmlElement(webmIDTrackNumber, []byte{1}),
+			ebmlElement(webmIDCodecID, []byte(webmCodecOpus)),
+			ebmlElement(webmIDAudio, concat(
+				ebmlElement(webmIDChannels, []byte{1}),
+				ebmlElement(webmIDSampling, rate),
+			)),
+		))),
+		ebmlUnknown(webmIDCluster),
+		ebmlElement(0xE7, []byte{0}),
+	)
+	for i, packet := range packets {
+		block := append([]byte{0x81, 0, byte(i * 20), flags}, packet...)
+		out = append(out, ebmlElement(webmIDSimpleBlock, block)...)
+	}
+	return out
+}
+
+func feedInChunks(t *testing.T, write func([]byte) ([][]byte, error), data []byte, size int) [][]byte {
+	t.Helper()
+	var got [][]byte
+	for off := 0; off < len(data); off += size {
+		packets, err := write(data[off:min(off+size, len(data))])
+		if err != nil {
+			t.Fatalf("Write error at offset %d: %v", off, err)
+		}
+		got = append(got, packets...)
+	}
+	return got
+}
+
+func TestWebMOpusDemuxerChunkedStream(t *testing.T) {
+	packets := encodeSinePackets(t, 48000, 12)
+	stream := mediaRecorderWebM(packets, 0x80)
+	for _, size := range []int{1, 7, 64, len(stream)} {
+		d := &WebMOpusDemuxer{}
+		got := feedInChunks(t, d.Write, stream, size)
+		if len(got) != len(packets) {
+			t.Fatalf("chunk %d: got %d packets, want %d", size, len(got), len(packets))
+		}
+		for i := range packets {
+			if !bytes.Equal(got[i], packets[i]) {
+				t.Fatalf("chunk %d: packet %d differs", size, i)
+			}
+		}
+		if d.SampleRate != 48000 || d.Channels != 1 {
+			t.Fatalf("format=%d/%d, want 48000/1", d.SampleRate, d.Channels)
+		}
+	}
+}
+
+func TestWebMOpusDemuxerRestartsOnNewHeader(t *testing.T) {
+	packets := encodeSinePackets(t, 48000, 3)
+	stream := append(mediaRecorderWebM(packets, 0x80), mediaRecorderWebM(packets, 0x80)...)
+	d := &WebMOpusDemuxer{}
+	got, err := d.Write(stream)
+	if err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if len(got) != 2*len(packets) {
+		t.Fatalf("got %d packets, want %d", len(got), 2*len(packets))
+	}
+}
+
+func TestWebMOpusDemuxerRejectsLacing(t *testing.T) {
+	d := &WebMOpusDemuxer{}
+	if _, err := d.Write(mediaRecorderWebM([][]byte{{0x08, 1, 2}}, 0x82)); err == nil {
+		t.Fatalf("laced block returned nil error")
+	}
+}
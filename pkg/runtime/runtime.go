@@ -24,14 +24,19 @@ import (
 	appconfig "github.com/saker-ai/vtuber-server/internal/config"
 	apphttp "github.com/saker-ai/vtuber-server/internal/http"
 	applogger "github.com/saker-ai/vtuber-server/internal/logger"
+	"github.com/saker-ai/vtuber-server/internal/storage"
 	"github.com/saker-ai/vtuber-server/internal/ws"
 )
 
 // Server represents a server.
 type Server struct {
-	cfg    appconfig.Config
-	logger *zap.Logger
-	server *http.Server
+	cfg     appconfig.Config
+	logger  *zap.Logger
+	server  *http.Server
+	history storage.HistoryStore
+	ws      *ws.Handler
+	// stopJanitor stops the history retention janitor, if one is running.
+	stopJanitor context.CancelFunc
 }
 
 // New executes the new function.
@@ -58,26 +63,45 @@ func New(configPath string) (*Server, error) {
 		zap.String("http_addr", cfg.HTTPAddr),
 	)
 
-	wsHandler := ws.NewHandler(logger, cfg)
-	router := apphttp.NewRouter(cfg, wsHandler, logger)
+	history, err := storage.Open(cfg.HistoryBackend, cfg.ChatHistoryDir, cfg.HistoryDBPath)
+	if err != nil {
+		return nil, fmt.Errorf("open chat history store: %w", err)
+	}
+	logger.Info("chat history store opened", zap.String("backend", cfg.HistoryBackend))
+
+	wsHandler := ws.NewHandler(logger, cfg, history)
+	router := apphttp.NewRouter(cfg, wsHandler, history, logger)
 	httpServer := &http.Server{
 		Addr:    cfg.HTTPAddr,
 		Handler: router,
 	}
 
 	return &Server{
-		cfg:    cfg,
-		logger: logger,
-		server: httpServer,
+		cfg:     cfg,
+		logger:  logger,
+		server:  httpServer,
+		history: history,
+		ws:      wsHandler,
 	}, nil
 }
 
+// startHistoryJanitor starts the retention janitor when it is enabled.
+func (s *Server) startHistoryJanitor() {
+	ctx, cancel := context.WithCancel(context.Background())
+	if !storage.StartRetention(ctx, s.cfg.SystemConfig.HistoryRetention, s.history, s.cfg.RecordingsDir, s.logger) {
+		cancel()
+		return
+	}
+	s.stopJanitor = cancel
+}
+
 // Run executes the run method.
 func (s *Server) Run() error {
 	if s == nil || s.server == nil {
 		return nil
 	}
 
+	s.startHistoryJanitor()
 	err := listen(s.server, s.cfg, s.logger)
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
@@ -98,7 +122,19 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	if s == nil || s.server == nil {
 		return nil
 	}
-	return ignoreServerClosed(s.server.Shutdown(ctx))
+	if s.stopJanitor != nil {
+		s.stopJanitor()
+	}
+	err := ignoreServerClosed(s.server.Shutdown(ctx))
+	if s.ws != nil {
+		s.ws.Close()
+	}
+	if s.history != nil {
+		if closeErr := s.history.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 func ignoreServerClosed(err error) error {
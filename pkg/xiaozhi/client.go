@@ -1,6 +1,7 @@
 package xiaozhi
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
@@ -15,6 +16,7 @@ import (
 	"go.uber.org/zap"
 
 	xzcodec "github.com/saker-ai/vtuber-server/internal/transport/xiaozhi/codec"
+	"github.com/saker-ai/vtuber-server/pkg/audio"
 )
 
 const (
@@ -26,6 +28,12 @@ type AudioFrame struct {
 	PCM        []byte
 	SampleRate int
 	Channels   int
+	// Opus is the original packet when the server sent Opus; PCM is then its
+	// decoded form.
+	Opus []byte
+	// Seq numbers the Opus packets received by the client, counting those
+	// dropped for failing to decode, so a gap marks a lost packet.
+	Seq uint32
 }
 
 // Callbacks represents a callbacks.
@@ -65,6 +73,9 @@ type Client struct {
 
 	encoder *godepsopus.Encoder
 	writeMu sync.Mutex
+
+	// audioSeq is only touched by the read loop.
+	audioSeq uint32
 }
 
 // NewClient executes the newClient function.
@@ -122,6 +133,14 @@ func (c *Client) Close() {
 	c.mu.Unlock()
 }
 
+// Connected reports whether the connection is up and its hello was
+// acknowledged.
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil && c.helloReady
+}
+
 // SendTextInput executes the sendTextInput method.
 func (c *Client) SendTextInput(ctx context.Context, text string) error {
 	if err := c.waitHelloReady(ctx); err != nil {
@@ -567,6 +586,8 @@ func (c *Client) handleBinaryFrame(frame []byte) {
 	format, sampleRate, channels, _ := c.downstreamSnapshot()
 	switch format {
 	case "opus":
+		seq := c.audioSeq
+		c.audioSeq++
 		pcm, err := c.decodeOpus(frame, sampleRate, channels)
 		if err != nil {
 			c.reportError(err)
@@ -575,11 +596,11 @@ func (c *Client) handleBinaryFrame(frame []byte) {
 		if len(pcm) == 0 {
 			return
 		}
-		c.callbacks.OnAudio(AudioFrame{PCM: pcm, SampleRate: sampleRate, Channels: channels})
+		c.callbacks.OnAudio(AudioFrame{PCM: pcm, SampleRate: sampleRate, Channels: channels, Opus: frame, Seq: seq})
 	case "pcm_s16le", "pcm16", "pcm":
 		c.callbacks.OnAudio(AudioFrame{PCM: frame, SampleRate: sampleRate, Channels: channels})
 	case "wav":
-		pcm, sr, ch, err := decodeWAVFrame(frame, sampleRate, channels)
+		pcm, sr, ch, err := decodeWAVFrame(frame)
 		if err != nil {
 			c.reportError(err)
 			return
@@ -626,60 +647,15 @@ func (c *Client) decodeOpus(frame []byte, sampleRate int, channels int) ([]byte,
 	return pcm16ToBytes(pcm), nil
 }
 
-func decodeWAVFrame(frame []byte, fallbackSampleRate int, fallbackChannels int) ([]byte, int, int, error) {
-	if len(frame) < 12 || string(frame[0:4]) != "RIFF" || string(frame[8:12]) != "WAVE" {
-		return nil, 0, 0, errors.New("invalid wav frame")
-	}
-
-	sampleRate := fallbackSampleRate
-	if sampleRate <= 0 {
-		sampleRate = 16000
-	}
-	channels := fallbackChannels
-	if channels <= 0 {
-		channels = 1
-	}
-	bitsPerSample := 16
-
-	offset := 12
-	dataOffset := -1
-	dataSize := 0
-	for offset+8 <= len(frame) {
-		chunkID := string(frame[offset : offset+4])
-		chunkSize := int(binary.LittleEndian.Uint32(frame[offset+4 : offset+8]))
-		offset += 8
-		if chunkSize < 0 {
-			return nil, 0, 0, errors.New("invalid wav chunk size")
-		}
-		if offset+chunkSize > len(frame) {
-			chunkSize = len(frame) - offset
-		}
-
-		switch chunkID {
-		case "fmt ":
-			if chunkSize >= 16 {
-				channels = int(binary.LittleEndian.Uint16(frame[offset+2 : offset+4]))
-				sampleRate = int(binary.LittleEndian.Uint32(frame[offset+4 : offset+8]))
-				bitsPerSample = int(binary.LittleEndian.Uint16(frame[offset+14 : offset+16]))
-			}
-		case "data":
-			dataOffset = offset
-			dataSize = chunkSize
-		}
-
-		offset += chunkSize
-		if chunkSize%2 == 1 {
-			offset++
-		}
-	}
-
-	if dataOffset < 0 || dataSize <= 0 || dataOffset+dataSize > len(frame) {
-		return nil, 0, 0, errors.New("wav data chunk not found")
+func decodeWAVFrame(frame []byte) ([]byte, int, int, error) {
+	samples, format, err := audio.DecodeWAV(bytes.NewReader(frame))
+	if err != nil {
+		return nil, 0, 0, err
 	}
-	if bitsPerSample != 16 {
-		return nil, 0, 0, errors.New("unsupported wav bits per sample")
+	if len(samples) == 0 {
+		return nil, 0, 0, errors.New("wav data chunk is empty")
 	}
-	return frame[dataOffset : dataOffset+dataSize], sampleRate, channels, nil
+	return pcm16ToBytes(samples), format.SampleRate, format.Channels, nil
 }
 
 func pcm16ToBytes(pcm []int16) []byte {
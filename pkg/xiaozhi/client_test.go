@@ -1,9 +1,11 @@
 package xiaozhi
 
 import (
+	"bytes"
 	"testing"
 
 	xzcodec "github.com/saker-ai/vtuber-server/internal/transport/xiaozhi/codec"
+	"github.com/saker-ai/vtuber-server/pkg/audio"
 )
 
 func TestPackDecodeBinaryProtocol2Audio(t *testing.T) {
@@ -72,3 +74,54 @@ func TestNormalizeListenMode(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeWAVFrameConvertsFloatSamples(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := audio.NewWAVWriter(&buf, audio.WAVFormat{SampleRate: 24000, Channels: 1, BitsPerSample: 32, Float: true})
+	if err != nil {
+		t.Fatalf("NewWAVWriter error: %v", err)
+	}
+	if err := w.WriteFloat32([]float32{0, 0.5, -0.5}); err != nil {
+		t.Fatalf("WriteFloat32 error: %v", err)
+	}
+	w.Close()
+
+	pcm, sampleRate, channels, err := decodeWAVFrame(buf.Bytes())
+	if err != nil {
+		t.Fatalf("decodeWAVFrame error: %v", err)
+	}
+	if sampleRate != 24000 || channels != 1 {
+		t.Fatalf("format=%d/%d, want 24000/1", sampleRate, channels)
+	}
+	if len(pcm) != 6 {
+		t.Fatalf("pcm bytes=%d, want 6", len(pcm))
+	}
+	if got := int16(uint16(pcm[2]) | uint16(pcm[3])<<8); got != 16383 {
+		t.Fatalf("sample=%d, want 16383", got)
+	}
+}
+
+func TestHandleBinaryFrameNumbersDroppedOpusPackets(t *testing.T) {
+	enc, err := audio.NewOpusEncoder(16000, 1, 20)
+	if err != nil {
+		t.Fatalf("NewOpusEncoder error: %v", err)
+	}
+	defer enc.Close()
+	packet, err := enc.Encode(make([]byte, 320*2))
+	if err != nil {
+		t.Fatalf("Encode error: %v", err)
+	}
+
+	var seqs []uint32
+	c := NewClient(Config{AudioParams: AudioParams{Format: "opus", SampleRate: 16000, Channels: 1}}, Callbacks{
+		OnAudio: func(frame AudioFrame) { seqs = append(seqs, frame.Seq) },
+	}, nil)
+	c.downstream = initialDownstreamAudio(c.cfg.AudioParams)
+	c.handleBinaryFrame(packet)
+	// A packet with a frame count of zero fails to decode.
+	c.handleBinaryFrame([]byte{0x03, 0x00})
+	c.handleBinaryFrame(packet)
+	if len(seqs) != 2 || seqs[0] != 0 || seqs[1] != 2 {
+		t.Fatalf("seqs=%v, want [0 2]", seqs)
+	}
+}